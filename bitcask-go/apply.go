@@ -0,0 +1,55 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"encoding/binary"
+)
+
+// SetWriteFence 设置写入屏障，开启之后 Put、Delete 和 WriteBatch 的提交都会返回 ErrWriteFenced
+// 用于复制的从节点，从节点的数据只能通过 ApplyLogEntries 写入
+func (db *DB) SetWriteFence(fenced bool) {
+	db.writeFenced.Store(fenced)
+}
+
+// ApplyLogEntries 将从其他实例中读取到的日志记录按顺序追加到当前实例中，并更新内存索引
+// 事务中的记录在读取到事务完成的标识之后才会生效，不受写入屏障的限制
+func (db *DB) ApplyLogEntries(entries []*LogEntry) error {
+	if db.options.ReadOnly {
+		return ErrReadOnly
+	}
+	var size int64
+	for _, entry := range entries {
+		size += int64(len(entry.Key)+len(entry.Value)) + binary.MaxVarintLen64
+	}
+	db.waitWriteTokens(size + int64(len(entries))*(&data.LogRecord{}).MaxEncodedSize())
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, entry := range entries {
+		logRecord := &data.LogRecord{
+			Key:   logRecordKeyWithSeq(entry.Key, entry.SeqNo),
+			Value: entry.Value,
+			Type:  entry.Type,
+		}
+		pos, err := db.appendLogRecord(logRecord)
+		if err != nil {
+			return err
+		}
+
+		// 发布变更，事务在完成的时候作为一个变更组发布
+		var changes []*data.LogRecord
+		switch {
+		case entry.SeqNo == nonTransactionSeqNo:
+			changes = []*data.LogRecord{{Key: entry.Key, Value: entry.Value, Type: entry.Type}}
+		case entry.Type == data.LogRecordTxnFinished:
+			for _, txnRecord := range db.pendingTxns[entry.SeqNo] {
+				changes = append(changes, txnRecord.Record)
+			}
+		}
+		db.replayLogRecord(logRecord, pos)
+		if len(changes) > 0 {
+			db.publishChanges(entry.SeqNo, changes)
+		}
+	}
+	return nil
+}
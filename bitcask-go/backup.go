@@ -0,0 +1,362 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/fio"
+	"bitcask-go/utils"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const backupManifestFileName = "backup-manifest"
+
+// BackupManifest 备份清单，记录了备份时每个数据文件的范围
+type BackupManifest struct {
+	Dir      string       `json:"-"`         // 备份所在的目录
+	Position LogPosition  `json:"position"`  // 备份时日志的结束位置
+	MergeFid uint32       `json:"merge_fid"` // 最近一次 merge 时没有参与 merge 的最小文件 id，为 0 表示没有 merge 过
+	Files    []BackupFile `json:"files"`     // 备份时所有的数据文件，按照文件 id 排序
+}
+
+// BackupFile 数据文件在备份中的范围
+type BackupFile struct {
+	FileId uint32 `json:"file_id"`
+	Start  int64  `json:"start"` // 本次备份拷贝的起始偏移，为 0 表示拷贝了完整的文件
+	End    int64  `json:"end"`   // 备份时文件的大小
+}
+
+// BackupIncremental 增量备份，只拷贝 since 之后新追加的数据
+// since 为空的清单时进行全量备份，since 之后发生了 merge 时，id 小于新的 MergeFid 的文件都被重写过，会重新完整拷贝
+// merge 生成的 hint 文件在 since 之后发生了 merge 时才会拷贝
+// 返回本次备份的清单，清单同时保存在备份目录中，可以作为下一次增量备份的起点
+func (db *DB) BackupIncremental(dir string, since BackupManifest) (BackupManifest, error) {
+	if err := prepareEmptyDir(dir); err != nil {
+		return BackupManifest{}, err
+	}
+
+	// 加锁记录当前时刻的数据文件和写入位置
+	db.mu.Lock()
+	if db.activeFile != nil && !db.options.ReadOnly {
+		if err := db.activeFile.Sync(); err != nil {
+			db.mu.Unlock()
+			return BackupManifest{}, err
+		}
+	}
+	fileSizes := make(map[uint32]int64)
+	for fid := range db.olderFiles {
+		fileSizes[fid] = -1
+	}
+	manifest := BackupManifest{Dir: dir}
+	if db.activeFile != nil {
+		fileSizes[db.activeFile.FileId] = db.activeFile.WriteOff
+		manifest.Position = LogPosition{Fid: db.activeFile.FileId, Offset: db.activeFile.WriteOff}
+	}
+	mergeFid, err := db.mergedFileId()
+	db.mu.Unlock()
+	if err != nil {
+		return BackupManifest{}, err
+	}
+	manifest.MergeFid = mergeFid
+
+	if err := db.writeBackup(&manifest, fileSizes, since); err != nil {
+		_ = os.RemoveAll(dir)
+		return BackupManifest{}, err
+	}
+	return manifest, nil
+}
+
+func (db *DB) writeBackup(manifest *BackupManifest, fileSizes map[uint32]int64, since BackupManifest) error {
+	sinceFiles := make(map[uint32]BackupFile)
+	for _, file := range since.Files {
+		sinceFiles[file.FileId] = file
+	}
+	// since 之后生效的 merge 重写了 id 小于 MergeFid 的所有文件
+	var rewrittenFid uint32
+	if manifest.MergeFid != since.MergeFid {
+		rewrittenFid = manifest.MergeFid
+	}
+
+	var fileIds []uint32
+	for fid := range fileSizes {
+		fileIds = append(fileIds, fid)
+	}
+	sort.Slice(fileIds, func(i, j int) bool {
+		return fileIds[i] < fileIds[j]
+	})
+
+	for _, fid := range fileIds {
+		fileName := data.GetDataFileName(db.options.DirPath, fid)
+		end := fileSizes[fid]
+		// 旧的数据文件不会再被修改，大小就是文件的大小
+		if end < 0 {
+			info, err := os.Stat(fileName)
+			if err != nil {
+				return err
+			}
+			end = info.Size()
+		}
+
+		// 上次备份之后文件没有被 merge 重写过，只需要拷贝新追加的部分
+		var start int64
+		if prev, ok := sinceFiles[fid]; ok && fid >= rewrittenFid && prev.End <= end {
+			start = prev.End
+		}
+
+		err := utils.CopyFileRange(fileName, data.GetDataFileName(manifest.Dir, fid), start, end-start, db.bgLimiter.Wait)
+		if err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, BackupFile{
+			FileId: fid,
+			Start:  start,
+			End:    end,
+		})
+	}
+
+	// merge 之后 hint 文件和 merge 完成的标识文件会被替换，和 merge 之后的数据文件一起拷贝
+	if manifest.MergeFid != 0 && manifest.MergeFid != since.MergeFid {
+		for _, fileName := range []string{data.HintFileName, data.MergeFinishedFileName} {
+			err := utils.CopyFile(filepath.Join(db.options.DirPath, fileName), filepath.Join(manifest.Dir, fileName),
+				-1, db.bgLimiter.Wait)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return writeBackupManifest(*manifest)
+}
+
+// LoadBackupManifest 读取备份目录中的备份清单
+func LoadBackupManifest(dir string) (BackupManifest, error) {
+	buf, err := os.ReadFile(filepath.Join(dir, backupManifestFileName))
+	if err != nil {
+		return BackupManifest{}, err
+	}
+	var manifest BackupManifest
+	if err := json.Unmarshal(buf, &manifest); err != nil {
+		return BackupManifest{}, err
+	}
+	manifest.Dir = dir
+	return manifest, nil
+}
+
+func writeBackupManifest(manifest BackupManifest) error {
+	buf, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	fileName := filepath.Join(manifest.Dir, backupManifestFileName)
+	if err := os.WriteFile(fileName, buf, fio.DataFilePerm); err != nil {
+		return err
+	}
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// Restore 从全量备份以及之后的增量备份中恢复数据目录，manifests 按照备份的先后顺序传入
+// 恢复出来的目录需要从数据文件中重新构建索引，不包含 B+ 树索引文件
+func Restore(target string, manifests ...BackupManifest) error {
+	if len(manifests) == 0 {
+		return ErrInvalidBackupManifest
+	}
+	return restore(target, manifests, nil)
+}
+
+// RestoreToPosition 恢复到日志写入到 pos 的时刻，pos 之后写入的所有数据都会被丢弃
+// pos 可以是 LogEnd 的返回值或者日志记录的 Next 位置，和事务序列号不同，非事务的写入同样可以定位
+// merge 会重写 id 小于 MergeFid 的数据文件，pos 落在被重写的文件中时返回 ErrRestoreAcrossMerge
+// merge 进行期间写入的数据会让 merge 丢弃旧的值，pos 应该在 merge 生效之后，例如重启之后的 LogEnd
+func RestoreToPosition(target string, pos LogPosition, manifests ...BackupManifest) error {
+	// 只需要用到包含 pos 的第一份备份
+	covered := -1
+	for i, manifest := range manifests {
+		if !positionBefore(manifest.Position, pos) {
+			covered = i
+			break
+		}
+	}
+	if covered < 0 {
+		return ErrLogPositionNotFound
+	}
+	// pos 所在的文件已经被 merge 重写，原来的日志不存在了
+	if pos.Fid < manifests[covered].MergeFid {
+		return ErrRestoreAcrossMerge
+	}
+	return restore(target, manifests[:covered+1], &pos)
+}
+
+// RestoreToSeqNo 恢复到事务 seqNo 提交的时刻，seqNo 之后写入的所有数据都会被丢弃
+// 在备份中查找事务 seqNo 完成的标识记录，恢复到这条记录之后的位置，找不到时返回 ErrLogPositionNotFound
+func RestoreToSeqNo(target string, seqNo uint64, manifests ...BackupManifest) error {
+	pos, err := findTxnFinishedPosition(seqNo, manifests)
+	if err != nil {
+		return err
+	}
+	return RestoreToPosition(target, pos, manifests...)
+}
+
+// 按照备份的先后顺序查找事务 seqNo 完成的标识记录，返回这条记录之后的位置
+func findTxnFinishedPosition(seqNo uint64, manifests []BackupManifest) (LogPosition, error) {
+	for _, manifest := range manifests {
+		for _, file := range manifest.Files {
+			pos, found, err := findTxnFinishedInFile(manifest.Dir, file, seqNo)
+			if err != nil {
+				return LogPosition{}, err
+			}
+			if found {
+				return pos, nil
+			}
+		}
+	}
+	return LogPosition{}, ErrLogPositionNotFound
+}
+
+// 备份中的文件只包含 [Start, End) 范围的数据，记录在原来的文件中的位置需要加上 Start
+func findTxnFinishedInFile(dir string, file BackupFile, seqNo uint64) (LogPosition, bool, error) {
+	dataFile, err := data.OpenDataFile(dir, file.FileId, fio.ReadOnlyFIO)
+	if err != nil {
+		return LogPosition{}, false, err
+	}
+	defer dataFile.Close()
+
+	var offset int64
+	for {
+		logRecord, size, err := dataFile.ReadLogRecord(offset)
+		if err == io.EOF {
+			return LogPosition{}, false, nil
+		}
+		if err != nil {
+			return LogPosition{}, false, err
+		}
+		offset += size
+		if logRecord.Type != data.LogRecordTxnFinished {
+			continue
+		}
+		if _, recordSeqNo := parseLogRecordKey(logRecord.Key); recordSeqNo == seqNo {
+			return LogPosition{Fid: file.FileId, Offset: file.Start + offset}, true, nil
+		}
+	}
+}
+
+func restore(target string, manifests []BackupManifest, pos *LogPosition) error {
+	if err := prepareEmptyDir(target); err != nil {
+		return err
+	}
+	err := restoreBackups(target, manifests)
+	if err == nil && pos != nil {
+		err = truncateAfterPosition(target, manifests[len(manifests)-1], *pos)
+	}
+	if err != nil {
+		_ = os.RemoveAll(target)
+		return err
+	}
+	return nil
+}
+
+func restoreBackups(target string, manifests []BackupManifest) error {
+	// 依次应用每一份备份
+	fileSizes := make(map[uint32]int64)
+	for _, manifest := range manifests {
+		for _, file := range manifest.Files {
+			src := data.GetDataFileName(manifest.Dir, file.FileId)
+			dest := data.GetDataFileName(target, file.FileId)
+			if file.Start == 0 {
+				if err := utils.CopyFile(src, dest, -1, nil); err != nil {
+					return err
+				}
+			} else {
+				// 增量的部分必须紧接在已经恢复的数据之后
+				if size, ok := fileSizes[file.FileId]; !ok || size != file.Start {
+					return ErrInvalidBackupManifest
+				}
+				if err := appendFile(src, dest); err != nil {
+					return err
+				}
+			}
+			info, err := os.Stat(dest)
+			if err != nil {
+				return err
+			}
+			if info.Size() != file.End {
+				return ErrInvalidBackupManifest
+			}
+			fileSizes[file.FileId] = file.End
+		}
+
+		// 备份中包含 hint 文件说明在上一次备份之后发生了 merge
+		for _, fileName := range []string{data.HintFileName, data.MergeFinishedFileName} {
+			src := filepath.Join(manifest.Dir, fileName)
+			if _, err := os.Stat(src); os.IsNotExist(err) {
+				continue
+			}
+			if err := utils.CopyFile(src, filepath.Join(target, fileName), -1, nil); err != nil {
+				return err
+			}
+		}
+	}
+
+	// 删除最后一次备份时已经不存在的文件（被 merge 掉的文件）
+	liveFiles := make(map[uint32]bool)
+	for _, file := range manifests[len(manifests)-1].Files {
+		liveFiles[file.FileId] = true
+	}
+	for fid := range fileSizes {
+		if liveFiles[fid] {
+			continue
+		}
+		if err := os.Remove(data.GetDataFileName(target, fid)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 将 pos 所在的文件截断到 pos，并删除之后的所有文件
+// merge 之后的数据文件都在 pos 所在的文件之前，hint 文件仍然有效
+func truncateAfterPosition(dirPath string, manifest BackupManifest, pos LogPosition) error {
+	for _, file := range manifest.Files {
+		switch {
+		case file.FileId < pos.Fid:
+			continue
+		case file.FileId == pos.Fid:
+			if pos.Offset > file.End {
+				return ErrLogPositionNotFound
+			}
+			if err := os.Truncate(data.GetDataFileName(dirPath, file.FileId), pos.Offset); err != nil {
+				return err
+			}
+		default:
+			if err := os.Remove(data.GetDataFileName(dirPath, file.FileId)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// 将备份的数据追加到文件的末尾
+func appendFile(src, dest string) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	destFile, err := os.OpenFile(dest, os.O_WRONLY|os.O_APPEND, fio.DataFilePerm)
+	if err != nil {
+		return err
+	}
+	defer destFile.Close()
+	if _, err := io.Copy(destFile, srcFile); err != nil {
+		return err
+	}
+	return destFile.Sync()
+}
@@ -0,0 +1,260 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDB_BackupIncremental(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-backup-incremental")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+
+	// 全量备份
+	fullDir, _ := os.MkdirTemp("", "bitcask-go-backup-full")
+	defer os.RemoveAll(fullDir)
+	full, err := db.BackupIncremental(fullDir, BackupManifest{})
+	assert.Nil(t, err)
+	assert.True(t, len(full.Files) > 1)
+	for _, file := range full.Files {
+		assert.Equal(t, int64(0), file.Start)
+	}
+
+	// 增量备份只包含新追加的数据
+	for i := 1000; i < 1100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	err = db.Delete(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	incDir, _ := os.MkdirTemp("", "bitcask-go-backup-inc")
+	defer os.RemoveAll(incDir)
+	inc, err := db.BackupIncremental(incDir, full)
+	assert.Nil(t, err)
+	fullSize, _ := utils.DirSize(fullDir)
+	incSize, _ := utils.DirSize(incDir)
+	assert.True(t, incSize < fullSize/2)
+
+	// 两个事务
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	_ = wb.Put(utils.GetTestKey(2000), []byte("txn-1"))
+	err = wb.Commit()
+	assert.Nil(t, err)
+	pitPos := db.LogEnd()
+	pitSeqNo := db.seqNo
+	err = db.Put(utils.GetTestKey(2002), []byte("non-txn"))
+	assert.Nil(t, err)
+	wb = db.NewWriteBatch(DefaultWriteBatchOptions)
+	_ = wb.Put(utils.GetTestKey(2001), []byte("txn-2"))
+	_ = wb.Delete(utils.GetTestKey(2))
+	err = wb.Commit()
+	assert.Nil(t, err)
+	inc2Dir, _ := os.MkdirTemp("", "bitcask-go-backup-inc2")
+	defer os.RemoveAll(inc2Dir)
+	_, err = db.BackupIncremental(inc2Dir, inc)
+	assert.Nil(t, err)
+
+	// 清单可以从备份目录中读取
+	loaded, err := LoadBackupManifest(incDir)
+	assert.Nil(t, err)
+	assert.Equal(t, inc, loaded)
+	inc2, err := LoadBackupManifest(inc2Dir)
+	assert.Nil(t, err)
+
+	// 恢复全部的数据
+	target, _ := os.MkdirTemp("", "bitcask-go-restore")
+	defer os.RemoveAll(target)
+	err = Restore(target, full, inc, inc2)
+	assert.Nil(t, err)
+	restoreOpts := opts
+	restoreOpts.DirPath = target
+	restored, err := Open(restoreOpts)
+	assert.Nil(t, err)
+	assert.Equal(t, len(db.ListKeys()), len(restored.ListKeys()))
+	for _, key := range db.ListKeys() {
+		expected, _ := db.Get(key)
+		val, err := restored.Get(key)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, val)
+	}
+	err = restored.Close()
+	assert.Nil(t, err)
+
+	// 恢复到第一个事务提交的时刻，之后非事务的写入同样被丢弃
+	pitTarget, _ := os.MkdirTemp("", "bitcask-go-restore-pit")
+	defer os.RemoveAll(pitTarget)
+	err = RestoreToPosition(pitTarget, pitPos, full, inc, inc2)
+	assert.Nil(t, err)
+	restoreOpts.DirPath = pitTarget
+	restored, err = Open(restoreOpts)
+	assert.Nil(t, err)
+	val, err := restored.Get(utils.GetTestKey(2000))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("txn-1"), val)
+	_, err = restored.Get(utils.GetTestKey(2001))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = restored.Get(utils.GetTestKey(2002))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = restored.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	_, err = restored.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	err = restored.Close()
+	assert.Nil(t, err)
+
+	// 按照事务序列号恢复，停在事务完成的标识记录之后
+	seqTarget, _ := os.MkdirTemp("", "bitcask-go-restore-seq")
+	defer os.RemoveAll(seqTarget)
+	pos, err := findTxnFinishedPosition(pitSeqNo, []BackupManifest{full, inc, inc2})
+	assert.Nil(t, err)
+	assert.Equal(t, pitPos, pos)
+	err = RestoreToSeqNo(seqTarget, pitSeqNo, full, inc, inc2)
+	assert.Nil(t, err)
+	restoreOpts.DirPath = seqTarget
+	restored, err = Open(restoreOpts)
+	assert.Nil(t, err)
+	val, err = restored.Get(utils.GetTestKey(2000))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("txn-1"), val)
+	_, err = restored.Get(utils.GetTestKey(2001))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = restored.Get(utils.GetTestKey(2002))
+	assert.Equal(t, ErrKeyNotFound, err)
+	err = restored.Close()
+	assert.Nil(t, err)
+
+	// 缺少全量备份，无法恢复
+	badTarget, _ := os.MkdirTemp("", "bitcask-go-restore-bad")
+	defer os.RemoveAll(badTarget)
+	err = Restore(badTarget, inc, inc2)
+	assert.Equal(t, ErrInvalidBackupManifest, err)
+
+	// 位置在最后一次备份之后，无法恢复
+	err = RestoreToPosition(badTarget, db.LogEnd(), full, inc)
+	assert.Equal(t, ErrLogPositionNotFound, err)
+	err = RestoreToSeqNo(badTarget, pitSeqNo+100, full, inc, inc2)
+	assert.Equal(t, ErrLogPositionNotFound, err)
+}
+
+func TestDB_BackupIncremental_Merge(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-backup-merge")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	fullDir, _ := os.MkdirTemp("", "bitcask-go-backup-merge-full")
+	defer os.RemoveAll(fullDir)
+	full, err := db.BackupIncremental(fullDir, BackupManifest{})
+	assert.Nil(t, err)
+
+	// merge 之后重启，旧的数据文件被替换
+	for i := 0; i < 500; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	beforeMerge := db.LogEnd()
+	err = db.Merge()
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	incDir, _ := os.MkdirTemp("", "bitcask-go-backup-merge-inc")
+	defer os.RemoveAll(incDir)
+	inc, err := db.BackupIncremental(incDir, full)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), inc.Files[0].Start)
+	assert.True(t, inc.MergeFid > 0)
+	_, err = os.Stat(filepath.Join(incDir, data.HintFileName))
+	assert.Nil(t, err)
+
+	// merge 之前的位置已经被重写，无法恢复
+	pitTarget, _ := os.MkdirTemp("", "bitcask-go-restore-merge-pit")
+	defer os.RemoveAll(pitTarget)
+	err = RestoreToPosition(pitTarget, beforeMerge, full, inc)
+	assert.Equal(t, ErrRestoreAcrossMerge, err)
+
+	// merge 生效之后的位置可以恢复，hint 文件只在 merge 之后的第一次备份中
+	err = db.Put(utils.GetTestKey(1), []byte("after-merge"))
+	assert.Nil(t, err)
+	afterMerge := db.LogEnd()
+	err = db.Put(utils.GetTestKey(2), []byte("after-merge"))
+	assert.Nil(t, err)
+	inc2Dir, _ := os.MkdirTemp("", "bitcask-go-backup-merge-inc2")
+	defer os.RemoveAll(inc2Dir)
+	inc2, err := db.BackupIncremental(inc2Dir, inc)
+	assert.Nil(t, err)
+	_, err = os.Stat(filepath.Join(inc2Dir, data.HintFileName))
+	assert.True(t, os.IsNotExist(err))
+	err = RestoreToPosition(pitTarget, afterMerge, full, inc, inc2)
+	assert.Nil(t, err)
+	_, err = os.Stat(filepath.Join(pitTarget, data.HintFileName))
+	assert.Nil(t, err)
+	restoreOpts := opts
+	restoreOpts.DirPath = pitTarget
+	restored, err := Open(restoreOpts)
+	assert.Nil(t, err)
+	assert.Equal(t, 501, len(restored.ListKeys()))
+	val, err := restored.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("after-merge"), val)
+	_, err = restored.Get(utils.GetTestKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+	err = restored.Close()
+	assert.Nil(t, err)
+
+	// merge 之后的全量备份同样可以恢复到 merge 生效之后的位置
+	full2Dir, _ := os.MkdirTemp("", "bitcask-go-backup-merge-full2")
+	defer os.RemoveAll(full2Dir)
+	full2, err := db.BackupIncremental(full2Dir, BackupManifest{})
+	assert.Nil(t, err)
+	assert.Equal(t, inc.MergeFid, full2.MergeFid)
+	pit2Target, _ := os.MkdirTemp("", "bitcask-go-restore-merge-pit2")
+	defer os.RemoveAll(pit2Target)
+	err = RestoreToPosition(pit2Target, afterMerge, full2)
+	assert.Nil(t, err)
+	restoreOpts.DirPath = pit2Target
+	restored, err = Open(restoreOpts)
+	assert.Nil(t, err)
+	assert.Equal(t, 501, len(restored.ListKeys()))
+	err = restored.Close()
+	assert.Nil(t, err)
+
+	target, _ := os.MkdirTemp("", "bitcask-go-restore-merge")
+	defer os.RemoveAll(target)
+	err = Restore(target, full, inc)
+	assert.Nil(t, err)
+	restoreOpts.DirPath = target
+	restored, err = Open(restoreOpts)
+	assert.Nil(t, err)
+	assert.Equal(t, 500, len(restored.ListKeys()))
+	_, err = restored.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = restored.Get(utils.GetTestKey(999))
+	assert.Nil(t, err)
+	err = restored.Close()
+	assert.Nil(t, err)
+}
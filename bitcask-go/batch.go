@@ -3,6 +3,7 @@ package bitcask_go
 import (
 	"bitcask-go/data"
 	"encoding/binary"
+	"math"
 	"sync"
 	"sync/atomic"
 )
@@ -16,14 +17,11 @@ type WriteBatch struct {
 	options       WriteBatchOptions
 	mu            *sync.Mutex
 	db            *DB
-	pendingWrites map[string]*data.LogRecord // 暂存用户写入的数据
+	pendingWrites map[string]*data.LogRecord // 暂存用户写入的数据，key 为命名空间 id + key，默认命名空间的 id 为 0
 }
 
 // NewWriteBatch 初始化 WriteBatch
 func (db *DB) NewWriteBatch(opts WriteBatchOptions) *WriteBatch {
-	if db.options.IndexType == BPlusTree && !db.seqNoFileExists && !db.isInitial {
-		panic("cannot use write batch, seq no file not exists")
-	}
 	return &WriteBatch{
 		options:       opts,
 		mu:            new(sync.Mutex),
@@ -42,7 +40,7 @@ func (wb *WriteBatch) Put(key []byte, value []byte) error {
 
 	// 暂存 LogRecord
 	logRecord := &data.LogRecord{Key: key, Value: value}
-	wb.pendingWrites[string(key)] = logRecord
+	wb.pendingWrites[string(namespaceKey(0, key))] = logRecord
 	return nil
 }
 
@@ -55,22 +53,74 @@ func (wb *WriteBatch) Delete(key []byte) error {
 	defer wb.mu.Unlock()
 
 	// 数据不存在直接返回
+	pendingKey := string(namespaceKey(0, key))
 	logRecordPos := wb.db.index.Get(key)
 	if logRecordPos == nil {
-		if wb.pendingWrites[string(key)] != nil {
-			delete(wb.pendingWrites, string(key))
+		if wb.pendingWrites[pendingKey] != nil {
+			delete(wb.pendingWrites, pendingKey)
 		}
 		return nil
 	}
 
 	// 暂存 LogRecord
 	logRecord := &data.LogRecord{Key: key, Type: data.LogRecordDeleted}
-	wb.pendingWrites[string(key)] = logRecord
+	wb.pendingWrites[pendingKey] = logRecord
+	return nil
+}
+
+// PutIn 批量写数据到命名空间 ns 中，同一个批次可以写入多个命名空间
+func (wb *WriteBatch) PutIn(ns *Namespace, key []byte, value []byte) error {
+	if err := wb.checkNamespace(ns, key); err != nil {
+		return err
+	}
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+
+	nsKey := namespaceKey(ns.id, key)
+	logRecord := &data.LogRecord{Key: nsKey, Value: value, Type: data.LogRecordNsNormal}
+	wb.pendingWrites[string(nsKey)] = logRecord
+	return nil
+}
+
+// DeleteIn 删除命名空间 ns 中的数据
+func (wb *WriteBatch) DeleteIn(ns *Namespace, key []byte) error {
+	if err := wb.checkNamespace(ns, key); err != nil {
+		return err
+	}
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+
+	nsKey := namespaceKey(ns.id, key)
+	if ns.index.Get(key) == nil {
+		delete(wb.pendingWrites, string(nsKey))
+		return nil
+	}
+	logRecord := &data.LogRecord{Key: nsKey, Type: data.LogRecordNsDeleted}
+	wb.pendingWrites[string(nsKey)] = logRecord
+	return nil
+}
+
+func (wb *WriteBatch) checkNamespace(ns *Namespace, key []byte) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+	if ns.db != wb.db {
+		return ErrNamespaceNotFound
+	}
+	if ns.dropped.Load() {
+		return ErrNamespaceDropped
+	}
 	return nil
 }
 
 // Commit 提交事务 将暂存的数据写到数据文件，并更新内存索引
 func (wb *WriteBatch) Commit() error {
+	if wb.db.options.ReadOnly {
+		return ErrReadOnly
+	}
+	if wb.db.writeFenced.Load() {
+		return ErrWriteFenced
+	}
 	wb.mu.Lock()
 	defer wb.mu.Unlock()
 
@@ -85,61 +135,103 @@ func (wb *WriteBatch) Commit() error {
 	}
 
 	// 加锁保证事务提交的串行化
+	wb.db.waitWriteTokens(txnWriteSize(wb.pendingWrites))
 	wb.db.mu.Lock()
 	defer wb.db.mu.Unlock()
 
-	// 获取当前最新的事务序列号
-	seqNo := atomic.AddUint64(&wb.db.seqNo, 1)
+	// 存在二级索引时，索引的变更和数据在同一个事务中提交
+	pendingWrites := wb.pendingWrites
+	if wb.db.needSecondaryIndexWrites() {
+		var err error
+		if pendingWrites, err = wb.db.withSecondaryIndexWrites(pendingWrites); err != nil {
+			return err
+		}
+	}
+	if err := wb.db.commitTxn(pendingWrites, wb.options.SyncWrites); err != nil {
+		return err
+	}
 
-	positions := make(map[string]*data.LogRecordPos)
+	// 清空暂存的数据
+	wb.pendingWrites = make(map[string]*data.LogRecord)
+
+	return nil
+}
+
+// 写入事务中的数据，还没有写入事务完成的标识
+type preparedTxn struct {
+	seqNo     uint64
+	records   []*data.LogRecord
+	positions []*data.LogRecordPos
+}
+
+// 写入事务中的数据但不写入完成的标识，调用方需要持有 db.mu
+// 没有完成标识的数据在重启之后会被丢弃
+func (db *DB) prepareTxn(pendingWrites map[string]*data.LogRecord) (*preparedTxn, error) {
+	// 获取当前最新的事务序列号
+	txn := &preparedTxn{
+		seqNo:     atomic.AddUint64(&db.seqNo, 1),
+		records:   make([]*data.LogRecord, 0, len(pendingWrites)),
+		positions: make([]*data.LogRecordPos, 0, len(pendingWrites)),
+	}
+	db.markSeqNo(txn.seqNo)
 
 	// 开始去写数据
-	for _, record := range wb.pendingWrites {
-		logRecordPos, err := wb.db.appendLogRecord(&data.LogRecord{
-			Key:   logRecordKeyWithSeq(record.Key, seqNo),
+	for _, record := range pendingWrites {
+		logRecordPos, err := db.appendLogRecord(&data.LogRecord{
+			Key:   logRecordKeyWithSeq(record.Key, txn.seqNo),
 			Value: record.Value,
 			Type:  record.Type,
 		})
 		if err != nil {
-			return err
+			return nil, err
 		}
-		positions[string(record.Key)] = logRecordPos
+		txn.records = append(txn.records, record)
+		txn.positions = append(txn.positions, logRecordPos)
 	}
+	return txn, nil
+}
 
+// 写入事务完成的标识并更新内存索引，调用方需要持有 db.mu
+func (db *DB) finishTxn(txn *preparedTxn, syncWrites bool) error {
 	// 写一条标识事务完成的数据
 	finishedRecord := &data.LogRecord{
-		Key:  logRecordKeyWithSeq(txnFinKey, seqNo),
+		Key:  logRecordKeyWithSeq(txnFinKey, txn.seqNo),
 		Type: data.LogRecordTxnFinished,
 	}
-	if _, err := wb.db.appendLogRecord(finishedRecord); err != nil {
+	if _, err := db.appendLogRecord(finishedRecord); err != nil {
 		return err
 	}
 
 	// 根据配置去进行持久化
-	if wb.options.SyncWrites && wb.db.activeFile != nil {
-		if err := wb.db.activeFile.Sync(); err != nil {
+	if syncWrites && db.activeFile != nil {
+		if err := db.activeFile.Sync(); err != nil {
 			return err
 		}
 	}
 
 	// 更新对应的内存索引
-	for _, record := range wb.pendingWrites {
-		pos := positions[string(record.Key)]
+	for i, record := range txn.records {
+		pos := txn.positions[i]
+		// 命名空间中的数据更新到命名空间的索引中
+		if isNamespaceRecord(record.Type) {
+			db.updateNamespaceIndex(record.Key, record.Type, pos)
+			continue
+		}
+		db.markApplied(pos)
 		var oldPos *data.LogRecordPos
 		if record.Type == data.LogRecordNormal {
-			oldPos = wb.db.index.Put(record.Key, pos)
+			oldPos = db.index.Put(record.Key, pos)
 		}
 		if record.Type == data.LogRecordDeleted {
-			oldPos, _ = wb.db.index.Delete(record.Key)
+			oldPos, _ = db.index.Delete(record.Key)
 		}
 		if oldPos != nil {
-			wb.db.reclaimSize += int64(oldPos.Size)
+			db.reclaimSize += int64(oldPos.Size)
 		}
 	}
 
-	// 清空暂存的数据
-	wb.pendingWrites = make(map[string]*data.LogRecord)
-
+	// 整个批次作为一个变更组发布
+	db.publishChanges(txn.seqNo, txn.records)
 	return nil
 }
 
@@ -161,3 +253,12 @@ func parseLogRecordKey(key []byte) ([]byte, uint64) {
 	realKey := key[n:]
 	return realKey, seqNo
 }
+
+// 事务提交时最多写入的字节数，包括每条记录 key 之前的事务序列号和事务完成的标识
+func txnWriteSize(pendingWrites map[string]*data.LogRecord) int64 {
+	size := (&data.LogRecord{Key: logRecordKeyWithSeq(txnFinKey, math.MaxUint64)}).MaxEncodedSize()
+	for _, record := range pendingWrites {
+		size += record.MaxEncodedSize() + binary.MaxVarintLen64
+	}
+	return size
+}
@@ -1,9 +1,11 @@
 package bitcask_go
 
 import (
+	"bitcask-go/data"
 	"bitcask-go/utils"
 	"github.com/stretchr/testify/assert"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -115,3 +117,41 @@ func TestDB_WriteBatch3(t *testing.T) {
 	err = db.Close()
 	assert.Nil(t, err)
 }
+
+// B+ 树索引不依赖关闭时写入的事务序列号文件，崩溃之后仍然可以使用 WriteBatch
+func TestDB_WriteBatch_BPlusTreeWithoutSeqNoFile(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-batch-bptree")
+	opts.DirPath = dir
+	opts.IndexType = BPlusTree
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	for i := 0; i < 3; i++ {
+		wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+		err = wb.Put(utils.GetTestKey(i), utils.RandomValue(10))
+		assert.Nil(t, err)
+		err = wb.Commit()
+		assert.Nil(t, err)
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+	// 模拟崩溃，关闭时写入的事务序列号文件不存在
+	err = os.Remove(filepath.Join(dir, data.SeqNoFileName))
+	assert.Nil(t, err)
+
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db2)
+	assert.Equal(t, uint64(3), db2.seqNo)
+
+	wb := db2.NewWriteBatch(DefaultWriteBatchOptions)
+	err = wb.Put(utils.GetTestKey(10), []byte("batch"))
+	assert.Nil(t, err)
+	err = wb.Commit()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(4), db2.seqNo)
+	val, err := db2.Get(utils.GetTestKey(10))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("batch"), val)
+}
@@ -2,65 +2,196 @@ package benchmark
 
 import (
 	bitcask "bitcask-go"
+	"bitcask-go/data"
+	"bitcask-go/index"
 	"bitcask-go/utils"
 	"errors"
 	"github.com/stretchr/testify/assert"
 	"math/rand"
 	"os"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
-var db *bitcask.DB
+// 参与对比的索引类型，每种索引类型在相同的负载下分别运行
+var indexTypes = []struct {
+	name string
+	typ  bitcask.IndexerType
+}{
+	{"btree", bitcask.Btree},
+	{"art", bitcask.ART},
+	{"bptree", bitcask.BPlusTree},
+	{"hash", bitcask.Hash},
+	{"compact", bitcask.Compact},
+	{"tiered", bitcask.Tiered},
+	{"skiplist", bitcask.SkipList},
+}
 
-func init() {
-	// 初始化用于基准测试的存储引擎
-	options := bitcask.DefaultOptions
-	dir, _ := os.MkdirTemp("", "bitcask-go-bench")
-	options.DirPath = dir
+// 为每种索引类型打开一个独立的存储引擎，并在上面运行 workload
+// 例如 go test -bench=Put/skiplist 只运行跳表索引的写入
+func benchmarkIndexTypes(b *testing.B, workload func(b *testing.B, db *bitcask.DB)) {
+	for _, it := range indexTypes {
+		b.Run(it.name, func(b *testing.B) {
+			options := bitcask.DefaultOptions
+			dir, _ := os.MkdirTemp("", "bitcask-go-bench")
+			options.DirPath = dir
+			options.IndexType = it.typ
+			db, err := bitcask.Open(options)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer func() {
+				_ = db.Close()
+				_ = os.RemoveAll(dir)
+			}()
 
-	var err error
-	db, err = bitcask.Open(options)
-	if err != nil {
-		panic(err)
+			workload(b, db)
+		})
 	}
 }
 
 func Benchmark_Put(b *testing.B) {
-	b.ResetTimer()
-	// 内存分配
-	b.ReportAllocs()
+	benchmarkIndexTypes(b, func(b *testing.B, db *bitcask.DB) {
+		b.ResetTimer()
+		// 内存分配
+		b.ReportAllocs()
 
-	for i := 0; i < b.N; i++ {
-		err := db.Put(utils.GetTestKey(i), utils.RandomValue(1024))
-		assert.Nil(b, err)
-	}
+		for i := 0; i < b.N; i++ {
+			err := db.Put(utils.GetTestKey(i), utils.RandomValue(1024))
+			assert.Nil(b, err)
+		}
+	})
+}
+
+// 多个 goroutine 并发写入不同的 key
+func Benchmark_PutParallel(b *testing.B) {
+	benchmarkIndexTypes(b, func(b *testing.B, db *bitcask.DB) {
+		var seq atomic.Int64
+		b.ResetTimer()
+		b.ReportAllocs()
+
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				err := db.Put(utils.GetTestKey(int(seq.Add(1))), utils.RandomValue(1024))
+				assert.Nil(b, err)
+			}
+		})
+	})
 }
 
 func Benchmark_Get(b *testing.B) {
-	for i := 0; i < 10000; i++ {
-		err := db.Put(utils.GetTestKey(i), utils.RandomValue(1024))
-		assert.Nil(b, err)
-	}
+	benchmarkIndexTypes(b, func(b *testing.B, db *bitcask.DB) {
+		for i := 0; i < 10000; i++ {
+			err := db.Put(utils.GetTestKey(i), utils.RandomValue(1024))
+			assert.Nil(b, err)
+		}
 
-	b.ResetTimer()
-	b.ReportAllocs()
+		b.ResetTimer()
+		b.ReportAllocs()
 
-	for i := 0; i < b.N; i++ {
-		_, err := db.Get(utils.GetTestKey(rand.Int()))
-		if err != nil && !errors.Is(err, bitcask.ErrKeyNotFound) {
-			b.Fatal(err)
+		for i := 0; i < b.N; i++ {
+			_, err := db.Get(utils.GetTestKey(rand.Int()))
+			if err != nil && !errors.Is(err, bitcask.ErrKeyNotFound) {
+				b.Fatal(err)
+			}
 		}
-	}
+	})
 }
 
 func Benchmark_Delete(b *testing.B) {
-	b.ResetTimer()
-	b.ReportAllocs()
+	benchmarkIndexTypes(b, func(b *testing.B, db *bitcask.DB) {
+		b.ResetTimer()
+		b.ReportAllocs()
+
+		rand.NewSource(time.Now().UnixNano())
+		for i := 0; i < b.N; i++ {
+			err := db.Delete(utils.GetTestKey(rand.Int()))
+			assert.Nil(b, err)
+		}
+	})
+}
+
+// 遍历所有的 key
+func Benchmark_Iterate(b *testing.B) {
+	benchmarkIndexTypes(b, func(b *testing.B, db *bitcask.DB) {
+		for i := 0; i < 10000; i++ {
+			err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+			assert.Nil(b, err)
+		}
+
+		b.ResetTimer()
+		b.ReportAllocs()
+
+		for i := 0; i < b.N; i++ {
+			iter := db.NewIterator(bitcask.IteratorOptions{KeysOnly: true})
+			for iter.Rewind(); iter.Valid(); iter.Next() {
+			}
+			iter.Close()
+		}
+	})
+}
+
+// 直接对索引并发写入，存储引擎的写入会经过全局的写锁，看不出索引本身的并发能力
+func Benchmark_IndexPutParallel(b *testing.B) {
+	for _, it := range indexTypes {
+		if it.typ == bitcask.BPlusTree || it.typ == bitcask.Tiered {
+			continue
+		}
+		b.Run(it.name, func(b *testing.B) {
+			indexer := index.NewIndexer(it.typ, index.Options{})
+			defer indexer.Close()
+			var seq atomic.Int64
+			b.ResetTimer()
+			b.ReportAllocs()
+
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					i := seq.Add(1)
+					indexer.Put(utils.GetTestKey(rand.Int()), &data.LogRecordPos{Fid: 1, Offset: i})
+				}
+			})
+		})
+	}
+}
+
+// 重启时重建索引，数据经过 merge 之后从 hint 文件中加载
+// Tiered 索引的 run 只在运行期间存在，重启之后重新写入内存并再次写入磁盘，这里对比它和 BTree 的重建耗时
+func Benchmark_Open(b *testing.B) {
+	for _, it := range indexTypes {
+		if it.typ != bitcask.Btree && it.typ != bitcask.Tiered {
+			continue
+		}
+		b.Run(it.name, func(b *testing.B) {
+			options := bitcask.DefaultOptions
+			dir, _ := os.MkdirTemp("", "bitcask-go-bench-open")
+			defer os.RemoveAll(dir)
+			options.DirPath = dir
+			options.IndexType = it.typ
+			// 预算远小于全部 key 占用的内存，重建时需要多次写入磁盘
+			options.IndexMemoryBudget = 1 << 20
+			options.DataFileMergeRatio = 0
+			db, err := bitcask.Open(options)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for i := 0; i < 200000; i++ {
+				err := db.Put(utils.GetTestKey(i), utils.RandomValue(16))
+				assert.Nil(b, err)
+			}
+			assert.Nil(b, db.Merge())
+			assert.Nil(b, db.Close())
+
+			b.ResetTimer()
+			b.ReportAllocs()
 
-	rand.NewSource(time.Now().UnixNano())
-	for i := 0; i < b.N; i++ {
-		err := db.Delete(utils.GetTestKey(rand.Int()))
-		assert.Nil(b, err)
+			for i := 0; i < b.N; i++ {
+				db, err := bitcask.Open(options)
+				if err != nil {
+					b.Fatal(err)
+				}
+				assert.Nil(b, db.Close())
+			}
+		})
 	}
 }
@@ -0,0 +1,250 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/fio"
+	"bitcask-go/index"
+	"bitcask-go/utils"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+const (
+	// 布隆过滤器期望的误判率
+	dataFileBloomFalsePositive = 0.01
+	// 第一个布隆过滤器的容量
+	dataFileBloomMinCapacity = 1 << 16
+	// 布隆过滤器文件的头部：下一个需要读取的文件 id + 最后一个过滤器中 key 的数量 + 容量 + 过滤器的数量
+	dataFileBloomHeaderSize = 4 + 8 + 8 + 4
+)
+
+// 所有数据文件中 key 的布隆过滤器，查询不存在的 key 时不需要访问索引和数据文件
+// 由容量依次翻倍的一组过滤器组成，最后一个写满之后追加一个新的，第 i 个的误判率为 p/2^(i+1)，合计不超过 p
+// 过滤器的数量和 key 的数量是对数关系，和数据文件的数量无关
+// 只记录默认命名空间中写入的 key，被删除的 key 仍然会被判断为可能存在，merge 之后从索引重建时才会去掉
+// 活跃文件写满时持久化到 bloom-filter 文件中，重启之后只需要读取之后写入的数据文件
+type dataFileBlooms struct {
+	fileName       string
+	filters        []*utils.BloomFilter // 从旧到新排列，只有最后一个还在写入
+	count          int                  // 最后一个过滤器中 key 的数量，包括重复写入的 key
+	capacity       int                  // 最后一个过滤器的容量
+	nextFid        uint32               // 持久化的布隆过滤器包含了 id 小于 nextFid 的文件中所有的 key
+	rejects        atomic.Uint64        // 判断为不存在的查询次数
+	falsePositives atomic.Uint64        // 判断为可能存在，但实际不存在的查询次数
+}
+
+func newDataFileBlooms(dirPath string) *dataFileBlooms {
+	b := &dataFileBlooms{fileName: filepath.Join(dirPath, data.BloomFileName)}
+	b.reset(0)
+	return b
+}
+
+// 索引不在内存中时才需要布隆过滤器，只读模式下数据文件由其他进程写入，不使用布隆过滤器
+func usesDataFileBlooms(options Options) bool {
+	return !options.ReadOnly && (options.IndexType == BPlusTree || options.IndexType == Tiered)
+}
+
+// 清空布隆过滤器，第一个过滤器的容量至少是 keyNum 的两倍
+func (b *dataFileBlooms) reset(keyNum int) {
+	b.filters = nil
+	b.grow(max(keyNum*2, dataFileBloomMinCapacity))
+}
+
+// 追加一个容量为 capacity 的过滤器，误判率是上一个的一半
+func (b *dataFileBlooms) grow(capacity int) {
+	rate := dataFileBloomFalsePositive / float64(uint64(2)<<len(b.filters))
+	b.filters = append(b.filters, utils.NewBloomFilter(capacity, rate))
+	b.count, b.capacity = 0, capacity
+}
+
+// 记录写入的 key，调用方需要持有 db.mu
+func (b *dataFileBlooms) add(key []byte) {
+	if b.count >= b.capacity {
+		b.grow(b.capacity * 2)
+	}
+	b.filters[len(b.filters)-1].Add(key)
+	b.count++
+}
+
+// 判断 key 是否可能存在于某个数据文件中，调用方需要持有 db.mu 的读锁
+func (b *dataFileBlooms) mayContain(key []byte) bool {
+	h := utils.BloomHash(key)
+	for _, bf := range b.filters {
+		if bf.MayContainHash(h) {
+			return true
+		}
+	}
+	b.rejects.Add(1)
+	return false
+}
+
+// 持久化布隆过滤器，id 小于 nextFid 的文件中的 key 都已经加入，调用方需要持有 db.mu
+// 失败时内存中的布隆过滤器不受影响，下一次轮转时重试
+func (b *dataFileBlooms) save(nextFid uint32) error {
+	buf := make([]byte, dataFileBloomHeaderSize)
+	binary.LittleEndian.PutUint32(buf[0:], nextFid)
+	binary.LittleEndian.PutUint64(buf[4:], uint64(b.count))
+	binary.LittleEndian.PutUint64(buf[12:], uint64(b.capacity))
+	binary.LittleEndian.PutUint32(buf[20:], uint32(len(b.filters)))
+	for _, bf := range b.filters {
+		encoded := bf.Encode()
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(encoded)))
+		buf = append(buf, encoded...)
+	}
+	buf = binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+	if err := writeBloomFile(b.fileName, buf); err != nil {
+		return err
+	}
+	b.nextFid = nextFid
+	return nil
+}
+
+// 读取持久化的布隆过滤器，文件不存在或者损坏时返回 false
+func (b *dataFileBlooms) load() (bool, error) {
+	buf, err := os.ReadFile(b.fileName)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if len(buf) < dataFileBloomHeaderSize+4 {
+		return false, nil
+	}
+	body, crc := buf[:len(buf)-4], binary.LittleEndian.Uint32(buf[len(buf)-4:])
+	if crc32.ChecksumIEEE(body) != crc {
+		return false, nil
+	}
+	filterNum := int(binary.LittleEndian.Uint32(body[20:]))
+	filters := make([]*utils.BloomFilter, 0, filterNum)
+	rest := body[dataFileBloomHeaderSize:]
+	for i := 0; i < filterNum; i++ {
+		if len(rest) < 4 || len(rest)-4 < int(binary.LittleEndian.Uint32(rest)) {
+			return false, nil
+		}
+		n := int(binary.LittleEndian.Uint32(rest))
+		bf, err := utils.DecodeBloomFilter(rest[4 : 4+n])
+		if err != nil {
+			return false, nil
+		}
+		filters = append(filters, bf)
+		rest = rest[4+n:]
+	}
+	if filterNum == 0 || len(rest) > 0 {
+		return false, nil
+	}
+	b.filters = filters
+	b.nextFid = binary.LittleEndian.Uint32(body[0:])
+	b.count = int(binary.LittleEndian.Uint64(body[4:]))
+	b.capacity = int(binary.LittleEndian.Uint64(body[12:]))
+	return true, nil
+}
+
+// 先写入临时文件再重命名，保证文件中始终是完整的布隆过滤器
+func writeBloomFile(fileName string, buf []byte) error {
+	tmpFileName := fileName + ".tmp"
+	file, err := os.OpenFile(tmpFileName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, fio.DataFilePerm)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(buf)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFileName, fileName)
+	}
+	if err != nil {
+		_ = os.Remove(tmpFileName)
+	}
+	return err
+}
+
+// 误判率：所有不存在的 key 的查询中，没有被布隆过滤器过滤掉的比例
+func (b *dataFileBlooms) falsePositiveRate() float64 {
+	return bloomFalsePositiveRate(b.falsePositives.Load(), b.rejects.Load())
+}
+
+func bloomFalsePositiveRate(falsePositives, rejects uint64) float64 {
+	if falsePositives == 0 {
+		return 0
+	}
+	return float64(falsePositives) / float64(falsePositives+rejects)
+}
+
+// 从索引中的所有 key 重建布隆过滤器，已经删除的 key 不会再被判断为可能存在
+// 只在打开数据库时调用，这时所有写入的 key 都已经在索引中
+func (db *DB) rebuildDataFileBloom() error {
+	db.blooms.reset(db.index.Size())
+	iter := db.index.IteratorWithOptions(index.IteratorOptions{})
+	defer iter.Close()
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		db.blooms.add(iter.Key())
+	}
+	return index.Err(db.index)
+}
+
+// 加载布隆过滤器，再加入持久化之后写入的数据文件中的 key
+// 文件不存在或者损坏时从索引重建，merge 之后布隆过滤器文件被删除，同样重建
+func (db *DB) loadDataFileBlooms() error {
+	if db.blooms == nil {
+		return nil
+	}
+	ok, err := db.blooms.load()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		// 索引已经包含了活跃文件中的 key
+		if err := db.rebuildDataFileBloom(); err != nil {
+			return err
+		}
+		if db.activeFile == nil {
+			return nil
+		}
+		return db.blooms.save(db.activeFile.FileId)
+	}
+	for fid, dataFile := range db.olderFiles {
+		if fid < db.blooms.nextFid {
+			continue
+		}
+		if err := db.readDataFileKeys(dataFile, db.blooms.add); err != nil {
+			return err
+		}
+	}
+	if db.activeFile == nil || db.activeFile.FileId < db.blooms.nextFid {
+		return nil
+	}
+	return db.readDataFileKeys(db.activeFile, db.blooms.add)
+}
+
+// 读取数据文件中默认命名空间写入的所有 key
+func (db *DB) readDataFileKeys(dataFile *data.DataFile, fn func(key []byte)) error {
+	if err := db.acquireDataFile(dataFile); err != nil {
+		return err
+	}
+	defer db.releaseDataFile(dataFile)
+
+	var offset int64
+	for {
+		logRecord, size, err := dataFile.ReadLogRecord(offset)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if logRecord.Type == data.LogRecordNormal {
+			key, _ := parseLogRecordKey(logRecord.Key)
+			fn(key)
+		}
+		offset += size
+	}
+}
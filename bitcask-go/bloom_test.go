@@ -0,0 +1,236 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDB_BloomFilter(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-bloom")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.IndexType = BPlusTree
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	assert.True(t, len(db.olderFiles) > 1)
+	// 轮转时持久化，包含所有旧的数据文件中的 key
+	bloomFile := filepath.Join(dir, data.BloomFileName)
+	assert.FileExists(t, bloomFile)
+	assert.Equal(t, db.activeFile.FileId, db.blooms.nextFid)
+
+	checkGets := func(db *DB) {
+		for i := 0; i < 2000; i++ {
+			_, err := db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+		}
+		for i := 2000; i < 4000; i++ {
+			_, err := db.Get(utils.GetTestKey(i))
+			assert.Equal(t, ErrKeyNotFound, err)
+		}
+	}
+	checkGets(db)
+	stat := db.Stat()
+	assert.True(t, stat.BloomFilterRejects > 1900)
+	assert.Equal(t, 2000-stat.BloomFilterRejects, stat.BloomFilterFalsePositives)
+	assert.True(t, stat.BloomFilterFalsePositiveRate < 0.05, "false positive rate: %f", stat.BloomFilterFalsePositiveRate)
+
+	// 被删除的 key 仍然在布隆过滤器中，查询时计入误判
+	assert.Nil(t, db.Delete(utils.GetTestKey(0)))
+	_, err = db.Get(utils.GetTestKey(0))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Equal(t, stat.BloomFilterFalsePositives+1, db.Stat().BloomFilterFalsePositives)
+	assert.Nil(t, db.Put(utils.GetTestKey(0), utils.RandomValue(64)))
+	assert.Nil(t, db.Close())
+
+	// 重新打开之后从文件中加载，只读取活跃文件
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, db.activeFile.FileId, db.blooms.nextFid)
+	checkGets(db)
+	assert.Nil(t, db.Close())
+
+	// 布隆过滤器文件损坏时从索引重建
+	assert.Nil(t, os.WriteFile(bloomFile, []byte("corrupted"), 0644))
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, db.activeFile.FileId, db.blooms.nextFid)
+	checkGets(db)
+	assert.Nil(t, db.Close())
+
+	// 文件丢失时同样重建
+	assert.Nil(t, os.Remove(bloomFile))
+	db, err = Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.FileExists(t, bloomFile)
+	checkGets(db)
+}
+
+func TestDB_BloomFilter_Merge(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-bloom-merge")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.IndexType = BPlusTree
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	for i := 0; i < 4000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	for i := 0; i < 4000; i += 2 {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.Merge())
+	assert.NoFileExists(t, filepath.Join(db.getMergePath(), data.BloomFileName))
+	assert.Nil(t, db.Close())
+
+	// merge 之后从索引重建，被删除的 key 大多数不会再被判断为可能存在
+	db, err = Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 4000; i++ {
+		_, err := db.Get(utils.GetTestKey(i))
+		if i%2 == 0 {
+			assert.Equal(t, ErrKeyNotFound, err)
+		} else {
+			assert.Nil(t, err)
+		}
+	}
+	_, err = os.Stat(db.getMergePath())
+	assert.True(t, os.IsNotExist(err))
+	assert.True(t, db.Stat().BloomFilterRejects > 1900)
+}
+
+// 索引在内存中时不使用布隆过滤器
+func TestDB_BloomFilter_InMemoryIndex(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-bloom-btree")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	_, err = db.Get([]byte("missing"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Nil(t, db.blooms)
+	assert.NoFileExists(t, filepath.Join(dir, data.BloomFileName))
+	assert.Equal(t, uint64(0), db.Stat().BloomFilterRejects)
+}
+
+// 布隆过滤器持久化失败时不影响内存中的 key，重试之后可以加载
+func TestDataFileBlooms_SaveFailure(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-bloom-save")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	blooms := newDataFileBlooms(dir)
+	blooms.add([]byte("key-1"))
+
+	// 布隆过滤器文件的位置被目录占用，无法写入
+	assert.Nil(t, os.Mkdir(blooms.fileName, os.ModePerm))
+	assert.NotNil(t, blooms.save(2))
+	assert.True(t, blooms.mayContain([]byte("key-1")))
+	assert.Equal(t, uint32(0), blooms.nextFid)
+	assert.NoFileExists(t, blooms.fileName+".tmp")
+
+	// 轮转失败之后继续写入，重试成功
+	assert.Nil(t, os.Remove(blooms.fileName))
+	blooms.add([]byte("key-2"))
+	assert.Nil(t, blooms.save(2))
+
+	loaded := newDataFileBlooms(dir)
+	ok, err := loaded.load()
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(2), loaded.nextFid)
+	assert.True(t, loaded.mayContain([]byte("key-1")))
+	assert.True(t, loaded.mayContain([]byte("key-2")))
+
+	// 截断的文件当作损坏
+	buf, err := os.ReadFile(blooms.fileName)
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(blooms.fileName, buf[:len(buf)/2], 0644))
+	ok, err = newDataFileBlooms(dir).load()
+	assert.Nil(t, err)
+	assert.False(t, ok)
+}
+
+// key 的数量远超第一个过滤器的容量时，合计的误判率仍然不超过期望的误判率
+func TestDataFileBlooms_FalsePositiveRate(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-bloom-rate")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	blooms := newDataFileBlooms(dir)
+	const keyNum = dataFileBloomMinCapacity * 6
+	for i := 0; i < keyNum; i++ {
+		blooms.add(utils.GetTestKey(i))
+	}
+	// 容量依次为 1、2、4 倍
+	assert.Equal(t, 3, len(blooms.filters))
+	assert.Nil(t, blooms.save(1))
+	loaded := newDataFileBlooms(dir)
+	ok, err := loaded.load()
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, blooms.count, loaded.count)
+	assert.Equal(t, blooms.capacity, loaded.capacity)
+
+	for i := 0; i < keyNum; i++ {
+		assert.True(t, loaded.mayContain(utils.GetTestKey(i)))
+	}
+	var falsePositives int
+	const queries = 50000
+	for i := 0; i < queries; i++ {
+		if loaded.mayContain(utils.GetTestKey(keyNum + i)) {
+			falsePositives++
+		}
+	}
+	rate := float64(falsePositives) / queries
+	assert.True(t, rate < dataFileBloomFalsePositive*1.5, "false positive rate: %f", rate)
+}
+
+// 分片的统计信息中汇总所有分片的布隆过滤器
+func TestShardedDB_BloomFilterStat(t *testing.T) {
+	opts := DefaultShardedOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-sharded-bloom")
+	opts.DirPath = dir
+	opts.ShardOptions.DataFileSize = 64 * 1024
+	opts.ShardOptions.IndexType = BPlusTree
+	sdb, err := OpenSharded(opts)
+	defer destroyShardedDB(sdb)
+	assert.Nil(t, err)
+
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, sdb.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	for i := 2000; i < 4000; i++ {
+		_, err := sdb.Get(utils.GetTestKey(i))
+		assert.Equal(t, ErrKeyNotFound, err)
+	}
+
+	stat := sdb.Stat()
+	var rejects uint64
+	for _, shard := range sdb.shards {
+		rejects += shard.Stat().BloomFilterRejects
+	}
+	assert.Equal(t, rejects, stat.BloomFilterRejects)
+	assert.True(t, stat.BloomFilterRejects > 1900)
+	assert.Equal(t, 2000-stat.BloomFilterRejects, stat.BloomFilterFalsePositives)
+	assert.True(t, stat.BloomFilterFalsePositiveRate < 0.05, "false positive rate: %f", stat.BloomFilterFalsePositiveRate)
+}
@@ -0,0 +1,164 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/fio"
+	"bitcask-go/index"
+	"bitcask-go/utils"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const checkpointPositionFileName = "checkpoint-position"
+
+// Checkpoint 在线创建数据库的检查点，检查点是一个可以直接打开的一致的数据目录
+// 旧的数据文件不会再被修改，直接创建硬链接，活跃文件只拷贝当前已经写入的部分
+// 无法创建硬链接时（例如跨设备）退化为拷贝文件，拷贝受后台 IO 限速的控制
+func (db *DB) Checkpoint(dir string) error {
+	if err := prepareEmptyDir(dir); err != nil {
+		return err
+	}
+	err := db.snapshotFilesTo(dir, utils.LinkOrCopyFile)
+	if err != nil {
+		_ = os.RemoveAll(dir)
+	}
+	return err
+}
+
+// 在锁内记录当前时刻的数据文件和写入位置，然后在锁外通过 linkFile 将这些文件放到 dir 中
+func (db *DB) snapshotFilesTo(dir string, linkFile func(src, dest string, throttle func(n int)) error) error {
+	// 加锁记录当前时刻的数据文件和写入位置，之后的写入不会出现在检查点中
+	db.mu.Lock()
+	if db.activeFile != nil && !db.options.ReadOnly {
+		if err := db.activeFile.Sync(); err != nil {
+			db.mu.Unlock()
+			return err
+		}
+	}
+	var olderFileIds []uint32
+	for fid := range db.olderFiles {
+		olderFileIds = append(olderFileIds, fid)
+	}
+	var activeFileId uint32
+	var activeWriteOff int64 = -1
+	if db.activeFile != nil {
+		activeFileId = db.activeFile.FileId
+		activeWriteOff = db.activeFile.WriteOff
+	}
+	seqNo := db.seqNo
+
+	// B+ 树索引是持久化的，需要在同一时刻开启索引的快照
+	var snapshot *index.BPlusTreeSnapshot
+	if bpt, ok := db.index.(*index.BPlusTree); ok {
+		var err error
+		if snapshot, err = bpt.Snapshot(); err != nil {
+			db.mu.Unlock()
+			return err
+		}
+	}
+	db.mu.Unlock()
+
+	if snapshot != nil {
+		defer func() {
+			_ = snapshot.Release()
+		}()
+	}
+
+	return db.writeCheckpoint(dir, olderFileIds, activeFileId, activeWriteOff, seqNo, snapshot, linkFile)
+}
+
+func (db *DB) writeCheckpoint(dir string, olderFileIds []uint32, activeFileId uint32, activeWriteOff int64,
+	seqNo uint64, snapshot *index.BPlusTreeSnapshot, linkFile func(src, dest string, throttle func(n int)) error) error {
+	srcDir := db.options.DirPath
+	sort.Slice(olderFileIds, func(i, j int) bool {
+		return olderFileIds[i] < olderFileIds[j]
+	})
+
+	// 旧的数据文件
+	for _, fid := range olderFileIds {
+		err := linkFile(data.GetDataFileName(srcDir, fid), data.GetDataFileName(dir, fid), db.bgLimiter.Wait)
+		if err != nil {
+			return err
+		}
+	}
+	// 布隆过滤器只会通过重命名整体替换，链接之后内容不会再变化，不存在时在打开检查点的时候重建
+	bloomFile := filepath.Join(srcDir, data.BloomFileName)
+	if _, err := os.Stat(bloomFile); err == nil {
+		if err := linkFile(bloomFile, filepath.Join(dir, data.BloomFileName), db.bgLimiter.Wait); err != nil {
+			return err
+		}
+	}
+
+	// 活跃文件只拷贝已经写入的部分
+	if activeWriteOff >= 0 {
+		err := utils.CopyFile(data.GetDataFileName(srcDir, activeFileId), data.GetDataFileName(dir, activeFileId),
+			activeWriteOff, db.bgLimiter.Wait)
+		if err != nil {
+			return err
+		}
+	}
+
+	// merge 之后生成的 hint 文件和 merge 完成的标识文件，在下次 merge 之前不会被修改
+	for _, fileName := range []string{data.HintFileName, data.MergeFinishedFileName} {
+		src := filepath.Join(srcDir, fileName)
+		if _, err := os.Stat(src); os.IsNotExist(err) {
+			continue
+		}
+		if err := linkFile(src, filepath.Join(dir, fileName), db.bgLimiter.Wait); err != nil {
+			return err
+		}
+	}
+
+	// B+ 树索引
+	if snapshot != nil {
+		if err := snapshot.WriteTo(dir); err != nil {
+			return err
+		}
+	}
+
+	// 检查点对应的日志位置，可以从这个位置开始读取之后写入的数据
+	pos := LogPosition{}
+	if activeWriteOff >= 0 {
+		pos = LogPosition{Fid: activeFileId, Offset: activeWriteOff}
+	}
+	buf, err := json.Marshal(pos)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, checkpointPositionFileName), buf, fio.DataFilePerm); err != nil {
+		return err
+	}
+
+	// 事务序列号
+	return writeSeqNo(dir, seqNo)
+}
+
+// ReadCheckpointPosition 读取检查点对应的日志位置
+func ReadCheckpointPosition(dir string) (LogPosition, error) {
+	buf, err := os.ReadFile(filepath.Join(dir, checkpointPositionFileName))
+	if err != nil {
+		return LogPosition{}, err
+	}
+	var pos LogPosition
+	if err := json.Unmarshal(buf, &pos); err != nil {
+		return LogPosition{}, err
+	}
+	return pos, nil
+}
+
+// 目标目录不存在则创建，存在的话必须为空
+func prepareEmptyDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return os.MkdirAll(dir, os.ModePerm)
+	}
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return ErrDirectoryNotEmpty
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDB_Checkpoint(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-checkpoint")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	err = db.Delete(utils.GetTestKey(1))
+	assert.Nil(t, err)
+
+	checkpointDir, _ := os.MkdirTemp("", "bitcask-go-checkpoint-dir")
+	defer os.RemoveAll(checkpointDir)
+	err = db.Checkpoint(checkpointDir)
+	assert.Nil(t, err)
+
+	// 旧的数据文件是硬链接
+	srcInfo, err := os.Stat(data.GetDataFileName(dir, 0))
+	assert.Nil(t, err)
+	dstInfo, err := os.Stat(data.GetDataFileName(checkpointDir, 0))
+	assert.Nil(t, err)
+	assert.True(t, os.SameFile(srcInfo, dstInfo))
+
+	// 检查点之后的写入不会出现在检查点中
+	for i := 1000; i < 1100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	err = db.Delete(utils.GetTestKey(2))
+	assert.Nil(t, err)
+
+	// 目录不为空
+	err = db.Checkpoint(checkpointDir)
+	assert.Equal(t, ErrDirectoryNotEmpty, err)
+
+	cpOpts := opts
+	cpOpts.DirPath = checkpointDir
+	cpDB, err := Open(cpOpts)
+	assert.Nil(t, err)
+	assert.Equal(t, 999, len(cpDB.ListKeys()))
+	_, err = cpDB.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = cpDB.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	_, err = cpDB.Get(utils.GetTestKey(1000))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// 检查点可以继续写入，并且不会影响原来的数据库
+	err = cpDB.Put(utils.GetTestKey(5000), []byte("checkpoint"))
+	assert.Nil(t, err)
+	err = cpDB.Close()
+	assert.Nil(t, err)
+	_, err = db.Get(utils.GetTestKey(5000))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Equal(t, 1098, len(db.ListKeys()))
+}
+
+func TestDB_Checkpoint_Merge(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-checkpoint-merge")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 500; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db.Merge()
+	assert.Nil(t, err)
+
+	// 重启之后应用 merge 的结果，数据目录中存在 hint 文件
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	err = db.Put(utils.GetTestKey(2000), []byte("after-merge"))
+	assert.Nil(t, err)
+
+	checkpointDir := filepath.Join(os.TempDir(), "bitcask-go-checkpoint-merge-dir")
+	defer os.RemoveAll(checkpointDir)
+	err = db.Checkpoint(checkpointDir)
+	assert.Nil(t, err)
+	_, err = os.Stat(filepath.Join(checkpointDir, data.HintFileName))
+	assert.Nil(t, err)
+
+	cpOpts := opts
+	cpOpts.DirPath = checkpointDir
+	cpDB, err := Open(cpOpts)
+	assert.Nil(t, err)
+	assert.Equal(t, 501, len(cpDB.ListKeys()))
+	val, err := cpDB.Get(utils.GetTestKey(2000))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("after-merge"), val)
+	err = cpDB.Close()
+	assert.Nil(t, err)
+}
+
+func TestDB_Checkpoint_BPlusTree(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-checkpoint-bptree")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.IndexType = BPlusTree
+	opts.MMapAtStartup = false
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 500; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	err = db.Put(utils.GetTestKey(1000), []byte("before"))
+	assert.Nil(t, err)
+
+	checkpointDir := filepath.Join(os.TempDir(), "bitcask-go-checkpoint-bptree-dir")
+	defer os.RemoveAll(checkpointDir)
+	err = db.Checkpoint(checkpointDir)
+	assert.Nil(t, err)
+
+	err = db.Put(utils.GetTestKey(1001), []byte("after"))
+	assert.Nil(t, err)
+
+	cpOpts := opts
+	cpOpts.DirPath = checkpointDir
+	cpDB, err := Open(cpOpts)
+	assert.Nil(t, err)
+	assert.Equal(t, 501, len(cpDB.ListKeys()))
+	val, err := cpDB.Get(utils.GetTestKey(1000))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("before"), val)
+	_, err = cpDB.Get(utils.GetTestKey(1001))
+	assert.Equal(t, ErrKeyNotFound, err)
+	err = cpDB.Close()
+	assert.Nil(t, err)
+}
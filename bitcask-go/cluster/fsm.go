@@ -0,0 +1,143 @@
+package cluster
+
+import (
+	bitcask "bitcask-go"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+)
+
+type EntryType = byte
+
+const (
+	// EntryNoop Leader 当选之后写入的空日志，用于提交之前任期的日志
+	EntryNoop EntryType = iota + 1
+
+	// EntryCommand 写入状态机的一批操作
+	EntryCommand
+
+	// EntryConfig 集群成员变更，数据为新的成员列表
+	EntryConfig
+)
+
+// Entry 一条 Raft 日志
+type Entry struct {
+	Index uint64
+	Term  uint64
+	Type  EntryType
+	Data  []byte
+}
+
+type OpType = byte
+
+const (
+	// OpPut 写入数据
+	OpPut OpType = iota + 1
+
+	// OpDelete 删除数据
+	OpDelete
+)
+
+// Op 状态机上的一个写操作
+type Op struct {
+	Type  OpType
+	Key   []byte
+	Value []byte
+}
+
+// 操作的编码 | count | type | key size | key | value size | value | ...
+func encodeCommand(ops []Op) []byte {
+	buf := binary.AppendUvarint(nil, uint64(len(ops)))
+	for _, op := range ops {
+		buf = append(buf, op.Type)
+		buf = binary.AppendUvarint(buf, uint64(len(op.Key)))
+		buf = append(buf, op.Key...)
+		buf = binary.AppendUvarint(buf, uint64(len(op.Value)))
+		buf = append(buf, op.Value...)
+	}
+	return buf
+}
+
+func decodeCommand(buf []byte) ([]Op, error) {
+	count, n := binary.Uvarint(buf)
+	if n <= 0 || count > uint64(len(buf)) {
+		return nil, ErrStorageCorrupted
+	}
+	buf = buf[n:]
+	readBytes := func() ([]byte, bool) {
+		size, n := binary.Uvarint(buf)
+		if n <= 0 || size > uint64(len(buf)-n) {
+			return nil, false
+		}
+		b := buf[n : n+int(size)]
+		buf = buf[n+int(size):]
+		return b, true
+	}
+
+	ops := make([]Op, 0, count)
+	for i := uint64(0); i < count; i++ {
+		if len(buf) == 0 {
+			return nil, ErrStorageCorrupted
+		}
+		op := Op{Type: buf[0]}
+		buf = buf[1:]
+		var ok bool
+		if op.Key, ok = readBytes(); !ok {
+			return nil, ErrStorageCorrupted
+		}
+		if op.Value, ok = readBytes(); !ok {
+			return nil, ErrStorageCorrupted
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+func encodeMembers(members []string) []byte {
+	buf, _ := json.Marshal(members)
+	return buf
+}
+
+func decodeMembers(buf []byte) ([]string, error) {
+	var members []string
+	if err := json.Unmarshal(buf, &members); err != nil {
+		return nil, ErrStorageCorrupted
+	}
+	return members, nil
+}
+
+// 日志的内容导致的错误，重复应用得到的结果相同，所有节点都会拒绝这条日志
+func isDeterministicApplyError(err error) bool {
+	return errors.Is(err, ErrStorageCorrupted) || errors.Is(err, ErrInvalidOp) ||
+		errors.Is(err, bitcask.ErrKeyIsEmpty) || errors.Is(err, bitcask.ErrExceedMaxBatchNum)
+}
+
+// 通过 WriteBatch 原子地将一条日志应用到状态机
+// 重复应用同一段日志得到的结果相同，重启之后可以从持久化的位置重新应用
+func applyEntry(db *bitcask.DB, entry *Entry) error {
+	if entry.Type != EntryCommand {
+		return nil
+	}
+	ops, err := decodeCommand(entry.Data)
+	if err != nil {
+		return err
+	}
+	wb := db.NewWriteBatch(bitcask.WriteBatchOptions{
+		MaxBatchSize: uint(len(ops)),
+		SyncWrites:   false,
+	})
+	for _, op := range ops {
+		switch op.Type {
+		case OpPut:
+			err = wb.Put(op.Key, op.Value)
+		case OpDelete:
+			err = wb.Delete(op.Key)
+		default:
+			err = ErrInvalidOp
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return wb.Commit()
+}
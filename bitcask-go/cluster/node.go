@@ -0,0 +1,1338 @@
+package cluster
+
+import (
+	bitcask "bitcask-go"
+	"bitcask-go/utils"
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidOptions          = errors.New("invalid cluster node options")
+	ErrNotLeader               = errors.New("the node is not the leader")
+	ErrLeadershipLost          = errors.New("leadership lost before the entry was applied")
+	ErrNodeClosed              = errors.New("the node is closed")
+	ErrUnreachable             = errors.New("the target node is unreachable")
+	ErrStorageCorrupted        = errors.New("raft storage corrupted")
+	ErrInvalidSnapshot         = errors.New("invalid raft snapshot")
+	ErrInvalidOp               = errors.New("invalid operation type")
+	ErrMembershipChangePending = errors.New("another membership change is in progress")
+	ErrMemberExists            = errors.New("the member already exists")
+	ErrMemberNotFound          = errors.New("the member is not found")
+)
+
+// 发送快照时每个分块的大小
+const snapshotChunkSize = 1024 * 1024
+
+type Role = int8
+
+const (
+	// Follower 接收 Leader 复制的日志
+	Follower Role = iota + 1
+
+	// Candidate 正在发起选举
+	Candidate
+
+	// Leader 处理写入并复制日志
+	Leader
+)
+
+type ReadConsistency = int8
+
+const (
+	// ReadLinearizable 线性一致读，只能在 Leader 上执行，读取之前确认 Leader 身份并等待状态机追上提交位置
+	ReadLinearizable ReadConsistency = iota + 1
+
+	// ReadStale 直接读取本地状态机，可能读到旧的数据
+	ReadStale
+)
+
+// Options 集群节点配置项
+type Options struct {
+	// 节点的唯一标识，也是 Transport 中的地址
+	Id string
+
+	// 集群初始的成员，只在第一次启动时使用，为空表示等待被加入已有的集群
+	Peers []string
+
+	// 节点的数据目录，包含 Raft 日志、状态机数据和快照
+	DirPath string
+
+	// 节点之间的通信
+	Transport Transport
+
+	// 状态机 DB 的配置，DirPath 会被忽略
+	DBOptions bitcask.Options
+
+	// Leader 发送心跳的间隔
+	HeartbeatInterval time.Duration
+
+	// 选举超时时间，实际的超时时间在 [ElectionTimeout, 2*ElectionTimeout) 之间随机
+	ElectionTimeout time.Duration
+
+	// 一次最多复制的日志数量
+	MaxAppendEntries int
+
+	// 应用了多少条日志之后生成一次快照
+	SnapshotThreshold uint64
+
+	// 记录选举、应用日志和快照等后台错误的日志，为空时不记录
+	Logger *log.Logger
+}
+
+var DefaultOptions = Options{
+	DBOptions:         bitcask.DefaultOptions,
+	HeartbeatInterval: 50 * time.Millisecond,
+	ElectionTimeout:   500 * time.Millisecond,
+	MaxAppendEntries:  256,
+	SnapshotThreshold: 10000,
+}
+
+// Status 节点的状态
+type Status struct {
+	Id            string
+	Role          Role
+	Term          uint64
+	Leader        string
+	Members       []string
+	LastIndex     uint64
+	CommitIndex   uint64
+	AppliedIndex  uint64
+	SnapshotIndex uint64
+}
+
+// 等待日志被应用的写入请求
+type waiter struct {
+	term uint64
+	ch   chan error
+}
+
+// Node Raft 集群中的一个节点，将 DB 作为状态机
+// 写入经过 Raft 共识之后通过 WriteBatch 应用到 DB，快照是 DB 数据目录的检查点
+type Node struct {
+	options   Options
+	transport Transport
+	storage   *storage
+	mu        *sync.Mutex
+	cond      *sync.Cond // Raft 状态变化时广播
+
+	role             Role
+	term             uint64
+	votedFor         string
+	leaderId         string
+	lastContact      time.Time // 最后一次收到 Leader 消息的时间
+	electionDeadline time.Time
+	votes            map[string]bool
+
+	entries     []*Entry     // 内存中的日志，entries[0] 是快照的位置
+	snapshot    SnapshotMeta // 最新的快照
+	members     []string     // 最新的成员配置，写入日志之后立即生效
+	configIndex uint64       // 最新的成员配置所在的日志索引
+	commitIndex uint64
+	lastApplied uint64
+	installing  bool // 收到的快照还没有应用到状态机
+	recv        *snapshotReceiver
+
+	// Leader 的复制状态
+	nextIndex        map[string]uint64
+	matchIndex       map[string]uint64
+	lastAck          map[string]time.Time
+	replicating      map[string]bool
+	pendingReplicate map[string]bool
+	waiters          map[uint64]*waiter
+
+	dbMu *sync.RWMutex // 恢复快照时会替换状态机
+	db   *bitcask.DB
+
+	closed chan struct{}
+	wg     *sync.WaitGroup
+}
+
+// NewNode 打开一个集群节点
+func NewNode(opts Options) (*Node, error) {
+	if err := checkOptions(opts); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(opts.DirPath, os.ModePerm); err != nil {
+		return nil, err
+	}
+	// 替换快照或者状态机的数据目录的过程中崩溃，恢复原来的目录并删除残留的临时目录
+	snapshotDir, dataDir := filepath.Join(opts.DirPath, snapshotDirName), filepath.Join(opts.DirPath, dataDirName)
+	if err := recoverDir(snapshotDir, snapshotDir+".recv", snapshotDir+".tmp"); err != nil {
+		return nil, err
+	}
+	if err := recoverDir(dataDir, dataDir+".installing"); err != nil {
+		return nil, err
+	}
+	st, err := openStorage(filepath.Join(opts.DirPath, raftDirName), opts.DBOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &Node{
+		options:          opts,
+		transport:        opts.Transport,
+		storage:          st,
+		mu:               new(sync.Mutex),
+		role:             Follower,
+		nextIndex:        make(map[string]uint64),
+		matchIndex:       make(map[string]uint64),
+		lastAck:          make(map[string]time.Time),
+		replicating:      make(map[string]bool),
+		pendingReplicate: make(map[string]bool),
+		waiters:          make(map[uint64]*waiter),
+		recv:             newSnapshotReceiver(filepath.Join(opts.DirPath, snapshotDirName+".recv")),
+		dbMu:             new(sync.RWMutex),
+		closed:           make(chan struct{}),
+		wg:               new(sync.WaitGroup),
+	}
+	n.cond = sync.NewCond(n.mu)
+	if err := n.restore(); err != nil {
+		_ = st.close()
+		return nil, err
+	}
+	n.resetElectionDeadline()
+
+	n.transport.Serve(n)
+	n.wg.Add(2)
+	go n.ticker()
+	go n.applier()
+	return n, nil
+}
+
+// 从持久化的数据中恢复节点的状态
+func (n *Node) restore() error {
+	term, votedFor, err := n.storage.loadHardState()
+	if err != nil {
+		return err
+	}
+	n.term, n.votedFor = term, votedFor
+
+	meta, err := readSnapshotMeta(n.snapshotDir())
+	if err != nil {
+		return err
+	}
+	n.snapshot = meta
+	n.entries = []*Entry{{Index: meta.Index, Term: meta.Term}}
+
+	// 快照之后的日志，生成快照之后没来得及删除的日志会被忽略
+	entries, err := n.storage.loadEntries()
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Index <= meta.Index {
+			continue
+		}
+		if entry.Index != n.lastIndex()+1 {
+			break
+		}
+		n.entries = append(n.entries, entry)
+	}
+
+	// 第一次启动时将初始的成员作为第一条日志，所有初始成员的第一条日志都相同
+	if n.term == 0 && n.lastIndex() == 0 && len(n.options.Peers) > 0 {
+		entry := &Entry{Index: 1, Term: 0, Type: EntryConfig, Data: encodeMembers(n.options.Peers)}
+		if err := n.storage.replaceEntries(entry.Index, 0, []*Entry{entry}); err != nil {
+			return err
+		}
+		n.entries = append(n.entries, entry)
+	}
+	n.refreshMembers()
+
+	// 状态机落后于快照时（例如应用快照的过程中崩溃）从快照恢复
+	applied, err := n.storage.loadApplied()
+	if err != nil {
+		return err
+	}
+	if applied < meta.Index {
+		if err := restoreData(n.snapshotDir(), n.dataDir()); err != nil {
+			return err
+		}
+		applied = meta.Index
+		if err := n.storage.saveApplied(applied); err != nil {
+			return err
+		}
+	}
+	n.lastApplied, n.commitIndex = applied, applied
+	return n.openDB()
+}
+
+func (n *Node) openDB() error {
+	dbOpts := n.options.DBOptions
+	dbOpts.DirPath = n.dataDir()
+	dbOpts.ReadOnly = false
+	db, err := bitcask.Open(dbOpts)
+	if err != nil {
+		return err
+	}
+	n.db = db
+	return nil
+}
+
+// Put 通过 Raft 写入一条数据，数据应用到 Leader 的状态机之后返回
+func (n *Node) Put(key []byte, value []byte) error {
+	return n.Write([]Op{{Type: OpPut, Key: key, Value: value}})
+}
+
+// Delete 通过 Raft 删除一条数据
+func (n *Node) Delete(key []byte) error {
+	return n.Write([]Op{{Type: OpDelete, Key: key}})
+}
+
+// Write 原子地写入一批操作，只能在 Leader 上执行
+// 返回 ErrLeadershipLost 时无法确定写入是否成功
+func (n *Node) Write(ops []Op) error {
+	if len(ops) == 0 {
+		return nil
+	}
+	for _, op := range ops {
+		if len(op.Key) == 0 {
+			return bitcask.ErrKeyIsEmpty
+		}
+		if op.Type != OpPut && op.Type != OpDelete {
+			return ErrInvalidOp
+		}
+	}
+
+	n.mu.Lock()
+	ch, err := n.propose(EntryCommand, encodeCommand(ops))
+	n.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return <-ch
+}
+
+// Get 读取数据
+func (n *Node) Get(key []byte, consistency ReadConsistency) ([]byte, error) {
+	if consistency == ReadLinearizable {
+		if err := n.readBarrier(); err != nil {
+			return nil, err
+		}
+	}
+	n.dbMu.RLock()
+	defer n.dbMu.RUnlock()
+	if n.isClosed() {
+		return nil, ErrNodeClosed
+	}
+	return n.db.Get(key)
+}
+
+// AddMember 向集群中加入一个节点，一次只能变更一个成员
+// 新节点需要以空的 Peers 启动，加入之后由 Leader 复制日志或者快照
+func (n *Node) AddMember(id string) error {
+	return n.changeMembers(id, true)
+}
+
+// RemoveMember 从集群中移除一个节点，移除 Leader 自身时 Leader 会在变更提交之后退位
+func (n *Node) RemoveMember(id string) error {
+	return n.changeMembers(id, false)
+}
+
+func (n *Node) changeMembers(id string, add bool) error {
+	n.mu.Lock()
+	if n.role == Leader {
+		// 上一次变更提交之前不能开始新的变更，Leader 还需要先提交一条当前任期的日志
+		if term, _ := n.termAt(n.commitIndex); n.configIndex > n.commitIndex || term != n.term {
+			n.mu.Unlock()
+			return ErrMembershipChangePending
+		}
+	}
+	var members []string
+	if add {
+		if n.isMember(id) {
+			n.mu.Unlock()
+			return ErrMemberExists
+		}
+		members = append(append(members, n.members...), id)
+	} else {
+		if !n.isMember(id) {
+			n.mu.Unlock()
+			return ErrMemberNotFound
+		}
+		for _, member := range n.members {
+			if member != id {
+				members = append(members, member)
+			}
+		}
+	}
+	ch, err := n.propose(EntryConfig, encodeMembers(members))
+	n.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return <-ch
+}
+
+// Members 返回当前的集群成员
+func (n *Node) Members() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]string(nil), n.members...)
+}
+
+// Leader 返回当前已知的 Leader，未知时为空
+func (n *Node) Leader() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.leaderId
+}
+
+// Status 返回节点的状态
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return Status{
+		Id:            n.options.Id,
+		Role:          n.role,
+		Term:          n.term,
+		Leader:        n.leaderId,
+		Members:       append([]string(nil), n.members...),
+		LastIndex:     n.lastIndex(),
+		CommitIndex:   n.commitIndex,
+		AppliedIndex:  n.lastApplied,
+		SnapshotIndex: n.snapshot.Index,
+	}
+}
+
+// Close 关闭节点
+func (n *Node) Close() error {
+	n.mu.Lock()
+	if n.isClosed() {
+		n.mu.Unlock()
+		return nil
+	}
+	close(n.closed)
+	n.failWaiters(ErrNodeClosed)
+	n.cond.Broadcast()
+	n.mu.Unlock()
+
+	_ = n.transport.Close()
+	n.wg.Wait()
+
+	n.dbMu.Lock()
+	err := n.db.Close()
+	n.dbMu.Unlock()
+	if storageErr := n.storage.close(); err == nil {
+		err = storageErr
+	}
+	return err
+}
+
+// HandleRequestVote 处理候选人的投票请求
+func (n *Node) HandleRequestVote(req *RequestVoteRequest) (*RequestVoteResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.isClosed() {
+		return nil, ErrNodeClosed
+	}
+
+	resp := &RequestVoteResponse{Term: n.term}
+	if req.Term < n.term {
+		return resp, nil
+	}
+	// 最近收到过 Leader 的消息时不投票也不更新任期，防止被移除或者被隔离的节点干扰集群
+	if n.leaderId != "" && time.Since(n.lastContact) < n.options.ElectionTimeout {
+		return resp, nil
+	}
+	if req.Term > n.term {
+		if err := n.becomeFollower(req.Term, ""); err != nil {
+			return nil, err
+		}
+		resp.Term = n.term
+	}
+
+	upToDate := req.LastLogTerm > n.lastTerm() ||
+		(req.LastLogTerm == n.lastTerm() && req.LastLogIndex >= n.lastIndex())
+	if (n.votedFor == "" || n.votedFor == req.CandidateId) && upToDate {
+		if err := n.storage.saveHardState(n.term, req.CandidateId); err != nil {
+			return nil, err
+		}
+		n.votedFor = req.CandidateId
+		n.resetElectionDeadline()
+		resp.VoteGranted = true
+	}
+	return resp, nil
+}
+
+// HandleAppendEntries 处理 Leader 复制的日志
+func (n *Node) HandleAppendEntries(req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.isClosed() {
+		return nil, ErrNodeClosed
+	}
+
+	resp := &AppendEntriesResponse{Term: n.term}
+	if req.Term < n.term {
+		return resp, nil
+	}
+	if err := n.followLeader(req.Term, req.LeaderId); err != nil {
+		return nil, err
+	}
+	resp.Term = n.term
+
+	// 快照之前的日志都已经提交，一定和 Leader 的日志匹配
+	prevIndex, prevTerm, entries := req.PrevLogIndex, req.PrevLogTerm, req.Entries
+	if prevIndex < n.snapshot.Index {
+		skip := n.snapshot.Index - prevIndex
+		if uint64(len(entries)) <= skip {
+			entries = nil
+		} else {
+			entries = entries[skip:]
+		}
+		prevIndex, prevTerm = n.snapshot.Index, n.snapshot.Term
+	}
+
+	if prevIndex > n.lastIndex() {
+		resp.ConflictIndex = n.lastIndex() + 1
+		return resp, nil
+	}
+	if term, _ := n.termAt(prevIndex); term != prevTerm {
+		// 跳过整个冲突的任期
+		index := prevIndex
+		for index > n.snapshot.Index+1 {
+			if t, _ := n.termAt(index - 1); t != term {
+				break
+			}
+			index--
+		}
+		resp.ConflictIndex = index
+		return resp, nil
+	}
+
+	// 从第一条冲突或者新的日志开始覆盖
+	for i, entry := range entries {
+		if term, ok := n.termAt(entry.Index); ok && term == entry.Term {
+			continue
+		}
+		if err := n.storage.replaceEntries(entry.Index, n.lastIndex(), entries[i:]); err != nil {
+			return nil, err
+		}
+		n.entries = append(n.entries[:entry.Index-n.snapshot.Index], entries[i:]...)
+		n.refreshMembers()
+		break
+	}
+
+	if commitIndex := min(req.LeaderCommit, prevIndex+uint64(len(entries))); commitIndex > n.commitIndex {
+		n.commitIndex = commitIndex
+		n.cond.Broadcast()
+	}
+	resp.Success = true
+	return resp, nil
+}
+
+// HandleInstallSnapshot 处理 Leader 发送的快照分块
+// 分块在锁外写入临时目录，接收完整之后才持有 n.mu 替换快照
+func (n *Node) HandleInstallSnapshot(req *InstallSnapshotRequest) (*InstallSnapshotResponse, error) {
+	n.mu.Lock()
+	if n.isClosed() {
+		n.mu.Unlock()
+		return nil, ErrNodeClosed
+	}
+	resp := &InstallSnapshotResponse{Term: n.term}
+	if req.Term < n.term {
+		n.mu.Unlock()
+		return resp, nil
+	}
+	if err := n.followLeader(req.Term, req.LeaderId); err != nil {
+		n.mu.Unlock()
+		return nil, err
+	}
+	resp.Term = n.term
+	// 已经提交的日志不需要快照
+	if req.Meta.Index <= n.commitIndex {
+		n.mu.Unlock()
+		return resp, nil
+	}
+	n.mu.Unlock()
+
+	n.recv.mu.Lock()
+	defer n.recv.mu.Unlock()
+	done, err := n.recv.write(req)
+	if err != nil || !done {
+		return resp, err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.isClosed() {
+		return nil, ErrNodeClosed
+	}
+	// 接收的过程中任期发生了变化，或者已经提交了快照之后的日志
+	meta := req.Meta
+	if req.Term < n.term || meta.Index <= n.commitIndex {
+		return resp, n.recv.reset()
+	}
+	if err := replaceDir(n.recv.dir, n.snapshotDir()); err != nil {
+		return nil, err
+	}
+	if err := n.compactLog(meta); err != nil {
+		return nil, err
+	}
+
+	// 由应用日志的协程替换状态机
+	n.commitIndex = meta.Index
+	n.installing = true
+	n.cond.Broadcast()
+	return resp, nil
+}
+
+// 发起选举或者发送心跳
+func (n *Node) ticker() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.options.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.closed:
+			return
+		case <-ticker.C:
+		}
+
+		n.mu.Lock()
+		if n.role == Leader {
+			n.heartbeat()
+		} else if time.Now().After(n.electionDeadline) && n.isMember(n.options.Id) {
+			n.campaign()
+		}
+		n.mu.Unlock()
+	}
+}
+
+// Leader 在一个选举超时时间内没有收到大多数节点的回复时退位，否则发送心跳
+func (n *Node) heartbeat() {
+	acked := map[string]bool{n.options.Id: true}
+	for peer, t := range n.lastAck {
+		if time.Since(t) < n.options.ElectionTimeout {
+			acked[peer] = true
+		}
+	}
+	if !n.hasQuorum(acked) {
+		if err := n.becomeFollower(n.term, ""); err != nil {
+			n.logf("failed to step down: %v", err)
+		}
+		return
+	}
+	n.lastContact = time.Now()
+	n.broadcast()
+}
+
+func (n *Node) campaign() {
+	n.role = Candidate
+	n.leaderId = ""
+	if err := n.storage.saveHardState(n.term+1, n.options.Id); err != nil {
+		n.logf("failed to start election: %v", err)
+		return
+	}
+	n.term++
+	n.votedFor = n.options.Id
+	n.resetElectionDeadline()
+	n.votes = map[string]bool{n.options.Id: true}
+	if n.hasQuorum(n.votes) {
+		n.becomeLeader()
+		return
+	}
+
+	req := &RequestVoteRequest{
+		Term:         n.term,
+		CandidateId:  n.options.Id,
+		LastLogIndex: n.lastIndex(),
+		LastLogTerm:  n.lastTerm(),
+	}
+	for _, peer := range n.peers() {
+		n.wg.Add(1)
+		go n.requestVote(peer, req)
+	}
+}
+
+func (n *Node) requestVote(peer string, req *RequestVoteRequest) {
+	defer n.wg.Done()
+	resp, err := n.transport.RequestVote(peer, req)
+	if err != nil {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.isClosed() {
+		return
+	}
+	if resp.Term > n.term {
+		_ = n.becomeFollower(resp.Term, "")
+		return
+	}
+	if n.role != Candidate || n.term != req.Term || !resp.VoteGranted {
+		return
+	}
+	n.votes[peer] = true
+	if n.hasQuorum(n.votes) {
+		n.becomeLeader()
+	}
+}
+
+// 收到当前 Leader 的请求
+func (n *Node) followLeader(term uint64, leaderId string) error {
+	if term > n.term || n.role != Follower {
+		if err := n.becomeFollower(term, leaderId); err != nil {
+			return err
+		}
+	}
+	n.leaderId = leaderId
+	n.lastContact = time.Now()
+	n.resetElectionDeadline()
+	return nil
+}
+
+func (n *Node) becomeFollower(term uint64, leaderId string) error {
+	if term > n.term {
+		if err := n.storage.saveHardState(term, ""); err != nil {
+			return err
+		}
+		n.term, n.votedFor = term, ""
+	}
+	if n.role == Leader {
+		n.failWaiters(ErrLeadershipLost)
+	}
+	n.role = Follower
+	n.leaderId = leaderId
+	n.resetElectionDeadline()
+	n.cond.Broadcast()
+	return nil
+}
+
+func (n *Node) becomeLeader() {
+	n.role = Leader
+	n.leaderId = n.options.Id
+	n.lastContact = time.Now()
+	n.nextIndex = make(map[string]uint64)
+	n.matchIndex = make(map[string]uint64)
+	n.lastAck = make(map[string]time.Time)
+	for _, peer := range n.peers() {
+		n.nextIndex[peer] = n.lastIndex() + 1
+		n.lastAck[peer] = time.Now()
+	}
+
+	// 提交一条当前任期的空日志，之前任期的日志随之提交
+	if _, err := n.propose(EntryNoop, nil); err != nil {
+		n.logf("failed to append noop entry: %v", err)
+		_ = n.becomeFollower(n.term, "")
+	}
+}
+
+// 在 Leader 上写入一条日志并开始复制，返回等待日志被应用的 channel，调用方需要持有 n.mu
+func (n *Node) propose(typ EntryType, data []byte) (chan error, error) {
+	if n.isClosed() {
+		return nil, ErrNodeClosed
+	}
+	if n.role != Leader {
+		return nil, ErrNotLeader
+	}
+
+	entry := &Entry{Index: n.lastIndex() + 1, Term: n.term, Type: typ, Data: data}
+	if err := n.storage.replaceEntries(entry.Index, n.lastIndex(), []*Entry{entry}); err != nil {
+		return nil, err
+	}
+	n.entries = append(n.entries, entry)
+	if typ == EntryConfig {
+		n.refreshMembers()
+	}
+
+	ch := make(chan error, 1)
+	n.waiters[entry.Index] = &waiter{term: entry.Term, ch: ch}
+	n.advanceCommit()
+	n.broadcast()
+	return ch, nil
+}
+
+// 向所有节点复制日志，每个节点同时只有一个复制的协程
+func (n *Node) broadcast() {
+	for _, peer := range n.peers() {
+		// 新加入的成员从最新的日志开始尝试
+		if _, ok := n.nextIndex[peer]; !ok {
+			n.nextIndex[peer] = n.lastIndex() + 1
+			n.lastAck[peer] = time.Now()
+		}
+		if n.replicating[peer] {
+			n.pendingReplicate[peer] = true
+			continue
+		}
+		n.replicating[peer] = true
+		n.wg.Add(1)
+		go n.replicate(peer, n.term)
+	}
+}
+
+// 持续向 peer 复制日志，直到 peer 追上 Leader
+func (n *Node) replicate(peer string, term uint64) {
+	defer n.wg.Done()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for !n.isClosed() && n.role == Leader && n.term == term && n.isMember(peer) {
+		n.pendingReplicate[peer] = false
+		var ok bool
+		if n.nextIndex[peer] <= n.snapshot.Index {
+			ok = n.sendSnapshot(peer)
+		} else {
+			ok = n.sendEntries(peer)
+		}
+		if !ok || (n.nextIndex[peer] > n.lastIndex() && !n.pendingReplicate[peer]) {
+			break
+		}
+	}
+	n.replicating[peer] = false
+}
+
+// 发送一批日志，调用方需要持有 n.mu，发送的过程中会释放锁
+func (n *Node) sendEntries(peer string) bool {
+	req := n.appendEntriesRequest(peer, n.options.MaxAppendEntries)
+	n.mu.Unlock()
+	resp, err := n.transport.AppendEntries(peer, req)
+	n.mu.Lock()
+	if err != nil || !n.checkResponse(req.Term, resp.Term) {
+		return false
+	}
+
+	n.lastAck[peer] = time.Now()
+	if resp.Success {
+		match := req.PrevLogIndex + uint64(len(req.Entries))
+		if match > n.matchIndex[peer] {
+			n.matchIndex[peer] = match
+			n.advanceCommit()
+		}
+		n.nextIndex[peer] = max(n.nextIndex[peer], match+1)
+		return true
+	}
+	next := req.PrevLogIndex
+	if resp.ConflictIndex > 0 {
+		next = min(next, resp.ConflictIndex)
+	}
+	n.nextIndex[peer] = max(next, n.matchIndex[peer]+1, 1)
+	return true
+}
+
+// 发送快照，调用方需要持有 n.mu，发送的过程中会释放锁
+// 持有锁的时候只打开快照中的文件，读取和发送都在锁外进行
+func (n *Node) sendSnapshot(peer string) bool {
+	files, err := openSnapshotFiles(n.snapshotDir())
+	if err != nil {
+		n.logf("failed to read snapshot: %v", err)
+		return false
+	}
+	term, meta := n.term, n.snapshot
+	n.mu.Unlock()
+	respTerm, err := n.streamSnapshot(peer, term, meta, files)
+	closeSnapshotFiles(files)
+	n.mu.Lock()
+	if err != nil || !n.checkResponse(term, respTerm) {
+		return false
+	}
+
+	n.lastAck[peer] = time.Now()
+	if meta.Index > n.matchIndex[peer] {
+		n.matchIndex[peer] = meta.Index
+		n.advanceCommit()
+	}
+	n.nextIndex[peer] = max(n.nextIndex[peer], meta.Index+1)
+	return true
+}
+
+// 按照文件名的顺序分块发送快照中的文件，返回最后一次回复的任期，发现更大的任期时提前返回
+func (n *Node) streamSnapshot(peer string, term uint64, meta SnapshotMeta, files []snapshotFile) (uint64, error) {
+	if len(files) == 0 {
+		return 0, ErrInvalidSnapshot
+	}
+	req := &InstallSnapshotRequest{Term: term, LeaderId: n.options.Id, Meta: meta}
+	buf := make([]byte, snapshotChunkSize)
+	var respTerm uint64
+	for i, f := range files {
+		var offset int64
+		for {
+			size, err := f.file.ReadAt(buf, offset)
+			if err != nil && err != io.EOF {
+				return 0, err
+			}
+			last := size < len(buf)
+			req.File, req.Offset, req.Data = f.name, offset, buf[:size]
+			req.Done = last && i == len(files)-1
+			resp, err := n.transport.InstallSnapshot(peer, req)
+			if err != nil {
+				return 0, err
+			}
+			if respTerm = resp.Term; respTerm > term {
+				return respTerm, nil
+			}
+			req.Seq++
+			offset += int64(size)
+			if last {
+				break
+			}
+		}
+	}
+	return respTerm, nil
+}
+
+// 检查回复的任期，发现更大的任期时退位，返回当前是否仍然是发送请求时任期的 Leader
+func (n *Node) checkResponse(reqTerm, respTerm uint64) bool {
+	if n.isClosed() {
+		return false
+	}
+	if respTerm > n.term {
+		_ = n.becomeFollower(respTerm, "")
+		return false
+	}
+	return n.role == Leader && n.term == reqTerm
+}
+
+// 构造复制日志的请求，maxEntries 为 0 时是心跳
+func (n *Node) appendEntriesRequest(peer string, maxEntries int) *AppendEntriesRequest {
+	prevIndex := max(n.nextIndex[peer]-1, n.snapshot.Index)
+	prevTerm, _ := n.termAt(prevIndex)
+	end := min(n.lastIndex(), prevIndex+uint64(maxEntries))
+	req := &AppendEntriesRequest{
+		Term:         n.term,
+		LeaderId:     n.options.Id,
+		PrevLogIndex: prevIndex,
+		PrevLogTerm:  prevTerm,
+		LeaderCommit: n.commitIndex,
+	}
+	if end > prevIndex {
+		req.Entries = append([]*Entry(nil), n.entries[prevIndex+1-n.snapshot.Index:end+1-n.snapshot.Index]...)
+	}
+	return req
+}
+
+// 大多数节点都复制了的当前任期的日志可以提交
+func (n *Node) advanceCommit() {
+	for index := n.lastIndex(); index > n.commitIndex; index-- {
+		if term, _ := n.termAt(index); term != n.term {
+			return
+		}
+		count := 0
+		for _, member := range n.members {
+			if member == n.options.Id || n.matchIndex[member] >= index {
+				count++
+			}
+		}
+		if count > len(n.members)/2 {
+			n.commitIndex = index
+			n.cond.Broadcast()
+			return
+		}
+	}
+}
+
+// 线性一致读之前调用，确认自己仍然是 Leader 并且状态机已经应用了读取时的提交位置
+func (n *Node) readBarrier() error {
+	n.mu.Lock()
+	// 当前任期的空日志提交之后，commitIndex 才包含了之前所有已经提交的日志
+	for {
+		if n.isClosed() {
+			n.mu.Unlock()
+			return ErrNodeClosed
+		}
+		if n.role != Leader {
+			n.mu.Unlock()
+			return ErrNotLeader
+		}
+		if term, _ := n.termAt(n.commitIndex); term == n.term {
+			break
+		}
+		n.cond.Wait()
+	}
+	readIndex, term := n.commitIndex, n.term
+	members := append([]string(nil), n.members...)
+	acks := make(chan string, len(members))
+	for _, peer := range n.peers() {
+		req := n.appendEntriesRequest(peer, 0)
+		n.wg.Add(1)
+		go func(peer string) {
+			defer n.wg.Done()
+			resp, err := n.transport.AppendEntries(peer, req)
+			if err == nil {
+				n.mu.Lock()
+				if n.checkResponse(term, resp.Term) {
+					acks <- peer
+				}
+				n.mu.Unlock()
+			}
+		}(peer)
+	}
+	n.mu.Unlock()
+
+	// 大多数节点回复了心跳说明在读取时仍然是 Leader
+	acked := map[string]bool{n.options.Id: true}
+	timeout := time.After(n.options.ElectionTimeout)
+	for !quorum(members, acked) {
+		select {
+		case peer := <-acks:
+			acked[peer] = true
+		case <-timeout:
+			return ErrNotLeader
+		case <-n.closed:
+			return ErrNodeClosed
+		}
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for n.lastApplied < readIndex {
+		if n.isClosed() {
+			return ErrNodeClosed
+		}
+		n.cond.Wait()
+	}
+	return nil
+}
+
+// 将提交的日志应用到状态机
+func (n *Node) applier() {
+	defer n.wg.Done()
+	for {
+		n.mu.Lock()
+		for !n.isClosed() && !n.installing && n.lastApplied >= n.commitIndex {
+			n.cond.Wait()
+		}
+		if n.isClosed() {
+			n.mu.Unlock()
+			return
+		}
+		if n.installing {
+			meta := n.snapshot
+			n.mu.Unlock()
+			if err := n.installSnapshot(meta); err != nil {
+				n.logf("failed to install snapshot: %v", err)
+				n.backoff()
+			}
+			continue
+		}
+		from := n.lastApplied + 1
+		to := min(n.commitIndex, from+uint64(n.options.MaxAppendEntries)-1)
+		entries := append([]*Entry(nil), n.entries[from-n.snapshot.Index:to+1-n.snapshot.Index]...)
+		n.mu.Unlock()
+
+		// 日志本身导致的错误在所有节点上都相同，作为这条日志的结果返回给写入方
+		// 其他错误（例如磁盘错误）停在这条日志，之后重试，不能跳过
+		results := make([]error, 0, len(entries))
+		var applyErr error
+		n.dbMu.RLock()
+		for _, entry := range entries {
+			err := applyEntry(n.db, entry)
+			if err != nil && !isDeterministicApplyError(err) {
+				applyErr = err
+				break
+			}
+			results = append(results, err)
+		}
+		entries = entries[:len(results)]
+		// 状态机的数据持久化之后才能记录应用的位置
+		err := n.db.Sync()
+		n.dbMu.RUnlock()
+		if err == nil && len(entries) > 0 {
+			to = entries[len(entries)-1].Index
+			err = n.storage.saveApplied(to)
+		}
+		if err == nil {
+			err = applyErr
+		}
+		if err != nil {
+			n.logf("failed to apply entries: %v", err)
+		}
+		if len(entries) == 0 || (err != nil && err != applyErr) {
+			n.backoff()
+			continue
+		}
+
+		n.mu.Lock()
+		n.lastApplied = to
+		for i, entry := range entries {
+			if w, ok := n.waiters[entry.Index]; ok {
+				delete(n.waiters, entry.Index)
+				if w.term == entry.Term {
+					w.ch <- results[i]
+				} else {
+					w.ch <- ErrLeadershipLost
+				}
+			}
+		}
+		// 移除自身的成员变更应用之后 Leader 退位
+		if n.role == Leader && !n.isMember(n.options.Id) && n.lastApplied >= n.configIndex {
+			_ = n.becomeFollower(n.term, "")
+		}
+		n.cond.Broadcast()
+		needSnapshot := !n.installing && n.lastApplied-n.snapshot.Index >= n.options.SnapshotThreshold
+		n.mu.Unlock()
+
+		if needSnapshot {
+			if err := n.takeSnapshot(); err != nil {
+				n.logf("failed to take snapshot: %v", err)
+			}
+		}
+		if applyErr != nil {
+			n.backoff()
+		}
+	}
+}
+
+// 用收到的快照替换状态机，在锁外将快照拷贝到临时目录，之后只在替换数据目录的时候持有锁
+func (n *Node) installSnapshot(meta SnapshotMeta) error {
+	stagingDir := filepath.Join(n.options.DirPath, dataDirName+".installing")
+	if err := restoreData(n.snapshotDir(), stagingDir); err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	// 拷贝的过程中收到了更新的快照，重新拷贝
+	if n.snapshot.Index != meta.Index {
+		return os.RemoveAll(stagingDir)
+	}
+	if err := n.replaceData(stagingDir); err != nil {
+		return err
+	}
+	if err := n.storage.saveApplied(meta.Index); err != nil {
+		return err
+	}
+	n.lastApplied = meta.Index
+	n.installing = false
+	n.cond.Broadcast()
+	return nil
+}
+
+// 用 dir 中的数据替换状态机的数据目录，失败时重新打开原来的数据
+func (n *Node) replaceData(dir string) error {
+	n.dbMu.Lock()
+	defer n.dbMu.Unlock()
+	if err := n.db.Close(); err != nil {
+		if openErr := n.openDB(); openErr != nil {
+			return openErr
+		}
+		return err
+	}
+
+	oldDir := filepath.Join(n.options.DirPath, dataDirName+".old")
+	if err := os.RemoveAll(oldDir); err != nil {
+		return n.reopenAfter(err)
+	}
+	if err := os.Rename(n.dataDir(), oldDir); err != nil {
+		return n.reopenAfter(err)
+	}
+	err := os.Rename(dir, n.dataDir())
+	if err == nil {
+		if err = n.openDB(); err == nil {
+			return os.RemoveAll(oldDir)
+		}
+	}
+
+	// 恢复原来的数据目录
+	if removeErr := os.RemoveAll(n.dataDir()); removeErr != nil {
+		return removeErr
+	}
+	if renameErr := os.Rename(oldDir, n.dataDir()); renameErr != nil {
+		return renameErr
+	}
+	return n.reopenAfter(err)
+}
+
+// 重新打开状态机，返回导致重新打开的错误
+func (n *Node) reopenAfter(err error) error {
+	if openErr := n.openDB(); openErr != nil {
+		return openErr
+	}
+	return err
+}
+
+// 生成状态机的快照，只有应用日志的协程会写入状态机，检查点和应用的位置一致
+func (n *Node) takeSnapshot() error {
+	n.mu.Lock()
+	meta := SnapshotMeta{Index: n.lastApplied, Members: n.membersAt(n.lastApplied)}
+	meta.Term, _ = n.termAt(meta.Index)
+	n.mu.Unlock()
+
+	tmpDir := filepath.Join(n.options.DirPath, snapshotDirName+".tmp")
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return err
+	}
+	n.dbMu.RLock()
+	err := n.db.Checkpoint(tmpDir)
+	n.dbMu.RUnlock()
+	if err != nil {
+		return err
+	}
+	if err := writeSnapshotMeta(tmpDir, meta); err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	// 生成的过程中收到了更新的快照
+	if n.installing || meta.Index <= n.snapshot.Index {
+		return os.RemoveAll(tmpDir)
+	}
+	if err := replaceDir(tmpDir, n.snapshotDir()); err != nil {
+		return err
+	}
+	return n.compactLog(meta)
+}
+
+// 删除快照包含的日志，快照之后匹配的日志会被保留，调用方需要持有 n.mu
+func (n *Node) compactLog(meta SnapshotMeta) error {
+	var rest []*Entry
+	to := n.lastIndex()
+	if term, ok := n.termAt(meta.Index); ok && term == meta.Term {
+		rest = n.entries[meta.Index-n.snapshot.Index+1:]
+		to = meta.Index
+	}
+	if err := n.storage.replaceEntries(n.snapshot.Index+1, to, nil); err != nil {
+		return err
+	}
+	n.snapshot = meta
+	n.entries = append([]*Entry{{Index: meta.Index, Term: meta.Term}}, rest...)
+	n.refreshMembers()
+	return nil
+}
+
+func (n *Node) failWaiters(err error) {
+	for index, w := range n.waiters {
+		w.ch <- err
+		delete(n.waiters, index)
+	}
+}
+
+func (n *Node) backoff() {
+	select {
+	case <-n.closed:
+	case <-time.After(n.options.HeartbeatInterval):
+	}
+}
+
+func (n *Node) lastIndex() uint64 {
+	return n.entries[len(n.entries)-1].Index
+}
+
+func (n *Node) lastTerm() uint64 {
+	return n.entries[len(n.entries)-1].Term
+}
+
+// 日志的任期，日志不存在或者已经被快照删除时返回 false
+func (n *Node) termAt(index uint64) (uint64, bool) {
+	if index < n.snapshot.Index || index > n.lastIndex() {
+		return 0, false
+	}
+	return n.entries[index-n.snapshot.Index].Term, true
+}
+
+// index 位置生效的成员配置
+func (n *Node) membersAt(index uint64) []string {
+	for i := min(index, n.lastIndex()); i > n.snapshot.Index; i-- {
+		entry := n.entries[i-n.snapshot.Index]
+		if entry.Type != EntryConfig {
+			continue
+		}
+		if members, err := decodeMembers(entry.Data); err == nil {
+			return members
+		}
+	}
+	return n.snapshot.Members
+}
+
+func (n *Node) refreshMembers() {
+	n.members = n.membersAt(n.lastIndex())
+	n.configIndex = n.snapshot.Index
+	for i := len(n.entries) - 1; i > 0; i-- {
+		if n.entries[i].Type == EntryConfig {
+			n.configIndex = n.entries[i].Index
+			break
+		}
+	}
+}
+
+func (n *Node) isMember(id string) bool {
+	for _, member := range n.members {
+		if member == id {
+			return true
+		}
+	}
+	return false
+}
+
+// 除自身之外的成员
+func (n *Node) peers() []string {
+	var peers []string
+	for _, member := range n.members {
+		if member != n.options.Id {
+			peers = append(peers, member)
+		}
+	}
+	return peers
+}
+
+func (n *Node) hasQuorum(set map[string]bool) bool {
+	return quorum(n.members, set)
+}
+
+func quorum(members []string, set map[string]bool) bool {
+	count := 0
+	for _, member := range members {
+		if set[member] {
+			count++
+		}
+	}
+	return count > len(members)/2
+}
+
+func (n *Node) resetElectionDeadline() {
+	timeout := n.options.ElectionTimeout + time.Duration(rand.Int63n(int64(n.options.ElectionTimeout)))
+	n.electionDeadline = time.Now().Add(timeout)
+}
+
+func (n *Node) logf(format string, args ...any) {
+	if n.options.Logger != nil {
+		n.options.Logger.Printf("cluster: node %s "+format, append([]any{n.options.Id}, args...)...)
+	}
+}
+
+func (n *Node) isClosed() bool {
+	select {
+	case <-n.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (n *Node) snapshotDir() string {
+	return filepath.Join(n.options.DirPath, snapshotDirName)
+}
+
+func (n *Node) dataDir() string {
+	return filepath.Join(n.options.DirPath, dataDirName)
+}
+
+// 用快照替换状态机的数据目录
+func restoreData(snapshotDir, dataDir string) error {
+	if err := os.RemoveAll(dataDir); err != nil {
+		return err
+	}
+	return utils.CopyDir(snapshotDir, dataDir, []string{snapshotMetaFileName})
+}
+
+func checkOptions(opts Options) error {
+	if opts.Id == "" || opts.DirPath == "" || opts.Transport == nil {
+		return ErrInvalidOptions
+	}
+	if opts.HeartbeatInterval <= 0 || opts.ElectionTimeout <= opts.HeartbeatInterval {
+		return ErrInvalidOptions
+	}
+	if opts.MaxAppendEntries <= 0 || opts.SnapshotThreshold == 0 {
+		return ErrInvalidOptions
+	}
+	return nil
+}
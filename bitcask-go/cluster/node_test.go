@@ -0,0 +1,410 @@
+package cluster
+
+import (
+	bitcask "bitcask-go"
+	"bitcask-go/utils"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCluster struct {
+	t       *testing.T
+	network *InmemNetwork
+	dirs    map[string]string
+	nodes   map[string]*Node
+}
+
+func newTestCluster(t *testing.T, ids ...string) *testCluster {
+	c := &testCluster{
+		t:       t,
+		network: NewInmemNetwork(),
+		dirs:    make(map[string]string),
+		nodes:   make(map[string]*Node),
+	}
+	for _, id := range ids {
+		c.start(id, ids)
+	}
+	return c
+}
+
+func (c *testCluster) start(id string, peers []string) *Node {
+	dir, ok := c.dirs[id]
+	if !ok {
+		dir, _ = os.MkdirTemp("", "bitcask-go-cluster-"+id)
+		c.dirs[id] = dir
+	}
+	opts := DefaultOptions
+	opts.Id = id
+	opts.Peers = peers
+	opts.DirPath = dir
+	opts.Transport = c.network.Transport(id)
+	opts.HeartbeatInterval = 10 * time.Millisecond
+	opts.ElectionTimeout = 50 * time.Millisecond
+	opts.SnapshotThreshold = 50
+	node, err := NewNode(opts)
+	assert.Nil(c.t, err)
+	c.nodes[id] = node
+	return node
+}
+
+func (c *testCluster) stop(id string) {
+	err := c.nodes[id].Close()
+	assert.Nil(c.t, err)
+	delete(c.nodes, id)
+}
+
+func (c *testCluster) destroy() {
+	for id := range c.nodes {
+		c.stop(id)
+	}
+	for _, dir := range c.dirs {
+		_ = os.RemoveAll(dir)
+	}
+}
+
+// 等待除了 excluded 之外的节点中选出 Leader
+func (c *testCluster) waitLeader(excluded ...string) *Node {
+	var leader *Node
+	waitFor(c.t, func() bool {
+		for id, node := range c.nodes {
+			if contains(excluded, id) {
+				continue
+			}
+			if node.Status().Role == Leader {
+				leader = node
+				return true
+			}
+		}
+		return false
+	})
+	return leader
+}
+
+func (c *testCluster) waitApplied(id string, index uint64) {
+	waitFor(c.t, func() bool {
+		return c.nodes[id].Status().AppliedIndex >= index
+	})
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("condition not satisfied before timeout")
+}
+
+func contains(ids []string, id string) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+func TestCluster(t *testing.T) {
+	c := newTestCluster(t, "n1", "n2", "n3")
+	defer c.destroy()
+
+	leader := c.waitLeader()
+	for i := 0; i < 100; i++ {
+		err := leader.Put(utils.GetTestKey(i), []byte(fmt.Sprintf("value-%d", i)))
+		assert.Nil(t, err)
+	}
+	err := leader.Write([]Op{
+		{Type: OpPut, Key: []byte("batch-1"), Value: []byte("a")},
+		{Type: OpPut, Key: []byte("batch-2"), Value: []byte("b")},
+		{Type: OpDelete, Key: utils.GetTestKey(0)},
+	})
+	assert.Nil(t, err)
+	err = leader.Put(nil, []byte("a"))
+	assert.Equal(t, bitcask.ErrKeyIsEmpty, err)
+
+	val, err := leader.Get([]byte("batch-2"), ReadLinearizable)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("b"), val)
+	_, err = leader.Get(utils.GetTestKey(0), ReadLinearizable)
+	assert.Equal(t, bitcask.ErrKeyNotFound, err)
+
+	// Follower 只能读取本地的旧数据
+	index := leader.Status().CommitIndex
+	for id, node := range c.nodes {
+		if node == leader {
+			continue
+		}
+		assert.Equal(t, ErrNotLeader, node.Put([]byte("a"), []byte("b")))
+		_, err := node.Get([]byte("batch-1"), ReadLinearizable)
+		assert.Equal(t, ErrNotLeader, err)
+
+		c.waitApplied(id, index)
+		val, err := node.Get(utils.GetTestKey(99), ReadStale)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("value-99"), val)
+		_, err = node.Get(utils.GetTestKey(0), ReadStale)
+		assert.Equal(t, bitcask.ErrKeyNotFound, err)
+		assert.Equal(t, leader.Status().Leader, node.Leader())
+	}
+}
+
+func TestCluster_LeaderFailover(t *testing.T) {
+	c := newTestCluster(t, "n1", "n2", "n3")
+	defer c.destroy()
+
+	oldLeader := c.waitLeader()
+	err := oldLeader.Put([]byte("key"), []byte("v1"))
+	assert.Nil(t, err)
+
+	// 隔离 Leader 之后剩下的节点选出新的 Leader
+	oldId := oldLeader.Status().Id
+	c.network.Disconnect(oldId)
+	leader := c.waitLeader(oldId)
+	err = leader.Put([]byte("key"), []byte("v2"))
+	assert.Nil(t, err)
+	val, err := leader.Get([]byte("key"), ReadLinearizable)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v2"), val)
+
+	// 被隔离的 Leader 无法完成写入和线性一致读
+	assert.NotNil(t, oldLeader.Put([]byte("key"), []byte("v3")))
+	_, err = oldLeader.Get([]byte("key"), ReadLinearizable)
+	assert.NotNil(t, err)
+
+	// 恢复之后旧的 Leader 追上新的数据
+	c.network.Reconnect(oldId)
+	waitFor(t, func() bool {
+		val, err := oldLeader.Get([]byte("key"), ReadStale)
+		return err == nil && string(val) == "v2" && oldLeader.Status().Role != Leader
+	})
+	leader = c.waitLeader()
+	val, err = leader.Get([]byte("key"), ReadLinearizable)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v2"), val)
+}
+
+func TestCluster_Restart(t *testing.T) {
+	ids := []string{"n1", "n2", "n3"}
+	c := newTestCluster(t, ids...)
+	defer c.destroy()
+
+	leader := c.waitLeader()
+	var followerId string
+	for id, node := range c.nodes {
+		if node != leader {
+			followerId = id
+		}
+	}
+	c.stop(followerId)
+	for i := 0; i < 120; i++ {
+		err := leader.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+
+	// 重启的节点从持久化的日志和快照恢复，然后追上 Leader
+	c.start(followerId, ids)
+	c.waitApplied(followerId, leader.Status().CommitIndex)
+	val, err := c.nodes[followerId].Get(utils.GetTestKey(119), ReadStale)
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(119), val)
+
+	// 所有节点重启之后数据仍然存在
+	for _, id := range ids {
+		c.stop(id)
+	}
+	for _, id := range ids {
+		c.start(id, ids)
+	}
+	leader = c.waitLeader()
+	assert.True(t, leader.Status().SnapshotIndex > 0)
+	for i := 0; i < 120; i++ {
+		val, err := leader.Get(utils.GetTestKey(i), ReadLinearizable)
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i), val)
+	}
+}
+
+func TestCluster_Membership(t *testing.T) {
+	c := newTestCluster(t, "n1", "n2", "n3")
+	defer c.destroy()
+
+	leader := c.waitLeader()
+	for i := 0; i < 200; i++ {
+		err := leader.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	assert.True(t, leader.Status().SnapshotIndex > 0)
+
+	// 新节点通过快照追上 Leader
+	n4 := c.start("n4", nil)
+	assert.Equal(t, ErrNotLeader, n4.AddMember("n5"))
+	err := leader.AddMember("n4")
+	assert.Nil(t, err)
+	assert.Equal(t, ErrMemberExists, leader.AddMember("n4"))
+	assert.Equal(t, 4, len(leader.Members()))
+	c.waitApplied("n4", leader.Status().CommitIndex)
+	assert.Equal(t, 4, len(n4.Members()))
+	val, err := n4.Get(utils.GetTestKey(10), ReadStale)
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(10), val)
+
+	// 移除 Leader 之后剩下的节点选出新的 Leader
+	oldId := leader.Status().Id
+	err = leader.RemoveMember(oldId)
+	assert.Nil(t, err)
+	assert.NotEqual(t, Leader, leader.Status().Role)
+	c.stop(oldId)
+
+	leader = c.waitLeader()
+	assert.Equal(t, 3, len(leader.Members()))
+	// 新的 Leader 提交了当前任期的日志之后才能变更成员
+	err = leader.Put([]byte("after-remove"), []byte("ok"))
+	assert.Nil(t, err)
+	assert.Equal(t, ErrMemberNotFound, leader.RemoveMember(oldId))
+	c.waitApplied("n4", leader.Status().CommitIndex)
+	val, err = n4.Get([]byte("after-remove"), ReadStale)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("ok"), val)
+}
+
+func TestCommand(t *testing.T) {
+	ops := []Op{
+		{Type: OpPut, Key: []byte("a"), Value: []byte("1")},
+		{Type: OpDelete, Key: []byte("b")},
+	}
+	decoded, err := decodeCommand(encodeCommand(ops))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(decoded))
+	assert.Equal(t, ops[0].Key, decoded[0].Key)
+	assert.Equal(t, ops[0].Value, decoded[0].Value)
+	assert.Equal(t, OpDelete, decoded[1].Type)
+
+	buf := encodeCommand(ops)
+	_, err = decodeCommand(buf[:len(buf)-3])
+	assert.Equal(t, ErrStorageCorrupted, err)
+}
+
+// 替换状态机的数据失败时重新打开原来的数据
+func TestNode_ReplaceDataFailure(t *testing.T) {
+	c := newTestCluster(t, "n1")
+	defer c.destroy()
+	leader := c.waitLeader()
+	err := leader.Put([]byte("key"), []byte("value"))
+	assert.Nil(t, err)
+
+	leader.mu.Lock()
+	err = leader.replaceData(filepath.Join(c.dirs["n1"], "not-exist"))
+	leader.mu.Unlock()
+	assert.NotNil(t, err)
+	val, err := leader.Get([]byte("key"), ReadStale)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), val)
+	err = leader.Put([]byte("key"), []byte("value2"))
+	assert.Nil(t, err)
+}
+
+// 替换快照目录的过程中崩溃，重启时恢复完整的目录
+func TestRecoverDir(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-cluster-recover")
+	defer os.RemoveAll(dir)
+	dest := filepath.Join(dir, snapshotDirName)
+	src := dest + ".tmp"
+	assert.Nil(t, os.MkdirAll(dest, os.ModePerm))
+	assert.Nil(t, writeSnapshotMeta(dest, SnapshotMeta{Index: 1}))
+	assert.Nil(t, os.MkdirAll(src, os.ModePerm))
+	assert.Nil(t, writeSnapshotMeta(src, SnapshotMeta{Index: 2}))
+
+	// 旧的目录已经移走，新的目录还没有就位
+	assert.Nil(t, os.Rename(dest, dest+".old"))
+	assert.Nil(t, recoverDir(dest, src))
+	meta, err := readSnapshotMeta(dest)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), meta.Index)
+	_, err = os.Stat(src)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(dest + ".old")
+	assert.True(t, os.IsNotExist(err))
+
+	// 正常替换
+	assert.Nil(t, os.MkdirAll(src, os.ModePerm))
+	assert.Nil(t, writeSnapshotMeta(src, SnapshotMeta{Index: 2}))
+	assert.Nil(t, replaceDir(src, dest))
+	meta, err = readSnapshotMeta(dest)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), meta.Index)
+	_, err = os.Stat(dest + ".old")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSnapshotReceiver(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-cluster-recv")
+	defer os.RemoveAll(dir)
+	r := newSnapshotReceiver(filepath.Join(dir, "recv"))
+	meta := SnapshotMeta{Index: 10, Term: 2}
+	chunk := func(seq uint64, file string, offset int64, data string, done bool) *InstallSnapshotRequest {
+		return &InstallSnapshotRequest{Term: 2, Meta: meta, Seq: seq, File: file, Offset: offset, Data: []byte(data), Done: done}
+	}
+
+	done, err := r.write(chunk(0, "a", 0, "hello ", false))
+	assert.Nil(t, err)
+	assert.False(t, done)
+	// 序号不连续的分块被拒绝
+	_, err = r.write(chunk(2, "a", 6, "world", false))
+	assert.Equal(t, ErrInvalidSnapshot, err)
+	// 文件名不能包含路径
+	_, err = r.write(chunk(1, "../a", 0, "x", false))
+	assert.Equal(t, ErrInvalidSnapshot, err)
+
+	// 新的快照丢弃没有接收完的快照
+	_, err = r.write(chunk(0, "a", 0, "hello ", false))
+	assert.Nil(t, err)
+	_, err = r.write(chunk(1, "a", 6, "world", false))
+	assert.Nil(t, err)
+	done, err = r.write(chunk(2, "b", 0, "", true))
+	assert.Nil(t, err)
+	assert.True(t, done)
+
+	buf, err := os.ReadFile(filepath.Join(r.dir, "a"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello world"), buf)
+	buf, err = os.ReadFile(filepath.Join(r.dir, "b"))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(buf))
+	readMeta, err := readSnapshotMeta(r.dir)
+	assert.Nil(t, err)
+	assert.Equal(t, meta.Index, readMeta.Index)
+}
+
+// 状态机写入失败时停在失败的日志，之后重试，不会跳过
+func TestNode_ApplyRetry(t *testing.T) {
+	c := newTestCluster(t, "n1")
+	defer c.destroy()
+	leader := c.waitLeader()
+	err := leader.Put([]byte("key"), []byte("value"))
+	assert.Nil(t, err)
+
+	applied := leader.Status().AppliedIndex
+	leader.db.SetWriteFence(true)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- leader.Put([]byte("key"), []byte("value2"))
+	}()
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, applied, leader.Status().AppliedIndex)
+
+	leader.db.SetWriteFence(false)
+	assert.Nil(t, <-errCh)
+	val, err := leader.Get([]byte("key"), ReadStale)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value2"), val)
+
+	// 日志本身无效时所有节点都会拒绝，作为结果返回
+	assert.True(t, isDeterministicApplyError(applyEntry(leader.db, &Entry{Type: EntryCommand, Data: []byte{1}})))
+	assert.False(t, isDeterministicApplyError(bitcask.ErrWriteFenced))
+}
@@ -0,0 +1,366 @@
+package cluster
+
+import (
+	bitcask "bitcask-go"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	// Raft 日志和持久化状态所在的目录
+	raftDirName = "raft"
+	// 状态机数据所在的目录
+	dataDirName = "data"
+	// 最新的快照，是状态机数据目录的检查点
+	snapshotDirName = "snapshot"
+	// 快照的元数据，保存在快照目录中
+	snapshotMetaFileName = "snapshot-meta"
+)
+
+var (
+	hardStateKey = []byte("hard-state")
+	appliedKey   = []byte("applied")
+	logKeyPrefix = []byte("log/")
+)
+
+// SnapshotMeta 快照的元数据
+type SnapshotMeta struct {
+	Index   uint64   `json:"index"`   // 快照包含的最后一条日志的索引
+	Term    uint64   `json:"term"`    // 快照包含的最后一条日志的任期
+	Members []string `json:"members"` // 快照时的集群成员
+}
+
+// Raft 日志、任期和投票信息存储在一个单独的 bitcask 实例中
+type storage struct {
+	db *bitcask.DB
+}
+
+func openStorage(dirPath string, dbOpts bitcask.Options) (*storage, error) {
+	dbOpts.DirPath = dirPath
+	dbOpts.IndexType = bitcask.Btree
+	dbOpts.ReadOnly = false
+	db, err := bitcask.Open(dbOpts)
+	if err != nil {
+		return nil, err
+	}
+	return &storage{db: db}, nil
+}
+
+func (s *storage) close() error {
+	return s.db.Close()
+}
+
+// 读取任期和投票的对象
+func (s *storage) loadHardState() (uint64, string, error) {
+	buf, err := s.db.Get(hardStateKey)
+	if err == bitcask.ErrKeyNotFound {
+		return 0, "", nil
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	term, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return 0, "", ErrStorageCorrupted
+	}
+	return term, string(buf[n:]), nil
+}
+
+// 任期和投票必须在回复请求之前持久化
+func (s *storage) saveHardState(term uint64, votedFor string) error {
+	buf := binary.AppendUvarint(nil, term)
+	buf = append(buf, votedFor...)
+	if err := s.db.Put(hardStateKey, buf); err != nil {
+		return err
+	}
+	return s.db.Sync()
+}
+
+// 状态机已经应用的日志索引
+func (s *storage) loadApplied() (uint64, error) {
+	buf, err := s.db.Get(appliedKey)
+	if err == bitcask.ErrKeyNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	applied, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return 0, ErrStorageCorrupted
+	}
+	return applied, nil
+}
+
+func (s *storage) saveApplied(applied uint64) error {
+	if err := s.db.Put(appliedKey, binary.AppendUvarint(nil, applied)); err != nil {
+		return err
+	}
+	return s.db.Sync()
+}
+
+// 读取所有的日志，按照索引从小到大排序
+func (s *storage) loadEntries() ([]*Entry, error) {
+	iterOpts := bitcask.DefaultIteratorOptions
+	iterOpts.Prefix = logKeyPrefix
+	iter := s.db.NewIterator(iterOpts)
+	defer iter.Close()
+
+	var entries []*Entry
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		buf, err := iter.Value()
+		if err != nil {
+			return nil, err
+		}
+		entry, err := decodeEntry(buf)
+		if err != nil {
+			return nil, err
+		}
+		entry.Index = binary.BigEndian.Uint64(iter.Key()[len(logKeyPrefix):])
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// 删除 [from, to] 之间的日志，然后写入新的日志，在一个事务中完成
+func (s *storage) replaceEntries(from, to uint64, entries []*Entry) error {
+	for {
+		wb := s.db.NewWriteBatch(bitcask.DefaultWriteBatchOptions)
+		count := 0
+		for ; from <= to && count < int(bitcask.DefaultWriteBatchOptions.MaxBatchSize)/2; from++ {
+			if err := wb.Delete(logKey(from)); err != nil {
+				return err
+			}
+			count++
+		}
+		// 删除的日志太多时分多个批次，最后一个批次写入新的日志
+		if from <= to {
+			if err := wb.Commit(); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, entry := range entries {
+			if err := wb.Put(logKey(entry.Index), encodeEntry(entry)); err != nil {
+				return err
+			}
+		}
+		return wb.Commit()
+	}
+}
+
+func logKey(index uint64) []byte {
+	key := make([]byte, len(logKeyPrefix)+8)
+	copy(key, logKeyPrefix)
+	binary.BigEndian.PutUint64(key[len(logKeyPrefix):], index)
+	return key
+}
+
+// 日志的编码 | type | term | data |
+func encodeEntry(entry *Entry) []byte {
+	buf := make([]byte, 1, 1+binary.MaxVarintLen64+len(entry.Data))
+	buf[0] = entry.Type
+	buf = binary.AppendUvarint(buf, entry.Term)
+	return append(buf, entry.Data...)
+}
+
+func decodeEntry(buf []byte) (*Entry, error) {
+	if len(buf) == 0 {
+		return nil, ErrStorageCorrupted
+	}
+	term, n := binary.Uvarint(buf[1:])
+	if n <= 0 {
+		return nil, ErrStorageCorrupted
+	}
+	return &Entry{Type: buf[0], Term: term, Data: buf[1+n:]}, nil
+}
+
+// 读取快照的元数据，快照不存在时返回空的元数据
+func readSnapshotMeta(snapshotDir string) (SnapshotMeta, error) {
+	var meta SnapshotMeta
+	buf, err := os.ReadFile(filepath.Join(snapshotDir, snapshotMetaFileName))
+	if os.IsNotExist(err) {
+		return meta, nil
+	}
+	if err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal(buf, &meta)
+	return meta, err
+}
+
+func writeSnapshotMeta(snapshotDir string, meta SnapshotMeta) error {
+	buf, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(snapshotDir, snapshotMetaFileName), buf, 0644)
+}
+
+// 快照中的一个文件，发送快照之前打开，之后快照目录被替换也不影响读取
+type snapshotFile struct {
+	name string
+	file *os.File
+}
+
+// 在持有 n.mu 的时候打开快照目录中的所有文件，按照文件名排序
+func openSnapshotFiles(snapshotDir string) ([]snapshotFile, error) {
+	dirEntries, err := os.ReadDir(snapshotDir)
+	if err != nil {
+		return nil, err
+	}
+	var files []snapshotFile
+	for _, dirEntry := range dirEntries {
+		if dirEntry.IsDir() {
+			continue
+		}
+		file, err := os.Open(filepath.Join(snapshotDir, dirEntry.Name()))
+		if err != nil {
+			closeSnapshotFiles(files)
+			return nil, err
+		}
+		files = append(files, snapshotFile{name: dirEntry.Name(), file: file})
+	}
+	return files, nil
+}
+
+func closeSnapshotFiles(files []snapshotFile) {
+	for _, f := range files {
+		_ = f.file.Close()
+	}
+}
+
+// 接收 Leader 分块发送的快照，写入到临时目录中
+// 同时只接收一个快照，Seq 为 0 的分块开始一个新的快照，丢弃没有接收完的快照
+type snapshotReceiver struct {
+	mu     *sync.Mutex
+	dir    string
+	term   uint64 // 正在接收的快照的 Leader 任期
+	index  uint64 // 正在接收的快照的最后一条日志的索引
+	next   uint64 // 下一个分块的序号
+	file   *os.File
+	name   string // 正在写入的文件名
+	offset int64  // 正在写入的文件的大小
+}
+
+func newSnapshotReceiver(dir string) *snapshotReceiver {
+	return &snapshotReceiver{mu: new(sync.Mutex), dir: dir}
+}
+
+// 写入一个分块，最后一个分块写入之后返回 true，调用方需要持有 r.mu
+func (r *snapshotReceiver) write(req *InstallSnapshotRequest) (bool, error) {
+	if req.Seq == 0 {
+		if err := r.reset(); err != nil {
+			return false, err
+		}
+		if err := os.MkdirAll(r.dir, os.ModePerm); err != nil {
+			return false, err
+		}
+		r.term, r.index = req.Term, req.Meta.Index
+	}
+	if req.Term != r.term || req.Meta.Index != r.index || req.Seq != r.next {
+		return false, ErrInvalidSnapshot
+	}
+	// 文件名不能包含路径
+	if req.File == "" || filepath.Base(req.File) != req.File {
+		return false, ErrInvalidSnapshot
+	}
+
+	if req.File != r.name {
+		if err := r.closeFile(); err != nil {
+			return false, err
+		}
+		file, err := os.OpenFile(filepath.Join(r.dir, req.File), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err != nil {
+			return false, err
+		}
+		r.file, r.name, r.offset = file, req.File, 0
+	}
+	if req.Offset != r.offset {
+		return false, ErrInvalidSnapshot
+	}
+	if _, err := r.file.Write(req.Data); err != nil {
+		return false, err
+	}
+	r.offset += int64(len(req.Data))
+	r.next++
+	if !req.Done {
+		return false, nil
+	}
+
+	if err := r.closeFile(); err != nil {
+		return false, err
+	}
+	if err := writeSnapshotMeta(r.dir, req.Meta); err != nil {
+		return false, err
+	}
+	r.term, r.index, r.next = 0, 0, 0
+	return true, nil
+}
+
+// 丢弃没有接收完的快照
+func (r *snapshotReceiver) reset() error {
+	if r.file != nil {
+		_ = r.file.Close()
+		r.file, r.name = nil, ""
+	}
+	r.term, r.index, r.next = 0, 0, 0
+	return os.RemoveAll(r.dir)
+}
+
+func (r *snapshotReceiver) closeFile() error {
+	if r.file == nil {
+		return nil
+	}
+	file := r.file
+	r.file, r.name = nil, ""
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// 用 src 目录替换 dest 目录，先将 dest 移动到一边，新的目录就位之后再删除
+// 任意时刻崩溃，recoverDir 都可以恢复出一个完整的 dest 目录
+func replaceDir(src, dest string) error {
+	oldDir := dest + ".old"
+	if err := os.RemoveAll(oldDir); err != nil {
+		return err
+	}
+	if err := os.Rename(dest, oldDir); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(src, dest); err != nil {
+		if _, statErr := os.Stat(oldDir); statErr == nil {
+			_ = os.Rename(oldDir, dest)
+		}
+		return err
+	}
+	return os.RemoveAll(oldDir)
+}
+
+// 恢复 replaceDir 中途崩溃时的 dest 目录，并删除残留的临时目录
+func recoverDir(dest string, tmpDirs ...string) error {
+	oldDir := dest + ".old"
+	if _, err := os.Stat(dest); os.IsNotExist(err) {
+		// 旧的目录已经移走，新的目录还没有就位
+		if _, err := os.Stat(oldDir); err == nil {
+			if err := os.Rename(oldDir, dest); err != nil {
+				return err
+			}
+		}
+	}
+	if err := os.RemoveAll(oldDir); err != nil {
+		return err
+	}
+	for _, dir := range tmpDirs {
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package cluster
+
+import (
+	"sync"
+)
+
+// RequestVoteRequest 候选人请求投票
+type RequestVoteRequest struct {
+	Term         uint64
+	CandidateId  string
+	LastLogIndex uint64
+	LastLogTerm  uint64
+}
+
+type RequestVoteResponse struct {
+	Term        uint64
+	VoteGranted bool
+}
+
+// AppendEntriesRequest Leader 复制日志，没有日志时作为心跳
+type AppendEntriesRequest struct {
+	Term         uint64
+	LeaderId     string
+	PrevLogIndex uint64
+	PrevLogTerm  uint64
+	Entries      []*Entry
+	LeaderCommit uint64
+}
+
+type AppendEntriesResponse struct {
+	Term    uint64
+	Success bool
+	// 日志不匹配时，Leader 下一次从这个索引开始发送
+	ConflictIndex uint64
+}
+
+// InstallSnapshotRequest Leader 发送快照给落后太多的节点
+// 快照目录中的文件按照文件名的顺序分块发送，每个请求是一个分块
+type InstallSnapshotRequest struct {
+	Term     uint64
+	LeaderId string
+	Meta     SnapshotMeta
+	Seq      uint64 // 分块的序号，从 0 开始
+	File     string // 分块所在的文件名
+	Offset   int64  // 分块在文件中的偏移
+	Data     []byte
+	Done     bool // 是否是最后一个分块
+}
+
+type InstallSnapshotResponse struct {
+	Term uint64
+}
+
+// Handler 处理其他节点发来的请求，Node 实现了这个接口
+type Handler interface {
+	HandleRequestVote(req *RequestVoteRequest) (*RequestVoteResponse, error)
+	HandleAppendEntries(req *AppendEntriesRequest) (*AppendEntriesResponse, error)
+	HandleInstallSnapshot(req *InstallSnapshotRequest) (*InstallSnapshotResponse, error)
+}
+
+// Transport 节点之间的通信
+type Transport interface {
+	// Serve 开始将发给本节点的请求交给 handler 处理
+	Serve(handler Handler)
+
+	RequestVote(target string, req *RequestVoteRequest) (*RequestVoteResponse, error)
+	AppendEntries(target string, req *AppendEntriesRequest) (*AppendEntriesResponse, error)
+	InstallSnapshot(target string, req *InstallSnapshotRequest) (*InstallSnapshotResponse, error)
+
+	// Close 停止接收请求
+	Close() error
+}
+
+// InmemNetwork 进程内的网络，用于测试，可以断开和恢复节点的连接
+type InmemNetwork struct {
+	mu           *sync.RWMutex
+	handlers     map[string]Handler
+	disconnected map[string]bool
+}
+
+func NewInmemNetwork() *InmemNetwork {
+	return &InmemNetwork{
+		mu:           new(sync.RWMutex),
+		handlers:     make(map[string]Handler),
+		disconnected: make(map[string]bool),
+	}
+}
+
+// Transport 返回节点 id 使用的 Transport
+func (nw *InmemNetwork) Transport(id string) Transport {
+	return &inmemTransport{network: nw, id: id}
+}
+
+// Disconnect 断开节点和其他所有节点的连接
+func (nw *InmemNetwork) Disconnect(id string) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	nw.disconnected[id] = true
+}
+
+// Reconnect 恢复节点的连接
+func (nw *InmemNetwork) Reconnect(id string) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	delete(nw.disconnected, id)
+}
+
+// 找到处理请求的节点，两个节点中任意一个断开连接都无法通信
+func (nw *InmemNetwork) route(from, to string) (Handler, error) {
+	nw.mu.RLock()
+	defer nw.mu.RUnlock()
+	if nw.disconnected[from] || nw.disconnected[to] {
+		return nil, ErrUnreachable
+	}
+	handler, ok := nw.handlers[to]
+	if !ok {
+		return nil, ErrUnreachable
+	}
+	return handler, nil
+}
+
+type inmemTransport struct {
+	network *InmemNetwork
+	id      string
+}
+
+func (t *inmemTransport) Serve(handler Handler) {
+	t.network.mu.Lock()
+	defer t.network.mu.Unlock()
+	t.network.handlers[t.id] = handler
+}
+
+func (t *inmemTransport) RequestVote(target string, req *RequestVoteRequest) (*RequestVoteResponse, error) {
+	handler, err := t.network.route(t.id, target)
+	if err != nil {
+		return nil, err
+	}
+	return handler.HandleRequestVote(req)
+}
+
+func (t *inmemTransport) AppendEntries(target string, req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+	handler, err := t.network.route(t.id, target)
+	if err != nil {
+		return nil, err
+	}
+	return handler.HandleAppendEntries(req)
+}
+
+func (t *inmemTransport) InstallSnapshot(target string, req *InstallSnapshotRequest) (*InstallSnapshotResponse, error) {
+	handler, err := t.network.route(t.id, target)
+	if err != nil {
+		return nil, err
+	}
+	return handler.HandleInstallSnapshot(req)
+}
+
+func (t *inmemTransport) Close() error {
+	t.network.mu.Lock()
+	defer t.network.mu.Unlock()
+	delete(t.network.handlers, t.id)
+	return nil
+}
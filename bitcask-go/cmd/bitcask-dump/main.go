@@ -0,0 +1,137 @@
+package main
+
+import (
+	bitcask "bitcask-go"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+const usage = `usage:
+  bitcask-dump export -dir <data dir> [-format binary|jsonl] [-prefix <prefix>] [-out <file>]
+  bitcask-dump import -dir <data dir> [-format binary|jsonl] [-batch <size>] [-in <file>]
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "export":
+		err = runExport(os.Args[2:])
+	case "import":
+		err = runImport(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "bitcask-dump: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func runExport(args []string) (err error) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	dir := fs.String("dir", "", "data directory of the database")
+	format := fs.String("format", "binary", "export format, binary or jsonl")
+	prefix := fs.String("prefix", "", "only export keys with the prefix")
+	out := fs.String("out", "", "output file, default is stdout")
+	_ = fs.Parse(args)
+
+	exportOpts := bitcask.DefaultExportOptions
+	exportFormat, err := parseFormat(*format)
+	if err != nil {
+		return err
+	}
+	exportOpts.Format = exportFormat
+	if *prefix != "" {
+		exportOpts.Prefix = []byte(*prefix)
+	}
+
+	// 以只读的方式打开，不影响正在写入的进程
+	opts := bitcask.DefaultOptions
+	opts.DirPath = *dir
+	opts.ReadOnly = true
+	db, err := openDB(opts)
+	if err != nil {
+		return err
+	}
+	defer closeAndKeepError(db.Close, &err)
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		file, createErr := os.Create(*out)
+		if createErr != nil {
+			return createErr
+		}
+		defer closeAndKeepError(file.Close, &err)
+		w = file
+	}
+	return db.Export(w, exportOpts)
+}
+
+func runImport(args []string) (err error) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	dir := fs.String("dir", "", "data directory of the database")
+	format := fs.String("format", "binary", "import format, binary or jsonl")
+	batch := fs.Uint("batch", bitcask.DefaultImportOptions.BatchSize, "max number of keys in one write batch")
+	in := fs.String("in", "", "input file, default is stdin")
+	_ = fs.Parse(args)
+
+	importOpts := bitcask.DefaultImportOptions
+	importFormat, err := parseFormat(*format)
+	if err != nil {
+		return err
+	}
+	importOpts.Format = importFormat
+	importOpts.BatchSize = *batch
+
+	opts := bitcask.DefaultOptions
+	opts.DirPath = *dir
+	db, err := openDB(opts)
+	if err != nil {
+		return err
+	}
+	defer closeAndKeepError(db.Close, &err)
+
+	var r io.Reader = os.Stdin
+	if *in != "" {
+		file, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+	return db.Import(r, importOpts)
+}
+
+// 关闭资源，之前没有出错时返回关闭时的错误
+func closeAndKeepError(closeFn func() error, err *error) {
+	if closeErr := closeFn(); *err == nil {
+		*err = closeErr
+	}
+}
+
+func openDB(opts bitcask.Options) (*bitcask.DB, error) {
+	if opts.DirPath == "" {
+		return nil, fmt.Errorf("the data directory is required")
+	}
+	return bitcask.Open(opts)
+}
+
+func parseFormat(format string) (bitcask.ExportFormat, error) {
+	switch format {
+	case "binary":
+		return bitcask.ExportBinary, nil
+	case "jsonl":
+		return bitcask.ExportJSONLines, nil
+	default:
+		return 0, fmt.Errorf("unsupported format: %s", format)
+	}
+}
@@ -0,0 +1,82 @@
+package bitcask_go
+
+import (
+	"bitcask-go/index"
+	"bitcask-go/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// 不需要故障注入的崩溃恢复测试，默认的构建就会运行
+
+func crashTestOptions(name string) Options {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", name)
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.SyncWrites = true
+	return opts
+}
+
+// 数据文件已经持久化，B+ 树索引停留在较早的状态，重新打开时需要重放缺少的数据
+func TestDB_Crash_BPlusTree_IndexBehind(t *testing.T) {
+	opts := crashTestOptions("bitcask-go-crash-bptree-behind")
+	opts.IndexType = BPlusTree
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	acked := make(map[string][]byte)
+	for i := 0; i < 300; i++ {
+		key, value := utils.GetTestKey(i), utils.RandomValue(128)
+		err := db.Put(key, value)
+		assert.Nil(t, err)
+		acked[string(key)] = value
+	}
+	snapshotDir, _ := os.MkdirTemp("", "bitcask-go-crash-bptree-snapshot")
+	defer os.RemoveAll(snapshotDir)
+	snapshot, err := db.index.(*index.BPlusTree).Snapshot()
+	assert.Nil(t, err)
+	err = snapshot.WriteTo(snapshotDir)
+	assert.Nil(t, err)
+	err = snapshot.Release()
+	assert.Nil(t, err)
+
+	// 快照之后的写入、删除和事务，跨越多个数据文件
+	for i := 300; i < 600; i++ {
+		key, value := utils.GetTestKey(i), utils.RandomValue(128)
+		err := db.Put(key, value)
+		assert.Nil(t, err)
+		acked[string(key)] = value
+	}
+	for i := 0; i < 20; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		delete(acked, string(utils.GetTestKey(i)))
+	}
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	for i := 20; i < 30; i++ {
+		err := wb.Put(utils.GetTestKey(i), []byte("in-batch"))
+		assert.Nil(t, err)
+		acked[string(utils.GetTestKey(i))] = []byte("in-batch")
+	}
+	err = wb.Commit()
+	assert.Nil(t, err)
+	assert.True(t, len(db.olderFiles) > 1)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// 用快照替换索引文件，模拟索引的更新没有持久化
+	entries, err := os.ReadDir(snapshotDir)
+	assert.Nil(t, err)
+	for _, entry := range entries {
+		err := os.Rename(filepath.Join(snapshotDir, entry.Name()), filepath.Join(opts.DirPath, entry.Name()))
+		assert.Nil(t, err)
+	}
+
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db2)
+	assertAcknowledgedState(t, db2, acked)
+}
@@ -0,0 +1,252 @@
+//go:build faultinject
+
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/fio"
+	"bitcask-go/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+// 开启故障注入并打开数据库
+func openWithFaultInjector(t *testing.T, opts Options) (*DB, *fio.FaultInjector) {
+	fi := fio.NewFaultInjector()
+	fio.EnableFaultInjection(fi)
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+	return db, fi
+}
+
+// 模拟崩溃，关闭故障注入之后重新打开数据库
+func crashAndReopen(t *testing.T, db *DB, fi *fio.FaultInjector, opts Options) *DB {
+	err := fi.Crash()
+	assert.Nil(t, err)
+	// 崩溃之后的 Close 只是为了释放文件锁
+	_ = db.Close()
+	fio.DisableFaultInjection()
+
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	assert.NotNil(t, db2)
+	return db2
+}
+
+func TestDB_Crash_Put(t *testing.T) {
+	for _, failAfter := range []int64{0, 100, 4096, 33 * 1024, 100 * 1024} {
+		opts := crashTestOptions("bitcask-go-crash-put")
+		db, fi := openWithFaultInjector(t, opts)
+
+		fi.FailAfter(failAfter)
+		acked := make(map[string][]byte)
+		var failedKey []byte
+		for i := 0; i < 10000; i++ {
+			key, value := utils.GetTestKey(i), utils.RandomValue(128)
+			if err := db.Put(key, value); err != nil {
+				failedKey = key
+				break
+			}
+			acked[string(key)] = value
+		}
+		assert.NotNil(t, failedKey)
+
+		db2 := crashAndReopen(t, db, fi, opts)
+		assertAcknowledgedState(t, db2, acked)
+		_, err := db2.Get(failedKey)
+		assert.Equal(t, ErrKeyNotFound, err)
+
+		// 恢复之后可以继续正常写入
+		err = db2.Put(failedKey, []byte("after-crash"))
+		assert.Nil(t, err)
+		val, err := db2.Get(failedKey)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("after-crash"), val)
+		destroyDB(db2)
+	}
+}
+
+func TestDB_Crash_ShortWrite(t *testing.T) {
+	opts := crashTestOptions("bitcask-go-crash-short")
+	db, fi := openWithFaultInjector(t, opts)
+
+	acked := make(map[string][]byte)
+	for i := 0; i < 100; i++ {
+		key, value := utils.GetTestKey(i), utils.RandomValue(128)
+		err := db.Put(key, value)
+		assert.Nil(t, err)
+		acked[string(key)] = value
+	}
+
+	fi.ShortWriteOnce()
+	err := db.Put(utils.GetTestKey(100), utils.RandomValue(128))
+	assert.NotNil(t, err)
+
+	// 短写的数据被回滚，之后的写入位置依然正确
+	key, value := utils.GetTestKey(101), utils.RandomValue(128)
+	err = db.Put(key, value)
+	assert.Nil(t, err)
+	acked[string(key)] = value
+	val, err := db.Get(key)
+	assert.Nil(t, err)
+	assert.Equal(t, value, val)
+
+	db2 := crashAndReopen(t, db, fi, opts)
+	defer destroyDB(db2)
+	assertAcknowledgedState(t, db2, acked)
+}
+
+func TestDB_Crash_WriteBatch(t *testing.T) {
+	for _, failAfter := range []int64{0, 1000, 20 * 1024, 50 * 1024} {
+		opts := crashTestOptions("bitcask-go-crash-batch")
+		opts.SyncWrites = false
+		db, fi := openWithFaultInjector(t, opts)
+
+		fi.FailAfter(failAfter)
+		acked := make(map[string][]byte)
+		var failedBatch [][]byte
+		for i := 0; i < 1000 && failedBatch == nil; i++ {
+			wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+			pending := make(map[string][]byte)
+			for j := 0; j < 10; j++ {
+				key, value := utils.GetTestKey(i*10+j), utils.RandomValue(128)
+				err := wb.Put(key, value)
+				assert.Nil(t, err)
+				pending[string(key)] = value
+			}
+			if err := wb.Commit(); err != nil {
+				for key := range pending {
+					failedBatch = append(failedBatch, []byte(key))
+				}
+				break
+			}
+			for key, value := range pending {
+				acked[key] = value
+			}
+		}
+		assert.NotNil(t, failedBatch)
+
+		db2 := crashAndReopen(t, db, fi, opts)
+		assertAcknowledgedState(t, db2, acked)
+		// 失败的批次不能有任何一条数据生效
+		for _, key := range failedBatch {
+			_, err := db2.Get(key)
+			assert.Equal(t, ErrKeyNotFound, err)
+		}
+		destroyDB(db2)
+	}
+}
+
+func TestDB_Crash_Merge(t *testing.T) {
+	for _, failAfter := range []int64{0, 10 * 1024, 100 * 1024, -1} {
+		opts := crashTestOptions("bitcask-go-crash-merge")
+		opts.DataFileMergeRatio = 0
+		db, fi := openWithFaultInjector(t, opts)
+
+		acked := make(map[string][]byte)
+		for i := 0; i < 2000; i++ {
+			key, value := utils.GetTestKey(i), utils.RandomValue(128)
+			err := db.Put(key, value)
+			assert.Nil(t, err)
+			acked[string(key)] = value
+		}
+		for i := 0; i < 1000; i++ {
+			err := db.Delete(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			delete(acked, string(utils.GetTestKey(i)))
+		}
+
+		if failAfter >= 0 {
+			fi.FailAfter(failAfter)
+			err := db.Merge()
+			assert.NotNil(t, err)
+		} else {
+			// merge 成功之后立即崩溃
+			err := db.Merge()
+			assert.Nil(t, err)
+		}
+
+		db2 := crashAndReopen(t, db, fi, opts)
+		assertAcknowledgedState(t, db2, acked)
+		destroyDB(db2)
+	}
+}
+
+func TestDB_Crash_Corrupt(t *testing.T) {
+	opts := crashTestOptions("bitcask-go-crash-corrupt")
+	db, fi := openWithFaultInjector(t, opts)
+	defer fio.DisableFaultInjection()
+
+	acked := make(map[string][]byte)
+	var lastKey []byte
+	for i := 0; i < 1000; i++ {
+		key, value := utils.GetTestKey(i), utils.RandomValue(128)
+		err := db.Put(key, value)
+		assert.Nil(t, err)
+		acked[string(key)] = value
+		lastKey = key
+	}
+	assert.True(t, len(db.olderFiles) > 0)
+	activeFid, activeSize := db.activeFile.FileId, db.activeFile.WriteOff
+	err := db.Close()
+	assert.Nil(t, err)
+
+	// 活跃文件末尾的数据损坏，视为没有写完整的数据丢弃掉
+	err = fi.Corrupt(data.GetDataFileName(opts.DirPath, activeFid), activeSize-10, 10)
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	delete(acked, string(lastKey))
+	assertAcknowledgedState(t, db2, acked)
+	err = db2.Close()
+	assert.Nil(t, err)
+
+	// 旧的数据文件中间的数据损坏，需要报错
+	err = fi.Corrupt(data.GetDataFileName(opts.DirPath, 0), 1000, 10)
+	assert.Nil(t, err)
+	_, err = Open(opts)
+	assert.Equal(t, data.ErrInvalidCRC, err)
+	_ = os.RemoveAll(opts.DirPath)
+}
+
+// 数据文件中没有持久化的数据在崩溃时丢失，但是已经写入到了 B+ 树索引中，重新打开时需要回滚索引
+func TestDB_Crash_BPlusTree_IndexAhead(t *testing.T) {
+	opts := crashTestOptions("bitcask-go-crash-bptree-ahead")
+	opts.SyncWrites = false
+	opts.IndexType = BPlusTree
+	// 切换活跃文件时会持久化数据，所有的数据都写入到同一个文件中
+	opts.DataFileSize = 1024 * 1024
+	db, fi := openWithFaultInjector(t, opts)
+
+	acked := make(map[string][]byte)
+	for i := 0; i < 500; i++ {
+		key, value := utils.GetTestKey(i), utils.RandomValue(128)
+		err := db.Put(key, value)
+		assert.Nil(t, err)
+		acked[string(key)] = value
+	}
+	err := db.Sync()
+	assert.Nil(t, err)
+
+	// 没有持久化的写入和删除
+	for i := 500; i < 600; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 10; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+
+	db2 := crashAndReopen(t, db, fi, opts)
+	defer destroyDB(db2)
+	assertAcknowledgedState(t, db2, acked)
+
+	err = db2.Put(utils.GetTestKey(1000), []byte("after-crash"))
+	assert.Nil(t, err)
+	val, err := db2.Get(utils.GetTestKey(1000))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("after-crash"), val)
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"hash/crc32"
 	"io"
+	"os"
 	"path/filepath"
 )
 
@@ -15,6 +16,7 @@ var (
 
 const (
 	DataFileNameSuffix    = ".data"
+	BloomFileName         = "bloom-filter"
 	HintFileName          = "hint-index"
 	MergeFinishedFileName = "merge-finished"
 	SeqNoFileName         = "seq-no"
@@ -25,6 +27,10 @@ type DataFile struct {
 	FileId    uint32        // 文件id
 	WriteOff  int64         // 文件写到了哪个位置
 	IoManager fio.IOManager //io 读写管理
+	Cache     *RecordCache  // 日志记录的读缓存，为空表示不缓存
+
+	fileName string      // 文件路径
+	fileInfo os.FileInfo // 打开时的文件信息，用来判断文件是否被替换
 }
 
 // OpenDataFile 打开新的数据文件
@@ -61,19 +67,47 @@ func newDataFile(fileName string, fileId uint32, ioType fio.FileIOType) (*DataFi
 	if err != nil {
 		return nil, err
 	}
+	fileInfo, err := os.Stat(fileName)
+	if err != nil {
+		_ = ioManager.Close()
+		return nil, err
+	}
 	return &DataFile{
 		FileId:    fileId,
 		WriteOff:  0,
 		IoManager: ioManager,
+		fileName:  fileName,
+		fileInfo:  fileInfo,
 	}, nil
 }
 
+// ReadLogRecord 读取指定位置的日志记录，设置了读缓存时优先从缓存中获取
 func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
+	if df.Cache == nil {
+		return df.readLogRecord(offset)
+	}
+	if logRecord, size, ok := df.Cache.Get(df.FileId, offset); ok {
+		return logRecord, size, nil
+	}
+	logRecord, size, err := df.readLogRecord(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	df.Cache.Put(df.FileId, offset, logRecord, size)
+	return logRecord, size, nil
+}
+
+func (df *DataFile) readLogRecord(offset int64) (*LogRecord, int64, error) {
 	fileSize, err := df.IoManager.Size()
 	if err != nil {
 		return nil, 0, err
 	}
 
+	// 读取的位置已经超过了文件的末尾
+	if offset >= fileSize {
+		return nil, 0, io.EOF
+	}
+
 	// 如果读取的最大 Header 长度已经超过了文件的长度，则只需要读取到文件的结尾即可
 	var headerBytes int64 = maxLogRecordHeaderSize
 	if offset+headerBytes > fileSize {
@@ -98,6 +132,10 @@ func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
 	// 取出对应的 key 和 value 的长度
 	keySize, valueSize := int64(header.keySize), int64(header.valueSize)
 	var recordSize = headerSize + keySize + valueSize
+	// 记录超出了文件的长度，说明是没有写完整的数据
+	if offset+recordSize > fileSize {
+		return nil, 0, io.EOF
+	}
 
 	logRecord := &LogRecord{
 		Type: header.recordType,
@@ -127,17 +165,22 @@ func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
 func (df *DataFile) Write(buf []byte) error {
 	n, err := df.IoManager.Write(buf)
 	if err != nil {
+		// 只写入了部分数据，需要截断掉，否则后续追加的数据位置会错乱
+		if n > 0 {
+			_ = df.IoManager.Truncate(df.WriteOff)
+		}
 		return err
 	}
 	df.WriteOff += int64(n)
 	return nil
 }
 
-// WriteHintRecord 写入索引信息到 hint 文件中
-func (df *DataFile) WriteHintRecord(key []byte, pos *LogRecordPos) error {
+// WriteHintRecord 写入索引信息到 hint 文件中，typ 为对应数据记录的类型
+func (df *DataFile) WriteHintRecord(key []byte, typ LogRecordType, pos *LogRecordPos) error {
 	record := &LogRecord{
 		Key:   key,
 		Value: EncodeLogRecordPos(pos),
+		Type:  typ,
 	}
 	encRecord, _ := EncodeLogRecord(record)
 	return df.Write(encRecord)
@@ -163,6 +206,38 @@ func (df *DataFile) SetIOManager(dirPath string, ioType fio.FileIOType) error {
 	return nil
 }
 
+// Reopen 重新打开已经关闭的文件
+// 文件在关闭期间被替换时（例如 merge 之后复用了文件 id），缓存的记录需要失效
+func (df *DataFile) Reopen(ioType fio.FileIOType) error {
+	ioManager, err := fio.NewIOManager(df.fileName, ioType)
+	if err != nil {
+		return err
+	}
+	fileInfo, err := os.Stat(df.fileName)
+	if err != nil {
+		_ = ioManager.Close()
+		return err
+	}
+	if df.Cache != nil && !os.SameFile(df.fileInfo, fileInfo) {
+		df.Cache.RemoveFile(df.FileId)
+	}
+	df.IoManager = ioManager
+	df.fileInfo = fileInfo
+	return nil
+}
+
+// Replaced 判断磁盘上同名的文件是否已经被删除或者替换成了其他的文件
+func (df *DataFile) Replaced() (bool, error) {
+	fileInfo, err := os.Stat(df.fileName)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return !os.SameFile(df.fileInfo, fileInfo), nil
+}
+
 func (df *DataFile) readNBytes(n int64, offset int64) (b []byte, err error) {
 	b = make([]byte, n)
 	_, err = df.IoManager.Read(b, offset)
@@ -108,3 +108,47 @@ func TestDataFile_ReadLogRecord(t *testing.T) {
 	assert.Equal(t, rec3, readRec3)
 	assert.Equal(t, size3, readSize3)
 }
+
+func TestDataFile_Reopen(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-reopen")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	dataFile, err := OpenDataFile(dir, 0, fio.StandardFIO)
+	assert.Nil(t, err)
+	dataFile.Cache = NewRecordCache(1024)
+
+	rec1 := &LogRecord{Key: []byte("name"), Value: []byte("bitcask kv go")}
+	buf1, _ := EncodeLogRecord(rec1)
+	assert.Nil(t, dataFile.Write(buf1))
+	_, _, err = dataFile.ReadLogRecord(0)
+	assert.Nil(t, err)
+
+	// 文件没有被替换，重新打开之后继续使用缓存
+	assert.Nil(t, dataFile.Close())
+	assert.Nil(t, dataFile.Reopen(fio.StandardFIO))
+	_, _, err = dataFile.ReadLogRecord(0)
+	assert.Nil(t, err)
+	hits, _ := dataFile.Cache.Stats()
+	assert.Equal(t, uint64(1), hits)
+	replaced, err := dataFile.Replaced()
+	assert.Nil(t, err)
+	assert.False(t, replaced)
+
+	// 文件 id 被其他的文件复用，缓存的记录失效
+	assert.Nil(t, dataFile.Close())
+	rec2 := &LogRecord{Key: []byte("name"), Value: []byte("a new value")}
+	buf2, _ := EncodeLogRecord(rec2)
+	fileName := GetDataFileName(dir, 0)
+	assert.Nil(t, os.WriteFile(fileName+".tmp", buf2, fio.DataFilePerm))
+	assert.Nil(t, os.Rename(fileName+".tmp", fileName))
+	replaced, err = dataFile.Replaced()
+	assert.Nil(t, err)
+	assert.True(t, replaced)
+
+	assert.Nil(t, dataFile.Reopen(fio.StandardFIO))
+	readRec, _, err := dataFile.ReadLogRecord(0)
+	assert.Nil(t, err)
+	assert.Equal(t, rec2.Value, readRec.Value)
+	assert.Nil(t, dataFile.Close())
+}
@@ -11,6 +11,12 @@ const (
 	LogRecordNormal LogRecordType = iota
 	LogRecordDeleted
 	LogRecordTxnFinished
+	// 命名空间中的数据，key 的开头编码了命名空间的 id
+	LogRecordNsNormal
+	LogRecordNsDeleted
+	// 创建和删除命名空间，key 为命名空间的 id 和名称
+	LogRecordNsCreated
+	LogRecordNsDropped
 )
 
 // crc type keySize valueSize
@@ -46,6 +52,11 @@ type TransactionRecord struct {
 	Pos    *LogRecordPos
 }
 
+// MaxEncodedSize 编码之后最多占用的字节数，用于在写入之前预留限速的令牌
+func (lr *LogRecord) MaxEncodedSize() int64 {
+	return int64(maxLogRecordHeaderSize + len(lr.Key) + len(lr.Value))
+}
+
 // EncodeLogRecord 对 LogRecord 进行编码，返回字节数组及长度
 // +-----------+------------+-------------+--------------+-----------+---------------+
 // / crc 校验值 /  type 类型  /  key size   /  value size  /    key    /     value     /
@@ -0,0 +1,132 @@
+package data
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// 每条缓存记录除了 key/value 之外额外占用的内存估算值
+const recordCacheEntryOverhead = 64
+
+// RecordCache 日志记录的读缓存，按照 文件 id + 偏移 缓存已经读取过的记录
+// 数据文件是只追加写入的，同一个位置的记录不会被修改，只有文件被删除时才需要失效
+type RecordCache struct {
+	mu       *sync.Mutex
+	capacity int64                              // 缓存最多占用的字节数
+	size     int64                              // 当前占用的字节数
+	lru      *list.List                         // 表头为最近使用的记录
+	files    map[uint32]map[int64]*list.Element // 文件 id -> 偏移 -> lru 中的节点
+	hits     uint64
+	misses   uint64
+}
+
+type recordCacheEntry struct {
+	fid    uint32
+	offset int64
+	record *LogRecord
+	size   int64 // 记录在磁盘上的大小
+	charge int64 // 记录在缓存中占用的大小
+}
+
+// NewRecordCache 初始化读缓存，capacity 为缓存最多占用的字节数
+func NewRecordCache(capacity int64) *RecordCache {
+	return &RecordCache{
+		mu:       new(sync.Mutex),
+		capacity: capacity,
+		lru:      list.New(),
+		files:    make(map[uint32]map[int64]*list.Element),
+	}
+}
+
+// Get 获取缓存的记录，返回的是缓存记录的拷贝，调用方可以修改
+func (rc *RecordCache) Get(fid uint32, offset int64) (*LogRecord, int64, bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	elem, ok := rc.files[fid][offset]
+	if !ok {
+		atomic.AddUint64(&rc.misses, 1)
+		return nil, 0, false
+	}
+	atomic.AddUint64(&rc.hits, 1)
+	rc.lru.MoveToFront(elem)
+	entry := elem.Value.(*recordCacheEntry)
+	record := &LogRecord{
+		Key:   append([]byte(nil), entry.record.Key...),
+		Value: append([]byte(nil), entry.record.Value...),
+		Type:  entry.record.Type,
+	}
+	return record, entry.size, true
+}
+
+// Put 缓存记录，记录会被拷贝一份，调用方之后可以继续修改原来的记录
+func (rc *RecordCache) Put(fid uint32, offset int64, record *LogRecord, size int64) {
+	entry := &recordCacheEntry{
+		fid:    fid,
+		offset: offset,
+		record: &LogRecord{
+			Key:   append([]byte(nil), record.Key...),
+			Value: append([]byte(nil), record.Value...),
+			Type:  record.Type,
+		},
+		size:   size,
+		charge: int64(len(record.Key)+len(record.Value)) + recordCacheEntryOverhead,
+	}
+	// 单条记录超过了缓存的容量，不进行缓存
+	if entry.charge > rc.capacity {
+		return
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	offsets, ok := rc.files[fid]
+	if !ok {
+		offsets = make(map[int64]*list.Element)
+		rc.files[fid] = offsets
+	}
+	if elem, ok := offsets[offset]; ok {
+		rc.lru.MoveToFront(elem)
+		return
+	}
+	offsets[offset] = rc.lru.PushFront(entry)
+	rc.size += entry.charge
+
+	// 超过容量之后淘汰最久没有使用的记录
+	for rc.size > rc.capacity {
+		rc.removeElement(rc.lru.Back())
+	}
+}
+
+// RemoveFile 删除某个文件所有的缓存记录，文件被删除或者替换时调用
+func (rc *RecordCache) RemoveFile(fid uint32) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	for _, elem := range rc.files[fid] {
+		rc.removeElement(elem)
+	}
+	delete(rc.files, fid)
+}
+
+// Stats 返回缓存命中和未命中的次数
+func (rc *RecordCache) Stats() (hits uint64, misses uint64) {
+	return atomic.LoadUint64(&rc.hits), atomic.LoadUint64(&rc.misses)
+}
+
+// Size 返回缓存当前占用的字节数
+func (rc *RecordCache) Size() int64 {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.size
+}
+
+func (rc *RecordCache) removeElement(elem *list.Element) {
+	entry := elem.Value.(*recordCacheEntry)
+	rc.lru.Remove(elem)
+	rc.size -= entry.charge
+	if offsets, ok := rc.files[entry.fid]; ok {
+		delete(offsets, entry.offset)
+		if len(offsets) == 0 {
+			delete(rc.files, entry.fid)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package data
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestRecordCache_GetPut(t *testing.T) {
+	rc := NewRecordCache(1024)
+
+	_, _, ok := rc.Get(0, 0)
+	assert.False(t, ok)
+
+	record := &LogRecord{Key: []byte("name"), Value: []byte("bitcask-go")}
+	rc.Put(0, 0, record, 20)
+	// 修改原来的记录不会影响缓存
+	record.Value[0] = 'B'
+
+	res, size, ok := rc.Get(0, 0)
+	assert.True(t, ok)
+	assert.Equal(t, int64(20), size)
+	assert.Equal(t, []byte("bitcask-go"), res.Value)
+
+	hits, misses := rc.Stats()
+	assert.Equal(t, uint64(1), hits)
+	assert.Equal(t, uint64(1), misses)
+}
+
+func TestRecordCache_Evict(t *testing.T) {
+	rc := NewRecordCache(3 * (recordCacheEntryOverhead + 10))
+	for i := 0; i < 3; i++ {
+		rc.Put(1, int64(i*10), &LogRecord{Key: []byte("key00"), Value: []byte("value")}, 10)
+	}
+	// 访问第一条记录，之后淘汰的是第二条
+	_, _, ok := rc.Get(1, 0)
+	assert.True(t, ok)
+
+	rc.Put(1, 30, &LogRecord{Key: []byte("key00"), Value: []byte("value")}, 10)
+	_, _, ok = rc.Get(1, 0)
+	assert.True(t, ok)
+	_, _, ok = rc.Get(1, 10)
+	assert.False(t, ok)
+	assert.Equal(t, int64(3*(recordCacheEntryOverhead+10)), rc.Size())
+
+	// 超过容量的记录不缓存
+	rc.Put(1, 40, &LogRecord{Value: make([]byte, 1024)}, 1024)
+	_, _, ok = rc.Get(1, 40)
+	assert.False(t, ok)
+}
+
+func TestRecordCache_RemoveFile(t *testing.T) {
+	rc := NewRecordCache(1024)
+	rc.Put(1, 0, &LogRecord{Key: []byte("a")}, 10)
+	rc.Put(1, 10, &LogRecord{Key: []byte("b")}, 10)
+	rc.Put(2, 0, &LogRecord{Key: []byte("c")}, 10)
+
+	rc.RemoveFile(1)
+	_, _, ok := rc.Get(1, 0)
+	assert.False(t, ok)
+	_, _, ok = rc.Get(1, 10)
+	assert.False(t, ok)
+	_, _, ok = rc.Get(2, 0)
+	assert.True(t, ok)
+	assert.Equal(t, int64(recordCacheEntryOverhead+1), rc.Size())
+}
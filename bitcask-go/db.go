@@ -11,10 +11,13 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -24,19 +27,32 @@ const (
 
 // DB bitcask 存储引擎实例
 type DB struct {
-	options         Options
-	mu              *sync.RWMutex
-	fileIds         []int                     // 文件 id，只能在加载索引的时候使用，不能在其他的地方更新使用
-	activeFile      *data.DataFile            // 当前活跃数据文件，可用于写入
-	olderFiles      map[uint32]*data.DataFile // 旧的数据文件，只能用于读
-	index           index.Indexer             // 内存索引
-	seqNo           uint64                    // 事务序列号，全局递增
-	isMerging       bool                      // 是否正在 merge
-	seqNoFileExists bool                      // 存储事务序列号的文件是否存在
-	isInitial       bool                      // 是否第一次初始化数据目录
-	fileLock        *flock.Flock              // 文件锁保证多进程之间的互斥
-	bytesWrite      uint                      // 累计写了多少个字节
-	reclaimSize     int64                     // 标识有多少数据是无效的
+	options        Options
+	mu             *sync.RWMutex
+	fileIds        []int                                // 文件 id，只能在加载索引的时候使用，不能在其他的地方更新使用
+	activeFile     *data.DataFile                       // 当前活跃数据文件，可用于写入
+	olderFiles     map[uint32]*data.DataFile            // 旧的数据文件，只能用于读
+	index          index.Indexer                        // 内存索引
+	seqNo          uint64                               // 事务序列号，全局递增
+	isMerging      bool                                 // 是否正在 merge
+	fileLock       *flock.Flock                         // 文件锁保证多进程之间的互斥
+	bytesWrite     uint                                 // 累计写了多少个字节
+	reclaimSize    int64                                // 标识有多少数据是无效的
+	pendingTxns    map[uint64][]*data.TransactionRecord // 从数据文件中读取到的还没有完成的事务数据
+	bgLimiter      *fio.RateLimiter                     // 后台 IO 限速器
+	writeLimiter   *fio.RateLimiter                     // 前台写入限速器
+	fileCache      *fileCache                           // 旧数据文件的句柄缓存，为空表示不限制打开的文件数量
+	readCache      *data.RecordCache                    // 日志记录的读缓存，为空表示没有开启
+	blooms         *dataFileBlooms                      // 数据文件的布隆过滤器，为空表示没有开启
+	watchHub       *watchHub                            // 变更订阅，第一次调用 Watch 时初始化
+	consumers      map[string]LogPosition               // 持久化的日志消费者下一条要读取的位置
+	writeFenced    atomic.Bool                          // 写入屏障，开启之后只能通过 ApplyLogEntries 写入
+	namespaces     map[string]*Namespace                // 命名空间，key 为命名空间的名称
+	namespacesById map[uint32]*Namespace                // 命名空间，key 为命名空间的 id
+	maxNamespaceId uint32                               // 已经分配过的最大的命名空间 id，包括已经删除的
+
+	secondaryIndexes  map[string]*secondaryIndex // 本次打开之后注册的二级索引，key 为索引的名称
+	indexNamespaceNum int                        // 二级索引使用的命名空间的数量，包括没有注册的
 }
 
 // Stat 存储引擎统计信息
@@ -45,6 +61,17 @@ type Stat struct {
 	DataFileNum     uint  // 数据文件的数量
 	ReclaimableSize int64 // 可以进行 merge 回收的数据量 字节为单位
 	DiskSize        int64 // 所占用磁盘空间的大小
+	IndexMemory     int64 // 内存索引大致占用的内存大小，包括所有的命名空间 字节为单位
+
+	BackgroundThrottled time.Duration // 后台 IO 累计被限速等待的时间
+	WriteThrottled      time.Duration // 前台写入累计被限速等待的时间
+
+	ReadCacheHits   uint64 // 读缓存命中的次数
+	ReadCacheMisses uint64 // 读缓存未命中的次数
+
+	BloomFilterRejects           uint64  // 布隆过滤器判断 key 不存在，不需要访问索引的查询次数
+	BloomFilterFalsePositives    uint64  // 布隆过滤器判断 key 可能存在，但实际不存在的查询次数
+	BloomFilterFalsePositiveRate float64 // 不存在的 key 的查询中没有被布隆过滤器过滤掉的比例
 }
 
 // Open 打开 bitcask 存储引擎实例
@@ -54,58 +81,97 @@ func Open(options Options) (*DB, error) {
 		return nil, err
 	}
 
-	var isInitial bool
 	// 判断数据目录是否存在，不存在需要创建
 	if _, err := os.Stat(options.DirPath); os.IsNotExist(err) {
-		isInitial = true
+		// 只读模式不会创建数据目录
+		if options.ReadOnly {
+			return nil, err
+		}
 		if err = os.MkdirAll(options.DirPath, os.ModePerm); err != nil {
 			return nil, err
 		}
 	}
 
-	// 判断当前数据目录是否正在使用
-	fileLock := flock.New(filepath.Join(options.DirPath, fileLockName))
-	hold, err := fileLock.TryLock()
-	if err != nil {
-		return nil, err
-	}
+	// 判断当前数据目录是否正在使用，只读模式不需要加锁
+	var fileLock *flock.Flock
+	if !options.ReadOnly {
+		fileLock = flock.New(filepath.Join(options.DirPath, fileLockName))
+		hold, err := fileLock.TryLock()
+		if err != nil {
+			return nil, err
+		}
 
-	if !hold {
-		return nil, ErrDatabaseIsUsing
+		if !hold {
+			return nil, ErrDatabaseIsUsing
+		}
 	}
 
-	// 空的文件目录
-	entries, err := os.ReadDir(options.DirPath)
+	// 初始化索引，B+ 树索引需要打开数据目录中的索引文件，可能会失败
+	indexer, err := openIndexer(options)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(entries) == 0 {
-		isInitial = true
-	}
-
 	// 初始化 DB 实例结构体
 	db := &DB{
-		options:    options,
-		mu:         new(sync.RWMutex),
-		olderFiles: make(map[uint32]*data.DataFile),
-		index:      index.NewIndexer(options.IndexType, options.DirPath, options.SyncWrites),
-		isInitial:  isInitial,
-		fileLock:   fileLock,
+		options:          options,
+		mu:               new(sync.RWMutex),
+		olderFiles:       make(map[uint32]*data.DataFile),
+		pendingTxns:      make(map[uint64][]*data.TransactionRecord),
+		namespaces:       make(map[string]*Namespace),
+		namespacesById:   make(map[uint32]*Namespace),
+		secondaryIndexes: make(map[string]*secondaryIndex),
+		index:            indexer,
+		fileLock:         fileLock,
+		bgLimiter:        fio.NewRateLimiter(options.BackgroundIORate),
+		writeLimiter:     fio.NewRateLimiter(options.WriteIORate),
+	}
+	if options.MaxOpenFiles > 0 {
+		db.fileCache = newFileCache(options.MaxOpenFiles, db.standardIOType())
+	}
+	if options.ReadCacheSize > 0 {
+		db.readCache = data.NewRecordCache(options.ReadCacheSize)
+	}
+	if usesDataFileBlooms(options) {
+		db.blooms = newDataFileBlooms(options.DirPath)
+	}
+
+	// 加载 merge 数据目录，只读模式下由写入的进程负责
+	if !options.ReadOnly {
+		if err := db.loadMergeFiles(); err != nil {
+			return nil, err
+		}
+		// 分层索引上次运行时残留的临时目录
+		if err := index.RemoveSpillDirs(options.DirPath); err != nil {
+			return nil, err
+		}
 	}
 
-	// 加载 merge 数据目录
-	if err := db.loadMergeFiles(); err != nil {
+	// 读取数据文件
+	if err := db.loadDataFile(); err != nil {
 		return nil, err
 	}
 
-	// 读取数据文件
-	if err := db.loadDataFile(); err != nil {
+	// 加载日志消费者
+	if err := db.loadConsumers(); err != nil {
 		return nil, err
 	}
 
-	// B+ 树索引不需要从数据文件中加载索引
-	if options.IndexType != BPlusTree {
+	if options.IndexType == BPlusTree {
+		// 取出当前事务序列号
+		if err := db.loadSeqNo(); err != nil {
+			return nil, err
+		}
+		db.seqNo = max(db.seqNo, db.index.(*index.BPlusTree).SeqNo())
+		// 将 merge 之后的位置更新到 B+ 树索引中
+		if err := db.applyMergeToBPlusTree(); err != nil {
+			return nil, err
+		}
+		// B+ 树索引只需要补上崩溃时没有应用到索引中的数据
+		if err := db.recoverBPlusTreeIndex(); err != nil {
+			return nil, err
+		}
+	} else {
 		// 从 hint 索引文件中加载索引
 		if err := db.loadIndexFromHintFile(); err != nil {
 			return nil, err
@@ -114,27 +180,18 @@ func Open(options Options) (*DB, error) {
 		if err := db.loadIndexFromDataFile(); err != nil {
 			return nil, err
 		}
+	}
 
-		// 重置 IO 类型为标准文件 IO
-		if db.options.MMapAtStartup {
-			if err := db.resetIoType(); err != nil {
-				return nil, err
-			}
-		}
+	// 加载数据文件的布隆过滤器，需要在修复活跃文件末尾没有写完整的数据之后
+	if err := db.loadDataFileBlooms(); err != nil {
+		return nil, err
 	}
 
-	// 取出当前事务序列号
-	if options.IndexType == BPlusTree {
-		if err := db.loadSeqNo(); err != nil {
+	// 重置 IO 类型为标准文件 IO
+	if db.options.MMapAtStartup {
+		if err := db.resetIoType(); err != nil {
 			return nil, err
 		}
-		if db.activeFile != nil {
-			size, err := db.activeFile.IoManager.Size()
-			if err != nil {
-				return nil, err
-			}
-			db.activeFile.WriteOff = size
-		}
 	}
 
 	return db, nil
@@ -143,6 +200,9 @@ func Open(options Options) (*DB, error) {
 // Close 关闭数据库
 func (db *DB) Close() error {
 	defer func() {
+		if db.fileLock == nil {
+			return
+		}
 		if err := db.fileLock.Unlock(); err != nil {
 			panic(fmt.Sprintf("failed to unlock the directory, %v", err))
 		}
@@ -153,26 +213,24 @@ func (db *DB) Close() error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
+	// 关闭所有的变更订阅
+	db.closeWatchers()
+
 	// 关闭索引
 	if err := db.index.Close(); err != nil {
 		return err
 	}
-
-	// 保存当前事务序列号4w
-	seqNoFile, err := data.OpenSeqNoFIle(db.options.DirPath)
-	if err != nil {
-		return err
-	}
-	record := &data.LogRecord{
-		Key:   []byte(seqNoKey),
-		Value: []byte(strconv.FormatUint(db.seqNo, 10)),
-	}
-	encRecord, _ := data.EncodeLogRecord(record)
-	if err := seqNoFile.Write(encRecord); err != nil {
-		return err
+	for _, ns := range db.namespaces {
+		if err := ns.index.Close(); err != nil {
+			return err
+		}
 	}
-	if err := seqNoFile.Sync(); err != nil {
-		return err
+
+	// 保存当前事务序列号，只读模式不写入文件
+	if !db.options.ReadOnly {
+		if err := writeSeqNo(db.options.DirPath, db.seqNo); err != nil {
+			return err
+		}
 	}
 
 	// 关闭活跃文件
@@ -181,7 +239,15 @@ func (db *DB) Close() error {
 	}
 
 	// 关闭旧的数据文件
+	if db.fileCache != nil {
+		if err := db.fileCache.close(); err != nil {
+			return err
+		}
+	}
 	for _, file := range db.olderFiles {
+		if file.IoManager == nil {
+			continue
+		}
 		if err := file.Close(); err != nil {
 			return err
 		}
@@ -191,7 +257,7 @@ func (db *DB) Close() error {
 
 // Sync 数据的可持久化
 func (db *DB) Sync() error {
-	if db.activeFile == nil {
+	if db.activeFile == nil || db.options.ReadOnly {
 		return nil
 	}
 	db.mu.Lock()
@@ -213,24 +279,69 @@ func (db *DB) Stat() *Stat {
 	if err != nil {
 		panic(fmt.Sprintf("failed to get dir size: %v", err))
 	}
+	indexMemory := db.index.MemoryUsage()
+	for _, ns := range db.namespaces {
+		indexMemory += ns.index.MemoryUsage()
+	}
+	var cacheHits, cacheMisses uint64
+	if db.readCache != nil {
+		cacheHits, cacheMisses = db.readCache.Stats()
+	}
+	var bloomRejects, bloomFalsePositives uint64
+	var bloomFalsePositiveRate float64
+	if db.blooms != nil {
+		bloomRejects, bloomFalsePositives = db.blooms.rejects.Load(), db.blooms.falsePositives.Load()
+		bloomFalsePositiveRate = db.blooms.falsePositiveRate()
+	}
 	return &Stat{
 		KeyNum:          uint(db.index.Size()),
 		DataFileNum:     dataFiles,
 		ReclaimableSize: db.reclaimSize,
 		DiskSize:        dirSize, // todo
+		IndexMemory:     indexMemory,
+
+		BackgroundThrottled: db.bgLimiter.ThrottledTime(),
+		WriteThrottled:      db.writeLimiter.ThrottledTime(),
+
+		ReadCacheHits:   cacheHits,
+		ReadCacheMisses: cacheMisses,
+
+		BloomFilterRejects:           bloomRejects,
+		BloomFilterFalsePositives:    bloomFalsePositives,
+		BloomFilterFalsePositiveRate: bloomFalsePositiveRate,
 	}
 }
 
+// SetBackgroundIORate 运行时调整后台 IO 的限速，0 表示不限速
+func (db *DB) SetBackgroundIORate(rate int64) {
+	db.bgLimiter.SetRate(rate)
+}
+
+// SetWriteIORate 运行时调整前台写入的限速，0 表示不限速
+func (db *DB) SetWriteIORate(rate int64) {
+	db.writeLimiter.SetRate(rate)
+}
+
 // Backup 备份数据库，将数据文件拷贝到新的目录中
+// 和 Checkpoint 一样只在记录数据文件和写入位置的时候加锁，拷贝的过程不会阻塞读写
+// 和 Checkpoint 不同的是所有的文件都会完整地拷贝，不会创建硬链接
 func (db *DB) Backup(dir string) error {
-	db.mu.RLock()
-	defer db.mu.RUnlock()
-
-	return utils.CopyDir(db.options.DirPath, dir, []string{fileLockName})
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	return db.snapshotFilesTo(dir, func(src, dest string, throttle func(n int)) error {
+		return utils.CopyFile(src, dest, -1, throttle)
+	})
 }
 
 // Put 写入 key/value 数据，key 不能为空
 func (db *DB) Put(key []byte, value []byte) error {
+	if db.options.ReadOnly {
+		return ErrReadOnly
+	}
+	if db.writeFenced.Load() {
+		return ErrWriteFenced
+	}
 	// 判断 key 是否有效
 	if len(key) == 0 {
 		return ErrKeyIsEmpty
@@ -243,22 +354,31 @@ func (db *DB) Put(key []byte, value []byte) error {
 		Type:  data.LogRecordNormal,
 	}
 
-	// 追加写入到当前活跃文件中
-	pos, err := db.appendLogRecordWithLock(logRecord)
-	if err != nil {
-		return err
-	}
-
-	// 更新内存索引
-	if oldPos := db.index.Put(key, pos); oldPos != nil {
-		db.reclaimSize += int64(oldPos.Size)
+	db.waitWriteTokens(logRecord.MaxEncodedSize())
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	// 存在二级索引时，数据和索引的变更在同一个事务中提交
+	if db.needSecondaryIndexWrites() {
+		return db.commitWithSecondaryIndexes(key, &data.LogRecord{Key: key, Value: value})
 	}
 
-	return nil
+	// 追加写入到当前活跃文件中，并更新内存索引
+	return db.appendLogRecordAndUpdate(logRecord, func(pos *data.LogRecordPos) {
+		db.markApplied(pos)
+		if oldPos := db.index.Put(key, pos); oldPos != nil {
+			db.reclaimSize += int64(oldPos.Size)
+		}
+	})
 }
 
 // Delete 根据 key 删除对应的数据
 func (db *DB) Delete(key []byte) error {
+	if db.options.ReadOnly {
+		return ErrReadOnly
+	}
+	if db.writeFenced.Load() {
+		return ErrWriteFenced
+	}
 	// 判断 key 的有效性
 	if len(key) == 0 {
 		return ErrKeyIsEmpty
@@ -274,22 +394,29 @@ func (db *DB) Delete(key []byte) error {
 		Key:  logRecordKeyWithSeq(key, nonTransactionSeqNo),
 		Type: data.LogRecordDeleted,
 	}
-	// 写入到数据文件中
-	pos, err := db.appendLogRecordWithLock(logRecord)
-	if err != nil {
-		return nil
+	db.waitWriteTokens(logRecord.MaxEncodedSize())
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.needSecondaryIndexWrites() {
+		return db.commitWithSecondaryIndexes(key, &data.LogRecord{Key: key, Type: data.LogRecordDeleted})
 	}
 
-	db.reclaimSize += int64(pos.Size)
-
-	// 从内存索引中中删除对应的 key
-	oldPos, ok := db.index.Delete(key)
+	// 写入到数据文件中，并从内存索引中删除对应的 key
+	var ok bool
+	err := db.appendLogRecordAndUpdate(logRecord, func(pos *data.LogRecordPos) {
+		db.reclaimSize += int64(pos.Size)
+		db.markApplied(pos)
+		var oldPos *data.LogRecordPos
+		if oldPos, ok = db.index.Delete(key); oldPos != nil {
+			db.reclaimSize += int64(oldPos.Size)
+		}
+	})
+	if err != nil {
+		return err
+	}
 	if !ok {
 		return ErrIndexUpdateFailed
 	}
-	if oldPos != nil {
-		db.reclaimSize += int64(oldPos.Size)
-	}
 	return nil
 }
 
@@ -303,10 +430,22 @@ func (db *DB) Get(key []byte) ([]byte, error) {
 		return nil, ErrKeyIsEmpty
 	}
 
+	// 布隆过滤器判断 key 不存在时不需要访问索引
+	if db.blooms != nil && !db.blooms.mayContain(key) {
+		return nil, ErrKeyNotFound
+	}
+
 	// 从内存的数据结构中取出 key 对应的索引信息
 	logRecordPos := db.index.Get(key)
 	// 如果 key 不在内存索引中，说明 key 不存在
 	if logRecordPos == nil {
+		// 索引读取磁盘失败时查找的结果不可信
+		if err := index.Err(db.index); err != nil {
+			return nil, err
+		}
+		if db.blooms != nil {
+			db.blooms.falsePositives.Add(1)
+		}
 		return nil, ErrKeyNotFound
 	}
 
@@ -316,13 +455,13 @@ func (db *DB) Get(key []byte) ([]byte, error) {
 
 // ListKeys 获取数据库中的所有的 key
 func (db *DB) ListKeys() [][]byte {
-	iterator := db.index.Iterator(false)
+	db.mu.RLock()
+	iterator := newIndexIterator(db.index, index.IteratorOptions{})
+	db.mu.RUnlock()
 	defer iterator.Close()
-	keys := make([][]byte, db.index.Size())
-	var idx int
+	keys := make([][]byte, 0, db.index.Size())
 	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
-		keys[idx] = iterator.Key()
-		idx += 1
+		keys = append(keys, iterator.Key())
 	}
 	return keys
 }
@@ -348,21 +487,8 @@ func (db *DB) Fold(fn func(key []byte, value []byte) bool) error {
 
 // getValueByPosition 根据索引信息读取数据
 func (db *DB) getValueByPosition(logRecordPos *data.LogRecordPos) ([]byte, error) {
-
-	// 根据文件 id 找到对应的数据文件
-	var dataFile *data.DataFile
-	if db.activeFile.FileId == logRecordPos.Fid {
-		dataFile = db.activeFile
-	} else {
-		dataFile = db.olderFiles[logRecordPos.Fid]
-	}
-	// 数据文件为空
-	if dataFile == nil {
-		return nil, ErrDataFileNotFound
-	}
-
 	// 根据偏移量读取对应的数据
-	logRecord, _, err := dataFile.ReadLogRecord(logRecordPos.Offset)
+	logRecord, _, err := db.readLogRecord(logRecordPos.Fid, logRecordPos.Offset)
 	if err != nil {
 		return nil, err
 	}
@@ -374,10 +500,49 @@ func (db *DB) getValueByPosition(logRecordPos *data.LogRecordPos) ([]byte, error
 	return logRecord.Value, nil
 }
 
-func (db *DB) appendLogRecordWithLock(logRecord *data.LogRecord) (*data.LogRecordPos, error) {
+// 从指定的数据文件中读取一条日志记录，调用方需要持有 db.mu
+func (db *DB) readLogRecord(fileId uint32, offset int64) (*data.LogRecord, int64, error) {
+	// 根据文件 id 找到对应的数据文件
+	var dataFile *data.DataFile
+	if db.activeFile != nil && db.activeFile.FileId == fileId {
+		dataFile = db.activeFile
+	} else {
+		dataFile = db.olderFiles[fileId]
+	}
+	// 数据文件为空
+	if dataFile == nil {
+		return nil, 0, ErrDataFileNotFound
+	}
+	if dataFile != db.activeFile {
+		if err := db.acquireDataFile(dataFile); err != nil {
+			return nil, 0, err
+		}
+		defer db.releaseDataFile(dataFile)
+	}
+	return dataFile.ReadLogRecord(offset)
+}
+
+// 追加写入一条记录，并在锁内调用 updateIndex 更新索引
+// 索引的更新顺序和记录写入的顺序保持一致，B+ 树索引依赖这个顺序记录已经应用到的位置
+func (db *DB) appendLogRecordWithLock(logRecord *data.LogRecord, updateIndex func(pos *data.LogRecordPos)) error {
+	db.waitWriteTokens(logRecord.MaxEncodedSize())
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	return db.appendLogRecord(logRecord)
+	return db.appendLogRecordAndUpdate(logRecord, updateIndex)
+}
+
+// 同 appendLogRecordWithLock，调用方需要持有 db.mu
+func (db *DB) appendLogRecordAndUpdate(logRecord *data.LogRecord, updateIndex func(pos *data.LogRecordPos)) error {
+	pos, err := db.appendLogRecord(logRecord)
+	if err != nil {
+		return err
+	}
+	updateIndex(pos)
+
+	// 在锁内发布变更，保证变更的顺序和写入的顺序一致
+	key, _ := parseLogRecordKey(logRecord.Key)
+	db.publishChanges(nonTransactionSeqNo, []*data.LogRecord{{Key: key, Value: logRecord.Value, Type: logRecord.Type}})
+	return nil
 }
 
 // 追加写入数据到活跃文件中
@@ -400,7 +565,10 @@ func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, er
 		}
 
 		// 将当前活跃文件转换为旧的数据文件
-		db.olderFiles[db.activeFile.FileId] = db.activeFile
+		if err := db.sealDataFileBloom(); err != nil {
+			return nil, err
+		}
+		db.addOlderFile(db.activeFile)
 
 		// 打开新的数据文件
 		if err := db.setActiveDataFile(); err != nil {
@@ -414,6 +582,10 @@ func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, er
 	}
 
 	db.bytesWrite += uint(size)
+	if db.blooms != nil && logRecord.Type == data.LogRecordNormal {
+		key, _ := parseLogRecordKey(logRecord.Key)
+		db.blooms.add(key)
+	}
 	// 根据用户配置决定是否持久化
 	// 如果当前写入的字节数到达了用户的设置值
 	var needSync = db.options.SyncWrites
@@ -439,6 +611,14 @@ func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, er
 	return pos, nil
 }
 
+// 活跃文件写满或者 merge 时变为旧的数据文件，持久化布隆过滤器
+func (db *DB) sealDataFileBloom() error {
+	if db.blooms == nil {
+		return nil
+	}
+	return db.blooms.save(db.activeFile.FileId + 1)
+}
+
 // 设置当前活跃文件
 // 在访问此方法前必须持有互斥锁
 func (db *DB) setActiveDataFile() error {
@@ -452,11 +632,40 @@ func (db *DB) setActiveDataFile() error {
 	if err != nil {
 		return err
 	}
+	dataFile.Cache = db.readCache
 	db.activeFile = dataFile
 
 	return nil
 }
 
+// 将数据文件加入到旧的数据文件中
+func (db *DB) addOlderFile(dataFile *data.DataFile) {
+	db.olderFiles[dataFile.FileId] = dataFile
+	if db.fileCache != nil {
+		db.fileCache.add(dataFile)
+	}
+}
+
+// 保证旧的数据文件处于打开状态，使用完之后需要调用 releaseDataFile
+func (db *DB) acquireDataFile(dataFile *data.DataFile) error {
+	if db.fileCache == nil {
+		return nil
+	}
+	return db.fileCache.acquire(dataFile)
+}
+
+func (db *DB) releaseDataFile(dataFile *data.DataFile) {
+	if db.fileCache != nil {
+		db.fileCache.release(dataFile)
+	}
+}
+
+// 为即将写入的 n 个字节预留前台写入的令牌，令牌不足时等待
+// 必须在获取 db.mu 之前调用，限速等待的时候不会阻塞读取
+func (db *DB) waitWriteTokens(n int64) {
+	db.writeLimiter.Wait(int(n))
+}
+
 // 从磁盘加载数据文件
 func (db *DB) loadDataFile() error {
 	dirEntries, err := os.ReadDir(db.options.DirPath)
@@ -486,7 +695,7 @@ func (db *DB) loadDataFile() error {
 	// 遍历每个文件的id，打开对应的数据文件
 
 	for i, fid := range fileIds {
-		ioType := fio.StandardFIO
+		ioType := db.standardIOType()
 		if db.options.MMapAtStartup {
 			ioType = fio.MemoryMap
 		}
@@ -494,10 +703,11 @@ func (db *DB) loadDataFile() error {
 		if err != nil {
 			return err
 		}
+		dataFile.Cache = db.readCache
 		if i == len(fileIds)-1 { // 最后一个，id是最大的，说明是当前活跃文件
 			db.activeFile = dataFile
 		} else { // 说明是旧的数据文件
-			db.olderFiles[uint32(fid)] = dataFile
+			db.addOlderFile(dataFile)
 		}
 	}
 	return nil
@@ -523,31 +733,25 @@ func (db *DB) loadIndexFromDataFile() error {
 		nonMergeFileId = fid
 	}
 
-	updateIndex := func(key []byte, typ data.LogRecordType, pos *data.LogRecordPos) {
-		var oldPos *data.LogRecordPos
-		if typ == data.LogRecordDeleted {
-			oldPos, _ = db.index.Delete(key)
-			// 被删除的数据本身也是无效的 也要统计
-			db.reclaimSize += int64(pos.Size)
-		} else {
-			oldPos = db.index.Put(key, pos)
-		}
-		if oldPos != nil {
-			db.reclaimSize += int64(oldPos.Size)
-		}
+	// 如果比最近未参与 merge 的文件 id 更小，说明已经从 hint 文件中加载索引了
+	var startFid uint32
+	if hasMerge {
+		startFid = nonMergeFileId
 	}
+	return db.replayDataFiles(startFid, 0)
+}
 
-	// 暂存事务数据
-	transactionsRecords := make(map[uint64][]*data.TransactionRecord)
-	var currentSeqNo uint64 = nonTransactionSeqNo
-
-	// 遍历索引文件id，处理文件中的记录
+// 从指定文件的指定位置开始，依次重放之后所有数据文件中的记录
+func (db *DB) replayDataFiles(startFid uint32, startOffset int64) error {
 	for i, fid := range db.fileIds {
 		var fileID = uint32(fid)
-		// 如果比最近未参与 merge 的文件 id 更小，说明已经从 hint 文件中加载索引了
-		if hasMerge && fileID < nonMergeFileId {
+		if fileID < startFid {
 			continue
 		}
+		var offset int64
+		if fileID == startFid {
+			offset = startOffset
+		}
 		var dataFile *data.DataFile
 		if fileID == db.activeFile.FileId {
 			dataFile = db.activeFile
@@ -555,54 +759,164 @@ func (db *DB) loadIndexFromDataFile() error {
 			dataFile = db.olderFiles[fileID]
 		}
 
-		var offset int64 = 0
-		for {
-			logRecord, size, err := dataFile.ReadLogRecord(offset)
-			if err != nil {
-				if err == io.EOF {
-					break
+		isActive := i == len(db.fileIds)-1
+		offset, err := db.replayDataFile(dataFile, offset, isActive)
+		if err != nil {
+			return err
+		}
+		if isActive {
+			// 截断掉末尾不完整的数据，保证后续追加写入的位置正确
+			// 只读模式下数据文件可能正在被其他进程写入，不能截断
+			if !db.options.ReadOnly {
+				if err := db.truncateTornTail(fileID, offset); err != nil {
+					return err
 				}
-				return err
 			}
+			db.activeFile.WriteOff = offset
+		}
+	}
+	return nil
+}
 
-			// 构造内存索引并保存
-			logRecordPos := &data.LogRecordPos{Fid: fileID, Offset: offset, Size: uint32(size)}
-
-			// 解析 Key，拿到事务序列号
-			realKey, seqNo := parseLogRecordKey(logRecord.Key)
-			if seqNo == nonTransactionSeqNo {
-				updateIndex(realKey, logRecord.Type, logRecordPos)
-			} else {
-				// 事务完成，对应的 seq no 的数据可以更新到内存索引中
-				if logRecord.Type == data.LogRecordTxnFinished {
-					for _, txnRecord := range transactionsRecords[seqNo] {
-						updateIndex(txnRecord.Record.Key, txnRecord.Record.Type, txnRecord.Pos)
-					}
-					delete(transactionsRecords, seqNo)
-				} else {
-					logRecord.Key = realKey
-					transactionsRecords[seqNo] = append(transactionsRecords[seqNo], &data.TransactionRecord{
-						Record: logRecord,
-						Pos:    logRecordPos,
-					})
-				}
-			}
-			// 更新事务序列号
-			if seqNo > currentSeqNo {
-				currentSeqNo = seqNo
-			}
+// B+ 树索引和数据文件分别持久化，崩溃之后两者可能不一致
+// 索引中记录了最后一条应用的记录的位置，从这条记录之后开始重放，补上索引中缺少的数据
+// 如果这条记录已经不在数据文件中，说明索引中有数据文件里丢失的数据，需要清空索引重新构建
+func (db *DB) recoverBPlusTreeIndex() error {
+	bpt := db.index.(*index.BPlusTree)
+	applied := bpt.Applied()
+	if applied != nil && db.appliedRecordExists(applied) {
+		return db.replayDataFiles(applied.Fid, applied.Offset+int64(applied.Size))
+	}
+	// 没有记录过应用的位置，并且没有数据文件，是一个新的数据库
+	if applied == nil && len(db.fileIds) == 0 {
+		return nil
+	}
+
+	if err := bpt.Reset(); err != nil {
+		return err
+	}
+	if err := db.loadIndexFromHintFile(); err != nil {
+		return err
+	}
+	return db.loadIndexFromDataFile()
+}
+
+// 判断索引中记录的最后一条应用的记录是否完整地保存在数据文件中
+func (db *DB) appliedRecordExists(applied *data.LogRecordPos) bool {
+	// merge 之后已应用的位置指向最近未参与 merge 的文件的开头
+	if applied.Size == 0 {
+		return slices.Contains(db.fileIds, int(applied.Fid))
+	}
+	_, size, err := db.readLogRecord(applied.Fid, applied.Offset)
+	return err == nil && size == int64(applied.Size)
+}
 
-			// 递增 offset， 下一次直接从新的位置读取
-			offset += size
+// 从数据文件的指定位置开始读取记录并更新内存索引，返回读取结束的位置
+// 活跃文件末尾校验失败的数据视为没有写完整的数据，读取到此为止
+func (db *DB) replayDataFile(dataFile *data.DataFile, offset int64, isActive bool) (int64, error) {
+	if dataFile != db.activeFile {
+		if err := db.acquireDataFile(dataFile); err != nil {
+			return 0, err
 		}
-		if i == len(db.fileIds)-1 {
-			db.activeFile.WriteOff = offset
+		defer db.releaseDataFile(dataFile)
+	}
+
+	for {
+		logRecord, size, err := dataFile.ReadLogRecord(offset)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			// 活跃文件末尾的数据校验失败，说明是崩溃时没有写完整的数据
+			if err == data.ErrInvalidCRC && isActive {
+				break
+			}
+			return 0, err
 		}
+
+		// 构造内存索引并保存
+		logRecordPos := &data.LogRecordPos{Fid: dataFile.FileId, Offset: offset, Size: uint32(size)}
+		db.replayLogRecord(logRecord, logRecordPos)
+
+		// 递增 offset， 下一次直接从新的位置读取
+		offset += size
 	}
+	return offset, nil
+}
 
+// 将从数据文件中读取到的记录更新到内存索引中
+// 事务中的数据需要暂存起来，读到事务完成的标识之后才能更新
+func (db *DB) replayLogRecord(logRecord *data.LogRecord, logRecordPos *data.LogRecordPos) {
+	// 解析 Key，拿到事务序列号
+	realKey, seqNo := parseLogRecordKey(logRecord.Key)
+	if seqNo == nonTransactionSeqNo {
+		db.updateIndex(realKey, logRecord.Type, logRecordPos)
+	} else {
+		// 事务完成，对应的 seq no 的数据可以更新到内存索引中
+		if logRecord.Type == data.LogRecordTxnFinished {
+			for _, txnRecord := range db.pendingTxns[seqNo] {
+				db.updateIndex(txnRecord.Record.Key, txnRecord.Record.Type, txnRecord.Pos)
+			}
+			delete(db.pendingTxns, seqNo)
+		} else {
+			logRecord.Key = realKey
+			db.pendingTxns[seqNo] = append(db.pendingTxns[seqNo], &data.TransactionRecord{
+				Record: logRecord,
+				Pos:    logRecordPos,
+			})
+		}
+	}
 	// 更新事务序列号
-	db.seqNo = currentSeqNo
-	return nil
+	if seqNo > db.seqNo {
+		db.seqNo = seqNo
+	}
+}
+
+func (db *DB) updateIndex(key []byte, typ data.LogRecordType, pos *data.LogRecordPos) {
+	if isNamespaceRecord(typ) {
+		db.updateNamespaceIndex(key, typ, pos)
+		return
+	}
+	db.markApplied(pos)
+	var oldPos *data.LogRecordPos
+	if typ == data.LogRecordDeleted {
+		oldPos, _ = db.index.Delete(key)
+		// 被删除的数据本身也是无效的 也要统计
+		db.reclaimSize += int64(pos.Size)
+	} else {
+		oldPos = db.index.Put(key, pos)
+	}
+	if oldPos != nil {
+		db.reclaimSize += int64(oldPos.Size)
+	}
+}
+
+// 记录分配的事务序列号，B+ 树索引不会在启动时重放所有的数据文件，需要持久化事务序列号
+func (db *DB) markSeqNo(seqNo uint64) {
+	if bpt, ok := db.index.(*index.BPlusTree); ok {
+		bpt.MarkSeqNo(seqNo)
+	}
+}
+
+// 标记 pos 处的记录已经应用到索引中，只有 B+ 树索引需要记录
+// 标记和接下来的一次索引更新一起持久化，崩溃之后从这个位置开始重放
+func (db *DB) markApplied(pos *data.LogRecordPos) {
+	if bpt, ok := db.index.(*index.BPlusTree); ok {
+		bpt.MarkApplied(pos)
+	}
+}
+
+// 如果文件的实际大小超过了最后一条完整记录的位置，则将多余的部分截断
+func (db *DB) truncateTornTail(fileId uint32, offset int64) error {
+	fileName := data.GetDataFileName(db.options.DirPath, fileId)
+	stat, err := os.Stat(fileName)
+	if err != nil {
+		return err
+	}
+	if stat.Size() <= offset {
+		return nil
+	}
+	return os.Truncate(fileName, offset)
 }
 
 func checkOptions(options Options) error {
@@ -615,9 +929,54 @@ func checkOptions(options Options) error {
 	if options.DataFileMergeRatio < 0 || options.DataFileMergeRatio > 1 {
 		return errors.New("invalid merge ratio, must between 0 and 1")
 	}
+	if options.BackgroundIORate < 0 || options.WriteIORate < 0 {
+		return errors.New("io rate limit must not be negative")
+	}
+	if options.MaxOpenFiles < 0 {
+		return errors.New("max open files must not be negative")
+	}
+	if options.ReadCacheSize < 0 {
+		return errors.New("read cache size must not be negative")
+	}
+	if options.WatchHistorySize < 0 {
+		return errors.New("watch history size must not be negative")
+	}
+	if options.IndexType < Btree || options.IndexType > SkipList {
+		return errors.New("unsupported index type")
+	}
+	if options.IndexType == Tiered && options.IndexMemoryBudget <= 0 {
+		return errors.New("index memory budget must be greater than 0")
+	}
+	// B+ 树索引文件被写入的进程独占，只读模式需要使用内存索引从数据文件中构建
+	if options.ReadOnly && options.IndexType == BPlusTree {
+		return ErrReadOnlyBPlusTree
+	}
 	return nil
 }
 
+// 根据配置项初始化索引
+func openIndexer(options Options) (index.Indexer, error) {
+	opts := indexerOptions(options)
+	if options.IndexType == BPlusTree {
+		return index.OpenBPlusTree(opts.DirPath, opts.SyncWrites)
+	}
+	return index.NewIndexer(options.IndexType, opts), nil
+}
+
+// 创建索引的配置项，只读模式下不能在数据目录中创建文件，分层索引使用系统的临时目录
+func indexerOptions(options Options) index.Options {
+	opts := index.Options{
+		DirPath:           options.DirPath,
+		SyncWrites:        options.SyncWrites,
+		PrefixCompression: options.IndexPrefixCompression,
+		MemoryBudget:      options.IndexMemoryBudget,
+	}
+	if options.ReadOnly && options.IndexType == Tiered {
+		opts.DirPath = ""
+	}
+	return opts
+}
+
 func (db *DB) loadSeqNo() error {
 	fileName := filepath.Join(db.options.DirPath, data.SeqNoFileName)
 	if _, err := os.Stat(fileName); os.IsNotExist(err) {
@@ -633,24 +992,53 @@ func (db *DB) loadSeqNo() error {
 		return err
 	}
 	db.seqNo = seqNo
-	db.seqNoFileExists = true
 
 	return nil
 }
 
+// 将事务序列号保存到数据目录中
+func writeSeqNo(dirPath string, seqNo uint64) error {
+	seqNoFile, err := data.OpenSeqNoFIle(dirPath)
+	if err != nil {
+		return err
+	}
+	defer seqNoFile.Close()
+	record := &data.LogRecord{
+		Key:   []byte(seqNoKey),
+		Value: []byte(strconv.FormatUint(seqNo, 10)),
+	}
+	encRecord, _ := data.EncodeLogRecord(record)
+	if err := seqNoFile.Write(encRecord); err != nil {
+		return err
+	}
+	return seqNoFile.Sync()
+}
+
 // 将数据文件的 IO 类型设置为标准文件IO
 func (db *DB) resetIoType() error {
 	if db.activeFile == nil {
 		return nil
 	}
-	if err := db.activeFile.SetIOManager(db.options.DirPath, fio.StandardFIO); err != nil {
+	if err := db.activeFile.SetIOManager(db.options.DirPath, db.standardIOType()); err != nil {
 		return err
 	}
 
 	for _, dataFile := range db.olderFiles {
-		if err := dataFile.SetIOManager(db.options.DirPath, fio.StandardFIO); err != nil {
+		// 已经被文件句柄缓存关闭的文件，重新打开时使用的就是标准文件 IO
+		if dataFile.IoManager == nil {
+			continue
+		}
+		if err := dataFile.SetIOManager(db.options.DirPath, db.standardIOType()); err != nil {
 			return err
 		}
 	}
 	return nil
 }
+
+// 读写数据文件使用的标准文件 IO 类型，只读模式下以只读的方式打开文件
+func (db *DB) standardIOType() fio.FileIOType {
+	if db.options.ReadOnly {
+		return fio.ReadOnlyFIO
+	}
+	return fio.StandardFIO
+}
@@ -1,9 +1,11 @@
 package bitcask_go
 
 import (
+	"bitcask-go/index"
 	"bitcask-go/utils"
 	"github.com/stretchr/testify/assert"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -400,3 +402,225 @@ func TestDB_Backup(t *testing.T) {
 	assert.Nil(t, err)
 	assert.NotNil(t, db2)
 }
+
+func TestDB_WriteRateLimit(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-write-rate-limit")
+	opts.DirPath = dir
+	opts.WriteIORate = 64 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(64))
+		assert.Nil(t, err)
+	}
+	assert.True(t, db.Stat().WriteThrottled > 0)
+
+	// 关闭限速之后不再等待
+	db.SetWriteIORate(0)
+	throttled := db.Stat().WriteThrottled
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(64))
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, throttled, db.Stat().WriteThrottled)
+
+	// 限速等待的时候不持有锁，不会阻塞读取
+	db.SetWriteIORate(64 * 1024)
+	assert.Nil(t, db.Put([]byte("large"), make([]byte, 128*1024)))
+	done := make(chan error)
+	go func() {
+		done <- db.Put([]byte("small"), []byte("value"))
+	}()
+	time.Sleep(50 * time.Millisecond)
+	now := time.Now()
+	_, err = db.Get([]byte("large"))
+	assert.Nil(t, err)
+	assert.True(t, time.Since(now) < 100*time.Millisecond)
+	assert.Nil(t, <-done)
+	db.SetWriteIORate(0)
+
+	backupDir, _ := os.MkdirTemp("", "bitcask-go-backup-rate-limit")
+	defer os.RemoveAll(backupDir)
+	db.SetBackgroundIORate(64 * 1024)
+	err = db.Backup(backupDir)
+	assert.Nil(t, err)
+	assert.True(t, db.Stat().BackgroundThrottled > 0)
+}
+
+func TestDB_ReadCache(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-read-cache")
+	opts.DirPath = dir
+	opts.ReadCacheSize = 1024 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	val1 := utils.RandomValue(24)
+	err = db.Put(utils.GetTestKey(1), val1)
+	assert.Nil(t, err)
+
+	// 第一次读取未命中，之后命中缓存
+	for i := 0; i < 3; i++ {
+		val, err := db.Get(utils.GetTestKey(1))
+		assert.Nil(t, err)
+		assert.Equal(t, val1, val)
+	}
+	stat := db.Stat()
+	assert.Equal(t, uint64(2), stat.ReadCacheHits)
+	assert.Equal(t, uint64(1), stat.ReadCacheMisses)
+
+	// 修改返回的数据不会影响缓存
+	val, _ := db.Get(utils.GetTestKey(1))
+	val[0] = 'X'
+	val2, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, val1, val2)
+
+	// 更新之后读取到的是新的值
+	val3 := utils.RandomValue(24)
+	err = db.Put(utils.GetTestKey(1), val3)
+	assert.Nil(t, err)
+	val4, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, val3, val4)
+}
+
+func TestDB_HashIndex(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-hash-index")
+	opts.DirPath = dir
+	opts.IndexType = Hash
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(10)))
+	}
+	for i := 0; i < 50; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	keys := db.ListKeys()
+	assert.Equal(t, 50, len(keys))
+	assert.Equal(t, utils.GetTestKey(50), keys[0])
+
+	// merge 并重启之后索引从 hint 文件中重建
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db2)
+	assert.Equal(t, uint(50), db2.Stat().KeyNum)
+	_, err = db2.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err := db2.Get(utils.GetTestKey(99))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+}
+
+func TestDB_CompactIndex(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-compact-index")
+	opts.DirPath = dir
+	opts.IndexType = Compact
+	opts.IndexPrefixCompression = true
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 10000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(10)))
+	}
+	for i := 0; i < 5000; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	keys := db.ListKeys()
+	assert.Equal(t, 5000, len(keys))
+	assert.Equal(t, utils.GetTestKey(5000), keys[0])
+	stat := db.Stat()
+	assert.Equal(t, uint(5000), stat.KeyNum)
+	assert.True(t, stat.IndexMemory > 0)
+
+	// 重启之后索引从数据文件中重建
+	assert.Nil(t, db.Close())
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db2)
+	assert.Equal(t, uint(5000), db2.Stat().KeyNum)
+	_, err = db2.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err := db2.Get(utils.GetTestKey(9999))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+}
+
+func TestDB_TieredIndex(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-tiered-index")
+	opts.DirPath = dir
+	opts.IndexType = Tiered
+	opts.IndexMemoryBudget = 64 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 20000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(10)))
+	}
+	for i := 0; i < 10000; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	keys := db.ListKeys()
+	assert.Equal(t, 10000, len(keys))
+	assert.Equal(t, utils.GetTestKey(10000), keys[0])
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err := db.Get(utils.GetTestKey(19999))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+
+	// 索引的内存不超过预算太多，超出的部分写入了数据目录中的临时目录
+	stat := db.Stat()
+	assert.Equal(t, uint(10000), stat.KeyNum)
+	assert.True(t, stat.IndexMemory < opts.IndexMemoryBudget*11/10, "index memory: %d", stat.IndexMemory)
+	spillDirs, _ := filepath.Glob(filepath.Join(dir, index.SpillDirPattern))
+	assert.Equal(t, 1, len(spillDirs))
+
+	// 备份不包括临时目录
+	backupDir, _ := os.MkdirTemp("", "bitcask-go-tiered-index-backup")
+	defer func() {
+		_ = os.RemoveAll(backupDir)
+	}()
+	assert.Nil(t, db.Backup(backupDir))
+	spillDirs, _ = filepath.Glob(filepath.Join(backupDir, index.SpillDirPattern))
+	assert.Empty(t, spillDirs)
+
+	// 关闭时删除临时目录，重启之后索引从数据文件中重建
+	assert.Nil(t, db.Close())
+	spillDirs, _ = filepath.Glob(filepath.Join(dir, index.SpillDirPattern))
+	assert.Empty(t, spillDirs)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db2)
+	assert.Equal(t, uint(10000), db2.Stat().KeyNum)
+	val, err = db2.Get(utils.GetTestKey(10000))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+}
+
+// 校验数据库中的数据和已经确认写入的数据完全一致
+func assertAcknowledgedState(t *testing.T, db *DB, acked map[string][]byte) {
+	assert.Equal(t, len(acked), len(db.ListKeys()))
+	for key, value := range acked {
+		val, err := db.Get([]byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+	}
+}
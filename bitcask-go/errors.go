@@ -3,14 +3,40 @@ package bitcask_go
 import "errors"
 
 var (
-	ErrKeyIsEmpty             = errors.New("the key is empty")
-	ErrIndexUpdateFailed      = errors.New("failed to update index")
-	ErrKeyNotFound            = errors.New("key not found in database")
-	ErrDataFileNotFound       = errors.New("data file is not found")
-	ErrDataDirectoryCorrupted = errors.New("the database directory maybe corrupted")
-	ErrExceedMaxBatchNum      = errors.New("exceed the max batch num")
-	ErrMergeIsProgress        = errors.New("merge is in progress, try again later")
-	ErrDatabaseIsUsing        = errors.New("the database directory is used by another process")
-	ErrMergeRatioUnreached    = errors.New("the merge ratio do not reach the option")
-	ErrNoEnoughSpaceForMerge  = errors.New("no enough disk space for merge")
+	ErrKeyIsEmpty              = errors.New("the key is empty")
+	ErrIndexUpdateFailed       = errors.New("failed to update index")
+	ErrKeyNotFound             = errors.New("key not found in database")
+	ErrDataFileNotFound        = errors.New("data file is not found")
+	ErrDataDirectoryCorrupted  = errors.New("the database directory maybe corrupted")
+	ErrExceedMaxBatchNum       = errors.New("exceed the max batch num")
+	ErrMergeIsProgress         = errors.New("merge is in progress, try again later")
+	ErrDatabaseIsUsing         = errors.New("the database directory is used by another process")
+	ErrMergeRatioUnreached     = errors.New("the merge ratio do not reach the option")
+	ErrNoEnoughSpaceForMerge   = errors.New("no enough disk space for merge")
+	ErrReadOnly                = errors.New("the database is opened in read-only mode")
+	ErrDirectoryNotEmpty       = errors.New("the target directory is not empty")
+	ErrInvalidBackupManifest   = errors.New("the backup manifests do not form a valid chain")
+	ErrRestoreAcrossMerge      = errors.New("cannot restore to a log position that may have been rewritten by merge")
+	ErrUnsupportedExportFormat = errors.New("unsupported export format")
+	ErrExportDataCorrupted     = errors.New("the export data maybe corrupted")
+	ErrInvalidBatchSize        = errors.New("batch size must be greater than 0")
+	ErrInvalidWatchBufferSize  = errors.New("watch buffer size must be greater than 0")
+	ErrWatchCursorNotFound     = errors.New("the watch cursor is too old or unknown")
+	ErrWatchLagged             = errors.New("the subscriber lagged behind and was dropped")
+	ErrLogPositionNotFound     = errors.New("the log position is not found")
+	ErrConsumerBehind          = errors.New("a registered log consumer has not read all the data yet")
+	ErrInvalidShardOptions     = errors.New("shard num and virtual nodes must be greater than 0")
+	ErrShardConfigMismatch     = errors.New("the shard config does not match the existing data directory")
+	ErrWriteFenced             = errors.New("the database is fenced and does not accept writes")
+	ErrCommitIncomplete        = errors.New("the transaction is committed but some shards failed to finish it, reopen the database to recover")
+	ErrNamespaceUnsupported    = errors.New("namespaces are not supported by the b+ tree index")
+	ErrNamespaceNotFound       = errors.New("the namespace is not found")
+	ErrNamespaceDropped        = errors.New("the namespace has been dropped")
+	ErrInvalidNamespaceName    = errors.New("the namespace name is empty")
+	ErrInvalidScanLimit        = errors.New("scan limit must be greater than 0")
+	ErrInvalidIndexName        = errors.New("the index name or extractor is empty")
+	ErrSecondaryIndexExists    = errors.New("the secondary index is already registered")
+	ErrSecondaryIndexNotFound  = errors.New("the secondary index is not found")
+	ErrReadOnlyBPlusTree       = errors.New("the b+ tree index can not be opened in read-only mode, use an in-memory index")
+	ErrDataFilesReplaced       = errors.New("the data files have been replaced by merge, reopen the database")
 )
@@ -0,0 +1,334 @@
+package bitcask_go
+
+import (
+	"bitcask-go/index"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"math"
+)
+
+// 导出格式
+// 二进制格式：magic + 版本号，之后是一条条的记录，最后以结束标识结尾
+// 每条记录：| type | key size | value size | key | value | crc |
+// 其中 key size 和 value size 为变长编码，crc 校验的是记录中 crc 之前的所有数据
+// 结束标识：| type | 记录的数量 | crc |，用来发现被截断的数据
+// JSON Lines 格式：每行一条记录，最后一行是结束标识，记录了数据的条数和所有 key/value 的校验和
+
+var exportMagic = []byte("BCDUMP")
+
+const (
+	exportVersion byte = 1
+
+	exportRecordEntry byte = 1
+	exportRecordEnd   byte = 2
+)
+
+// Export 将数据库中的数据导出到 w 中，导出的是调用时刻的一致的数据视图
+func (db *DB) Export(w io.Writer, opts ExportOptions) error {
+	// 加锁获取索引的快照，事务提交时索引的更新也在锁内，快照中不会出现提交了一半的事务
+	db.mu.Lock()
+	indexIter := newIndexIterator(db.index, index.IteratorOptions{})
+	db.mu.Unlock()
+	defer indexIter.Close()
+
+	encoder, err := newExportEncoder(w, opts.Format)
+	if err != nil {
+		return err
+	}
+
+	if len(opts.Prefix) > 0 {
+		indexIter.Seek(opts.Prefix)
+	} else {
+		indexIter.Rewind()
+	}
+	for ; indexIter.Valid(); indexIter.Next() {
+		key := indexIter.Key()
+		if !bytes.HasPrefix(key, opts.Prefix) {
+			break
+		}
+		db.mu.RLock()
+		value, err := db.getValueByPosition(indexIter.Value())
+		db.mu.RUnlock()
+		if err != nil {
+			return err
+		}
+		if err := encoder.encode(key, value); err != nil {
+			return err
+		}
+	}
+	return encoder.close()
+}
+
+// Import 从 r 中读取导出的数据并写入到数据库中
+// 数据按照 BatchSize 分批通过 WriteBatch 写入，数据损坏时之前已经提交的批次不会回滚
+func (db *DB) Import(r io.Reader, opts ImportOptions) error {
+	if opts.BatchSize == 0 {
+		return ErrInvalidBatchSize
+	}
+	decoder, err := newExportDecoder(r, opts.Format)
+	if err != nil {
+		return err
+	}
+
+	batchOpts := WriteBatchOptions{MaxBatchSize: opts.BatchSize, SyncWrites: opts.SyncWrites}
+	wb := db.NewWriteBatch(batchOpts)
+	var pending uint
+	for {
+		key, value, err := decoder.decode()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := wb.Put(key, value); err != nil {
+			return err
+		}
+		if pending++; pending >= opts.BatchSize {
+			if err := wb.Commit(); err != nil {
+				return err
+			}
+			pending = 0
+		}
+	}
+	return wb.Commit()
+}
+
+type exportEncoder interface {
+	encode(key, value []byte) error
+	close() error
+}
+
+type exportDecoder interface {
+	// decode 读取下一条数据，数据读取完毕时返回 io.EOF
+	decode() ([]byte, []byte, error)
+}
+
+func newExportEncoder(w io.Writer, format ExportFormat) (exportEncoder, error) {
+	bw := bufio.NewWriter(w)
+	switch format {
+	case ExportBinary:
+		header := append(append([]byte(nil), exportMagic...), exportVersion)
+		if _, err := bw.Write(header); err != nil {
+			return nil, err
+		}
+		return &binaryEncoder{w: bw}, nil
+	case ExportJSONLines:
+		return &jsonLinesEncoder{w: bw, encoder: json.NewEncoder(bw)}, nil
+	default:
+		return nil, ErrUnsupportedExportFormat
+	}
+}
+
+func newExportDecoder(r io.Reader, format ExportFormat) (exportDecoder, error) {
+	br := bufio.NewReader(r)
+	switch format {
+	case ExportBinary:
+		header := make([]byte, len(exportMagic)+1)
+		if _, err := io.ReadFull(br, header); err != nil {
+			return nil, ErrExportDataCorrupted
+		}
+		if !bytes.Equal(header[:len(exportMagic)], exportMagic) {
+			return nil, ErrExportDataCorrupted
+		}
+		if header[len(exportMagic)] != exportVersion {
+			return nil, ErrUnsupportedExportFormat
+		}
+		return &binaryDecoder{r: br}, nil
+	case ExportJSONLines:
+		return &jsonLinesDecoder{decoder: json.NewDecoder(br)}, nil
+	default:
+		return nil, ErrUnsupportedExportFormat
+	}
+}
+
+type binaryEncoder struct {
+	w     *bufio.Writer
+	count uint64
+}
+
+func (e *binaryEncoder) encode(key, value []byte) error {
+	header := make([]byte, 1+binary.MaxVarintLen64*2)
+	header[0] = exportRecordEntry
+	index := 1
+	index += binary.PutUvarint(header[index:], uint64(len(key)))
+	index += binary.PutUvarint(header[index:], uint64(len(value)))
+
+	crc := crc32.ChecksumIEEE(header[:index])
+	crc = crc32.Update(crc, crc32.IEEETable, key)
+	crc = crc32.Update(crc, crc32.IEEETable, value)
+	crcBuf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(crcBuf, crc)
+
+	for _, buf := range [][]byte{header[:index], key, value, crcBuf} {
+		if _, err := e.w.Write(buf); err != nil {
+			return err
+		}
+	}
+	e.count++
+	return nil
+}
+
+func (e *binaryEncoder) close() error {
+	buf := make([]byte, 1+binary.MaxVarintLen64+4)
+	buf[0] = exportRecordEnd
+	index := 1
+	index += binary.PutUvarint(buf[index:], e.count)
+	binary.LittleEndian.PutUint32(buf[index:], crc32.ChecksumIEEE(buf[:index]))
+	if _, err := e.w.Write(buf[:index+4]); err != nil {
+		return err
+	}
+	return e.w.Flush()
+}
+
+type binaryDecoder struct {
+	r     *bufio.Reader
+	count uint64
+	done  bool
+}
+
+func (d *binaryDecoder) decode() ([]byte, []byte, error) {
+	if d.done {
+		return nil, nil, io.EOF
+	}
+	typ, err := d.r.ReadByte()
+	if err != nil {
+		// 没有读到结束标识，数据被截断了
+		return nil, nil, ErrExportDataCorrupted
+	}
+
+	switch typ {
+	case exportRecordEntry:
+		keySize, err := binary.ReadUvarint(d.r)
+		if err != nil {
+			return nil, nil, ErrExportDataCorrupted
+		}
+		valueSize, err := binary.ReadUvarint(d.r)
+		if err != nil {
+			return nil, nil, ErrExportDataCorrupted
+		}
+		// 和日志记录一样，key 和 value 的长度不会超过 32 位
+		if keySize > math.MaxUint32 || valueSize > math.MaxUint32 {
+			return nil, nil, ErrExportDataCorrupted
+		}
+		header := make([]byte, 1+binary.MaxVarintLen64*2)
+		header[0] = typ
+		index := 1
+		index += binary.PutUvarint(header[index:], keySize)
+		index += binary.PutUvarint(header[index:], valueSize)
+
+		buf := make([]byte, keySize+valueSize+4)
+		if _, err := io.ReadFull(d.r, buf); err != nil {
+			return nil, nil, ErrExportDataCorrupted
+		}
+		kv := buf[:keySize+valueSize]
+		crc := crc32.Update(crc32.ChecksumIEEE(header[:index]), crc32.IEEETable, kv)
+		if crc != binary.LittleEndian.Uint32(buf[len(kv):]) {
+			return nil, nil, ErrExportDataCorrupted
+		}
+		d.count++
+		return kv[:keySize], kv[keySize:], nil
+	case exportRecordEnd:
+		count, err := binary.ReadUvarint(d.r)
+		if err != nil {
+			return nil, nil, ErrExportDataCorrupted
+		}
+		buf := make([]byte, 1+binary.MaxVarintLen64)
+		buf[0] = typ
+		index := 1 + binary.PutUvarint(buf[1:], count)
+		crcBuf := make([]byte, 4)
+		if _, err := io.ReadFull(d.r, crcBuf); err != nil {
+			return nil, nil, ErrExportDataCorrupted
+		}
+		if crc32.ChecksumIEEE(buf[:index]) != binary.LittleEndian.Uint32(crcBuf) || count != d.count {
+			return nil, nil, ErrExportDataCorrupted
+		}
+		d.done = true
+		return nil, nil, io.EOF
+	default:
+		return nil, nil, ErrExportDataCorrupted
+	}
+}
+
+// JSON Lines 格式，每行一个 JSON 对象，key 和 value 使用 base64 编码
+type jsonLinesEntry struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// JSON Lines 格式的结束标识
+type jsonLinesEnd struct {
+	End      bool   `json:"end"`
+	Count    uint64 `json:"count"`
+	Checksum uint32 `json:"checksum"`
+}
+
+// 解码时每一行可能是记录也可能是结束标识
+type jsonLinesLine struct {
+	jsonLinesEntry
+	jsonLinesEnd
+}
+
+type jsonLinesEncoder struct {
+	w        *bufio.Writer
+	encoder  *json.Encoder
+	count    uint64
+	checksum uint32
+}
+
+func (e *jsonLinesEncoder) encode(key, value []byte) error {
+	if err := e.encoder.Encode(jsonLinesEntry{Key: key, Value: value}); err != nil {
+		return err
+	}
+	e.count++
+	e.checksum = jsonLinesChecksum(e.checksum, key, value)
+	return nil
+}
+
+func (e *jsonLinesEncoder) close() error {
+	if err := e.encoder.Encode(jsonLinesEnd{End: true, Count: e.count, Checksum: e.checksum}); err != nil {
+		return err
+	}
+	return e.w.Flush()
+}
+
+type jsonLinesDecoder struct {
+	decoder  *json.Decoder
+	count    uint64
+	checksum uint32
+	done     bool
+}
+
+func (d *jsonLinesDecoder) decode() ([]byte, []byte, error) {
+	if d.done {
+		return nil, nil, io.EOF
+	}
+	var line jsonLinesLine
+	if err := d.decoder.Decode(&line); err != nil {
+		// 没有读到结束标识，数据被截断了
+		return nil, nil, ErrExportDataCorrupted
+	}
+	if line.End {
+		if line.Count != d.count || line.Checksum != d.checksum {
+			return nil, nil, ErrExportDataCorrupted
+		}
+		d.done = true
+		return nil, nil, io.EOF
+	}
+	if len(line.Key) == 0 {
+		return nil, nil, ErrExportDataCorrupted
+	}
+	d.count++
+	d.checksum = jsonLinesChecksum(d.checksum, line.Key, line.Value)
+	return line.Key, line.Value, nil
+}
+
+// 依次计算每条记录的 key 和 value 的校验和
+func jsonLinesChecksum(crc uint32, key, value []byte) uint32 {
+	crc = crc32.Update(crc, crc32.IEEETable, key)
+	return crc32.Update(crc, crc32.IEEETable, value)
+}
@@ -0,0 +1,143 @@
+package bitcask_go
+
+import (
+	"bitcask-go/utils"
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func TestDB_ExportImport(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-export")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	err = db.Put([]byte("prefix-a"), []byte("a"))
+	assert.Nil(t, err)
+	err = db.Put([]byte("prefix-b"), nil)
+	assert.Nil(t, err)
+	err = db.Delete(utils.GetTestKey(1))
+	assert.Nil(t, err)
+
+	for _, format := range []ExportFormat{ExportBinary, ExportJSONLines} {
+		exportOpts := DefaultExportOptions
+		exportOpts.Format = format
+		var buf bytes.Buffer
+		err = db.Export(&buf, exportOpts)
+		assert.Nil(t, err)
+
+		opts2 := DefaultOptions
+		dir2, _ := os.MkdirTemp("", "bitcask-go-import")
+		opts2.DirPath = dir2
+		db2, err := Open(opts2)
+		assert.Nil(t, err)
+
+		// 分批写入
+		importOpts := DefaultImportOptions
+		importOpts.Format = format
+		importOpts.BatchSize = 64
+		err = db2.Import(&buf, importOpts)
+		assert.Nil(t, err)
+		assert.Equal(t, len(db.ListKeys()), len(db2.ListKeys()))
+		for _, key := range db.ListKeys() {
+			expected, _ := db.Get(key)
+			val, err := db2.Get(key)
+			assert.Nil(t, err)
+			assert.Equal(t, len(expected), len(val))
+			assert.True(t, bytes.Equal(expected, val))
+		}
+		destroyDB(db2)
+	}
+
+	// 按照前缀导出
+	var buf bytes.Buffer
+	exportOpts := DefaultExportOptions
+	exportOpts.Prefix = []byte("prefix-")
+	err = db.Export(&buf, exportOpts)
+	assert.Nil(t, err)
+	opts3 := DefaultOptions
+	dir3, _ := os.MkdirTemp("", "bitcask-go-import-prefix")
+	opts3.DirPath = dir3
+	db3, err := Open(opts3)
+	defer destroyDB(db3)
+	assert.Nil(t, err)
+	err = db3.Import(&buf, DefaultImportOptions)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(db3.ListKeys()))
+	val, err := db3.Get([]byte("prefix-a"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("a"), val)
+}
+
+func TestDB_Import_Corrupted(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-export-corrupted")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(32))
+		assert.Nil(t, err)
+	}
+	var buf bytes.Buffer
+	err = db.Export(&buf, DefaultExportOptions)
+	assert.Nil(t, err)
+	exported := buf.Bytes()
+
+	opts2 := DefaultOptions
+	dir2, _ := os.MkdirTemp("", "bitcask-go-import-corrupted")
+	opts2.DirPath = dir2
+	db2, err := Open(opts2)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+
+	// 数据被修改
+	corrupted := append([]byte(nil), exported...)
+	corrupted[len(corrupted)/2] ^= 0xff
+	err = db2.Import(bytes.NewReader(corrupted), DefaultImportOptions)
+	assert.Equal(t, ErrExportDataCorrupted, err)
+
+	// 数据被截断
+	err = db2.Import(bytes.NewReader(exported[:len(exported)-5]), DefaultImportOptions)
+	assert.Equal(t, ErrExportDataCorrupted, err)
+
+	// 格式不匹配
+	importOpts := DefaultImportOptions
+	importOpts.Format = ExportJSONLines
+	err = db2.Import(bytes.NewReader(exported), importOpts)
+	assert.Equal(t, ErrExportDataCorrupted, err)
+	importOpts.Format = 0
+	err = db2.Import(bytes.NewReader(exported), importOpts)
+	assert.Equal(t, ErrUnsupportedExportFormat, err)
+	assert.Equal(t, 0, len(db2.ListKeys()))
+
+	// JSON Lines 格式在行的边界被截断
+	buf.Reset()
+	exportOpts := DefaultExportOptions
+	exportOpts.Format = ExportJSONLines
+	err = db.Export(&buf, exportOpts)
+	assert.Nil(t, err)
+	lines := bytes.SplitAfter(buf.Bytes(), []byte("\n"))
+	importOpts.Format = ExportJSONLines
+	err = db2.Import(bytes.NewReader(bytes.Join(lines[:len(lines)-2], nil)), importOpts)
+	assert.Equal(t, ErrExportDataCorrupted, err)
+	err = db2.Import(bytes.NewReader(bytes.Join(lines[1:], nil)), importOpts)
+	assert.Equal(t, ErrExportDataCorrupted, err)
+	assert.Equal(t, 0, len(db2.ListKeys()))
+
+	// 批次大小
+	importOpts = DefaultImportOptions
+	importOpts.BatchSize = 0
+	err = db2.Import(bytes.NewReader(exported), importOpts)
+	assert.Equal(t, ErrInvalidBatchSize, err)
+}
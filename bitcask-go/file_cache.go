@@ -0,0 +1,128 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/fio"
+	"container/list"
+	"sync"
+)
+
+// fileCache 旧数据文件的句柄缓存，限制同时打开的文件数量
+// 超过容量之后按照 LRU 的策略关闭最近最少使用的文件，再次读取时重新打开
+// 正在被读取的文件（引用计数大于 0）不会被关闭
+type fileCache struct {
+	mu       *sync.Mutex
+	capacity int                      // 最多同时打开的文件数量
+	ioType   fio.FileIOType           // 重新打开文件时使用的 IO 类型
+	lru      *list.List               // 当前打开的文件，表头为最近使用的
+	entries  map[uint32]*list.Element // 文件 id -> lru 中的节点
+}
+
+type fileCacheEntry struct {
+	file *data.DataFile
+	refs int // 正在使用该文件的读取者数量
+}
+
+func newFileCache(capacity int, ioType fio.FileIOType) *fileCache {
+	return &fileCache{
+		mu:       new(sync.Mutex),
+		capacity: capacity,
+		ioType:   ioType,
+		lru:      list.New(),
+		entries:  make(map[uint32]*list.Element),
+	}
+}
+
+// add 将已经打开的文件交给缓存管理
+func (fc *fileCache) add(file *data.DataFile) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if elem, ok := fc.entries[file.FileId]; ok {
+		fc.lru.MoveToFront(elem)
+		return
+	}
+	fc.entries[file.FileId] = fc.lru.PushFront(&fileCacheEntry{file: file})
+	fc.evict()
+}
+
+// acquire 保证文件处于打开的状态，并增加引用计数，使用完之后必须调用 release
+func (fc *fileCache) acquire(file *data.DataFile) error {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if elem, ok := fc.entries[file.FileId]; ok {
+		elem.Value.(*fileCacheEntry).refs++
+		fc.lru.MoveToFront(elem)
+		return nil
+	}
+
+	// 文件已经被关闭，重新打开
+	if err := file.Reopen(fc.ioType); err != nil {
+		return err
+	}
+	fc.entries[file.FileId] = fc.lru.PushFront(&fileCacheEntry{file: file, refs: 1})
+	fc.evict()
+	return nil
+}
+
+// release 减少文件的引用计数
+func (fc *fileCache) release(file *data.DataFile) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if elem, ok := fc.entries[file.FileId]; ok {
+		elem.Value.(*fileCacheEntry).refs--
+	}
+	fc.evict()
+}
+
+// remove 关闭并移除文件，文件被删除之前调用
+func (fc *fileCache) remove(fileId uint32) error {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	elem, ok := fc.entries[fileId]
+	if !ok {
+		return nil
+	}
+	return fc.closeEntry(elem)
+}
+
+// close 关闭所有打开的文件
+func (fc *fileCache) close() error {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	for elem := fc.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if err := fc.closeEntry(elem); err != nil {
+			return err
+		}
+		elem = next
+	}
+	return nil
+}
+
+// openFiles 返回当前打开的文件数量
+func (fc *fileCache) openFiles() int {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.lru.Len()
+}
+
+// 从最久没有使用的文件开始，关闭没有被引用的文件，直到打开的文件数量不超过容量
+// 如果所有的文件都在使用中，允许暂时超过容量
+func (fc *fileCache) evict() {
+	for elem := fc.lru.Back(); elem != nil && fc.lru.Len() > fc.capacity; {
+		prev := elem.Prev()
+		if elem.Value.(*fileCacheEntry).refs <= 0 {
+			_ = fc.closeEntry(elem)
+		}
+		elem = prev
+	}
+}
+
+func (fc *fileCache) closeEntry(elem *list.Element) error {
+	entry := elem.Value.(*fileCacheEntry)
+	fc.lru.Remove(elem)
+	delete(fc.entries, entry.file.FileId)
+	err := entry.file.Close()
+	entry.file.IoManager = nil
+	return err
+}
@@ -0,0 +1,260 @@
+//go:build faultinject
+
+// 故障注入只在使用 faultinject 构建标签时编译，用于崩溃一致性测试：
+//
+//	go test -tags faultinject ./...
+
+package fio
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+var (
+	ErrInjectedFault = errors.New("injected io fault")
+	ErrInjectedCrash = errors.New("injected crash, file system is unavailable")
+)
+
+// 当前生效的故障注入器，为空表示不注入故障
+var (
+	faultMu       sync.Mutex
+	faultInjector *FaultInjector
+)
+
+// FaultInjector 故障注入器，仅用于崩溃一致性测试
+// 可以模拟写入 N 个字节后失败、短写、崩溃时丢弃未持久化的数据以及损坏指定范围的数据
+type FaultInjector struct {
+	mu         *sync.Mutex
+	failAfter  int64            // 累计写入多少字节后开始失败，小于 0 表示不限制
+	written    int64            // 累计写入的字节数
+	shortWrite bool             // 下一次写入是否只写一半
+	crashed    bool             // 是否已经模拟崩溃
+	synced     map[string]int64 // 每个文件已经持久化的数据长度
+	files      []*faultFile     // 打开过的文件
+}
+
+// NewFaultInjector 初始化故障注入器
+func NewFaultInjector() *FaultInjector {
+	return &FaultInjector{
+		mu:        new(sync.Mutex),
+		failAfter: -1,
+		synced:    make(map[string]int64),
+	}
+}
+
+// EnableFaultInjection 让之后通过 NewIOManager 打开的标准文件 IO 都经过故障注入器
+func EnableFaultInjection(fi *FaultInjector) {
+	faultMu.Lock()
+	defer faultMu.Unlock()
+	faultInjector = fi
+}
+
+// DisableFaultInjection 关闭故障注入
+func DisableFaultInjection() {
+	faultMu.Lock()
+	defer faultMu.Unlock()
+	faultInjector = nil
+}
+
+func activeFaultInjector() *FaultInjector {
+	faultMu.Lock()
+	defer faultMu.Unlock()
+	return faultInjector
+}
+
+// 开启了故障注入时使用经过包装的文件
+func newStandardIOManager(fileName string) (IOManager, error) {
+	if fi := activeFaultInjector(); fi != nil {
+		return fi.open(fileName)
+	}
+	return NewFileIOManager(fileName)
+}
+
+// FailAfter 从现在开始再写入 n 个字节之后，所有的写入都会失败
+func (fi *FaultInjector) FailAfter(n int64) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	fi.failAfter = fi.written + n
+}
+
+// ShortWriteOnce 下一次写入只会写入一半的数据并返回 io.ErrShortWrite
+func (fi *FaultInjector) ShortWriteOnce() {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	fi.shortWrite = true
+}
+
+// Written 返回累计写入的字节数
+func (fi *FaultInjector) Written() int64 {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	return fi.written
+}
+
+// Crash 模拟进程崩溃或者掉电
+// 所有文件中没有 Sync 过的数据都会被丢弃，之后的任何读写操作都会返回 ErrInjectedCrash
+func (fi *FaultInjector) Crash() error {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	if fi.crashed {
+		return nil
+	}
+	fi.crashed = true
+	for _, file := range fi.files {
+		_ = file.fd.Close()
+	}
+	fi.files = nil
+	for name, size := range fi.synced {
+		if err := os.Truncate(name, size); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Corrupt 将文件中 [offset, offset+n) 范围的数据按位取反
+func (fi *FaultInjector) Corrupt(fileName string, offset int64, n int) error {
+	fd, err := os.OpenFile(fileName, os.O_RDWR, DataFilePerm)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	buf := make([]byte, n)
+	read, err := fd.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	for i := 0; i < read; i++ {
+		buf[i] = ^buf[i]
+	}
+	_, err = fd.WriteAt(buf[:read], offset)
+	return err
+}
+
+func (fi *FaultInjector) open(fileName string) (*faultFile, error) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	if fi.crashed {
+		return nil, ErrInjectedCrash
+	}
+
+	fd, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDWR|os.O_APPEND, DataFilePerm)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := fd.Stat()
+	if err != nil {
+		return nil, err
+	}
+	// 打开之前就已经存在于磁盘上的数据视为已经持久化
+	if _, ok := fi.synced[fileName]; !ok {
+		fi.synced[fileName] = stat.Size()
+	}
+	file := &faultFile{fi: fi, fd: fd, name: fileName}
+	fi.files = append(fi.files, file)
+	return file, nil
+}
+
+// faultFile 经过故障注入器包装的文件
+type faultFile struct {
+	fi   *FaultInjector
+	fd   *os.File
+	name string
+}
+
+func (f *faultFile) Read(b []byte, offset int64) (int, error) {
+	f.fi.mu.Lock()
+	crashed := f.fi.crashed
+	f.fi.mu.Unlock()
+	if crashed {
+		return 0, ErrInjectedCrash
+	}
+	return f.fd.ReadAt(b, offset)
+}
+
+func (f *faultFile) Write(b []byte) (int, error) {
+	f.fi.mu.Lock()
+	defer f.fi.mu.Unlock()
+	if f.fi.crashed {
+		return 0, ErrInjectedCrash
+	}
+
+	// 计算本次可以写入多少数据
+	allowed, injected := len(b), error(nil)
+	if f.fi.shortWrite {
+		f.fi.shortWrite = false
+		allowed, injected = len(b)/2, io.ErrShortWrite
+	}
+	if f.fi.failAfter >= 0 && f.fi.written+int64(allowed) > f.fi.failAfter {
+		allowed, injected = int(f.fi.failAfter-f.fi.written), ErrInjectedFault
+		if allowed < 0 {
+			allowed = 0
+		}
+	}
+
+	n, err := f.fd.Write(b[:allowed])
+	f.fi.written += int64(n)
+	if err != nil {
+		return n, err
+	}
+	return n, injected
+}
+
+func (f *faultFile) Sync() error {
+	f.fi.mu.Lock()
+	defer f.fi.mu.Unlock()
+	if f.fi.crashed {
+		return ErrInjectedCrash
+	}
+	if err := f.fd.Sync(); err != nil {
+		return err
+	}
+	stat, err := f.fd.Stat()
+	if err != nil {
+		return err
+	}
+	f.fi.synced[f.name] = stat.Size()
+	return nil
+}
+
+func (f *faultFile) Close() error {
+	f.fi.mu.Lock()
+	defer f.fi.mu.Unlock()
+	if f.fi.crashed {
+		return nil
+	}
+	return f.fd.Close()
+}
+
+func (f *faultFile) Size() (int64, error) {
+	f.fi.mu.Lock()
+	crashed := f.fi.crashed
+	f.fi.mu.Unlock()
+	if crashed {
+		return 0, ErrInjectedCrash
+	}
+	stat, err := f.fd.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	f.fi.mu.Lock()
+	defer f.fi.mu.Unlock()
+	if f.fi.crashed {
+		return ErrInjectedCrash
+	}
+	if err := f.fd.Truncate(size); err != nil {
+		return err
+	}
+	if f.fi.synced[f.name] > size {
+		f.fi.synced[f.name] = size
+	}
+	return nil
+}
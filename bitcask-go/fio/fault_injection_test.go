@@ -0,0 +1,109 @@
+//go:build faultinject
+
+package fio
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFaultInjector_FailAfter(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-fault")
+	defer destroyFile(dir)
+	fi := NewFaultInjector()
+	EnableFaultInjection(fi)
+	defer DisableFaultInjection()
+
+	ioManager, err := NewIOManager(filepath.Join(dir, "a.data"), StandardFIO)
+	assert.Nil(t, err)
+
+	fi.FailAfter(12)
+	n, err := ioManager.Write([]byte("bitcask kv"))
+	assert.Equal(t, 10, n)
+	assert.Nil(t, err)
+
+	// 只能再写入 2 个字节
+	n, err = ioManager.Write([]byte("storage"))
+	assert.Equal(t, 2, n)
+	assert.Equal(t, ErrInjectedFault, err)
+
+	n, err = ioManager.Write([]byte("a"))
+	assert.Equal(t, 0, n)
+	assert.Equal(t, ErrInjectedFault, err)
+}
+
+func TestFaultInjector_ShortWrite(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-fault")
+	defer destroyFile(dir)
+	fi := NewFaultInjector()
+	EnableFaultInjection(fi)
+	defer DisableFaultInjection()
+
+	ioManager, err := NewIOManager(filepath.Join(dir, "a.data"), StandardFIO)
+	assert.Nil(t, err)
+
+	fi.ShortWriteOnce()
+	n, err := ioManager.Write([]byte("bitcask kv"))
+	assert.Equal(t, 5, n)
+	assert.Equal(t, io.ErrShortWrite, err)
+
+	// 只会影响一次写入
+	n, err = ioManager.Write([]byte("storage"))
+	assert.Equal(t, 7, n)
+	assert.Nil(t, err)
+}
+
+func TestFaultInjector_Crash(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-fault")
+	defer destroyFile(dir)
+	fi := NewFaultInjector()
+	EnableFaultInjection(fi)
+	defer DisableFaultInjection()
+
+	path := filepath.Join(dir, "a.data")
+	ioManager, err := NewIOManager(path, StandardFIO)
+	assert.Nil(t, err)
+
+	_, err = ioManager.Write([]byte("synced"))
+	assert.Nil(t, err)
+	err = ioManager.Sync()
+	assert.Nil(t, err)
+	_, err = ioManager.Write([]byte("not-synced"))
+	assert.Nil(t, err)
+
+	err = fi.Crash()
+	assert.Nil(t, err)
+
+	// 崩溃之后无法再进行读写
+	_, err = ioManager.Write([]byte("a"))
+	assert.Equal(t, ErrInjectedCrash, err)
+	_, err = NewIOManager(path, StandardFIO)
+	assert.Equal(t, ErrInjectedCrash, err)
+
+	// 没有持久化的数据被丢弃
+	content, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("synced"), content)
+}
+
+func TestFaultInjector_Corrupt(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-fault")
+	defer destroyFile(dir)
+	fi := NewFaultInjector()
+
+	path := filepath.Join(dir, "a.data")
+	err := os.WriteFile(path, []byte("bitcask"), DataFilePerm)
+	assert.Nil(t, err)
+
+	err = fi.Corrupt(path, 1, 2)
+	assert.Nil(t, err)
+	content, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, byte('b'), content[0])
+	assert.Equal(t, ^byte('i'), content[1])
+	assert.Equal(t, ^byte('t'), content[2])
+	assert.Equal(t, byte('c'), content[3])
+}
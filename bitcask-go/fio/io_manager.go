@@ -10,6 +10,9 @@ const (
 
 	// MemoryMap 内存文件映射
 	MemoryMap
+
+	// ReadOnlyFIO 只读的标准文件IO，不会创建文件
+	ReadOnlyFIO
 )
 
 // IOManager 抽象 IO 管理接口 可以接入不同的 IO 类型 目前支持标准文件 IO
@@ -28,15 +31,20 @@ type IOManager interface {
 
 	// Size 获取到文件大小
 	Size() (int64, error)
+
+	// Truncate 将文件截断到指定的大小
+	Truncate(size int64) error
 }
 
 // NewIOManager 初始化 IOManager，目前只支持标准 FileIO
 func NewIOManager(filename string, ioType FileIOType) (IOManager, error) {
 	switch ioType {
 	case StandardFIO:
-		return NewFileIOManager(filename)
+		return newStandardIOManager(filename)
 	case MemoryMap:
 		return NewMMapIOManager(filename)
+	case ReadOnlyFIO:
+		return NewReadOnlyFileIOManager(filename)
 	default:
 		panic("unsupported io type")
 	}
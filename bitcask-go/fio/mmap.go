@@ -42,3 +42,7 @@ func (mmap *MMap) Close() error {
 func (mmap *MMap) Size() (int64, error) {
 	return int64(mmap.readerAt.Len()), nil
 }
+
+func (mmap *MMap) Truncate(size int64) error {
+	panic("not implemented")
+}
@@ -0,0 +1,118 @@
+package fio
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter 基于令牌桶的 IO 限速器，令牌的单位是字节
+type RateLimiter struct {
+	mu        *sync.Mutex
+	rate      int64         // 每秒可以读写的字节数，小于等于 0 表示不限速
+	tokens    float64       // 当前桶中的令牌数，可以为负数，表示已经透支
+	last      time.Time     // 上一次补充令牌的时间
+	throttled time.Duration // 累计被限速等待的时间
+}
+
+// NewRateLimiter 初始化限速器，rate 为每秒可以读写的字节数
+func NewRateLimiter(rate int64) *RateLimiter {
+	return &RateLimiter{
+		mu:     new(sync.Mutex),
+		rate:   rate,
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// SetRate 运行时调整限速的大小
+func (rl *RateLimiter) SetRate(rate int64) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.refill()
+	// 从不限速切换为限速时，令牌桶是满的
+	if rl.rate <= 0 {
+		rl.tokens = float64(rate)
+	}
+	rl.rate = rate
+	if rl.tokens > float64(rate) {
+		rl.tokens = float64(rate)
+	}
+}
+
+// Rate 返回当前的限速大小
+func (rl *RateLimiter) Rate() int64 {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.rate
+}
+
+// ThrottledTime 返回累计被限速等待的时间
+func (rl *RateLimiter) ThrottledTime() time.Duration {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.throttled
+}
+
+// Wait 获取 n 个字节的令牌，令牌不足则阻塞等待
+// 令牌在等待之前就被预留，并发的调用方依次排在前一个之后，每次等待的时间只累计一次
+func (rl *RateLimiter) Wait(n int) {
+	rl.mu.Lock()
+	if rl.rate <= 0 {
+		rl.mu.Unlock()
+		return
+	}
+	rl.refill()
+	rl.tokens -= float64(n)
+	var wait time.Duration
+	if rl.tokens < 0 {
+		wait = time.Duration(-rl.tokens / float64(rl.rate) * float64(time.Second))
+		rl.throttled += wait
+	}
+	rl.mu.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// 根据流逝的时间补充令牌，桶的容量为一秒钟的流量
+func (rl *RateLimiter) refill() {
+	now := time.Now()
+	if rl.rate > 0 {
+		rl.tokens += now.Sub(rl.last).Seconds() * float64(rl.rate)
+		if rl.tokens > float64(rl.rate) {
+			rl.tokens = float64(rl.rate)
+		}
+	}
+	rl.last = now
+}
+
+// RateLimitedIO 经过限速的 IO 管理器
+type RateLimitedIO struct {
+	IOManager
+	readLimiter  *RateLimiter
+	writeLimiter *RateLimiter
+}
+
+// NewRateLimitedIOManager 对 IO 管理器的读写进行限速，限速器为空表示不限速
+func NewRateLimitedIOManager(ioManager IOManager, readLimiter, writeLimiter *RateLimiter) *RateLimitedIO {
+	return &RateLimitedIO{
+		IOManager:    ioManager,
+		readLimiter:  readLimiter,
+		writeLimiter: writeLimiter,
+	}
+}
+
+func (rio *RateLimitedIO) Read(b []byte, offset int64) (int, error) {
+	if rio.readLimiter != nil {
+		rio.readLimiter.Wait(len(b))
+	}
+	return rio.IOManager.Read(b, offset)
+}
+
+func (rio *RateLimitedIO) Write(b []byte) (int, error) {
+	if rio.writeLimiter != nil {
+		rio.writeLimiter.Wait(len(b))
+	}
+	return rio.IOManager.Write(b)
+}
@@ -0,0 +1,93 @@
+package fio
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter_Wait(t *testing.T) {
+	rl := NewRateLimiter(100 * 1024)
+
+	// 令牌桶初始是满的，不需要等待
+	now := time.Now()
+	rl.Wait(100 * 1024)
+	assert.True(t, time.Since(now) < 50*time.Millisecond)
+	assert.Equal(t, time.Duration(0), rl.ThrottledTime())
+
+	// 令牌用完之后需要等待
+	now = time.Now()
+	rl.Wait(20 * 1024)
+	assert.True(t, time.Since(now) >= 150*time.Millisecond)
+	assert.True(t, rl.ThrottledTime() >= 150*time.Millisecond)
+}
+
+func TestRateLimiter_SetRate(t *testing.T) {
+	rl := NewRateLimiter(0)
+	assert.Equal(t, int64(0), rl.Rate())
+
+	// 不限速
+	now := time.Now()
+	rl.Wait(100 * 1024 * 1024)
+	assert.True(t, time.Since(now) < 50*time.Millisecond)
+
+	rl.SetRate(10 * 1024)
+	assert.Equal(t, int64(10*1024), rl.Rate())
+	rl.Wait(10 * 1024)
+	now = time.Now()
+	rl.Wait(2 * 1024)
+	assert.True(t, time.Since(now) >= 150*time.Millisecond)
+}
+
+// 并发等待的调用方各自预留令牌，依次被唤醒
+func TestRateLimiter_Reserve(t *testing.T) {
+	rl := NewRateLimiter(10 * 1024)
+	rl.Wait(10 * 1024)
+
+	now := time.Now()
+	var wg sync.WaitGroup
+	waits := make([]time.Duration, 4)
+	for i := range waits {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rl.Wait(1024)
+			waits[i] = time.Since(now)
+		}(i)
+	}
+	wg.Wait()
+
+	// 4 KB 的令牌需要 400ms 才能补充完，最后一个调用方等待的时间不会少于这个值
+	slices.Sort(waits)
+	assert.True(t, waits[3] >= 350*time.Millisecond, "waits: %v", waits)
+	assert.True(t, waits[0] < 200*time.Millisecond, "waits: %v", waits)
+	// 累计的时间是每个调用方各自等待的时间之和，不会重复计算同一段透支
+	assert.True(t, rl.ThrottledTime() < 1200*time.Millisecond, "throttled: %v", rl.ThrottledTime())
+}
+
+func TestRateLimitedIO(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "bitcask-go-rate-limit.data")
+	defer destroyFile(path)
+	fio, err := NewFileIOManager(path)
+	assert.Nil(t, err)
+
+	writeLimiter := NewRateLimiter(1024)
+	rio := NewRateLimitedIOManager(fio, nil, writeLimiter)
+	n, err := rio.Write(make([]byte, 1024))
+	assert.Equal(t, 1024, n)
+	assert.Nil(t, err)
+	n, err = rio.Write(make([]byte, 256))
+	assert.Equal(t, 256, n)
+	assert.Nil(t, err)
+	assert.True(t, writeLimiter.ThrottledTime() > 0)
+
+	// 读取没有限速
+	b := make([]byte, 1280)
+	n, err = rio.Read(b, 0)
+	assert.Equal(t, 1280, n)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,7 @@
+//go:build !faultinject
+
+package fio
+
+func newStandardIOManager(fileName string) (IOManager, error) {
+	return NewFileIOManager(fileName)
+}
@@ -3,150 +3,414 @@ package index
 import (
 	"bitcask-go/data"
 	"bytes"
-	goart "github.com/plar/go-adaptive-radix-tree"
-	"sort"
 	"sync"
+	"sync/atomic"
+	"unsafe"
 )
 
-// 自适应基数树索引
-// 封装了 https://github.com/plar/go-adaptive-radix-tree 库
-
+// AdaptiveRadixTree 自适应基数树索引
+// 树的节点是不可变的，写入时复制从根节点到目标节点的路径，然后原子地替换根节点
+// 读取和遍历直接使用当前的根节点，不需要加锁，也不会被写入阻塞；写入之间通过互斥锁串行化
+// 写入需要复制路径上的节点，比原地修改的实现慢，适合读多写少的场景
 type AdaptiveRadixTree struct {
-	tree goart.Tree
-	lock *sync.RWMutex
+	root     *atomic.Pointer[artNode]
+	size     *atomic.Int64
+	keyBytes *atomic.Int64 // 所有 key 的总长度
+	lock     *sync.Mutex   // 写入的互斥锁
+}
+
+// 每条数据除了 key 之外大致占用的内存：叶子节点、Item、位置信息以及父节点中的指针，不包括只有子节点的中间节点
+const artItemOverhead = int64(unsafe.Sizeof(artNode{})+unsafe.Sizeof(Item{})+unsafe.Sizeof(data.LogRecordPos{})) + 8
+
+const (
+	// small 节点最多的子节点数量，超过之后转换为 full 节点
+	artSmallNodeMax = 48
+	// full 节点的子节点数量少于这个值之后转换回 small 节点，留出余量避免反复转换
+	artFullNodeMin = 40
+)
+
+// 树的节点，节点发布之后不会再被修改
+type artNode struct {
+	prefix   []byte     // 压缩的路径，从父节点到当前节点经过的字节
+	leaf     *Item      // key 恰好在当前节点结束时的数据
+	keys     []byte     // small 节点中子节点对应的字节，从小到大排列
+	children []*artNode // small 节点中和 keys 一一对应；full 节点中长度为 256，以字节为下标
+	count    int        // 子节点的数量
+	full     bool       // 是否是 full 节点
 }
 
 // NewART 初始化自适应基数树索引
 func NewART() *AdaptiveRadixTree {
 	return &AdaptiveRadixTree{
-		tree: goart.New(),
-		lock: new(sync.RWMutex),
+		root:     new(atomic.Pointer[artNode]),
+		size:     new(atomic.Int64),
+		keyBytes: new(atomic.Int64),
+		lock:     new(sync.Mutex),
 	}
 }
 
-func (art AdaptiveRadixTree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
+func (art *AdaptiveRadixTree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
+	// key 会被节点的路径引用，需要复制一份
+	item := &Item{key: append([]byte{}, key...), pos: pos}
+
 	art.lock.Lock()
-	oldValue, ok := art.tree.Insert(key, pos)
-	art.lock.Unlock()
-	if !ok {
+	defer art.lock.Unlock()
+	root, oldItem := artInsert(art.root.Load(), item, 0)
+	art.root.Store(root)
+	if oldItem == nil {
+		art.size.Add(1)
+		art.keyBytes.Add(int64(len(key)))
 		return nil
 	}
-	return oldValue.(*data.LogRecordPos)
+	return oldItem.pos
 }
 
-func (art AdaptiveRadixTree) Get(key []byte) *data.LogRecordPos {
-	art.lock.RLock()
-	defer art.lock.RUnlock()
-
-	val, found := art.tree.Search(key)
-	if !found {
-		return nil
+// Get 不需要加锁，读取的是调用时的根节点
+func (art *AdaptiveRadixTree) Get(key []byte) *data.LogRecordPos {
+	n := art.root.Load()
+	depth := 0
+	for n != nil {
+		if !bytes.HasPrefix(key[depth:], n.prefix) {
+			return nil
+		}
+		depth += len(n.prefix)
+		if depth == len(key) {
+			if n.leaf == nil {
+				return nil
+			}
+			return n.leaf.pos
+		}
+		n = n.child(key[depth])
+		depth++
 	}
-	return val.(*data.LogRecordPos)
+	return nil
 }
 
-func (art AdaptiveRadixTree) Delete(key []byte) (*data.LogRecordPos, bool) {
+func (art *AdaptiveRadixTree) Delete(key []byte) (*data.LogRecordPos, bool) {
 	art.lock.Lock()
-	oldValue, deleted := art.tree.Delete(key)
-	art.lock.Unlock()
-	if !deleted {
+	defer art.lock.Unlock()
+	root, oldItem := artRemove(art.root.Load(), key, 0)
+	if oldItem == nil {
 		return nil, false
 	}
-	return oldValue.(*data.LogRecordPos), true
+	art.root.Store(root)
+	art.size.Add(-1)
+	art.keyBytes.Add(-int64(len(key)))
+	return oldItem.pos, true
+}
+
+func (art *AdaptiveRadixTree) Size() int {
+	return int(art.size.Load())
+}
+
+func (art *AdaptiveRadixTree) Iterator(reverse bool) Iterator {
+	return art.IteratorWithOptions(IteratorOptions{Reverse: reverse})
 }
 
-func (art AdaptiveRadixTree) Size() int {
-	art.lock.RLock()
-	size := art.tree.Size()
-	art.lock.RUnlock()
-	return size
+// IteratorWithOptions 遍历创建时的根节点，之后的写入不会影响遍历的结果
+func (art *AdaptiveRadixTree) IteratorWithOptions(opts IteratorOptions) Iterator {
+	return withLimit(newSnapshotIterator(artSnapshot{root: art.root.Load()}, opts), opts.Limit)
 }
 
-func (art AdaptiveRadixTree) Iterator(reverse bool) Iterator {
-	art.lock.RLock()
-	defer art.lock.RUnlock()
-	return newARTIterator(art.tree, reverse)
+func (art *AdaptiveRadixTree) Capabilities() Capabilities {
+	return Capabilities{Ordered: true, Snapshot: true}
 }
 
-func (art AdaptiveRadixTree) Close() error {
+func (art *AdaptiveRadixTree) MemoryUsage() int64 {
+	return art.size.Load()*artItemOverhead + art.keyBytes.Load()
+}
+
+func (art *AdaptiveRadixTree) Close() error {
 	return nil
 }
 
-// Art 索引迭代器
-type artIterator struct {
-	currIndex int     // 当前遍历位置
-	reverse   bool    // 是否是反向遍历
-	values    []*Item // key+位置索引信息
+// 向以 n 为根的子树中写入数据，返回新的子树的根节点和被覆盖的数据
+// depth 为 n 的路径在 key 中开始的位置
+func artInsert(n *artNode, item *Item, depth int) (*artNode, *Item) {
+	key := item.key
+	if n == nil {
+		return &artNode{prefix: key[depth:], leaf: item}, nil
+	}
+
+	p := commonPrefixLen(key[depth:], n.prefix)
+	if p < len(n.prefix) {
+		// 路径在中间分叉，拆分出一个新的父节点，原来的节点只有路径变短了，子节点可以共享
+		child := *n
+		child.prefix = n.prefix[p+1:]
+		parent := &artNode{prefix: n.prefix[:p]}
+		parent.setChild(n.prefix[p], &child)
+		if depth+p == len(key) {
+			parent.leaf = item
+		} else {
+			parent.setChild(key[depth+p], &artNode{prefix: key[depth+p+1:], leaf: item})
+		}
+		return parent, nil
+	}
+
+	depth += len(n.prefix)
+	newNode := n.clone()
+	if depth == len(key) {
+		newNode.leaf = item
+		return newNode, n.leaf
+	}
+	child, oldItem := artInsert(n.child(key[depth]), item, depth+1)
+	newNode.setChild(key[depth], child)
+	return newNode, oldItem
 }
 
-func newARTIterator(tree goart.Tree, reverse bool) *artIterator {
-	var idx int
-	if reverse {
-		idx = tree.Size() - 1
+// 从以 n 为根的子树中删除数据，返回新的子树的根节点和被删除的数据，数据不存在时返回原来的节点
+func artRemove(n *artNode, key []byte, depth int) (*artNode, *Item) {
+	if n == nil || !bytes.HasPrefix(key[depth:], n.prefix) {
+		return n, nil
 	}
-	values := make([]*Item, tree.Size())
-	saveValues := func(node goart.Node) bool {
-		item := &Item{
-			key: node.Key(),
-			pos: node.Value().(*data.LogRecordPos),
+
+	depth += len(n.prefix)
+	if depth == len(key) {
+		if n.leaf == nil {
+			return n, nil
 		}
-		values[idx] = item
-		if reverse {
-			idx--
-		} else {
-			idx++
+		newNode := n.clone()
+		newNode.leaf = nil
+		return newNode.compact(), n.leaf
+	}
+
+	child, oldItem := artRemove(n.child(key[depth]), key, depth+1)
+	if oldItem == nil {
+		return n, nil
+	}
+	newNode := n.clone()
+	newNode.setChild(key[depth], child)
+	return newNode.compact(), oldItem
+}
+
+// 复制节点，子节点的数组也会被复制，复制出来的节点在发布之前可以修改
+func (n *artNode) clone() *artNode {
+	c := *n
+	c.keys = append([]byte(nil), n.keys...)
+	c.children = append([]*artNode(nil), n.children...)
+	return &c
+}
+
+func (n *artNode) child(b byte) *artNode {
+	if n.full {
+		return n.children[b]
+	}
+	if i := bytes.IndexByte(n.keys, b); i >= 0 {
+		return n.children[i]
+	}
+	return nil
+}
+
+// 设置字节 b 对应的子节点，child 为空表示删除，只能在发布之前的节点上调用
+func (n *artNode) setChild(b byte, child *artNode) {
+	if n.full {
+		if n.children[b] == nil && child != nil {
+			n.count++
+		} else if n.children[b] != nil && child == nil {
+			n.count--
 		}
-		return true
+		n.children[b] = child
+		if n.count < artFullNodeMin {
+			n.shrink()
+		}
+		return
 	}
 
-	tree.ForEach(saveValues)
+	i := 0
+	for i < len(n.keys) && n.keys[i] < b {
+		i++
+	}
+	exists := i < len(n.keys) && n.keys[i] == b
+	switch {
+	case exists && child != nil:
+		n.children[i] = child
+	case exists:
+		n.keys = append(n.keys[:i], n.keys[i+1:]...)
+		n.children = append(n.children[:i], n.children[i+1:]...)
+		n.count--
+	case child != nil:
+		n.keys = append(n.keys, 0)
+		copy(n.keys[i+1:], n.keys[i:])
+		n.keys[i] = b
+		n.children = append(n.children, nil)
+		copy(n.children[i+1:], n.children[i:])
+		n.children[i] = child
+		n.count++
+		if n.count > artSmallNodeMax {
+			n.grow()
+		}
+	}
+}
 
-	return &artIterator{
-		currIndex: 0,
-		reverse:   reverse,
-		values:    values,
+// small 节点转换为 full 节点
+func (n *artNode) grow() {
+	children := make([]*artNode, 256)
+	for i, b := range n.keys {
+		children[b] = n.children[i]
 	}
+	n.keys, n.children, n.full = nil, children, true
 }
 
-// Rewind 重新回到迭代器的起点，即第一个数据
-func (ai *artIterator) Rewind() {
-	ai.currIndex = 0
+// full 节点转换为 small 节点
+func (n *artNode) shrink() {
+	keys := make([]byte, 0, n.count)
+	children := make([]*artNode, 0, n.count)
+	for b, child := range n.children {
+		if child != nil {
+			keys = append(keys, byte(b))
+			children = append(children, child)
+		}
+	}
+	n.keys, n.children, n.full = keys, children, false
 }
 
-// Seek 根据传入的 key 查找第一个大于(或小于)等于的目标key，从这个key开始遍历
-func (ai *artIterator) Seek(key []byte) {
-	if ai.reverse {
-		ai.currIndex = sort.Search(len(ai.values), func(i int) bool {
-			return bytes.Compare(ai.values[i].key, key) <= 0
-		})
-	} else {
-		ai.currIndex = sort.Search(len(ai.values), func(i int) bool {
-			return bytes.Compare(ai.values[i].key, key) >= 0
-		})
+// 删除之后整理节点：没有数据的节点被删除，只有一个子节点的节点和子节点合并
+func (n *artNode) compact() *artNode {
+	if n.leaf != nil || n.count > 1 {
+		return n
+	}
+	if n.count == 0 {
+		return nil
 	}
+	var b byte
+	var child *artNode
+	n.forEachChild(false, func(cb byte, c *artNode) bool {
+		b, child = cb, c
+		return false
+	})
+	merged := *child
+	merged.prefix = make([]byte, 0, len(n.prefix)+1+len(child.prefix))
+	merged.prefix = append(merged.prefix, n.prefix...)
+	merged.prefix = append(merged.prefix, b)
+	merged.prefix = append(merged.prefix, child.prefix...)
+	return &merged
 }
 
-// Next 跳转到下一个key
-func (ai *artIterator) Next() {
-	ai.currIndex += 1
+// 按照字节的顺序遍历子节点，fn 返回 false 时停止
+func (n *artNode) forEachChild(reverse bool, fn func(b byte, child *artNode) bool) bool {
+	if n.full {
+		for i := 0; i < 256; i++ {
+			b := i
+			if reverse {
+				b = 255 - i
+			}
+			if child := n.children[b]; child != nil && !fn(byte(b), child) {
+				return false
+			}
+		}
+		return true
+	}
+	for i := range n.keys {
+		j := i
+		if reverse {
+			j = len(n.keys) - 1 - i
+		}
+		if !fn(n.keys[j], n.children[j]) {
+			return false
+		}
+	}
+	return true
 }
 
-// Valid 当前遍历的位置的
-func (ai *artIterator) Valid() bool {
-	return ai.currIndex < len(ai.values)
+func commonPrefixLen(a, b []byte) int {
+	n := min(len(a), len(b))
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
 }
 
-// Key 当前遍历位置的 Key 数据
-func (ai *artIterator) Key() []byte {
-	return ai.values[ai.currIndex].key
+// ART 在某个时刻的快照，即当时的根节点
+type artSnapshot struct {
+	root *artNode
 }
 
-// Value 当前遍历位置的 Value 数据
-func (ai *artIterator) Value() *data.LogRecordPos {
-	return ai.values[ai.currIndex].pos
+func (s artSnapshot) ascend(pivot []byte, fn func(item *Item) bool) {
+	if s.root != nil {
+		artAscend(s.root, pivot, 0, pivot != nil, fn)
+	}
 }
 
-// Close 关闭迭代器，释放相应资源
-func (ai *artIterator) Close() {
-	ai.values = nil
+func (s artSnapshot) descend(pivot []byte, fn func(item *Item) bool) {
+	if s.root != nil {
+		artDescend(s.root, pivot, 0, pivot != nil, fn)
+	}
+}
+
+// 正向遍历子树中大于等于 pivot 的数据，bounded 为 false 表示子树中所有的数据都满足条件
+// 返回 false 表示 fn 要求停止遍历
+func artAscend(n *artNode, pivot []byte, depth int, bounded bool, fn func(item *Item) bool) bool {
+	if bounded {
+		rest := pivot[depth:]
+		m := min(len(n.prefix), len(rest))
+		switch cmp := bytes.Compare(n.prefix[:m], rest[:m]); {
+		case cmp < 0:
+			// 子树中的数据都小于 pivot
+			return true
+		case cmp > 0 || len(rest) <= len(n.prefix):
+			// 子树中的数据都大于等于 pivot
+			bounded = false
+		}
+	}
+	if !bounded {
+		if n.leaf != nil && !fn(n.leaf) {
+			return false
+		}
+		return n.forEachChild(false, func(_ byte, child *artNode) bool {
+			return artAscend(child, nil, 0, false, fn)
+		})
+	}
+
+	// 当前节点的路径是 pivot 的前缀，当前节点的数据小于 pivot
+	depth += len(n.prefix)
+	next := pivot[depth]
+	return n.forEachChild(false, func(b byte, child *artNode) bool {
+		if b < next {
+			return true
+		}
+		return artAscend(child, pivot, depth+1, b == next, fn)
+	})
+}
+
+// 反向遍历子树中小于等于 pivot 的数据，bounded 为 false 表示子树中所有的数据都满足条件
+// 返回 false 表示 fn 要求停止遍历
+func artDescend(n *artNode, pivot []byte, depth int, bounded bool, fn func(item *Item) bool) bool {
+	if bounded {
+		rest := pivot[depth:]
+		m := min(len(n.prefix), len(rest))
+		switch cmp := bytes.Compare(n.prefix[:m], rest[:m]); {
+		case cmp > 0 || (cmp == 0 && len(rest) < len(n.prefix)):
+			// 子树中的数据都大于 pivot
+			return true
+		case cmp < 0:
+			// 子树中的数据都小于 pivot
+			bounded = false
+		}
+	}
+	if !bounded {
+		if !n.forEachChild(true, func(_ byte, child *artNode) bool {
+			return artDescend(child, nil, 0, false, fn)
+		}) {
+			return false
+		}
+		return n.leaf == nil || fn(n.leaf)
+	}
+
+	depth += len(n.prefix)
+	if depth == len(pivot) {
+		// 只有当前节点的数据等于 pivot，子节点中的数据都大于 pivot
+		return n.leaf == nil || fn(n.leaf)
+	}
+	next := pivot[depth]
+	if !n.forEachChild(true, func(b byte, child *artNode) bool {
+		if b > next {
+			return true
+		}
+		return artDescend(child, pivot, depth+1, b == next, fn)
+	}) {
+		return false
+	}
+	return n.leaf == nil || fn(n.leaf)
 }
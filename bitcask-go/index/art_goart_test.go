@@ -0,0 +1,122 @@
+package index
+
+import (
+	"bitcask-go/data"
+	goart "github.com/plar/go-adaptive-radix-tree"
+	"sync"
+)
+
+// 封装了 https://github.com/plar/go-adaptive-radix-tree 库的索引，整棵树使用一把读写锁
+// 作为 AdaptiveRadixTree 的对照，用于测试结果的正确性和性能对比
+type goartIndex struct {
+	tree goart.Tree
+	lock *sync.RWMutex
+}
+
+// newGoartIndex 初始化对照的索引
+func newGoartIndex() *goartIndex {
+	return &goartIndex{
+		tree: goart.New(),
+		lock: new(sync.RWMutex),
+	}
+}
+
+func (art *goartIndex) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
+	art.lock.Lock()
+	oldValue, ok := art.tree.Insert(key, pos)
+	art.lock.Unlock()
+	if !ok {
+		return nil
+	}
+	return oldValue.(*data.LogRecordPos)
+}
+
+func (art *goartIndex) Get(key []byte) *data.LogRecordPos {
+	art.lock.RLock()
+	defer art.lock.RUnlock()
+
+	val, found := art.tree.Search(key)
+	if !found {
+		return nil
+	}
+	return val.(*data.LogRecordPos)
+}
+
+func (art *goartIndex) Delete(key []byte) (*data.LogRecordPos, bool) {
+	art.lock.Lock()
+	oldValue, deleted := art.tree.Delete(key)
+	art.lock.Unlock()
+	if !deleted {
+		return nil, false
+	}
+	return oldValue.(*data.LogRecordPos), true
+}
+
+func (art *goartIndex) Size() int {
+	art.lock.RLock()
+	size := art.tree.Size()
+	art.lock.RUnlock()
+	return size
+}
+
+func (art *goartIndex) Iterator(reverse bool) Iterator {
+	return art.IteratorWithOptions(IteratorOptions{Reverse: reverse})
+}
+
+// IteratorWithOptions 在创建时复制遍历范围内的数据，指定了前缀时只遍历前缀对应的子树
+func (art *goartIndex) IteratorWithOptions(opts IteratorOptions) Iterator {
+	art.lock.RLock()
+	defer art.lock.RUnlock()
+	return withLimit(newGoartIterator(art.tree, opts), opts.Limit)
+}
+
+func (art *goartIndex) Capabilities() Capabilities {
+	return Capabilities{Ordered: true, Snapshot: true}
+}
+
+func (art *goartIndex) MemoryUsage() int64 {
+	return 0
+}
+
+func (art *goartIndex) Close() error {
+	return nil
+}
+
+// 复制遍历范围内的所有数据，ART 按照 key 的顺序遍历
+func newGoartIterator(tree goart.Tree, opts IteratorOptions) *sliceIterator {
+	rng := newKeyRange(opts)
+	var values []*Item
+	saveValues := func(node goart.Node) bool {
+		// 按前缀遍历时也会回调内部节点
+		if node.Kind() != goart.Leaf {
+			return true
+		}
+		key := node.Key()
+		if !rng.belowUpper(key) {
+			return false
+		}
+		if rng.aboveLower(key) {
+			values = append(values, &Item{
+				key: key,
+				pos: node.Value().(*data.LogRecordPos),
+			})
+		}
+		return true
+	}
+	if len(opts.Prefix) > 0 {
+		// 只遍历前缀对应的子树
+		tree.ForEachPrefix(opts.Prefix, saveValues)
+	} else {
+		tree.ForEach(saveValues)
+	}
+
+	if opts.Reverse {
+		for i, j := 0, len(values)-1; i < j; i, j = i+1, j-1 {
+			values[i], values[j] = values[j], values[i]
+		}
+	}
+	return &sliceIterator{
+		reverse: opts.Reverse,
+		values:  values,
+	}
+}
@@ -2,8 +2,13 @@ package index
 
 import (
 	"bitcask-go/data"
+	"bytes"
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestAdaptiveRadixTree_Put(t *testing.T) {
@@ -78,3 +83,221 @@ func TestAdaptiveRadixTree_Iterator(t *testing.T) {
 		assert.NotNil(t, iter.Value())
 	}
 }
+
+// 随机写入和删除，和 go-adaptive-radix-tree 的结果对比
+func TestAdaptiveRadixTree_CompareWithGoart(t *testing.T) {
+	art := NewART()
+	ref := newGoartIndex()
+	rnd := rand.New(rand.NewSource(1))
+
+	// 短 key 和相同的前缀让节点频繁地拆分、合并，单字节的 key 让节点的子节点数量超过 small 节点的上限
+	randomKey := func() []byte {
+		key := make([]byte, rnd.Intn(4))
+		for i := range key {
+			key[i] = byte(rnd.Intn(256))
+			if rnd.Intn(2) == 0 {
+				key[i] = byte('a' + rnd.Intn(3))
+			}
+		}
+		return key
+	}
+
+	for i := 0; i < 20000; i++ {
+		key := randomKey()
+		if len(key) == 0 {
+			// go-adaptive-radix-tree 不支持空的 key
+			continue
+		}
+		if rnd.Intn(3) == 0 {
+			pos1, ok1 := art.Delete(key)
+			pos2, ok2 := ref.Delete(key)
+			assert.Equal(t, ok2, ok1)
+			assert.Equal(t, pos2, pos1)
+		} else {
+			pos := &data.LogRecordPos{Fid: uint32(i), Offset: int64(i)}
+			assert.Equal(t, ref.Put(key, pos), art.Put(key, pos))
+		}
+		assert.Equal(t, ref.Get(key), art.Get(key))
+		assert.Equal(t, ref.Size(), art.Size())
+
+		if i%1000 == 0 {
+			for _, reverse := range []bool{false, true} {
+				iter1, iter2 := art.Iterator(reverse), ref.Iterator(reverse)
+				iter1.Rewind()
+				for iter2.Rewind(); iter2.Valid(); iter2.Next() {
+					assert.True(t, iter1.Valid())
+					assert.Equal(t, iter2.Key(), iter1.Key())
+					assert.Equal(t, iter2.Value(), iter1.Value())
+					iter1.Next()
+				}
+				assert.False(t, iter1.Valid())
+
+				seek := randomKey()
+				iter1.Seek(seek)
+				iter2.Seek(seek)
+				assert.Equal(t, iter2.Valid(), iter1.Valid())
+				if iter2.Valid() {
+					assert.Equal(t, iter2.Key(), iter1.Key())
+				}
+				iter1.Close()
+				iter2.Close()
+			}
+		}
+	}
+}
+
+// 并发读写，读取不会看到写了一半的数据，迭代器遍历的是创建时的快照
+func TestAdaptiveRadixTree_Concurrent(t *testing.T) {
+	art := NewART()
+	const keyNum = 2000
+	for i := 0; i < keyNum; i++ {
+		art.Put([]byte(fmt.Sprintf("key-%05d", i)), &data.LogRecordPos{Fid: 0, Offset: int64(i)})
+	}
+
+	stop := make(chan struct{})
+	wg := new(sync.WaitGroup)
+	// 写入者不断提高每个 key 的 Fid，删除并重新写入奇数的 key
+	for w := 0; w < 2; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for round := uint32(1); round <= 20; round++ {
+				for i := w; i < keyNum; i += 2 {
+					key := []byte(fmt.Sprintf("key-%05d", i))
+					if i%2 == 1 {
+						art.Delete(key)
+					}
+					art.Put(key, &data.LogRecordPos{Fid: round, Offset: int64(i)})
+				}
+			}
+		}(w)
+	}
+
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lastFid := make([]uint32, keyNum)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				// 偶数的 key 一直存在，并且 Fid 不会变小
+				for i := 0; i < keyNum; i += 2 {
+					pos := art.Get([]byte(fmt.Sprintf("key-%05d", i)))
+					if !assert.NotNil(t, pos) {
+						return
+					}
+					assert.Equal(t, int64(i), pos.Offset)
+					assert.GreaterOrEqual(t, pos.Fid, lastFid[i])
+					lastFid[i] = pos.Fid
+				}
+
+				// 快照中的 key 有序，偶数的 key 都存在
+				iter := art.Iterator(false)
+				var prev []byte
+				var even int
+				for iter.Rewind(); iter.Valid(); iter.Next() {
+					assert.True(t, bytes.Compare(prev, iter.Key()) < 0)
+					prev = iter.Key()
+					if iter.Value().Offset%2 == 0 {
+						even++
+					}
+				}
+				iter.Close()
+				assert.Equal(t, keyNum/2, even)
+			}
+		}()
+	}
+
+	// 等待写入者结束之后停止读取
+	done := make(chan struct{})
+	go func() {
+		for art.Get([]byte(fmt.Sprintf("key-%05d", keyNum-1))).Fid < 20 || art.Get([]byte(fmt.Sprintf("key-%05d", keyNum-2))).Fid < 20 {
+			time.Sleep(time.Millisecond)
+		}
+		close(done)
+	}()
+	<-done
+	close(stop)
+	wg.Wait()
+	assert.Equal(t, keyNum, art.Size())
+}
+
+func benchmarkIndexGet(b *testing.B, indexer Indexer) {
+	for i := 0; i < 100000; i++ {
+		indexer.Put([]byte(fmt.Sprintf("bitcask-key-%09d", i)), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			indexer.Get([]byte(fmt.Sprintf("bitcask-key-%09d", i%100000)))
+			i++
+		}
+	})
+}
+
+// 一个写入者和多个读取者并发，统计读取的性能
+func benchmarkIndexGetWithWriter(b *testing.B, indexer Indexer) {
+	for i := 0; i < 100000; i++ {
+		indexer.Put([]byte(fmt.Sprintf("bitcask-key-%09d", i)), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			indexer.Put([]byte(fmt.Sprintf("bitcask-key-%09d", i%100000)), &data.LogRecordPos{Fid: 2, Offset: int64(i)})
+		}
+	}()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			indexer.Get([]byte(fmt.Sprintf("bitcask-key-%09d", i%100000)))
+			i++
+		}
+	})
+	b.StopTimer()
+	close(stop)
+	<-done
+}
+
+func benchmarkIndexPut(b *testing.B, indexer Indexer) {
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		indexer.Put([]byte(fmt.Sprintf("bitcask-key-%09d", i)), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+}
+
+func BenchmarkAdaptiveRadixTree_Get(b *testing.B) {
+	benchmarkIndexGet(b, NewART())
+}
+
+func BenchmarkGoart_Get(b *testing.B) {
+	benchmarkIndexGet(b, newGoartIndex())
+}
+
+func BenchmarkAdaptiveRadixTree_GetWithWriter(b *testing.B) {
+	benchmarkIndexGetWithWriter(b, NewART())
+}
+
+func BenchmarkGoart_GetWithWriter(b *testing.B) {
+	benchmarkIndexGetWithWriter(b, newGoartIndex())
+}
+
+func BenchmarkAdaptiveRadixTree_Put(b *testing.B) {
+	benchmarkIndexPut(b, NewART())
+}
+
+func BenchmarkGoart_Put(b *testing.B) {
+	benchmarkIndexPut(b, newGoartIndex())
+}
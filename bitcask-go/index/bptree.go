@@ -2,41 +2,59 @@ package index
 
 import (
 	"bitcask-go/data"
+	"bytes"
+	"encoding/binary"
 	bolt "go.etcd.io/bbolt"
 	"path/filepath"
+	"sync/atomic"
 )
 
 const bptreeIndexFileName = "bptree-index"
 
-var indexBucketName = []byte("bitcask-index")
+var (
+	indexBucketName = []byte("bitcask-index")
+	metaBucketName  = []byte("bitcask-meta")
+	appliedKey      = []byte("applied")
+	seqNoKey        = []byte("seq-no")
+	mergedKey       = []byte("merged")
+)
 
 // BPlusTree B+树索引
 // 主要封装了 go.etcd.io/bbolt 库
 type BPlusTree struct {
-	tree *bolt.DB
+	tree    *bolt.DB
+	applied atomic.Pointer[data.LogRecordPos] // 等待和下一次更新一起持久化的已应用位置
+	seqNo   atomic.Uint64                     // 等待和下一次更新一起持久化的事务序列号
 }
 
 // NewBPlusTree 初始化 B+ 树索引
 func NewBPlusTree(dirPath string, syncWrites bool) *BPlusTree {
+	bpt, err := OpenBPlusTree(dirPath, syncWrites)
+	if err != nil {
+		panic("failed to open bptree")
+	}
+	return bpt
+}
+
+// OpenBPlusTree 打开 B+ 树索引，索引文件不存在时创建
+func OpenBPlusTree(dirPath string, syncWrites bool) (*BPlusTree, error) {
 	opts := bolt.DefaultOptions
 	opts.NoSync = !syncWrites
 
 	bptree, err := bolt.Open(filepath.Join(dirPath, bptreeIndexFileName), 0644, opts)
 	if err != nil {
-		panic("failed to open bptree")
+		return nil, err
 	}
 
 	// 创建对应的 bucket
-	if err := bptree.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists(indexBucketName)
-		return err
-	}); err != nil {
-		panic("failed to create bucket in bptree")
+	if err := bptree.Update(createBuckets); err != nil {
+		_ = bptree.Close()
+		return nil, err
 	}
 
 	return &BPlusTree{
 		tree: bptree,
-	}
+	}, nil
 }
 
 func (bpt *BPlusTree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
@@ -44,6 +62,9 @@ func (bpt *BPlusTree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos
 	if err := bpt.tree.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket(indexBucketName)
 		oldValue = bucket.Get(key)
+		if err := bpt.saveMeta(tx); err != nil {
+			return err
+		}
 		return bucket.Put(key, data.EncodeLogRecordPos(pos))
 	}); err != nil {
 		panic("failed to put value in bptree")
@@ -73,6 +94,9 @@ func (bpt *BPlusTree) Delete(key []byte) (*data.LogRecordPos, bool) {
 	var oldValue []byte
 	if err := bpt.tree.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket(indexBucketName)
+		if err := bpt.saveMeta(tx); err != nil {
+			return err
+		}
 		if oldValue = bucket.Get(key); len(oldValue) != 0 {
 			return bucket.Delete(key)
 		}
@@ -99,23 +123,185 @@ func (bpt *BPlusTree) Size() int {
 }
 
 func (bpt *BPlusTree) Iterator(reverse bool) Iterator {
-	return newBptreeIterator(bpt.tree, reverse)
+	return bpt.IteratorWithOptions(IteratorOptions{Reverse: reverse})
+}
+
+// IteratorWithOptions 迭代器持有一个只读事务，遍历的是创建时的快照
+func (bpt *BPlusTree) IteratorWithOptions(opts IteratorOptions) Iterator {
+	return withLimit(newBptreeIterator(bpt.tree, opts), opts.Limit)
+}
+
+func (bpt *BPlusTree) Capabilities() Capabilities {
+	return Capabilities{Ordered: true, Persistent: true, Snapshot: true}
+}
+
+// MemoryUsage B+ 树存储在磁盘上，通过 mmap 读取的页由操作系统管理，不计入索引的内存
+func (bpt *BPlusTree) MemoryUsage() int64 {
+	return 0
 }
 
 func (bpt *BPlusTree) Close() error {
 	return bpt.tree.Close()
 }
 
+// MarkApplied 标记 pos 处的记录已经应用到索引中
+// 标记和下一次 Put 或者 Delete 在同一个事务中持久化，调用方需要按照数据文件中记录的顺序更新索引
+func (bpt *BPlusTree) MarkApplied(pos *data.LogRecordPos) {
+	bpt.applied.Store(pos)
+}
+
+// MarkSeqNo 记录已经分配的事务序列号，和下一次 Put 或者 Delete 在同一个事务中持久化
+func (bpt *BPlusTree) MarkSeqNo(seqNo uint64) {
+	bpt.seqNo.Store(seqNo)
+}
+
+// Applied 返回索引中已经持久化的最后一条应用的记录的位置，没有记录过时返回 nil
+func (bpt *BPlusTree) Applied() *data.LogRecordPos {
+	if value := bpt.getMeta(appliedKey); len(value) != 0 {
+		return data.DecodeLogRecordPos(value)
+	}
+	return nil
+}
+
+// SeqNo 返回索引中已经持久化的事务序列号
+func (bpt *BPlusTree) SeqNo() uint64 {
+	if value := bpt.getMeta(seqNoKey); len(value) == 8 {
+		return binary.BigEndian.Uint64(value)
+	}
+	return 0
+}
+
+// MergedFid 返回最近一次更新到索引中的 merge 对应的最近未参与 merge 的文件 id
+func (bpt *BPlusTree) MergedFid() uint32 {
+	if value := bpt.getMeta(mergedKey); len(value) == 4 {
+		return binary.BigEndian.Uint32(value)
+	}
+	return 0
+}
+
+// ApplyMerge 在一个事务中将 merge 之后的位置更新到索引中
+// load 依次调用 update 传入 hint 文件中的每一条位置索引
+// 只更新仍然指向 nonMergeFid 之前的数据文件的 key，merge 之后写入或者删除的 key 保持不变
+// 已应用的位置如果在 merge 之前的数据文件中，改为指向 nonMergeFid 文件的开头
+func (bpt *BPlusTree) ApplyMerge(nonMergeFid uint32, load func(update func(key []byte, pos *data.LogRecordPos)) error) error {
+	return bpt.tree.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(indexBucketName)
+		var err error
+		loadErr := load(func(key []byte, pos *data.LogRecordPos) {
+			oldValue := bucket.Get(key)
+			if err != nil || len(oldValue) == 0 || data.DecodeLogRecordPos(oldValue).Fid >= nonMergeFid {
+				return
+			}
+			err = bucket.Put(key, data.EncodeLogRecordPos(pos))
+		})
+		if loadErr != nil {
+			return loadErr
+		}
+		if err != nil {
+			return err
+		}
+
+		meta := tx.Bucket(metaBucketName)
+		applied := meta.Get(appliedKey)
+		if len(applied) != 0 && data.DecodeLogRecordPos(applied).Fid < nonMergeFid {
+			if err := meta.Put(appliedKey, data.EncodeLogRecordPos(&data.LogRecordPos{Fid: nonMergeFid})); err != nil {
+				return err
+			}
+		}
+		merged := make([]byte, 4)
+		binary.BigEndian.PutUint32(merged, nonMergeFid)
+		return meta.Put(mergedKey, merged)
+	})
+}
+
+// Reset 清空索引中的所有数据和已应用的位置，事务序列号和 merge 的记录保持不变
+func (bpt *BPlusTree) Reset() error {
+	bpt.applied.Store(nil)
+	return bpt.tree.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(indexBucketName); err != nil {
+			return err
+		}
+		if err := tx.Bucket(metaBucketName).Delete(appliedKey); err != nil {
+			return err
+		}
+		return createBuckets(tx)
+	})
+}
+
+func (bpt *BPlusTree) getMeta(key []byte) []byte {
+	var value []byte
+	if err := bpt.tree.View(func(tx *bolt.Tx) error {
+		value = bytes.Clone(tx.Bucket(metaBucketName).Get(key))
+		return nil
+	}); err != nil {
+		panic("failed to get meta in bptree")
+	}
+	return value
+}
+
+// 将等待持久化的已应用位置和事务序列号写入到当前事务中
+func (bpt *BPlusTree) saveMeta(tx *bolt.Tx) error {
+	meta := tx.Bucket(metaBucketName)
+	if pos := bpt.applied.Swap(nil); pos != nil {
+		if err := meta.Put(appliedKey, data.EncodeLogRecordPos(pos)); err != nil {
+			return err
+		}
+	}
+	if seqNo := bpt.seqNo.Swap(0); seqNo != 0 {
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, seqNo)
+		if err := meta.Put(seqNoKey, buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func createBuckets(tx *bolt.Tx) error {
+	for _, name := range [][]byte{indexBucketName, metaBucketName} {
+		if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Snapshot 开启一个只读事务作为索引在当前时刻的快照
+// 快照使用完之后必须调用 Release 释放
+func (bpt *BPlusTree) Snapshot() (*BPlusTreeSnapshot, error) {
+	tx, err := bpt.tree.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	return &BPlusTreeSnapshot{tx: tx}, nil
+}
+
+// BPlusTreeSnapshot B+ 树索引的快照
+type BPlusTreeSnapshot struct {
+	tx *bolt.Tx
+}
+
+// WriteTo 将快照写入到指定目录的索引文件中
+func (s *BPlusTreeSnapshot) WriteTo(dirPath string) error {
+	return s.tx.CopyFile(filepath.Join(dirPath, bptreeIndexFileName), 0644)
+}
+
+// Release 释放快照
+func (s *BPlusTreeSnapshot) Release() error {
+	return s.tx.Rollback()
+}
+
 // B+树迭代器
 type bptreeIterator struct {
 	tx        *bolt.Tx
 	cursor    *bolt.Cursor
 	reverse   bool
+	rng       keyRange // 遍历的范围
 	currKey   []byte
 	currValue []byte
 }
 
-func newBptreeIterator(tree *bolt.DB, reverse bool) *bptreeIterator {
+func newBptreeIterator(tree *bolt.DB, opts IteratorOptions) *bptreeIterator {
 	tx, err := tree.Begin(false)
 	if err != nil {
 		panic("failed to begin a transaction")
@@ -123,22 +309,40 @@ func newBptreeIterator(tree *bolt.DB, reverse bool) *bptreeIterator {
 	bpi := &bptreeIterator{
 		tx:      tx,
 		cursor:  tx.Bucket(indexBucketName).Cursor(),
-		reverse: reverse,
+		reverse: opts.Reverse,
+		rng:     newKeyRange(opts),
 	}
 	bpi.Rewind()
 	return bpi
 }
 
 func (bpi *bptreeIterator) Rewind() {
-	if bpi.reverse {
+	switch {
+	case bpi.reverse && len(bpi.rng.upper) > 0:
+		bpi.seekLessOrEqual(bpi.rng.upper)
+	case bpi.reverse:
 		bpi.currKey, bpi.currValue = bpi.cursor.Last()
-	} else {
+	case len(bpi.rng.lower) > 0:
+		bpi.currKey, bpi.currValue = bpi.cursor.Seek(bpi.rng.lower)
+	default:
 		bpi.currKey, bpi.currValue = bpi.cursor.First()
 	}
+	bpi.skipBound()
 }
 
 func (bpi *bptreeIterator) Seek(key []byte) {
-	bpi.currKey, bpi.currValue = bpi.cursor.Seek(key)
+	if bpi.reverse {
+		if len(bpi.rng.upper) > 0 && bytes.Compare(key, bpi.rng.upper) > 0 {
+			key = bpi.rng.upper
+		}
+		bpi.seekLessOrEqual(key)
+	} else {
+		if len(bpi.rng.lower) > 0 && bytes.Compare(key, bpi.rng.lower) < 0 {
+			key = bpi.rng.lower
+		}
+		bpi.currKey, bpi.currValue = bpi.cursor.Seek(key)
+	}
+	bpi.skipBound()
 }
 
 func (bpi *bptreeIterator) Next() {
@@ -150,7 +354,30 @@ func (bpi *bptreeIterator) Next() {
 }
 
 func (bpi *bptreeIterator) Valid() bool {
-	return len(bpi.currKey) != 0
+	return len(bpi.currKey) != 0 && bpi.rng.contains(bpi.currKey)
+}
+
+// 定位到最后一个小于等于 key 的位置
+func (bpi *bptreeIterator) seekLessOrEqual(key []byte) {
+	bpi.currKey, bpi.currValue = bpi.cursor.Seek(key)
+	if bpi.currKey == nil {
+		bpi.currKey, bpi.currValue = bpi.cursor.Last()
+	} else if bytes.Compare(bpi.currKey, key) > 0 {
+		bpi.currKey, bpi.currValue = bpi.cursor.Prev()
+	}
+}
+
+// 起点落在不包含的边界上时跳过
+func (bpi *bptreeIterator) skipBound() {
+	if bpi.currKey == nil {
+		return
+	}
+	if bpi.reverse && !bpi.rng.belowUpper(bpi.currKey) {
+		bpi.currKey, bpi.currValue = bpi.cursor.Prev()
+	}
+	if !bpi.reverse && !bpi.rng.aboveLower(bpi.currKey) {
+		bpi.currKey, bpi.currValue = bpi.cursor.Next()
+	}
 }
 
 func (bpi *bptreeIterator) Key() []byte {
@@ -116,3 +116,37 @@ func TestBPlusTree_Iterator(t *testing.T) {
 		assert.NotNil(t, iter.Value())
 	}
 }
+
+func TestBPlusTree_Applied(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "bptree-applied")
+	_ = os.MkdirAll(path, os.ModePerm)
+	defer func() {
+		_ = os.RemoveAll(path)
+	}()
+
+	tree := NewBPlusTree(path, false)
+	assert.Nil(t, tree.Applied())
+
+	// 标记和下一次更新一起持久化
+	tree.MarkApplied(&data.LogRecordPos{Fid: 1, Offset: 10, Size: 5})
+	assert.Nil(t, tree.Applied())
+	tree.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 10, Size: 5})
+	assert.Equal(t, &data.LogRecordPos{Fid: 1, Offset: 10, Size: 5}, tree.Applied())
+
+	tree.MarkApplied(&data.LogRecordPos{Fid: 2, Offset: 0, Size: 3})
+	tree.Delete([]byte("a"))
+	assert.Equal(t, &data.LogRecordPos{Fid: 2, Offset: 0, Size: 3}, tree.Applied())
+
+	// 重新打开之后仍然存在
+	err := tree.Close()
+	assert.Nil(t, err)
+	tree = NewBPlusTree(path, false)
+	assert.Equal(t, &data.LogRecordPos{Fid: 2, Offset: 0, Size: 3}, tree.Applied())
+
+	tree.Put([]byte("b"), &data.LogRecordPos{Fid: 2, Offset: 3, Size: 3})
+	err = tree.Reset()
+	assert.Nil(t, err)
+	assert.Nil(t, tree.Applied())
+	assert.Equal(t, 0, tree.Size())
+	_ = tree.Close()
+}
@@ -2,19 +2,22 @@ package index
 
 import (
 	"bitcask-go/data"
-	"bytes"
 	"github.com/google/btree"
-	"sort"
 	"sync"
+	"unsafe"
 )
 
 // BTree 索引 主要封装了google的btree库
 // https://github.com/google/btree
 type BTree struct {
-	tree *btree.BTree
-	lock *sync.RWMutex
+	tree     *btree.BTree
+	keyBytes int64 // 所有 key 的总长度
+	lock     *sync.RWMutex
 }
 
+// BTree 中每条数据除了 key 之外大致占用的内存：Item、单独分配的位置信息以及节点中的接口值
+const btreeItemOverhead = int64(unsafe.Sizeof(Item{})+unsafe.Sizeof(data.LogRecordPos{})) + 16
+
 // NewBTree 初始化 BTree 索引结构
 func NewBTree() *BTree {
 	return &BTree{
@@ -27,6 +30,9 @@ func (bt *BTree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
 	it := &Item{key: key, pos: pos}
 	bt.lock.Lock()
 	oldItem := bt.tree.ReplaceOrInsert(it)
+	if oldItem == nil {
+		bt.keyBytes += int64(len(key))
+	}
 	bt.lock.Unlock()
 	if oldItem == nil {
 		return nil
@@ -36,7 +42,9 @@ func (bt *BTree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
 
 func (bt *BTree) Get(key []byte) *data.LogRecordPos {
 	it := &Item{key: key}
+	bt.lock.RLock()
 	btreeItem := bt.tree.Get(it)
+	bt.lock.RUnlock()
 	if btreeItem == nil {
 		return nil
 	}
@@ -47,6 +55,9 @@ func (bt *BTree) Delete(key []byte) (*data.LogRecordPos, bool) {
 	it := &Item{key: key}
 	bt.lock.Lock()
 	oldItem := bt.tree.Delete(it)
+	if oldItem != nil {
+		bt.keyBytes -= int64(len(key))
+	}
 	bt.lock.Unlock()
 	if oldItem == nil {
 		return nil, false
@@ -55,91 +66,65 @@ func (bt *BTree) Delete(key []byte) (*data.LogRecordPos, bool) {
 }
 
 func (bt *BTree) Size() int {
+	bt.lock.RLock()
+	defer bt.lock.RUnlock()
 	return bt.tree.Len()
 }
 
 // Iterator 返回迭代器的一个方法
 func (bt *BTree) Iterator(reverse bool) Iterator {
+	return bt.IteratorWithOptions(IteratorOptions{Reverse: reverse})
+}
+
+// IteratorWithOptions 返回遍历树的快照的迭代器，创建时克隆一份树
+func (bt *BTree) IteratorWithOptions(opts IteratorOptions) Iterator {
 	if bt.tree == nil {
 		return nil
 	}
+	// 克隆会修改原来的树的写时复制标识，需要加写锁
+	bt.lock.Lock()
+	tree := bt.tree.Clone()
+	bt.lock.Unlock()
+	return withLimit(newSnapshotIterator(btreeSnapshot{tree: tree}, opts), opts.Limit)
+}
+
+func (bt *BTree) Capabilities() Capabilities {
+	return Capabilities{Ordered: true, Snapshot: true}
+}
+
+func (bt *BTree) MemoryUsage() int64 {
 	bt.lock.RLock()
 	defer bt.lock.RUnlock()
-	return newBTreeIterator(bt.tree, reverse)
+	return int64(bt.tree.Len())*btreeItemOverhead + bt.keyBytes
 }
 
 func (bt *BTree) Close() error {
 	return nil
 }
 
-// BTree 索引迭代器
-type btreeIterator struct {
-	currIndex int     // 当前遍历位置
-	reverse   bool    // 是否是反向遍历
-	values    []*Item // key+位置索引信息
+// BTree 的快照，克隆是写时复制的，不会复制所有的数据
+type btreeSnapshot struct {
+	tree *btree.BTree
 }
 
-func newBTreeIterator(tree *btree.BTree, reverse bool) *btreeIterator {
-	var idx int
-	values := make([]*Item, tree.Len())
-
-	saveValues := func(it btree.Item) bool {
-		values[idx] = it.(*Item)
-		idx++
-		return true
+func (s btreeSnapshot) ascend(pivot []byte, fn func(item *Item) bool) {
+	iter := func(it btree.Item) bool {
+		return fn(it.(*Item))
 	}
-
-	if reverse {
-		tree.Descend(saveValues)
+	if pivot == nil {
+		s.tree.Ascend(iter)
 	} else {
-		tree.Ascend(saveValues)
+		s.tree.AscendGreaterOrEqual(&Item{key: pivot}, iter)
 	}
-	return &btreeIterator{
-		currIndex: 0,
-		reverse:   reverse,
-		values:    values,
-	}
-}
-
-// Rewind 重新回到迭代器的起点，即第一个数据
-func (bti *btreeIterator) Rewind() {
-	bti.currIndex = 0
 }
 
-// Seek 根据传入的 key 查找第一个大于(或小于)等于的目标key，从这个key开始遍历
-func (bti *btreeIterator) Seek(key []byte) {
-	if bti.reverse {
-		bti.currIndex = sort.Search(len(bti.values), func(i int) bool {
-			return bytes.Compare(bti.values[i].key, key) <= 0
-		})
+func (s btreeSnapshot) descend(pivot []byte, fn func(item *Item) bool) {
+	iter := func(it btree.Item) bool {
+		return fn(it.(*Item))
+	}
+	if pivot == nil {
+		s.tree.Descend(iter)
 	} else {
-		bti.currIndex = sort.Search(len(bti.values), func(i int) bool {
-			return bytes.Compare(bti.values[i].key, key) >= 0
-		})
+		s.tree.DescendLessOrEqual(&Item{key: pivot}, iter)
 	}
 }
-
-// Next 跳转到下一个key
-func (bti *btreeIterator) Next() {
-	bti.currIndex += 1
-}
-
-// Valid 当前遍历的位置的
-func (bti *btreeIterator) Valid() bool {
-	return bti.currIndex < len(bti.values)
-}
-
-// Key 当前遍历位置的 Key 数据
-func (bti *btreeIterator) Key() []byte {
-	return bti.values[bti.currIndex].key
-}
-
-// Value 当前遍历位置的 Value 数据
-func (bti *btreeIterator) Value() *data.LogRecordPos {
-	return bti.values[bti.currIndex].pos
-}
-
-// Close 关闭迭代器，释放相应资源
-func (bti *btreeIterator) Close() {
-	bti.values = nil
-}
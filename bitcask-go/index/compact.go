@@ -0,0 +1,603 @@
+package index
+
+import (
+	"bitcask-go/data"
+	"bytes"
+	"encoding/binary"
+	"github.com/google/btree"
+	"sort"
+	"sync"
+	"unsafe"
+)
+
+const (
+	// 一个块中最多的数据条数
+	compactBlockSize = 256
+	// 前缀压缩时每隔多少条数据存储一个完整的 key，查找时在完整的 key 之间二分
+	compactRestartInterval = 16
+	// 修改的数据量至少达到这个值之后才合并到块中
+	compactDeltaMinSize = 4096
+	// 合并的阈值随着块的数量增长，平均每个块积累这么多条修改之后再合并，降低每次合并的代价
+	compactDeltaPerBlock = 4
+)
+
+// CompactIndex 紧凑的内存索引，适合 key 数量非常多、内存有限的场景
+// 大部分数据存储在不可变的有序块中，块中的 key 和位置信息变长编码在一段连续的内存中，没有每条数据单独的对象和指针
+// 可以选择对相邻的 key 做前缀压缩，key 有较长的公共前缀时可以进一步节省内存
+// 最近的修改先写入一个小的 BTree，数据量达到阈值之后在后台合并到块中，只有被修改的块会重新编码
+type CompactIndex struct {
+	blocks            []*compactBlock // 有序且范围不重叠，合并时整体替换，不会原地修改
+	delta             *btree.BTreeG[compactDelta]
+	flushing          *btree.BTreeG[compactDelta] // 正在后台合并到块中的 delta，合并完成之前不会再修改
+	size              int
+	blockBytes        int64 // 块占用的内存
+	deltaKeyBytes     int64 // delta 中 key 占用的内存
+	flushingKeyBytes  int64 // 正在合并的 delta 中 key 占用的内存
+	prefixCompression bool
+	lock              *sync.RWMutex
+	flushed           *sync.Cond // 后台合并完成时通知
+}
+
+// 还没有合并到块中的修改
+type compactDelta struct {
+	key     []byte
+	pos     data.LogRecordPos
+	deleted bool // 删除标记，块中的 key 被删除时需要记录，合并时丢弃
+}
+
+// 不可变的有序块
+// 每条数据编码为 公共前缀长度 | 剩余 key 长度 | 剩余 key | Fid | Offset | Size，都是变长整数
+// 重启点的数据公共前缀长度为 0，存储的是完整的 key
+type compactBlock struct {
+	buf      []byte   // 编码后的数据
+	restarts []uint32 // 重启点在 buf 中的偏移
+	first    []byte   // 块中的第一个 key，引用 buf 中的数据
+	count    int
+}
+
+// NewCompactIndex 初始化紧凑索引，prefixCompression 表示是否对相邻的 key 做前缀压缩
+func NewCompactIndex(prefixCompression bool) *CompactIndex {
+	ci := &CompactIndex{
+		delta:             newCompactDeltaTree(),
+		prefixCompression: prefixCompression,
+		lock:              new(sync.RWMutex),
+	}
+	ci.flushed = sync.NewCond(ci.lock)
+	return ci
+}
+
+func newCompactDeltaTree() *btree.BTreeG[compactDelta] {
+	return btree.NewG(32, func(a, b compactDelta) bool {
+		return bytes.Compare(a.key, b.key) < 0
+	})
+}
+
+func (ci *CompactIndex) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
+	ci.lock.Lock()
+	defer ci.lock.Unlock()
+
+	oldPos := ci.get(key)
+	if _, replaced := ci.delta.ReplaceOrInsert(compactDelta{key: key, pos: *pos}); !replaced {
+		ci.deltaKeyBytes += int64(len(key))
+	}
+	if oldPos == nil {
+		ci.size++
+	}
+	ci.maybeFlush()
+	return oldPos
+}
+
+func (ci *CompactIndex) Get(key []byte) *data.LogRecordPos {
+	ci.lock.RLock()
+	defer ci.lock.RUnlock()
+	return ci.get(key)
+}
+
+func (ci *CompactIndex) Delete(key []byte) (*data.LogRecordPos, bool) {
+	ci.lock.Lock()
+	defer ci.lock.Unlock()
+
+	oldPos := ci.get(key)
+	if oldPos == nil {
+		return nil, false
+	}
+	if ci.getFlushed(key) != nil {
+		// 块是不可变的，记录删除标记，合并时再真正删除
+		if _, replaced := ci.delta.ReplaceOrInsert(compactDelta{key: key, deleted: true}); !replaced {
+			ci.deltaKeyBytes += int64(len(key))
+		}
+		ci.maybeFlush()
+	} else {
+		ci.delta.Delete(compactDelta{key: key})
+		ci.deltaKeyBytes -= int64(len(key))
+	}
+	ci.size--
+	return oldPos, true
+}
+
+func (ci *CompactIndex) Size() int {
+	ci.lock.RLock()
+	defer ci.lock.RUnlock()
+	return ci.size
+}
+
+func (ci *CompactIndex) Iterator(reverse bool) Iterator {
+	return ci.IteratorWithOptions(IteratorOptions{Reverse: reverse})
+}
+
+// IteratorWithOptions 遍历创建时的块和 delta 的克隆，之后的写入不会影响遍历的结果
+func (ci *CompactIndex) IteratorWithOptions(opts IteratorOptions) Iterator {
+	// 克隆会修改原来的树的写时复制标识，需要加写锁
+	ci.lock.Lock()
+	snapshot := compactSnapshot{blocks: ci.blocks, delta: ci.delta.Clone()}
+	if ci.flushing != nil {
+		// 后台合并期间把最新的 delta 覆盖到正在合并的 delta 的克隆上，代价和 delta 的大小成正比
+		delta := ci.flushing.Clone()
+		ci.delta.Ascend(func(d compactDelta) bool {
+			delta.ReplaceOrInsert(d)
+			return true
+		})
+		snapshot.delta = delta
+	}
+	ci.lock.Unlock()
+	return withLimit(newSnapshotIterator(snapshot, opts), opts.Limit)
+}
+
+func (ci *CompactIndex) Capabilities() Capabilities {
+	return Capabilities{Ordered: true, Snapshot: true}
+}
+
+// MemoryUsage 块按照实际分配的内存计算，delta 按照每条数据的结构体大小估算
+func (ci *CompactIndex) MemoryUsage() int64 {
+	ci.lock.RLock()
+	defer ci.lock.RUnlock()
+	usage := ci.blockBytes + int64(ci.delta.Len())*compactDeltaOverhead + ci.deltaKeyBytes
+	if ci.flushing != nil {
+		usage += int64(ci.flushing.Len())*compactDeltaOverhead + ci.flushingKeyBytes
+	}
+	return usage
+}
+
+// Close 等待后台的合并完成
+func (ci *CompactIndex) Close() error {
+	ci.lock.Lock()
+	defer ci.lock.Unlock()
+	ci.waitFlush()
+	return nil
+}
+
+// delta 中每条数据除了 key 之外大致占用的内存，包括 BTree 节点中的位置
+const compactDeltaOverhead = int64(unsafe.Sizeof(compactDelta{})) * 3 / 2
+
+// 调用方需要持有锁
+func (ci *CompactIndex) get(key []byte) *data.LogRecordPos {
+	if d, ok := ci.delta.Get(compactDelta{key: key}); ok {
+		if d.deleted {
+			return nil
+		}
+		return &d.pos
+	}
+	return ci.getFlushed(key)
+}
+
+// 从正在合并的 delta 和块中查找，不包括最新的 delta
+func (ci *CompactIndex) getFlushed(key []byte) *data.LogRecordPos {
+	if ci.flushing != nil {
+		if d, ok := ci.flushing.Get(compactDelta{key: key}); ok {
+			if d.deleted {
+				return nil
+			}
+			return &d.pos
+		}
+	}
+	if pos, ok := ci.getFromBlocks(key); ok {
+		return &pos
+	}
+	return nil
+}
+
+func (ci *CompactIndex) getFromBlocks(key []byte) (data.LogRecordPos, bool) {
+	i := searchCompactBlocks(compactBlocks(ci.blocks), key)
+	if i < 0 {
+		return data.LogRecordPos{}, false
+	}
+	return ci.blocks[i].get(key)
+}
+
+// delta 中的数据量达到阈值之后交给后台合并到块中，写入可以继续进入新的 delta
+// 上一次合并还没有完成时等待，内存中最多有两份 delta
+// 调用方需要持有写锁
+func (ci *CompactIndex) maybeFlush() {
+	if ci.delta.Len() < max(compactDeltaMinSize, len(ci.blocks)*compactDeltaPerBlock) {
+		return
+	}
+	ci.waitFlush()
+	ci.flushing, ci.flushingKeyBytes = ci.delta, ci.deltaKeyBytes
+	ci.delta, ci.deltaKeyBytes = newCompactDeltaTree(), 0
+	go ci.flush(ci.blocks, ci.flushing)
+}
+
+// 等待后台的合并完成，调用方需要持有写锁
+func (ci *CompactIndex) waitFlush() {
+	for ci.flushing != nil {
+		ci.flushed.Wait()
+	}
+}
+
+// 在后台将 delta 合并到块中，完成之后替换索引中的块
+// 只有一个合并在进行，合并期间 blocks 不会被替换，delta 不会被修改
+func (ci *CompactIndex) flush(blocks []*compactBlock, delta *btree.BTreeG[compactDelta]) {
+	blocks = mergeCompactBlocks(blocks, delta, ci.prefixCompression)
+	var blockBytes int64
+	for _, b := range blocks {
+		blockBytes += b.memoryUsage()
+	}
+
+	ci.lock.Lock()
+	defer ci.lock.Unlock()
+	ci.blocks, ci.blockBytes = blocks, blockBytes
+	ci.flushing, ci.flushingKeyBytes = nil, 0
+	ci.flushed.Broadcast()
+}
+
+// 将 delta 中的修改合并到块中，返回新的块，只重新编码有修改的块，没有修改的块直接复用
+func mergeCompactBlocks(blocks []*compactBlock, delta *btree.BTreeG[compactDelta], prefixCompression bool) []*compactBlock {
+	deltas := make([]compactDelta, 0, delta.Len())
+	delta.Ascend(func(d compactDelta) bool {
+		deltas = append(deltas, d)
+		return true
+	})
+
+	builder := &compactBlockBuilder{prefixCompression: prefixCompression}
+	for i, b := range blocks {
+		// 属于当前块的修改是小于下一个块第一个 key 的部分，小于第一个块的修改也合并到第一个块中
+		end := len(deltas)
+		if i+1 < len(blocks) {
+			next := blocks[i+1].first
+			end = sort.Search(len(deltas), func(j int) bool {
+				return bytes.Compare(deltas[j].key, next) >= 0
+			})
+		}
+		if end == 0 {
+			builder.blocks = append(builder.blocks, b)
+			continue
+		}
+		builder.merge(b, deltas[:end])
+		deltas = deltas[end:]
+	}
+	builder.merge(nil, deltas)
+	return builder.blocks
+}
+
+// 有序的块的列表，块可能在内存中，也可能需要从磁盘上读取
+type compactBlockList interface {
+	// 块的数量
+	len() int
+	// 第 i 个块的第一个 key
+	first(i int) []byte
+	// 取出第 i 个块，块在磁盘上时可能读取失败
+	block(i int) (*compactBlock, error)
+}
+
+// 内存中的块
+type compactBlocks []*compactBlock
+
+func (bs compactBlocks) len() int {
+	return len(bs)
+}
+
+func (bs compactBlocks) first(i int) []byte {
+	return bs[i].first
+}
+
+func (bs compactBlocks) block(i int) (*compactBlock, error) {
+	return bs[i], nil
+}
+
+// 返回包含 key 的块，即第一个 key 小于等于 key 的最后一个块，不存在时返回 -1
+func searchCompactBlocks(blocks compactBlockList, key []byte) int {
+	return sort.Search(blocks.len(), func(i int) bool {
+		return bytes.Compare(blocks.first(i), key) > 0
+	}) - 1
+}
+
+func (b *compactBlock) get(key []byte) (data.LogRecordPos, bool) {
+	// 在重启点之间二分，找到最后一个小于等于 key 的重启点，然后顺序查找
+	r := sort.Search(len(b.restarts), func(i int) bool {
+		_, suffix, _, _ := b.decode(int(b.restarts[i]))
+		return bytes.Compare(suffix, key) > 0
+	}) - 1
+	if r < 0 {
+		return data.LogRecordPos{}, false
+	}
+	end := len(b.buf)
+	if r+1 < len(b.restarts) {
+		end = int(b.restarts[r+1])
+	}
+	var curr []byte
+	for off := int(b.restarts[r]); off < end; {
+		shared, suffix, pos, next := b.decode(off)
+		curr = append(curr[:shared], suffix...)
+		switch bytes.Compare(curr, key) {
+		case 0:
+			return pos, true
+		case 1:
+			return data.LogRecordPos{}, false
+		}
+		off = next
+	}
+	return data.LogRecordPos{}, false
+}
+
+// 顺序遍历块中的数据，key 只在回调中有效
+func (b *compactBlock) forEach(fn func(key []byte, pos data.LogRecordPos)) {
+	var curr []byte
+	for off := 0; off < len(b.buf); {
+		shared, suffix, pos, next := b.decode(off)
+		curr = append(curr[:shared], suffix...)
+		fn(curr, pos)
+		off = next
+	}
+}
+
+// 解码块中的所有数据，完整存储的 key 直接引用块中的数据
+func (b *compactBlock) items() []*Item {
+	items := make([]Item, b.count)
+	positions := make([]data.LogRecordPos, b.count)
+	res := make([]*Item, b.count)
+	var prev []byte
+	for i, off := 0, 0; off < len(b.buf); i++ {
+		shared, suffix, pos, next := b.decode(off)
+		key := suffix
+		if shared > 0 {
+			key = make([]byte, shared+len(suffix))
+			copy(key, prev[:shared])
+			copy(key[shared:], suffix)
+		}
+		positions[i] = pos
+		items[i] = Item{key: key, pos: &positions[i]}
+		res[i] = &items[i]
+		prev = key
+		off = next
+	}
+	return res
+}
+
+// 解码 off 处的一条数据，返回公共前缀长度、剩余的 key、位置信息和下一条数据的偏移
+func (b *compactBlock) decode(off int) (int, []byte, data.LogRecordPos, int) {
+	shared, n := binary.Uvarint(b.buf[off:])
+	off += n
+	unshared, n := binary.Uvarint(b.buf[off:])
+	off += n
+	suffix := b.buf[off : off+int(unshared) : off+int(unshared)]
+	off += int(unshared)
+	fid, n := binary.Uvarint(b.buf[off:])
+	off += n
+	offset, n := binary.Uvarint(b.buf[off:])
+	off += n
+	size, n := binary.Uvarint(b.buf[off:])
+	off += n
+	pos := data.LogRecordPos{Fid: uint32(fid), Offset: int64(offset), Size: uint32(size)}
+	return int(shared), suffix, pos, off
+}
+
+func (b *compactBlock) memoryUsage() int64 {
+	// 块本身的结构体以及块列表中的指针
+	return int64(unsafe.Sizeof(*b)) + 8 + int64(cap(b.buf)) + int64(cap(b.restarts))*4
+}
+
+// 按顺序写入数据，生成新的块
+type compactBlockBuilder struct {
+	prefixCompression bool
+	blocks            []*compactBlock // 已经生成的块
+	buf               []byte          // 当前块编码的数据
+	restarts          []uint32        // 当前块的重启点
+	count             int             // 当前块的数据条数
+	prev              []byte          // 上一条数据的 key
+}
+
+// 将块 b 和属于它的修改归并之后写入，b 为空时只写入修改
+func (bb *compactBlockBuilder) merge(b *compactBlock, deltas []compactDelta) {
+	addDelta := func(d compactDelta) {
+		if !d.deleted {
+			bb.add(d.key, d.pos)
+		}
+	}
+	if b != nil {
+		b.forEach(func(key []byte, pos data.LogRecordPos) {
+			for len(deltas) > 0 && bytes.Compare(deltas[0].key, key) < 0 {
+				addDelta(deltas[0])
+				deltas = deltas[1:]
+			}
+			if len(deltas) > 0 && bytes.Equal(deltas[0].key, key) {
+				addDelta(deltas[0])
+				deltas = deltas[1:]
+				return
+			}
+			bb.add(key, pos)
+		})
+	}
+	for _, d := range deltas {
+		addDelta(d)
+	}
+	bb.finish()
+}
+
+func (bb *compactBlockBuilder) add(key []byte, pos data.LogRecordPos) {
+	var shared int
+	if bb.prefixCompression && bb.count%compactRestartInterval != 0 {
+		shared = commonPrefixLen(bb.prev, key)
+	} else {
+		bb.restarts = append(bb.restarts, uint32(len(bb.buf)))
+	}
+	bb.buf = binary.AppendUvarint(bb.buf, uint64(shared))
+	bb.buf = binary.AppendUvarint(bb.buf, uint64(len(key)-shared))
+	bb.buf = append(bb.buf, key[shared:]...)
+	bb.buf = binary.AppendUvarint(bb.buf, uint64(pos.Fid))
+	bb.buf = binary.AppendUvarint(bb.buf, uint64(pos.Offset))
+	bb.buf = binary.AppendUvarint(bb.buf, uint64(pos.Size))
+	bb.prev = append(bb.prev[:0], key...)
+	bb.count++
+	if bb.count == compactBlockSize {
+		bb.finish()
+	}
+}
+
+// 结束当前的块，复制一份刚好大小的数据，避免块占用多余的内存
+func (bb *compactBlockBuilder) finish() {
+	if bb.count == 0 {
+		return
+	}
+	b := &compactBlock{
+		buf:      append(make([]byte, 0, len(bb.buf)), bb.buf...),
+		restarts: append(make([]uint32, 0, len(bb.restarts)), bb.restarts...),
+		count:    bb.count,
+	}
+	_, b.first, _, _ = b.decode(0)
+	bb.blocks = append(bb.blocks, b)
+	bb.buf, bb.restarts, bb.count = bb.buf[:0], bb.restarts[:0], 0
+}
+
+// 紧凑索引的快照，块是不可变的，delta 是写时复制的克隆
+type compactSnapshot struct {
+	blocks []*compactBlock
+	delta  *btree.BTreeG[compactDelta]
+}
+
+// 遍历 delta 的同时从块中按顺序取出数据归并，delta 中的数据覆盖块中相同的 key
+func (s compactSnapshot) ascend(pivot []byte, fn func(item *Item) bool) {
+	s.merge(pivot, false, fn)
+}
+
+func (s compactSnapshot) descend(pivot []byte, fn func(item *Item) bool) {
+	s.merge(pivot, true, fn)
+}
+
+func (s compactSnapshot) merge(pivot []byte, reverse bool, fn func(item *Item) bool) {
+	mergeDelta(s.delta, newCompactCursor(compactBlocks(s.blocks), pivot, reverse), pivot, reverse, fn)
+}
+
+// 从 pivot 开始遍历 delta，同时从 base 中按顺序取出数据归并，delta 中的数据覆盖 base 中相同的 key
+func mergeDelta(delta *btree.BTreeG[compactDelta], base cursor, pivot []byte, reverse bool, fn func(item *Item) bool) {
+	// base 中的 key 是否在 delta 中的 key 之前
+	before := func(key []byte) bool {
+		cmp := bytes.Compare(base.item().key, key)
+		return (!reverse && cmp < 0) || (reverse && cmp > 0)
+	}
+
+	stopped := false
+	iter := func(d compactDelta) bool {
+		for base.valid() && before(d.key) {
+			if !fn(base.item()) {
+				stopped = true
+				return false
+			}
+			base.next()
+		}
+		if base.valid() && bytes.Equal(base.item().key, d.key) {
+			base.next()
+		}
+		if d.deleted {
+			return true
+		}
+		pos := d.pos
+		if !fn(&Item{key: d.key, pos: &pos}) {
+			stopped = true
+			return false
+		}
+		return true
+	}
+	switch {
+	case reverse && pivot == nil:
+		delta.Descend(iter)
+	case reverse:
+		delta.DescendLessOrEqual(compactDelta{key: pivot}, iter)
+	case pivot == nil:
+		delta.Ascend(iter)
+	default:
+		delta.AscendGreaterOrEqual(compactDelta{key: pivot}, iter)
+	}
+	for !stopped && base.valid() {
+		if !fn(base.item()) {
+			return
+		}
+		base.next()
+	}
+}
+
+// 按顺序遍历有序的块，每次解码一个块
+type compactCursor struct {
+	blocks  compactBlockList
+	reverse bool
+	block   int     // 当前块的下标
+	items   []*Item // 当前块解码之后的数据
+	index   int     // 当前数据在块中的下标
+}
+
+func newCompactCursor(blocks compactBlockList, pivot []byte, reverse bool) *compactCursor {
+	c := &compactCursor{blocks: blocks, reverse: reverse}
+	if pivot == nil {
+		if reverse {
+			c.load(blocks.len() - 1)
+		} else {
+			c.load(0)
+		}
+		return c
+	}
+
+	i := searchCompactBlocks(blocks, pivot)
+	if reverse {
+		// 第一个 key 小于等于 pivot 的块中一定有小于等于 pivot 的 key
+		c.load(i)
+		c.index = sort.Search(len(c.items), func(j int) bool {
+			return bytes.Compare(c.items[j].key, pivot) > 0
+		}) - 1
+		return c
+	}
+	c.load(max(i, 0))
+	c.index = sort.Search(len(c.items), func(j int) bool {
+		return bytes.Compare(c.items[j].key, pivot) >= 0
+	})
+	if !c.valid() {
+		c.load(c.block + 1)
+	}
+	return c
+}
+
+// 解码第 i 个块，并移动到块的起点
+func (c *compactCursor) load(i int) {
+	c.block, c.items = i, nil
+	if i >= 0 && i < c.blocks.len() {
+		// 读取失败时当作遍历结束，错误由块列表自己记录
+		if b, err := c.blocks.block(i); err == nil {
+			c.items = b.items()
+		}
+	}
+	if c.reverse {
+		c.index = len(c.items) - 1
+	} else {
+		c.index = 0
+	}
+}
+
+func (c *compactCursor) valid() bool {
+	return c.index >= 0 && c.index < len(c.items)
+}
+
+func (c *compactCursor) item() *Item {
+	return c.items[c.index]
+}
+
+func (c *compactCursor) next() {
+	if c.reverse {
+		c.index--
+		if c.index < 0 {
+			c.load(c.block - 1)
+		}
+	} else {
+		c.index++
+		if c.index >= len(c.items) {
+			c.load(c.block + 1)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package index
+
+import (
+	"bitcask-go/data"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"testing"
+)
+
+func TestCompactIndex_Put(t *testing.T) {
+	ci := NewCompactIndex(true)
+
+	res1 := ci.Put(nil, &data.LogRecordPos{Fid: 1, Offset: 100})
+	assert.Nil(t, res1)
+	res2 := ci.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 2})
+	assert.Nil(t, res2)
+
+	// 重复 Put 得到的是旧值
+	res3 := ci.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 3, Size: 5})
+	assert.Equal(t, &data.LogRecordPos{Fid: 1, Offset: 2}, res3)
+	assert.Equal(t, &data.LogRecordPos{Fid: 1, Offset: 3, Size: 5}, ci.Get([]byte("a")))
+	assert.Equal(t, &data.LogRecordPos{Fid: 1, Offset: 100}, ci.Get(nil))
+	assert.Equal(t, 2, ci.Size())
+
+	res4, ok := ci.Delete([]byte("a"))
+	assert.True(t, ok)
+	assert.Equal(t, &data.LogRecordPos{Fid: 1, Offset: 3, Size: 5}, res4)
+	_, ok = ci.Delete([]byte("a"))
+	assert.False(t, ok)
+	assert.Nil(t, ci.Get([]byte("a")))
+	assert.Equal(t, 1, ci.Size())
+}
+
+// 随机的读写和 BTree 的结果保持一致，写入的数据量足够多次合并到块中
+func TestCompactIndex_CompareWithBTree(t *testing.T) {
+	for _, prefixCompression := range []bool{false, true} {
+		ci := NewCompactIndex(prefixCompression)
+		ref := NewBTree()
+		rnd := rand.New(rand.NewSource(1))
+
+		randomKey := func() []byte {
+			if rnd.Intn(10) == 0 {
+				return []byte(fmt.Sprintf("%c", 'a'+rnd.Intn(26)))
+			}
+			return []byte(fmt.Sprintf("key-%d-%d", rnd.Intn(5), rnd.Intn(6000)))
+		}
+
+		for i := 0; i < 40000; i++ {
+			key := randomKey()
+			if rnd.Intn(3) == 0 {
+				pos1, ok1 := ci.Delete(key)
+				pos2, ok2 := ref.Delete(key)
+				assert.Equal(t, ok2, ok1)
+				assert.Equal(t, pos2, pos1)
+			} else {
+				pos := &data.LogRecordPos{Fid: uint32(i % 7), Offset: int64(i) << 20, Size: uint32(i)}
+				assert.Equal(t, ref.Put(key, pos), ci.Put(key, pos))
+			}
+			assert.Equal(t, ref.Get(key), ci.Get(key))
+			assert.Equal(t, ref.Size(), ci.Size())
+
+			if i%4000 == 0 {
+				for _, prefix := range []string{"", "key-1", "key-3-5", "b"} {
+					for _, reverse := range []bool{false, true} {
+						opts := IteratorOptions{Prefix: []byte(prefix), Reverse: reverse}
+						iter1, iter2 := ci.IteratorWithOptions(opts), ref.IteratorWithOptions(opts)
+						iter1.Rewind()
+						for iter2.Rewind(); iter2.Valid(); iter2.Next() {
+							assert.True(t, iter1.Valid())
+							assert.Equal(t, iter2.Key(), iter1.Key())
+							assert.Equal(t, iter2.Value(), iter1.Value())
+							iter1.Next()
+						}
+						assert.False(t, iter1.Valid())
+
+						seek := randomKey()
+						iter1.Seek(seek)
+						iter2.Seek(seek)
+						assert.Equal(t, iter2.Valid(), iter1.Valid())
+						if iter2.Valid() {
+							assert.Equal(t, iter2.Key(), iter1.Key())
+						}
+						iter1.Close()
+						iter2.Close()
+					}
+				}
+			}
+		}
+		waitCompactFlush(ci)
+		assert.True(t, len(ci.blocks) > 1, "prefixCompression=%v", prefixCompression)
+	}
+}
+
+// 迭代器遍历的是创建时的快照，之后的写入和合并不会影响遍历的结果
+func TestCompactIndex_IteratorSnapshot(t *testing.T) {
+	ci := NewCompactIndex(true)
+	for i := 0; i < compactDeltaMinSize; i++ {
+		ci.Put([]byte(fmt.Sprintf("key-%05d", i)), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+	waitCompactFlush(ci)
+	assert.Equal(t, compactDeltaMinSize/compactBlockSize, len(ci.blocks))
+	ci.Put([]byte("key-00001"), &data.LogRecordPos{Fid: 2, Offset: 1})
+
+	iter := ci.Iterator(false)
+	defer iter.Close()
+	for i := 0; i < compactDeltaMinSize; i += 2 {
+		ci.Delete([]byte(fmt.Sprintf("key-%05d", i)))
+	}
+	assert.Equal(t, compactDeltaMinSize/2, ci.Size())
+
+	var count int
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		assert.Equal(t, []byte(fmt.Sprintf("key-%05d", count)), iter.Key())
+		if count == 1 {
+			assert.Equal(t, uint32(2), iter.Value().Fid)
+		} else {
+			assert.Equal(t, int64(count), iter.Value().Offset)
+		}
+		count++
+	}
+	assert.Equal(t, compactDeltaMinSize, count)
+}
+
+func TestCompactIndex_MemoryUsage(t *testing.T) {
+	bt := NewBTree()
+	plain := NewCompactIndex(false)
+	compressed := NewCompactIndex(true)
+	for i := 0; i < 100000; i++ {
+		key := []byte(fmt.Sprintf("bitcask-go-key-%09d", i))
+		pos := &data.LogRecordPos{Fid: uint32(i / 10000), Offset: int64(i%10000) * 1024, Size: 1024}
+		bt.Put(key, pos)
+		plain.Put(key, pos)
+		compressed.Put(key, pos)
+	}
+
+	waitCompactFlush(plain)
+	waitCompactFlush(compressed)
+
+	// 合并到块中之后每条数据不再有单独的对象，前缀压缩之后只存储 key 中不同的部分
+	assert.True(t, plain.MemoryUsage()*2 < bt.MemoryUsage())
+	assert.True(t, compressed.MemoryUsage()*2 < plain.MemoryUsage())
+	assert.True(t, compressed.MemoryUsage() > 0)
+}
+
+// 后台合并期间读写和遍历的结果和合并完成之后一致
+func TestCompactIndex_BackgroundFlush(t *testing.T) {
+	ci := NewCompactIndex(true)
+	for i := 0; i < compactDeltaMinSize; i++ {
+		ci.Put([]byte(fmt.Sprintf("key-%05d", i)), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+
+	// 合并完成之前继续写入，修改正在合并的 key
+	ci.Delete([]byte("key-00000"))
+	ci.Put([]byte("key-00001"), &data.LogRecordPos{Fid: 2, Offset: 1})
+	assert.Nil(t, ci.Get([]byte("key-00000")))
+	assert.Equal(t, &data.LogRecordPos{Fid: 2, Offset: 1}, ci.Get([]byte("key-00001")))
+	assert.Equal(t, &data.LogRecordPos{Fid: 1, Offset: 2}, ci.Get([]byte("key-00002")))
+	assert.Equal(t, compactDeltaMinSize-1, ci.Size())
+
+	iter := ci.Iterator(false)
+	iter.Rewind()
+	assert.Equal(t, []byte("key-00001"), iter.Key())
+	assert.Equal(t, uint32(2), iter.Value().Fid)
+	iter.Close()
+
+	assert.Nil(t, ci.Close())
+	assert.Nil(t, ci.flushing)
+	assert.Nil(t, ci.Get([]byte("key-00000")))
+	assert.Equal(t, &data.LogRecordPos{Fid: 2, Offset: 1}, ci.Get([]byte("key-00001")))
+	assert.Equal(t, compactDeltaMinSize-1, ci.Size())
+}
+
+// 等待后台的合并完成
+func waitCompactFlush(ci *CompactIndex) {
+	ci.lock.Lock()
+	defer ci.lock.Unlock()
+	ci.waitFlush()
+}
@@ -0,0 +1,140 @@
+package index
+
+import (
+	"bitcask-go/data"
+	"bytes"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// 哈希索引分片的数量，必须是 2 的幂
+const hashShardNum = 256
+
+// HashIndex 分片的哈希索引
+// 只支持按 key 查找，不维护 key 的顺序，适合只有点查的场景
+// 每个分片有单独的锁，不同分片上的读写互不影响
+type HashIndex struct {
+	shards   [hashShardNum]*hashShard
+	size     *atomic.Int64
+	keyBytes *atomic.Int64 // 所有 key 的总长度
+}
+
+// 哈希表中每条数据除了 key 之外大致占用的内存，包括 map 的桶中没有用满的空间
+const hashItemOverhead = int64(unsafe.Sizeof("")+unsafe.Sizeof(data.LogRecordPos{})) * 3 / 2
+
+type hashShard struct {
+	items map[string]data.LogRecordPos // 直接存储位置信息，减少每条数据的内存占用
+	lock  *sync.RWMutex
+}
+
+// NewHashIndex 初始化哈希索引
+func NewHashIndex() *HashIndex {
+	h := &HashIndex{size: new(atomic.Int64), keyBytes: new(atomic.Int64)}
+	for i := range h.shards {
+		h.shards[i] = &hashShard{
+			items: make(map[string]data.LogRecordPos),
+			lock:  new(sync.RWMutex),
+		}
+	}
+	return h
+}
+
+func (h *HashIndex) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
+	shard := h.shardOf(key)
+	shard.lock.Lock()
+	oldPos, ok := shard.items[string(key)]
+	shard.items[string(key)] = *pos
+	shard.lock.Unlock()
+	if !ok {
+		h.size.Add(1)
+		h.keyBytes.Add(int64(len(key)))
+		return nil
+	}
+	return &oldPos
+}
+
+func (h *HashIndex) Get(key []byte) *data.LogRecordPos {
+	shard := h.shardOf(key)
+	shard.lock.RLock()
+	pos, ok := shard.items[string(key)]
+	shard.lock.RUnlock()
+	if !ok {
+		return nil
+	}
+	return &pos
+}
+
+func (h *HashIndex) Delete(key []byte) (*data.LogRecordPos, bool) {
+	shard := h.shardOf(key)
+	shard.lock.Lock()
+	oldPos, ok := shard.items[string(key)]
+	if ok {
+		delete(shard.items, string(key))
+	}
+	shard.lock.Unlock()
+	if !ok {
+		return nil, false
+	}
+	h.size.Add(-1)
+	h.keyBytes.Add(-int64(len(key)))
+	return &oldPos, true
+}
+
+func (h *HashIndex) Size() int {
+	return int(h.size.Load())
+}
+
+func (h *HashIndex) Iterator(reverse bool) Iterator {
+	return h.IteratorWithOptions(IteratorOptions{Reverse: reverse})
+}
+
+// IteratorWithOptions 哈希索引本身是无序的，需要复制满足条件的所有 key 并排序，代价和索引的大小成正比
+func (h *HashIndex) IteratorWithOptions(opts IteratorOptions) Iterator {
+	rng := newKeyRange(opts)
+	var values []*Item
+	for _, shard := range h.shards {
+		shard.lock.RLock()
+		for key, pos := range shard.items {
+			if !rng.contains([]byte(key)) {
+				continue
+			}
+			pos := pos
+			values = append(values, &Item{key: []byte(key), pos: &pos})
+		}
+		shard.lock.RUnlock()
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if opts.Reverse {
+			return bytes.Compare(values[i].key, values[j].key) > 0
+		}
+		return bytes.Compare(values[i].key, values[j].key) < 0
+	})
+	return withLimit(&sliceIterator{
+		reverse: opts.Reverse,
+		values:  values,
+	}, opts.Limit)
+}
+
+func (h *HashIndex) Capabilities() Capabilities {
+	return Capabilities{Snapshot: true}
+}
+
+func (h *HashIndex) MemoryUsage() int64 {
+	return h.size.Load()*hashItemOverhead + h.keyBytes.Load()
+}
+
+func (h *HashIndex) Close() error {
+	return nil
+}
+
+// FNV-1a 哈希选择分片
+func (h *HashIndex) shardOf(key []byte) *hashShard {
+	var hash uint32 = 2166136261
+	for _, b := range key {
+		hash ^= uint32(b)
+		hash *= 16777619
+	}
+	return h.shards[hash&(hashShardNum-1)]
+}
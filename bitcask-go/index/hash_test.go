@@ -0,0 +1,100 @@
+package index
+
+import (
+	"bitcask-go/data"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+func TestHashIndex_Put(t *testing.T) {
+	h := NewHashIndex()
+
+	res1 := h.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 2})
+	assert.Nil(t, res1)
+
+	// 重复 Put 得到的是旧值
+	res2 := h.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 3})
+	assert.Equal(t, &data.LogRecordPos{Fid: 1, Offset: 2}, res2)
+	assert.Equal(t, 1, h.Size())
+}
+
+func TestHashIndex_Get(t *testing.T) {
+	h := NewHashIndex()
+
+	h.Put(nil, &data.LogRecordPos{Fid: 1, Offset: 100})
+	pos := h.Get(nil)
+	assert.Equal(t, uint32(1), pos.Fid)
+	assert.Equal(t, int64(100), pos.Offset)
+
+	h.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 2, Size: 10})
+	assert.Equal(t, &data.LogRecordPos{Fid: 1, Offset: 2, Size: 10}, h.Get([]byte("a")))
+	assert.Nil(t, h.Get([]byte("not exist")))
+}
+
+func TestHashIndex_Delete(t *testing.T) {
+	h := NewHashIndex()
+
+	res1, ok := h.Delete([]byte("a"))
+	assert.Nil(t, res1)
+	assert.False(t, ok)
+
+	h.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 2})
+	res2, ok := h.Delete([]byte("a"))
+	assert.True(t, ok)
+	assert.Equal(t, &data.LogRecordPos{Fid: 1, Offset: 2}, res2)
+	assert.Nil(t, h.Get([]byte("a")))
+	assert.Equal(t, 0, h.Size())
+}
+
+func TestHashIndex_Iterator(t *testing.T) {
+	h := NewHashIndex()
+	assert.False(t, h.Capabilities().Ordered)
+
+	// 空的索引
+	iter1 := h.Iterator(false)
+	assert.False(t, iter1.Valid())
+
+	for _, key := range []string{"ccde", "acee", "eede", "bbcd"} {
+		h.Put([]byte(key), &data.LogRecordPos{Fid: 1, Offset: 10})
+	}
+
+	// 哈希索引的迭代器也是有序的
+	var keys []string
+	iter2 := h.Iterator(false)
+	for iter2.Rewind(); iter2.Valid(); iter2.Next() {
+		keys = append(keys, string(iter2.Key()))
+		assert.NotNil(t, iter2.Value())
+	}
+	assert.Equal(t, []string{"acee", "bbcd", "ccde", "eede"}, keys)
+
+	iter3 := h.Iterator(true)
+	iter3.Seek([]byte("cc"))
+	assert.Equal(t, "bbcd", string(iter3.Key()))
+
+	iter4 := h.Iterator(false)
+	iter4.Seek([]byte("cc"))
+	assert.Equal(t, "ccde", string(iter4.Key()))
+}
+
+func TestHashIndex_Concurrent(t *testing.T) {
+	h := NewHashIndex()
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				key := []byte(fmt.Sprintf("key-%d-%d", i, j))
+				h.Put(key, &data.LogRecordPos{Fid: uint32(i), Offset: int64(j)})
+				assert.NotNil(t, h.Get(key))
+				if j%2 == 0 {
+					h.Delete(key)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, 4000, h.Size())
+}
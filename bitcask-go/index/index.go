@@ -20,13 +20,45 @@ type Indexer interface {
 	// Iterator 索引迭代器
 	Iterator(reverse bool) Iterator
 
+	// IteratorWithOptions 根据配置项创建索引迭代器，只遍历满足条件的 key
+	IteratorWithOptions(opts IteratorOptions) Iterator
+
 	// Size 返回索引中存在了多少条数据
 	Size() int
 
+	// Capabilities 返回索引具备的能力
+	Capabilities() Capabilities
+
+	// MemoryUsage 返回索引大致占用的内存字节数，存储在磁盘上的索引返回 0
+	MemoryUsage() int64
+
 	// Close 关闭索引迭代器
 	Close() error
 }
 
+// Err 返回索引读写磁盘时出现的错误，Indexer 的方法无法返回错误，出错的索引会记录下来
+// 索引不会出错或者没有出错时返回 nil
+func Err(idx Indexer) error {
+	if e, ok := idx.(interface{ Err() error }); ok {
+		return e.Err()
+	}
+	return nil
+}
+
+// Capabilities 索引具备的能力
+type Capabilities struct {
+	// Ordered 索引按照 key 的顺序组织，创建迭代器的代价很小
+	// 为 false 时迭代器仍然是有序的，但是每次创建都需要复制并排序所有的 key
+	Ordered bool
+
+	// Persistent 索引存储在磁盘上，重启之后不需要从数据文件中重建
+	Persistent bool
+
+	// Snapshot 迭代器遍历的是创建时刻的快照，之后的写入不可见
+	// 为 false 时遍历过程中的写入可能可见，需要一致的视图时使用 NewCopyIterator
+	Snapshot bool
+}
+
 type IndexType = int8
 
 const (
@@ -38,17 +70,52 @@ const (
 
 	// BPTree B+树索引
 	BPTree
+
+	// Hash 哈希索引
+	Hash
+
+	// Compact 紧凑索引
+	Compact
+
+	// Tiered 分层索引
+	Tiered
+
+	// SkipList 无锁跳表索引
+	SkipList
 )
 
+// Options 索引配置项，只对用到的索引类型生效
+type Options struct {
+	// B+ 树索引文件所在的目录，分层索引在这个目录中创建临时目录存放写入磁盘的数据，为空时使用系统的临时目录
+	DirPath string
+
+	// B+ 树索引每次写入是否持久化
+	SyncWrites bool
+
+	// 紧凑索引是否对相邻的 key 做前缀压缩
+	PrefixCompression bool
+
+	// 分层索引最多占用的内存字节数
+	MemoryBudget int64
+}
+
 // NewIndexer 根据类型初始化索引
-func NewIndexer(typ IndexType, dirPath string, sync bool) Indexer {
+func NewIndexer(typ IndexType, opts Options) Indexer {
 	switch typ {
 	case Btree:
 		return NewBTree()
 	case ART:
 		return NewART()
 	case BPTree:
-		return NewBPlusTree(dirPath, sync)
+		return NewBPlusTree(opts.DirPath, opts.SyncWrites)
+	case Hash:
+		return NewHashIndex()
+	case Compact:
+		return NewCompactIndex(opts.PrefixCompression)
+	case Tiered:
+		return NewTieredIndex(opts.DirPath, opts.MemoryBudget)
+	case SkipList:
+		return NewSkipListIndex()
 	default:
 		panic("unsupported index type")
 	}
@@ -63,6 +130,24 @@ func (ai *Item) Less(bi btree.Item) bool {
 	return bytes.Compare(ai.key, bi.(*Item).key) == -1
 }
 
+// IteratorOptions 索引迭代器配置项
+type IteratorOptions struct {
+	// 遍历前缀为指定值的 Key，默认为空
+	Prefix []byte
+	// 是否反向遍历，默认 false 是正向
+	Reverse bool
+	// 遍历的下界，默认包含下界本身，为空表示没有下界
+	LowerBound []byte
+	// 是否不包含下界本身
+	ExcludeLower bool
+	// 遍历的上界，默认不包含上界本身，为空表示没有上界
+	UpperBound []byte
+	// 是否包含上界本身
+	IncludeUpper bool
+	// 最多遍历的数据量，Rewind 或者 Seek 之后重新计数，0 表示不限制
+	Limit int
+}
+
 // Iterator 通用的索引迭代器接口
 type Iterator interface {
 	// Rewind 重新回到迭代器的起点，即第一个数据
@@ -0,0 +1,123 @@
+package index
+
+import (
+	"bitcask-go/data"
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"sort"
+	"testing"
+)
+
+// 按照迭代器配置项在有序的 key 中过滤出预期的结果
+func expectedKeys(keys []string, opts IteratorOptions, seek []byte) []string {
+	var res []string
+	for _, key := range keys {
+		if !bytes.HasPrefix([]byte(key), opts.Prefix) {
+			continue
+		}
+		if seek != nil && !opts.Reverse && key < string(seek) {
+			continue
+		}
+		if seek != nil && opts.Reverse && key > string(seek) {
+			continue
+		}
+		res = append(res, key)
+	}
+	if opts.Reverse {
+		for i, j := 0, len(res)-1; i < j; i, j = i+1, j-1 {
+			res[i], res[j] = res[j], res[i]
+		}
+	}
+	return res
+}
+
+func TestIndexer_IteratorWithOptions(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-index-iterator")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	bpt := NewBPlusTree(dir, false)
+	defer bpt.Close()
+
+	tiered := NewTieredIndex(dir, 1024)
+	defer tiered.Close()
+
+	indexers := map[string]Indexer{
+		"tiered":   tiered,
+		"btree":    NewBTree(),
+		"art":      NewART(),
+		"hash":     NewHashIndex(),
+		"compact":  NewCompactIndex(true),
+		"skiplist": NewSkipListIndex(),
+		"bptree":   bpt,
+	}
+
+	// 数据量超过 BTree 迭代器一个批次的大小
+	var keys []string
+	for i := 0; i < 300; i++ {
+		keys = append(keys, fmt.Sprintf("key-%d-%03d", i%3, i))
+	}
+	keys = append(keys, "a", "key-", "key.", "\\xff\\xff", "\\xff\\xff\\x01")
+	keys = append(keys, "\xff", "\xff\xff", "\xff\xff\x01")
+	sort.Strings(keys)
+
+	for name, indexer := range indexers {
+		for _, key := range keys {
+			indexer.Put([]byte(key), &data.LogRecordPos{Fid: 1, Offset: int64(len(key))})
+		}
+
+		for _, prefix := range []string{"", "key-", "key-1", "key-2-29", "none", "\xff", "\xff\xff"} {
+			for _, reverse := range []bool{false, true} {
+				opts := IteratorOptions{Prefix: []byte(prefix), Reverse: reverse}
+				iter := indexer.IteratorWithOptions(opts)
+
+				var got []string
+				for iter.Rewind(); iter.Valid(); iter.Next() {
+					got = append(got, string(iter.Key()))
+					assert.Equal(t, int64(len(iter.Key())), iter.Value().Offset)
+				}
+				assert.Equal(t, expectedKeys(keys, opts, nil), got, "%s prefix=%q reverse=%v", name, prefix, reverse)
+
+				for _, seek := range []string{"", "key-1-1", "key-1-100", "zzz"} {
+					got = nil
+					for iter.Seek([]byte(seek)); iter.Valid(); iter.Next() {
+						got = append(got, string(iter.Key()))
+					}
+					assert.Equal(t, expectedKeys(keys, opts, []byte(seek)), got, "%s prefix=%q reverse=%v seek=%q", name, prefix, reverse, seek)
+				}
+				iter.Close()
+			}
+		}
+	}
+}
+
+func TestBTree_IteratorSnapshot(t *testing.T) {
+	bt := NewBTree()
+	for i := 0; i < 200; i++ {
+		bt.Put([]byte(fmt.Sprintf("key-%03d", i)), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+
+	// 迭代器创建之后的写入不影响遍历的结果
+	iter := bt.IteratorWithOptions(IteratorOptions{Prefix: []byte("key-")})
+	defer iter.Close()
+	for i := 0; i < 200; i++ {
+		key := []byte(fmt.Sprintf("key-%03d", i))
+		if i%2 == 0 {
+			bt.Delete(key)
+		} else {
+			bt.Put(key, &data.LogRecordPos{Fid: 2, Offset: int64(i)})
+		}
+	}
+	bt.Put([]byte("key-999"), &data.LogRecordPos{Fid: 2})
+
+	var count int
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		assert.Equal(t, fmt.Sprintf("key-%03d", count), string(iter.Key()))
+		assert.Equal(t, uint32(1), iter.Value().Fid)
+		count++
+	}
+	assert.Equal(t, 200, count)
+	assert.Equal(t, 101, bt.Size())
+}
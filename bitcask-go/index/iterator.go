@@ -0,0 +1,367 @@
+package index
+
+import (
+	"bitcask-go/data"
+	"bytes"
+	"sort"
+)
+
+// 迭代器遍历的 key 的范围，前缀也会转换为范围
+type keyRange struct {
+	lower          []byte // 为空表示没有下界
+	lowerExclusive bool
+	upper          []byte // 为空表示没有上界
+	upperInclusive bool
+}
+
+func newKeyRange(opts IteratorOptions) keyRange {
+	r := keyRange{
+		lower:          opts.LowerBound,
+		lowerExclusive: opts.ExcludeLower,
+		upper:          opts.UpperBound,
+		upperInclusive: opts.IncludeUpper,
+	}
+	// 空的边界和 nil 一样表示没有边界，统一为 nil，遍历时 nil 的起点表示从头（或尾）开始
+	if len(r.lower) == 0 {
+		r.lower = nil
+	}
+	if len(r.upper) == 0 {
+		r.upper = nil
+	}
+	if len(opts.Prefix) == 0 {
+		return r
+	}
+	// 前缀为 prefix 的 key 在 [prefix, prefixUpperBound(prefix)) 之间，取两个范围的交集
+	if len(r.lower) == 0 || bytes.Compare(opts.Prefix, r.lower) > 0 {
+		r.lower, r.lowerExclusive = opts.Prefix, false
+	}
+	upper := prefixUpperBound(opts.Prefix)
+	if len(upper) > 0 && (len(r.upper) == 0 || bytes.Compare(upper, r.upper) <= 0) {
+		r.upper, r.upperInclusive = upper, false
+	}
+	return r
+}
+
+// key 是否满足下界
+func (r keyRange) aboveLower(key []byte) bool {
+	if len(r.lower) == 0 {
+		return true
+	}
+	cmp := bytes.Compare(key, r.lower)
+	return cmp > 0 || (cmp == 0 && !r.lowerExclusive)
+}
+
+// key 是否满足上界
+func (r keyRange) belowUpper(key []byte) bool {
+	if len(r.upper) == 0 {
+		return true
+	}
+	cmp := bytes.Compare(key, r.upper)
+	return cmp < 0 || (cmp == 0 && r.upperInclusive)
+}
+
+func (r keyRange) contains(key []byte) bool {
+	return r.aboveLower(key) && r.belowUpper(key)
+}
+
+// 限制遍历数据量的迭代器
+type limitIterator struct {
+	Iterator
+	limit int
+	count int
+}
+
+func withLimit(iter Iterator, limit int) Iterator {
+	if limit <= 0 {
+		return iter
+	}
+	return &limitIterator{Iterator: iter, limit: limit}
+}
+
+func (li *limitIterator) Rewind() {
+	li.Iterator.Rewind()
+	li.count = 0
+}
+
+func (li *limitIterator) Seek(key []byte) {
+	li.Iterator.Seek(key)
+	li.count = 0
+}
+
+func (li *limitIterator) Next() {
+	li.Iterator.Next()
+	li.count++
+}
+
+func (li *limitIterator) Valid() bool {
+	return li.count < li.limit && li.Iterator.Valid()
+}
+
+// 按顺序逐条取出数据的游标
+type cursor interface {
+	valid() bool
+	item() *Item
+	next()
+}
+
+// 归并多个有序的游标，相同的 key 以排在前面的游标中的数据为准
+type mergeCursor struct {
+	cursors []cursor
+	reverse bool
+	skip    func(item *Item) bool // 跳过的数据，可以为空
+	curr    *Item
+}
+
+func newMergeCursor(cursors []cursor, reverse bool, skip func(item *Item) bool) *mergeCursor {
+	mc := &mergeCursor{cursors: cursors, reverse: reverse, skip: skip}
+	mc.next()
+	return mc
+}
+
+func (mc *mergeCursor) valid() bool {
+	return mc.curr != nil
+}
+
+func (mc *mergeCursor) item() *Item {
+	return mc.curr
+}
+
+func (mc *mergeCursor) next() {
+	for {
+		// 取出所有游标中最小（反向时最大）的 key，相同时取排在前面的
+		mc.curr = nil
+		for _, c := range mc.cursors {
+			if !c.valid() {
+				continue
+			}
+			if mc.curr == nil {
+				mc.curr = c.item()
+				continue
+			}
+			cmp := bytes.Compare(c.item().key, mc.curr.key)
+			if (!mc.reverse && cmp < 0) || (mc.reverse && cmp > 0) {
+				mc.curr = c.item()
+			}
+		}
+		if mc.curr == nil {
+			return
+		}
+		// 所有游标都跳过这个 key
+		for _, c := range mc.cursors {
+			if c.valid() && bytes.Equal(c.item().key, mc.curr.key) {
+				c.next()
+			}
+		}
+		if mc.skip == nil || !mc.skip(mc.curr) {
+			return
+		}
+	}
+}
+
+// 有序的只读快照，可以从指定的位置开始遍历
+type orderedSnapshot interface {
+	// ascend 从第一个大于等于 pivot 的 key 开始正向遍历，pivot 为空表示从头开始，fn 返回 false 时停止
+	ascend(pivot []byte, fn func(item *Item) bool)
+
+	// descend 从最后一个小于等于 pivot 的 key 开始反向遍历，pivot 为空表示从尾开始，fn 返回 false 时停止
+	descend(pivot []byte, fn func(item *Item) bool)
+}
+
+// 迭代器每次从快照中取出的数据条数
+const snapshotIteratorBatchSize = 64
+
+// 遍历有序快照的迭代器，遍历时按批次从快照中取出数据，不会复制所有的数据
+type snapshotIterator struct {
+	snapshot  orderedSnapshot
+	reverse   bool     // 是否是反向遍历
+	rng       keyRange // 遍历的范围
+	items     []*Item  // 当前批次的数据
+	currIndex int      // 当前遍历位置
+	exhausted bool     // 当前批次之后是否已经没有数据
+}
+
+func newSnapshotIterator(snapshot orderedSnapshot, opts IteratorOptions) *snapshotIterator {
+	si := &snapshotIterator{
+		snapshot: snapshot,
+		reverse:  opts.Reverse,
+		rng:      newKeyRange(opts),
+	}
+	si.Rewind()
+	return si
+}
+
+// Rewind 重新回到迭代器的起点，即第一个数据
+func (si *snapshotIterator) Rewind() {
+	if si.reverse {
+		si.fill(si.rng.upper, true)
+	} else {
+		si.fill(si.rng.lower, true)
+	}
+}
+
+// Seek 根据传入的 key 查找第一个大于(或小于)等于的目标key，从这个key开始遍历
+func (si *snapshotIterator) Seek(key []byte) {
+	if si.reverse {
+		if len(si.rng.upper) > 0 && bytes.Compare(key, si.rng.upper) > 0 {
+			key = si.rng.upper
+		}
+	} else if len(si.rng.lower) > 0 && bytes.Compare(key, si.rng.lower) < 0 {
+		key = si.rng.lower
+	}
+	si.fill(key, true)
+}
+
+// Next 跳转到下一个key
+func (si *snapshotIterator) Next() {
+	si.currIndex += 1
+	if si.currIndex == len(si.items) && !si.exhausted {
+		// 从当前批次的最后一个 key 之后继续取数据
+		si.fill(si.items[len(si.items)-1].key, false)
+	}
+}
+
+// Valid 当前遍历的位置的
+func (si *snapshotIterator) Valid() bool {
+	return si.currIndex < len(si.items)
+}
+
+// Key 当前遍历位置的 Key 数据
+func (si *snapshotIterator) Key() []byte {
+	return si.items[si.currIndex].key
+}
+
+// Value 当前遍历位置的 Value 数据
+func (si *snapshotIterator) Value() *data.LogRecordPos {
+	return si.items[si.currIndex].pos
+}
+
+// Close 关闭迭代器，释放相应资源
+func (si *snapshotIterator) Close() {
+	si.snapshot = nil
+	si.items = nil
+	si.exhausted = true
+}
+
+// 从 pivot 开始取出一批数据，pivot 为空表示从头（或尾）开始，inclusive 表示是否包含 pivot 本身
+func (si *snapshotIterator) fill(pivot []byte, inclusive bool) {
+	si.items = si.items[:0]
+	si.currIndex = 0
+	si.exhausted = true
+	if si.snapshot == nil {
+		return
+	}
+
+	saveItems := func(item *Item) bool {
+		if !inclusive && bytes.Equal(item.key, pivot) {
+			return true
+		}
+		// 起点一侧的边界不满足时跳过，另一侧的边界不满足时说明已经遍历完
+		if si.reverse {
+			if !si.rng.belowUpper(item.key) {
+				return true
+			}
+			if !si.rng.aboveLower(item.key) {
+				return false
+			}
+		} else {
+			if !si.rng.aboveLower(item.key) {
+				return true
+			}
+			if !si.rng.belowUpper(item.key) {
+				return false
+			}
+		}
+		if len(si.items) == snapshotIteratorBatchSize {
+			si.exhausted = false
+			return false
+		}
+		si.items = append(si.items, item)
+		return true
+	}
+
+	if si.reverse {
+		si.snapshot.descend(pivot, saveItems)
+	} else {
+		si.snapshot.ascend(pivot, saveItems)
+	}
+}
+
+// NewCopyIterator 在创建时复制 indexer 中满足条件的所有数据，得到和创建时刻一致的视图
+// 用于迭代器不是快照的索引，调用方需要保证复制期间没有写入，代价和数据的条数成正比
+func NewCopyIterator(indexer Indexer, opts IteratorOptions) Iterator {
+	// 复制所有满足范围的数据，Seek 之后仍然可以取满 Limit 条
+	limit := opts.Limit
+	opts.Limit = 0
+	iter := indexer.IteratorWithOptions(opts)
+	defer iter.Close()
+	var values []*Item
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		values = append(values, &Item{key: iter.Key(), pos: iter.Value()})
+	}
+	return withLimit(&sliceIterator{
+		reverse: opts.Reverse,
+		values:  values,
+	}, limit)
+}
+
+// 基于有序切片的迭代器，创建时复制所有需要遍历的数据
+type sliceIterator struct {
+	currIndex int     // 当前遍历位置
+	reverse   bool    // 是否是反向遍历
+	values    []*Item // key+位置索引信息
+}
+
+// Rewind 重新回到迭代器的起点，即第一个数据
+func (si *sliceIterator) Rewind() {
+	si.currIndex = 0
+}
+
+// Seek 根据传入的 key 查找第一个大于(或小于)等于的目标key，从这个key开始遍历
+func (si *sliceIterator) Seek(key []byte) {
+	if si.reverse {
+		si.currIndex = sort.Search(len(si.values), func(i int) bool {
+			return bytes.Compare(si.values[i].key, key) <= 0
+		})
+	} else {
+		si.currIndex = sort.Search(len(si.values), func(i int) bool {
+			return bytes.Compare(si.values[i].key, key) >= 0
+		})
+	}
+}
+
+// Next 跳转到下一个key
+func (si *sliceIterator) Next() {
+	si.currIndex += 1
+}
+
+// Valid 当前遍历的位置的
+func (si *sliceIterator) Valid() bool {
+	return si.currIndex < len(si.values)
+}
+
+// Key 当前遍历位置的 Key 数据
+func (si *sliceIterator) Key() []byte {
+	return si.values[si.currIndex].key
+}
+
+// Value 当前遍历位置的 Value 数据
+func (si *sliceIterator) Value() *data.LogRecordPos {
+	return si.values[si.currIndex].pos
+}
+
+// Close 关闭迭代器，释放相应资源
+func (si *sliceIterator) Close() {
+	si.values = nil
+}
+
+// 前缀的上界，即大于所有以 prefix 开头的 key 的最小值，不存在时返回 nil
+func prefixUpperBound(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xff {
+			upper := append([]byte(nil), prefix[:i+1]...)
+			upper[i]++
+			return upper
+		}
+	}
+	return nil
+}
@@ -0,0 +1,276 @@
+package index
+
+import (
+	"bitcask-go/data"
+	"bytes"
+	"math/rand"
+	"sync/atomic"
+	"unsafe"
+)
+
+// SkipListIndex 无锁的并发跳表索引
+// 写入通过 CAS 修改节点之间的链接，不需要全局锁，并发写入不同的 key 时互不阻塞
+// 删除先把节点的位置信息替换为删除标记，再依次标记节点每一层的链接，最后由查找的过程把节点从链表中摘除
+// 迭代器直接沿着链表遍历，不会复制整个索引，但是遍历的不是快照，遍历过程中的写入可能可见也可能不可见
+// 需要一致的视图时，在阻止写入的同时通过 NewCopyIterator 复制一份数据
+type SkipListIndex struct {
+	head     *skipNode
+	size     atomic.Int64
+	keyBytes atomic.Int64 // 所有 key 的总长度
+}
+
+const (
+	// 跳表的最大层数，每一层的节点数量是下一层的 1/4，可以容纳 4^16 个节点
+	skipListMaxLevel = 16
+	// 节点升高一层的概率为 1/4
+	skipListLevelShift = 2
+)
+
+// 每条数据除了 key 之外大致占用的内存：节点、位置信息以及链接，每个节点平均有 4/3 层，按照 2 层估算
+const skipListItemOverhead = int64(unsafe.Sizeof(skipNode{})+unsafe.Sizeof(data.LogRecordPos{})) +
+	2*(8+int64(unsafe.Sizeof(skipLink{})))
+
+// 被删除的节点的位置信息，只比较指针
+var skipListTombstone = &data.LogRecordPos{}
+
+// 跳表的节点，key 在创建之后不会再被修改
+type skipNode struct {
+	key  []byte
+	pos  atomic.Pointer[data.LogRecordPos] // 为 skipListTombstone 时表示节点已经被删除
+	next []atomic.Pointer[skipLink]        // 每一层指向下一个节点的链接
+}
+
+// 节点之间的链接，创建之后不会再被修改，通过替换整个链接来修改指向的节点或者标记
+type skipLink struct {
+	node   *skipNode
+	marked bool // 链接所在的节点已经被删除，不能再在这个节点之后插入新的节点
+}
+
+// NewSkipListIndex 初始化跳表索引
+func NewSkipListIndex() *SkipListIndex {
+	return &SkipListIndex{head: newSkipNode(nil, skipListMaxLevel)}
+}
+
+func newSkipNode(key []byte, level int) *skipNode {
+	n := &skipNode{key: key, next: make([]atomic.Pointer[skipLink], level)}
+	for i := range n.next {
+		n.next[i].Store(&skipLink{})
+	}
+	return n
+}
+
+func (sl *SkipListIndex) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
+	var preds, succs [skipListMaxLevel]*skipNode
+	var predLinks [skipListMaxLevel]*skipLink
+	level := randomSkipListLevel()
+	for {
+		if node := sl.find(key, &preds, &succs, &predLinks); node != nil {
+			// key 已经存在，原子地替换位置信息
+			oldPos := node.pos.Load()
+			if oldPos == skipListTombstone {
+				// 节点正在被删除，协助完成删除之后重试
+				node.markLinks()
+				continue
+			}
+			if node.pos.CompareAndSwap(oldPos, pos) {
+				return oldPos
+			}
+			continue
+		}
+
+		node := newSkipNode(key, level)
+		node.pos.Store(pos)
+		for i := 0; i < level; i++ {
+			node.next[i].Store(&skipLink{node: succs[i]})
+		}
+		// 链接到最底层之后节点就可见了
+		if !preds[0].next[0].CompareAndSwap(predLinks[0], &skipLink{node: node}) {
+			continue
+		}
+		sl.size.Add(1)
+		sl.keyBytes.Add(int64(len(key)))
+		sl.linkUpperLevels(node, &preds, &succs, &predLinks)
+		return nil
+	}
+}
+
+// 依次把节点链接到更高的层，节点在这个过程中被删除时停止
+func (sl *SkipListIndex) linkUpperLevels(node *skipNode, preds, succs *[skipListMaxLevel]*skipNode,
+	predLinks *[skipListMaxLevel]*skipLink) {
+	for i := 1; i < len(node.next); i++ {
+		for {
+			link := node.next[i].Load()
+			if link.marked {
+				return
+			}
+			if link.node != succs[i] && !node.next[i].CompareAndSwap(link, &skipLink{node: succs[i]}) {
+				continue
+			}
+			if preds[i].next[i].CompareAndSwap(predLinks[i], &skipLink{node: node}) {
+				break
+			}
+			// 前驱节点发生了变化，重新查找
+			if sl.find(node.key, preds, succs, predLinks) != node {
+				return
+			}
+		}
+	}
+}
+
+// Get 不需要加锁，也不会修改链表
+func (sl *SkipListIndex) Get(key []byte) *data.LogRecordPos {
+	pred := sl.lastBefore(func(k []byte) bool { return bytes.Compare(k, key) < 0 })
+	node := pred.next[0].Load().node
+	if node == nil || !bytes.Equal(node.key, key) {
+		return nil
+	}
+	if pos := node.pos.Load(); pos != skipListTombstone {
+		return pos
+	}
+	return nil
+}
+
+func (sl *SkipListIndex) Delete(key []byte) (*data.LogRecordPos, bool) {
+	var preds, succs [skipListMaxLevel]*skipNode
+	var predLinks [skipListMaxLevel]*skipLink
+	node := sl.find(key, &preds, &succs, &predLinks)
+	if node == nil {
+		return nil, false
+	}
+	for {
+		oldPos := node.pos.Load()
+		if oldPos == skipListTombstone {
+			return nil, false
+		}
+		if node.pos.CompareAndSwap(oldPos, skipListTombstone) {
+			sl.size.Add(-1)
+			sl.keyBytes.Add(-int64(len(key)))
+			// 标记所有层的链接，再通过查找把节点从链表中摘除
+			node.markLinks()
+			sl.find(key, &preds, &succs, &predLinks)
+			return oldPos, true
+		}
+	}
+}
+
+func (sl *SkipListIndex) Size() int {
+	return int(sl.size.Load())
+}
+
+func (sl *SkipListIndex) Iterator(reverse bool) Iterator {
+	return sl.IteratorWithOptions(IteratorOptions{Reverse: reverse})
+}
+
+// IteratorWithOptions 沿着链表按批次取出数据，不会复制整个索引，遍历的不是快照
+func (sl *SkipListIndex) IteratorWithOptions(opts IteratorOptions) Iterator {
+	return withLimit(newSnapshotIterator(sl, opts), opts.Limit)
+}
+
+func (sl *SkipListIndex) Capabilities() Capabilities {
+	return Capabilities{Ordered: true}
+}
+
+func (sl *SkipListIndex) MemoryUsage() int64 {
+	return sl.size.Load()*skipListItemOverhead + sl.keyBytes.Load()
+}
+
+func (sl *SkipListIndex) Close() error {
+	return nil
+}
+
+// 查找 key 在每一层的前驱和后继节点，查找的过程中摘除已经被删除的节点
+// 返回 key 对应的节点，不存在时返回 nil
+func (sl *SkipListIndex) find(key []byte, preds, succs *[skipListMaxLevel]*skipNode,
+	predLinks *[skipListMaxLevel]*skipLink) *skipNode {
+retry:
+	pred := sl.head
+	for i := skipListMaxLevel - 1; i >= 0; i-- {
+		predLink := pred.next[i].Load()
+		if predLink.marked {
+			goto retry
+		}
+		curr := predLink.node
+		for curr != nil {
+			link := curr.next[i].Load()
+			if link.marked {
+				// curr 已经被删除，从这一层中摘除
+				newLink := &skipLink{node: link.node}
+				if !pred.next[i].CompareAndSwap(predLink, newLink) {
+					goto retry
+				}
+				predLink, curr = newLink, link.node
+				continue
+			}
+			if bytes.Compare(curr.key, key) >= 0 {
+				break
+			}
+			pred, predLink, curr = curr, link, link.node
+		}
+		preds[i], succs[i], predLinks[i] = pred, curr, predLink
+	}
+	if succ := succs[0]; succ != nil && bytes.Equal(succ.key, key) {
+		return succ
+	}
+	return nil
+}
+
+// 从高层到低层找到最后一个满足 before 的节点，不存在时返回头节点
+// 只读取链表，被删除但还没有摘除的节点也会被经过
+func (sl *SkipListIndex) lastBefore(before func(key []byte) bool) *skipNode {
+	pred := sl.head
+	for i := skipListMaxLevel - 1; i >= 0; i-- {
+		for {
+			next := pred.next[i].Load().node
+			if next == nil || !before(next.key) {
+				break
+			}
+			pred = next
+		}
+	}
+	return pred
+}
+
+// 从高层到低层依次标记节点的所有链接，已经标记过的链接不会再被修改
+func (n *skipNode) markLinks() {
+	for i := len(n.next) - 1; i >= 0; i-- {
+		for {
+			link := n.next[i].Load()
+			if link.marked || n.next[i].CompareAndSwap(link, &skipLink{node: link.node, marked: true}) {
+				break
+			}
+		}
+	}
+}
+
+func (sl *SkipListIndex) ascend(pivot []byte, fn func(item *Item) bool) {
+	node := sl.head
+	if pivot != nil {
+		node = sl.lastBefore(func(key []byte) bool { return bytes.Compare(key, pivot) < 0 })
+	}
+	for node = node.next[0].Load().node; node != nil; node = node.next[0].Load().node {
+		if pos := node.pos.Load(); pos != skipListTombstone && !fn(&Item{key: node.key, pos: pos}) {
+			return
+		}
+	}
+}
+
+// 链表只有正向的链接，每次反向移动都需要重新查找前驱节点
+func (sl *SkipListIndex) descend(pivot []byte, fn func(item *Item) bool) {
+	node := sl.lastBefore(func(key []byte) bool { return pivot == nil || bytes.Compare(key, pivot) <= 0 })
+	for node != sl.head {
+		if pos := node.pos.Load(); pos != skipListTombstone && !fn(&Item{key: node.key, pos: pos}) {
+			return
+		}
+		key := node.key
+		node = sl.lastBefore(func(k []byte) bool { return bytes.Compare(k, key) < 0 })
+	}
+}
+
+// 随机生成节点的层数，升高一层的概率为 1/4
+func randomSkipListLevel() int {
+	level := 1
+	for r := rand.Uint32(); level < skipListMaxLevel && r&(1<<skipListLevelShift-1) == 0; r >>= skipListLevelShift {
+		level++
+	}
+	return level
+}
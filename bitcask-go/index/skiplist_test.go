@@ -0,0 +1,208 @@
+package index
+
+import (
+	"bitcask-go/data"
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+func TestSkipListIndex_Put(t *testing.T) {
+	sl := NewSkipListIndex()
+	res1 := sl.Put(nil, &data.LogRecordPos{Fid: 1, Offset: 100})
+	assert.Nil(t, res1)
+	res2 := sl.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 2})
+	assert.Nil(t, res2)
+	res3 := sl.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 3})
+	assert.Equal(t, &data.LogRecordPos{Fid: 1, Offset: 2}, res3)
+	assert.Equal(t, 2, sl.Size())
+
+	assert.Equal(t, &data.LogRecordPos{Fid: 1, Offset: 100}, sl.Get(nil))
+	assert.Equal(t, &data.LogRecordPos{Fid: 1, Offset: 3}, sl.Get([]byte("a")))
+	assert.Nil(t, sl.Get([]byte("b")))
+}
+
+func TestSkipListIndex_Delete(t *testing.T) {
+	sl := NewSkipListIndex()
+	pos, ok := sl.Delete([]byte("not-exist"))
+	assert.Nil(t, pos)
+	assert.False(t, ok)
+
+	sl.Put([]byte("aac"), &data.LogRecordPos{Fid: 1, Offset: 11})
+	pos, ok = sl.Delete([]byte("aac"))
+	assert.True(t, ok)
+	assert.Equal(t, &data.LogRecordPos{Fid: 1, Offset: 11}, pos)
+	assert.Nil(t, sl.Get([]byte("aac")))
+	_, ok = sl.Delete([]byte("aac"))
+	assert.False(t, ok)
+
+	// 删除之后可以重新写入
+	res := sl.Put([]byte("aac"), &data.LogRecordPos{Fid: 2, Offset: 22})
+	assert.Nil(t, res)
+	assert.Equal(t, &data.LogRecordPos{Fid: 2, Offset: 22}, sl.Get([]byte("aac")))
+	assert.Equal(t, 1, sl.Size())
+	assert.Equal(t, skipListItemOverhead+3, sl.MemoryUsage())
+}
+
+// 随机的读写和 BTree 的结果保持一致
+func TestSkipListIndex_CompareWithBTree(t *testing.T) {
+	sl := NewSkipListIndex()
+	ref := NewBTree()
+	rnd := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 20000; i++ {
+		key := []byte(fmt.Sprintf("key-%d", rnd.Intn(2000)))
+		if rnd.Intn(3) == 0 {
+			pos1, ok1 := sl.Delete(key)
+			pos2, ok2 := ref.Delete(key)
+			assert.Equal(t, ok2, ok1)
+			assert.Equal(t, pos2, pos1)
+		} else {
+			pos := &data.LogRecordPos{Fid: uint32(i % 7), Offset: int64(i)}
+			assert.Equal(t, ref.Put(key, pos), sl.Put(key, pos))
+		}
+		assert.Equal(t, ref.Get(key), sl.Get(key))
+	}
+	assert.Equal(t, ref.Size(), sl.Size())
+
+	for _, reverse := range []bool{false, true} {
+		iter1, iter2 := sl.Iterator(reverse), ref.Iterator(reverse)
+		iter1.Rewind()
+		for iter2.Rewind(); iter2.Valid(); iter2.Next() {
+			assert.True(t, iter1.Valid())
+			assert.Equal(t, iter2.Key(), iter1.Key())
+			assert.Equal(t, iter2.Value(), iter1.Value())
+			iter1.Next()
+		}
+		assert.False(t, iter1.Valid())
+		iter1.Close()
+		iter2.Close()
+	}
+}
+
+// 并发写入和删除，每个写入者负责一部分 key，结束之后的结果和串行执行一致
+func TestSkipListIndex_Concurrent(t *testing.T) {
+	sl := NewSkipListIndex()
+	const writers, keyNum = 8, 2000
+
+	wg := new(sync.WaitGroup)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for round := uint32(1); round <= 5; round++ {
+				for i := w; i < keyNum; i += writers {
+					key := []byte(fmt.Sprintf("key-%05d", i))
+					sl.Put(key, &data.LogRecordPos{Fid: round, Offset: int64(i)})
+					// 奇数的 key 最后被删除
+					if i%2 == 1 {
+						_, ok := sl.Delete(key)
+						assert.True(t, ok)
+					}
+				}
+			}
+		}(w)
+	}
+
+	// 写入的同时遍历，key 始终有序
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for r := 0; r < 20; r++ {
+			for _, reverse := range []bool{false, true} {
+				iter := sl.Iterator(reverse)
+				var prev []byte
+				for iter.Rewind(); iter.Valid(); iter.Next() {
+					if prev != nil {
+						assert.Equal(t, !reverse, bytes.Compare(prev, iter.Key()) < 0)
+					}
+					prev = iter.Key()
+				}
+				iter.Close()
+			}
+		}
+	}()
+	wg.Wait()
+
+	assert.Equal(t, keyNum/2, sl.Size())
+	for i := 0; i < keyNum; i++ {
+		pos := sl.Get([]byte(fmt.Sprintf("key-%05d", i)))
+		if i%2 == 1 {
+			assert.Nil(t, pos)
+		} else {
+			assert.Equal(t, &data.LogRecordPos{Fid: 5, Offset: int64(i)}, pos)
+		}
+	}
+
+	// 被删除的节点已经从最底层的链表中摘除
+	var nodes int
+	for n := sl.head.next[0].Load().node; n != nil; n = n.next[0].Load().node {
+		nodes++
+	}
+	assert.Equal(t, keyNum/2, nodes)
+}
+
+// 多个写入者并发地写入和删除相同的 key，结束之后数量和遍历的结果一致
+func TestSkipListIndex_ConcurrentSameKeys(t *testing.T) {
+	sl := NewSkipListIndex()
+	wg := new(sync.WaitGroup)
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(int64(w)))
+			for i := 0; i < 20000; i++ {
+				key := []byte(fmt.Sprintf("key-%d", rnd.Intn(100)))
+				if rnd.Intn(2) == 0 {
+					sl.Delete(key)
+				} else {
+					sl.Put(key, &data.LogRecordPos{Fid: uint32(w), Offset: int64(i)})
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	var count int
+	iter := sl.Iterator(false)
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		assert.Equal(t, iter.Value(), sl.Get(iter.Key()))
+		count++
+	}
+	iter.Close()
+	assert.Equal(t, sl.Size(), count)
+}
+
+func TestSkipListIndex_CopyIterator(t *testing.T) {
+	sl := NewSkipListIndex()
+	assert.False(t, sl.Capabilities().Snapshot)
+	for i := 0; i < 10; i++ {
+		sl.Put([]byte(fmt.Sprintf("key-%d", i)), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+
+	iter := NewCopyIterator(sl, IteratorOptions{Prefix: []byte("key-"), Limit: 3})
+	defer iter.Close()
+	// 创建之后的写入和删除对迭代器不可见
+	sl.Put([]byte("key-10"), &data.LogRecordPos{Fid: 1, Offset: 10})
+	sl.Put([]byte("key-1"), &data.LogRecordPos{Fid: 2, Offset: 1})
+	sl.Delete([]byte("key-2"))
+
+	var keys []string
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		keys = append(keys, string(iter.Key()))
+	}
+	assert.Equal(t, []string{"key-0", "key-1", "key-2"}, keys)
+
+	iter.Seek([]byte("key-1"))
+	assert.Equal(t, &data.LogRecordPos{Fid: 1, Offset: 1}, iter.Value())
+
+	// Seek 之后仍然可以取满 Limit 条
+	keys = keys[:0]
+	for iter.Seek([]byte("key-5")); iter.Valid(); iter.Next() {
+		keys = append(keys, string(iter.Key()))
+	}
+	assert.Equal(t, []string{"key-5", "key-6", "key-7"}, keys)
+}
@@ -0,0 +1,604 @@
+package index
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/utils"
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/google/btree"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+const (
+	// 存放写入磁盘的数据的临时目录的前缀
+	tieredSpillDirPrefix = "index-spill-"
+	tieredRunFileSuffix  = ".run"
+	// 每个 run 的布隆过滤器的误判率
+	tieredBloomFalsePositive = 0.01
+	// 删除标记的位置信息中的 Offset，正常的数据不会有负数的偏移
+	tieredTombstoneOffset = -1
+	// 内存中的数据至少可以使用预算的几分之一，磁盘上的数据的元信息占满预算时也不会频繁地写入磁盘
+	tieredMinMemFraction = 4
+)
+
+// SpillDirPattern 分层索引的临时目录的名称格式，备份时需要排除
+const SpillDirPattern = tieredSpillDirPrefix + "*"
+
+// TieredIndex 分层索引，key 的数量超过内存能够容纳的范围时使用
+// 最近写入的 key 保存在内存的 BTree 中，占用的内存超过预算之后在后台按顺序写入磁盘，成为一个不可变的有序文件（run）
+// run 和紧凑索引的块使用相同的编码，内存中只保留每个块的第一个 key 以及每个 run 的布隆过滤器，查找不存在的 key 大多数时候不需要读取磁盘
+// 写入磁盘之后，大小接近的相邻的 run 合并为一个，run 的数量和 key 的数量是对数关系
+// 索引在重启之后从 hint 文件和数据文件中重建，磁盘上的 run 只在运行期间使用，不会跨重启保留
+// 重建时所有的 key 重新经过内存并再次写入磁盘，启动耗时比 BTree 更长，见 benchmark 中的 Benchmark_Open
+// 读写磁盘出错时索引的方法无法返回错误，第一个错误记录下来通过 Err 获取，写入失败之后数据保留在内存中
+type TieredIndex struct {
+	mem              *btree.BTreeG[compactDelta] // 内存中的数据，包括磁盘上的 key 的删除标记
+	memKeyBytes      int64                       // 内存中的 key 占用的内存
+	spilling         *btree.BTreeG[compactDelta] // 正在后台写入磁盘的数据，写入完成之前不会再修改
+	spillingKeyBytes int64                       // 正在写入磁盘的 key 占用的内存
+	runs             []*tieredRun                // 磁盘上的数据，从新到旧排列
+	runsMemory       int64                       // run 的元信息占用的内存
+	size             int
+	budget           int64
+	dirPath          string // 在这个目录中创建临时目录，为空时使用系统的临时目录
+	spillDir         string // 写入第一个 run 的时候创建
+	nextRunId        uint32
+	err              *tieredError
+	lock             *sync.RWMutex
+	spilled          *sync.Cond // 后台写入完成时通知
+}
+
+// 记录读写磁盘时出现的第一个错误
+type tieredError struct {
+	mu  sync.Mutex
+	err error
+}
+
+// 磁盘上的有序文件，由若干个紧凑编码的块组成，每个块之后是重启点的偏移、重启点的数量和数据条数
+type tieredRun struct {
+	path   string
+	file   *os.File
+	blocks []tieredBlockHandle
+	bloom  *utils.BloomFilter
+	count  int           // 数据条数，包括删除标记
+	refs   *atomic.Int32 // 索引和遍历中的迭代器各持有一个引用，全部释放之后删除文件
+	err    *tieredError  // 读取失败时记录到所属的索引
+}
+
+type tieredBlockHandle struct {
+	first  []byte // 块中的第一个 key
+	offset int64
+	length uint32
+}
+
+// NewTieredIndex 初始化分层索引，memoryBudget 为最多占用的内存字节数
+func NewTieredIndex(dirPath string, memoryBudget int64) *TieredIndex {
+	ti := &TieredIndex{
+		mem:     newCompactDeltaTree(),
+		budget:  memoryBudget,
+		dirPath: dirPath,
+		err:     new(tieredError),
+		lock:    new(sync.RWMutex),
+	}
+	ti.spilled = sync.NewCond(ti.lock)
+	return ti
+}
+
+// RemoveSpillDirs 删除 dirPath 中上次运行时残留的分层索引的临时目录
+func RemoveSpillDirs(dirPath string) error {
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasPrefix(entry.Name(), tieredSpillDirPrefix) {
+			if err := os.RemoveAll(filepath.Join(dirPath, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (ti *TieredIndex) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
+	ti.lock.Lock()
+	defer ti.lock.Unlock()
+
+	oldPos := ti.get(key)
+	if _, replaced := ti.mem.ReplaceOrInsert(compactDelta{key: key, pos: *pos}); !replaced {
+		ti.memKeyBytes += int64(len(key))
+	}
+	if oldPos == nil {
+		ti.size++
+	}
+	ti.maybeSpill()
+	return oldPos
+}
+
+func (ti *TieredIndex) Get(key []byte) *data.LogRecordPos {
+	ti.lock.RLock()
+	defer ti.lock.RUnlock()
+	return ti.get(key)
+}
+
+func (ti *TieredIndex) Delete(key []byte) (*data.LogRecordPos, bool) {
+	ti.lock.Lock()
+	defer ti.lock.Unlock()
+
+	oldPos := ti.get(key)
+	if oldPos == nil {
+		return nil, false
+	}
+	// 读取 run 失败时无法确定 key 是否在磁盘上，同样记录删除标记
+	if pos, err := ti.getSpilled(key); pos != nil || err != nil {
+		// run 是不可变的，记录删除标记，写入磁盘之后覆盖旧的 run 中的数据
+		if _, replaced := ti.mem.ReplaceOrInsert(compactDelta{key: key, deleted: true}); !replaced {
+			ti.memKeyBytes += int64(len(key))
+		}
+		ti.maybeSpill()
+	} else {
+		ti.mem.Delete(compactDelta{key: key})
+		ti.memKeyBytes -= int64(len(key))
+	}
+	ti.size--
+	return oldPos, true
+}
+
+func (ti *TieredIndex) Size() int {
+	ti.lock.RLock()
+	defer ti.lock.RUnlock()
+	return ti.size
+}
+
+func (ti *TieredIndex) Iterator(reverse bool) Iterator {
+	return ti.IteratorWithOptions(IteratorOptions{Reverse: reverse})
+}
+
+// IteratorWithOptions 遍历内存中数据的克隆以及创建时的 run，迭代器关闭之前 run 的文件不会被删除
+func (ti *TieredIndex) IteratorWithOptions(opts IteratorOptions) Iterator {
+	// 克隆会修改原来的树的写时复制标识，需要加写锁
+	ti.lock.Lock()
+	snapshot := tieredSnapshot{mem: ti.mem.Clone(), runs: append([]*tieredRun(nil), ti.runs...)}
+	if ti.spilling != nil {
+		// 后台写入期间把内存中最新的数据覆盖到正在写入的数据的克隆上
+		mem := ti.spilling.Clone()
+		ti.mem.Ascend(func(d compactDelta) bool {
+			mem.ReplaceOrInsert(d)
+			return true
+		})
+		snapshot.mem = mem
+	}
+	for _, run := range snapshot.runs {
+		run.refs.Add(1)
+	}
+	ti.lock.Unlock()
+	iter := &tieredIterator{Iterator: newSnapshotIterator(snapshot, opts), runs: snapshot.runs}
+	return withLimit(iter, opts.Limit)
+}
+
+func (ti *TieredIndex) Capabilities() Capabilities {
+	return Capabilities{Ordered: true, Snapshot: true}
+}
+
+// MemoryUsage 内存中的数据按照每条数据的结构体大小估算，加上 run 的块索引和布隆过滤器
+// 后台写入磁盘期间，正在写入的数据仍然占用内存，最多可能达到预算的两倍
+func (ti *TieredIndex) MemoryUsage() int64 {
+	ti.lock.RLock()
+	defer ti.lock.RUnlock()
+	usage := ti.memUsage() + ti.runsMemory
+	if ti.spilling != nil {
+		usage += int64(ti.spilling.Len())*compactDeltaOverhead + ti.spillingKeyBytes
+	}
+	return usage
+}
+
+// Err 返回读写磁盘时出现的第一个错误
+// 写入失败之后不再写入磁盘，读取失败之后查找和遍历的结果可能不完整
+func (ti *TieredIndex) Err() error {
+	return ti.err.get()
+}
+
+// Close 等待后台的写入完成之后删除磁盘上的临时目录，还没有关闭的迭代器仍然可以读取已经打开的文件
+// 之前读写磁盘出现过错误时同样返回
+func (ti *TieredIndex) Close() error {
+	ti.lock.Lock()
+	defer ti.lock.Unlock()
+	ti.waitSpill()
+	for _, run := range ti.runs {
+		run.release()
+	}
+	ti.runs = nil
+	ti.runsMemory = 0
+	var err error
+	if ti.spillDir != "" {
+		err = os.RemoveAll(ti.spillDir)
+		ti.spillDir = ""
+	}
+	return errors.Join(ti.err.get(), err)
+}
+
+func (ti *TieredIndex) memUsage() int64 {
+	return int64(ti.mem.Len())*compactDeltaOverhead + ti.memKeyBytes
+}
+
+// 调用方需要持有锁
+func (ti *TieredIndex) get(key []byte) *data.LogRecordPos {
+	if d, ok := ti.mem.Get(compactDelta{key: key}); ok {
+		if d.deleted {
+			return nil
+		}
+		return &d.pos
+	}
+	// 读取失败的错误已经记录，当作 key 不存在
+	pos, _ := ti.getSpilled(key)
+	return pos
+}
+
+// 从正在写入磁盘的数据和 run 中查找，不包括最新的内存中的数据
+func (ti *TieredIndex) getSpilled(key []byte) (*data.LogRecordPos, error) {
+	if ti.spilling != nil {
+		if d, ok := ti.spilling.Get(compactDelta{key: key}); ok {
+			if d.deleted {
+				return nil, nil
+			}
+			return &d.pos, nil
+		}
+	}
+	return ti.getFromRuns(key)
+}
+
+// 从新到旧依次查找 run，找到的第一个数据是最新的
+func (ti *TieredIndex) getFromRuns(key []byte) (*data.LogRecordPos, error) {
+	for _, run := range ti.runs {
+		if !run.bloom.MayContain(key) {
+			continue
+		}
+		i := searchCompactBlocks(run, key)
+		if i < 0 {
+			continue
+		}
+		b, err := run.block(i)
+		if err != nil {
+			return nil, err
+		}
+		pos, ok := b.get(key)
+		if !ok {
+			continue
+		}
+		if pos.Offset == tieredTombstoneOffset {
+			return nil, nil
+		}
+		return &pos, nil
+	}
+	return nil, nil
+}
+
+// 内存中的数据超过预算减去 run 的元信息之后交给后台写入磁盘，写入可以继续进入新的内存中的 BTree
+// 上一次写入还没有完成时等待，写入磁盘失败之后不再写入，数据保留在内存中
+// 调用方需要持有写锁
+func (ti *TieredIndex) maybeSpill() {
+	if ti.memUsage() < max(ti.budget-ti.runsMemory, ti.budget/tieredMinMemFraction) {
+		return
+	}
+	ti.waitSpill()
+	if ti.err.get() != nil {
+		return
+	}
+	ti.spilling, ti.spillingKeyBytes = ti.mem, ti.memKeyBytes
+	ti.mem, ti.memKeyBytes = newCompactDeltaTree(), 0
+	go ti.spill(ti.spilling, ti.runs)
+}
+
+// 等待后台的写入完成，调用方需要持有写锁
+func (ti *TieredIndex) waitSpill() {
+	for ti.spilling != nil {
+		ti.spilled.Wait()
+	}
+}
+
+// 在后台将 mem 写入一个新的 run 并合并大小接近的 run，完成之后替换索引中的 run
+// 只有一个写入在进行，写入期间 runs 不会被替换，mem 不会被修改
+func (ti *TieredIndex) spill(mem *btree.BTreeG[compactDelta], runs []*tieredRun) {
+	newRuns, obsolete, err := ti.writeRuns(mem, runs)
+
+	ti.lock.Lock()
+	defer ti.lock.Unlock()
+	if err != nil {
+		ti.err.set(err)
+	}
+	if newRuns == nil {
+		// 没有写入磁盘，放回内存中，内存中已经有的 key 是更新的数据
+		mem.Ascend(func(d compactDelta) bool {
+			if _, ok := ti.mem.Get(d); !ok {
+				ti.mem.ReplaceOrInsert(d)
+				ti.memKeyBytes += int64(len(d.key))
+			}
+			return true
+		})
+		newRuns = runs
+	}
+	ti.runs = newRuns
+	ti.runsMemory = 0
+	for _, run := range ti.runs {
+		ti.runsMemory += run.memoryUsage()
+	}
+	// 替换之后才能释放，之前的查找可能还在读取
+	for _, run := range obsolete {
+		run.release()
+	}
+	ti.spilling, ti.spillingKeyBytes = nil, 0
+	ti.spilled.Broadcast()
+}
+
+// 将 mem 写入一个新的 run，然后合并大小接近的 run，返回新的 run 的列表以及被合并掉的 run
+// 写入新的 run 失败时返回空的列表，合并失败时返回合并之前的列表
+func (ti *TieredIndex) writeRuns(mem *btree.BTreeG[compactDelta], runs []*tieredRun) ([]*tieredRun, []*tieredRun, error) {
+	writer, err := ti.newRunWriter(mem.Len())
+	if err != nil {
+		return nil, nil, err
+	}
+	// 没有更旧的 run 时删除标记不需要写入
+	dropTombstones := len(runs) == 0
+	mem.Ascend(func(d compactDelta) bool {
+		pos := d.pos
+		if d.deleted {
+			if dropTombstones {
+				return true
+			}
+			pos = data.LogRecordPos{Offset: tieredTombstoneOffset}
+		}
+		err = writer.add(d.key, pos)
+		return err == nil
+	})
+	if err != nil {
+		writer.run.release()
+		return nil, nil, err
+	}
+	run, err := writer.finish()
+	if err != nil {
+		return nil, nil, err
+	}
+	runs = append([]*tieredRun(nil), runs...)
+	if run != nil {
+		runs = append([]*tieredRun{run}, runs...)
+	}
+
+	// 新的 run 和更旧的 run 大小接近时合并，保证越旧的 run 越大
+	var obsolete []*tieredRun
+	for len(runs) >= 2 && runs[1].count <= runs[0].count*2 {
+		merged, err := ti.mergeRuns(runs[0], runs[1], len(runs) == 2)
+		if err != nil {
+			return runs, obsolete, err
+		}
+		obsolete = append(obsolete, runs[0], runs[1])
+		runs = runs[2:]
+		if merged != nil {
+			runs = append([]*tieredRun{merged}, runs...)
+		}
+	}
+	return runs, obsolete, nil
+}
+
+// 合并两个相邻的 run，newer 中的数据覆盖 older 中相同的 key
+// oldest 表示 older 是最旧的 run，这时删除标记已经没有需要覆盖的数据了
+func (ti *TieredIndex) mergeRuns(newer, older *tieredRun, oldest bool) (*tieredRun, error) {
+	writer, err := ti.newRunWriter(newer.count + older.count)
+	if err != nil {
+		return nil, err
+	}
+	var skip func(item *Item) bool
+	if oldest {
+		skip = isTieredTombstone
+	}
+	mc := newMergeCursor([]cursor{
+		newCompactCursor(newer, nil, false),
+		newCompactCursor(older, nil, false),
+	}, false, skip)
+	for ; mc.valid(); mc.next() {
+		if err := writer.add(mc.item().key, *mc.item().pos); err != nil {
+			writer.run.release()
+			return nil, err
+		}
+	}
+	// 读取失败时游标提前结束，合并的结果不完整
+	if err := ti.err.get(); err != nil {
+		writer.run.release()
+		return nil, err
+	}
+	return writer.finish()
+}
+
+func isTieredTombstone(item *Item) bool {
+	return item.pos.Offset == tieredTombstoneOffset
+}
+
+// 按顺序写入一个新的 run
+type tieredRunWriter struct {
+	run     *tieredRun
+	writer  *bufio.Writer
+	offset  int64
+	builder *compactBlockBuilder
+}
+
+// 创建一个新的 run 文件，n 为预计写入的数据条数，用于确定布隆过滤器的大小
+func (ti *TieredIndex) newRunWriter(n int) (*tieredRunWriter, error) {
+	if ti.spillDir == "" {
+		dir, err := os.MkdirTemp(ti.dirPath, tieredSpillDirPrefix)
+		if err != nil {
+			return nil, err
+		}
+		ti.spillDir = dir
+	}
+	ti.nextRunId++
+	path := filepath.Join(ti.spillDir, fmt.Sprintf("%09d", ti.nextRunId)+tieredRunFileSuffix)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	run := &tieredRun{
+		path:  path,
+		file:  file,
+		bloom: utils.NewBloomFilter(n, tieredBloomFalsePositive),
+		refs:  new(atomic.Int32),
+		err:   ti.err,
+	}
+	run.refs.Store(1)
+	return &tieredRunWriter{
+		run:     run,
+		writer:  bufio.NewWriter(file),
+		builder: &compactBlockBuilder{prefixCompression: true},
+	}, nil
+}
+
+func (rw *tieredRunWriter) add(key []byte, pos data.LogRecordPos) error {
+	rw.run.bloom.Add(key)
+	rw.run.count++
+	rw.builder.add(key, pos)
+	return rw.writeBlocks()
+}
+
+// 将已经生成的块写入文件，内存中只保留块的第一个 key 和位置
+func (rw *tieredRunWriter) writeBlocks() error {
+	for _, b := range rw.builder.blocks {
+		buf := b.buf
+		for _, restart := range b.restarts {
+			buf = binary.LittleEndian.AppendUint32(buf, restart)
+		}
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(b.restarts)))
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(b.count))
+		if _, err := rw.writer.Write(buf); err != nil {
+			return err
+		}
+		rw.run.blocks = append(rw.run.blocks, tieredBlockHandle{
+			first:  append([]byte(nil), b.first...),
+			offset: rw.offset,
+			length: uint32(len(buf)),
+		})
+		rw.offset += int64(len(buf))
+	}
+	rw.builder.blocks = rw.builder.blocks[:0]
+	return nil
+}
+
+// 写入剩余的数据，没有写入任何数据时删除文件并返回空
+func (rw *tieredRunWriter) finish() (*tieredRun, error) {
+	rw.builder.finish()
+	if err := rw.writeBlocks(); err != nil {
+		rw.run.release()
+		return nil, err
+	}
+	if err := rw.writer.Flush(); err != nil {
+		rw.run.release()
+		return nil, err
+	}
+	if rw.run.count == 0 {
+		rw.run.release()
+		return nil, nil
+	}
+	return rw.run, nil
+}
+
+func (r *tieredRun) len() int {
+	return len(r.blocks)
+}
+
+func (r *tieredRun) first(i int) []byte {
+	return r.blocks[i].first
+}
+
+// 从磁盘上读取第 i 个块，读取失败时记录到所属的索引
+func (r *tieredRun) block(i int) (*compactBlock, error) {
+	handle := r.blocks[i]
+	buf := make([]byte, handle.length)
+	if _, err := r.file.ReadAt(buf, handle.offset); err != nil {
+		err = fmt.Errorf("failed to read tiered index run: %w", err)
+		r.err.set(err)
+		return nil, err
+	}
+	trailer := len(buf) - 8
+	restartNum := int(binary.LittleEndian.Uint32(buf[trailer:]))
+	b := &compactBlock{
+		buf:      buf[:trailer-restartNum*4],
+		restarts: make([]uint32, restartNum),
+		first:    handle.first,
+		count:    int(binary.LittleEndian.Uint32(buf[trailer+4:])),
+	}
+	for j := range b.restarts {
+		b.restarts[j] = binary.LittleEndian.Uint32(buf[len(b.buf)+j*4:])
+	}
+	return b, nil
+}
+
+// 布隆过滤器和块索引占用的内存
+func (r *tieredRun) memoryUsage() int64 {
+	usage := int64(unsafe.Sizeof(*r)) + int64(r.bloom.Size())
+	for _, handle := range r.blocks {
+		usage += int64(unsafe.Sizeof(handle)) + int64(len(handle.first))
+	}
+	return usage
+}
+
+func (e *tieredError) set(err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.err == nil {
+		e.err = err
+	}
+}
+
+func (e *tieredError) get() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.err
+}
+
+func (r *tieredRun) release() {
+	if r.refs.Add(-1) == 0 {
+		_ = r.file.Close()
+		_ = os.Remove(r.path)
+	}
+}
+
+// 分层索引的快照，内存中的数据是写时复制的克隆，run 是不可变的
+type tieredSnapshot struct {
+	mem  *btree.BTreeG[compactDelta]
+	runs []*tieredRun
+}
+
+func (s tieredSnapshot) ascend(pivot []byte, fn func(item *Item) bool) {
+	mergeDelta(s.mem, s.runsCursor(pivot, false), pivot, false, fn)
+}
+
+func (s tieredSnapshot) descend(pivot []byte, fn func(item *Item) bool) {
+	mergeDelta(s.mem, s.runsCursor(pivot, true), pivot, true, fn)
+}
+
+// 归并所有 run 的游标，跳过删除标记
+func (s tieredSnapshot) runsCursor(pivot []byte, reverse bool) cursor {
+	cursors := make([]cursor, len(s.runs))
+	for i, run := range s.runs {
+		cursors[i] = newCompactCursor(run, pivot, reverse)
+	}
+	return newMergeCursor(cursors, reverse, isTieredTombstone)
+}
+
+// 关闭时释放快照中的 run
+type tieredIterator struct {
+	Iterator
+	runs []*tieredRun
+}
+
+func (ti *tieredIterator) Close() {
+	ti.Iterator.Close()
+	for _, run := range ti.runs {
+		run.release()
+	}
+	ti.runs = nil
+}
@@ -0,0 +1,240 @@
+package index
+
+import (
+	"bitcask-go/data"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTieredIndex_Put(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-tiered")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	ti := NewTieredIndex(dir, 64*1024)
+	defer ti.Close()
+
+	res1 := ti.Put(nil, &data.LogRecordPos{Fid: 1, Offset: 100})
+	assert.Nil(t, res1)
+	res2 := ti.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 2})
+	assert.Nil(t, res2)
+	res3 := ti.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 3})
+	assert.Equal(t, &data.LogRecordPos{Fid: 1, Offset: 2}, res3)
+
+	// 内存中的数据超过预算之后写入磁盘，仍然可以读取和覆盖
+	for i := 0; i < 10000; i++ {
+		ti.Put([]byte(fmt.Sprintf("key-%05d", i)), &data.LogRecordPos{Fid: 2, Offset: int64(i)})
+	}
+	waitTieredSpill(ti)
+	assert.True(t, len(ti.runs) > 0)
+	assert.Equal(t, 10002, ti.Size())
+	assert.Equal(t, &data.LogRecordPos{Fid: 1, Offset: 3}, ti.Get([]byte("a")))
+	assert.Equal(t, &data.LogRecordPos{Fid: 2, Offset: 10}, ti.Get([]byte("key-00010")))
+	assert.Nil(t, ti.Get([]byte("key-10000")))
+
+	pos, ok := ti.Delete([]byte("key-00010"))
+	assert.True(t, ok)
+	assert.Equal(t, &data.LogRecordPos{Fid: 2, Offset: 10}, pos)
+	_, ok = ti.Delete([]byte("key-00010"))
+	assert.False(t, ok)
+	assert.Nil(t, ti.Get([]byte("key-00010")))
+	assert.Equal(t, 10001, ti.Size())
+
+	// 后台写入完成之后占用的内存不超过预算太多
+	waitTieredSpill(ti)
+	assert.True(t, ti.MemoryUsage() < 64*1024*11/10, "memory usage: %d", ti.MemoryUsage())
+
+	// 关闭之后删除临时目录
+	spillDir := ti.spillDir
+	assert.DirExists(t, spillDir)
+	assert.Nil(t, ti.Close())
+	assert.NoDirExists(t, spillDir)
+}
+
+// 随机的读写和 BTree 的结果保持一致，内存预算很小，会频繁地写入磁盘并合并 run
+func TestTieredIndex_CompareWithBTree(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-tiered-compare")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	ti := NewTieredIndex(dir, 16*1024)
+	defer ti.Close()
+	ref := NewBTree()
+	rnd := rand.New(rand.NewSource(1))
+
+	randomKey := func() []byte {
+		if rnd.Intn(10) == 0 {
+			return []byte(fmt.Sprintf("%c", 'a'+rnd.Intn(26)))
+		}
+		return []byte(fmt.Sprintf("key-%d-%d", rnd.Intn(5), rnd.Intn(3000)))
+	}
+
+	for i := 0; i < 30000; i++ {
+		key := randomKey()
+		if rnd.Intn(3) == 0 {
+			pos1, ok1 := ti.Delete(key)
+			pos2, ok2 := ref.Delete(key)
+			assert.Equal(t, ok2, ok1)
+			assert.Equal(t, pos2, pos1)
+		} else {
+			pos := &data.LogRecordPos{Fid: uint32(i % 7), Offset: int64(i), Size: uint32(i)}
+			assert.Equal(t, ref.Put(key, pos), ti.Put(key, pos))
+		}
+		assert.Equal(t, ref.Get(key), ti.Get(key))
+		assert.Equal(t, ref.Size(), ti.Size())
+
+		if i%3000 == 0 {
+			for _, prefix := range []string{"", "key-1", "key-3-5", "b"} {
+				for _, reverse := range []bool{false, true} {
+					opts := IteratorOptions{Prefix: []byte(prefix), Reverse: reverse}
+					iter1, iter2 := ti.IteratorWithOptions(opts), ref.IteratorWithOptions(opts)
+					iter1.Rewind()
+					for iter2.Rewind(); iter2.Valid(); iter2.Next() {
+						assert.True(t, iter1.Valid())
+						assert.Equal(t, iter2.Key(), iter1.Key())
+						assert.Equal(t, iter2.Value(), iter1.Value())
+						iter1.Next()
+					}
+					assert.False(t, iter1.Valid())
+
+					seek := randomKey()
+					iter1.Seek(seek)
+					iter2.Seek(seek)
+					assert.Equal(t, iter2.Valid(), iter1.Valid())
+					if iter2.Valid() {
+						assert.Equal(t, iter2.Key(), iter1.Key())
+					}
+					iter1.Close()
+					iter2.Close()
+				}
+			}
+		}
+	}
+	waitTieredSpill(ti)
+	assert.True(t, len(ti.runs) > 1)
+	assert.Nil(t, ti.Err())
+}
+
+// 迭代器遍历的是创建时的快照，run 被合并之后文件在迭代器关闭之前不会被删除
+func TestTieredIndex_IteratorSnapshot(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-tiered-snapshot")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	ti := NewTieredIndex(dir, 16*1024)
+	defer ti.Close()
+
+	const keyNum = 2000
+	for i := 0; i < keyNum; i++ {
+		ti.Put([]byte(fmt.Sprintf("key-%05d", i)), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+	waitTieredSpill(ti)
+	iter := ti.Iterator(false)
+	runs := iter.(*tieredIterator).runs
+	assert.True(t, len(runs) > 0)
+
+	for i := 0; i < keyNum; i++ {
+		if i%2 == 0 {
+			ti.Delete([]byte(fmt.Sprintf("key-%05d", i)))
+		} else {
+			ti.Put([]byte(fmt.Sprintf("key-%05d", i)), &data.LogRecordPos{Fid: 2, Offset: int64(i)})
+		}
+	}
+	assert.Equal(t, keyNum/2, ti.Size())
+	waitTieredSpill(ti)
+
+	var count int
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		assert.Equal(t, []byte(fmt.Sprintf("key-%05d", count)), iter.Key())
+		assert.Equal(t, &data.LogRecordPos{Fid: 1, Offset: int64(count)}, iter.Value())
+		count++
+	}
+	assert.Equal(t, keyNum, count)
+
+	// 快照中的 run 已经被合并，关闭迭代器之后删除文件
+	for _, run := range runs {
+		assert.FileExists(t, run.path)
+	}
+	iter.Close()
+	for _, run := range runs {
+		assert.NoFileExists(t, run.path)
+	}
+}
+
+func TestRemoveSpillDirs(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-tiered-remove")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, tieredSpillDirPrefix+"123"), os.ModePerm))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "000000001.data"), nil, 0644))
+
+	assert.Nil(t, RemoveSpillDirs(dir))
+	assert.NoDirExists(t, filepath.Join(dir, tieredSpillDirPrefix+"123"))
+	assert.FileExists(t, filepath.Join(dir, "000000001.data"))
+}
+
+// 写入磁盘失败之后数据保留在内存中，错误通过 Err 和 Close 返回
+func TestTieredIndex_SpillError(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-tiered-spill-error")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	ti := NewTieredIndex(dir, 16*1024)
+
+	const keyNum = 2000
+	for i := 0; i < keyNum/2; i++ {
+		ti.Put([]byte(fmt.Sprintf("key-%05d", i)), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+	waitTieredSpill(ti)
+	assert.True(t, len(ti.runs) > 0)
+	assert.Nil(t, ti.Err())
+
+	// 删除临时目录之后无法创建新的 run，已经打开的 run 仍然可以读取
+	assert.Nil(t, os.RemoveAll(ti.spillDir))
+	for i := keyNum / 2; i < keyNum; i++ {
+		ti.Put([]byte(fmt.Sprintf("key-%05d", i)), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+	waitTieredSpill(ti)
+	assert.NotNil(t, ti.Err())
+	assert.NotNil(t, Err(ti))
+
+	assert.Equal(t, keyNum, ti.Size())
+	for i := 0; i < keyNum; i++ {
+		assert.Equal(t, &data.LogRecordPos{Fid: 1, Offset: int64(i)}, ti.Get([]byte(fmt.Sprintf("key-%05d", i))))
+	}
+	assert.NotNil(t, ti.Close())
+}
+
+// 读取 run 失败时不会 panic，错误通过 Err 返回
+func TestTieredIndex_ReadError(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-tiered-read-error")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	ti := NewTieredIndex(dir, 16*1024)
+	defer ti.Close()
+
+	for i := 0; i < 2000; i++ {
+		ti.Put([]byte(fmt.Sprintf("key-%05d", i)), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+	waitTieredSpill(ti)
+	assert.True(t, len(ti.runs) > 0)
+	for _, run := range ti.runs {
+		assert.Nil(t, run.file.Close())
+	}
+
+	assert.Nil(t, ti.Get([]byte("key-00000")))
+	assert.NotNil(t, ti.Err())
+}
+
+// 等待后台的写入完成
+func waitTieredSpill(ti *TieredIndex) {
+	ti.lock.Lock()
+	defer ti.lock.Unlock()
+	ti.waitSpill()
+}
@@ -2,7 +2,6 @@ package bitcask_go
 
 import (
 	"bitcask-go/index"
-	"bytes"
 )
 
 // Iterator 迭代器
@@ -12,19 +11,67 @@ type Iterator struct {
 	options   IteratorOptions
 }
 
+// NewIterator 初始化迭代器，遍历的是创建时刻的快照
 func (db *DB) NewIterator(opts IteratorOptions) *Iterator {
-	indexIter := db.index.Iterator(opts.Reverse)
+	db.mu.RLock()
+	defer db.mu.RUnlock()
 	return &Iterator{
-		indexIter: indexIter,
+		indexIter: newIndexIterator(db.index, opts.indexOptions()),
 		db:        db,
 		options:   opts,
 	}
 }
 
+// 创建索引的迭代器，索引的迭代器不是快照时（例如跳表）复制一份满足条件的数据
+// 写入索引时都持有 db.mu，调用方需要持有 db.mu 保证复制期间没有写入
+func newIndexIterator(indexer index.Indexer, opts index.IteratorOptions) index.Iterator {
+	if indexer.Capabilities().Snapshot {
+		return indexer.IteratorWithOptions(opts)
+	}
+	return index.NewCopyIterator(indexer, opts)
+}
+
+// ScanResult 分页读取的结果
+type ScanResult struct {
+	Keys   [][]byte
+	Values [][]byte
+
+	// 下一页的起始 key，读取下一页时作为 start 传入，为空表示已经读取完毕
+	Next []byte
+}
+
+// Scan 读取 [start, end) 范围内最多 limit 条数据，start 为空表示从头开始，end 为空表示读取到最后
+func (db *DB) Scan(start, end []byte, limit int) (*ScanResult, error) {
+	if limit <= 0 {
+		return nil, ErrInvalidScanLimit
+	}
+	// 多读取一条数据作为下一页的起始 key
+	iter := db.NewIterator(IteratorOptions{
+		LowerBound: start,
+		UpperBound: end,
+		Limit:      limit + 1,
+	})
+	defer iter.Close()
+
+	result := &ScanResult{}
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		if len(result.Keys) == limit {
+			result.Next = append([]byte(nil), iter.Key()...)
+			break
+		}
+		value, err := iter.Value()
+		if err != nil {
+			return nil, err
+		}
+		result.Keys = append(result.Keys, append([]byte(nil), iter.Key()...))
+		result.Values = append(result.Values, value)
+	}
+	return result, nil
+}
+
 // Rewind 重新回到迭代器的起点，即第一个数据
 func (it *Iterator) Rewind() {
 	it.indexIter.Rewind()
-	it.skipToNext()
 }
 
 // Seek 根据传入的 key 查找第一个大于(或小于)等于的目标key，从这个key开始遍历
@@ -35,7 +82,6 @@ func (it *Iterator) Seek(key []byte) {
 // Next 跳转到下一个key
 func (it *Iterator) Next() {
 	it.indexIter.Next()
-	it.skipToNext()
 }
 
 // Valid 当前遍历的位置的
@@ -50,6 +96,9 @@ func (it *Iterator) Key() []byte {
 
 // Value 当前遍历位置的 Value 数据
 func (it *Iterator) Value() ([]byte, error) {
+	if it.options.KeysOnly {
+		return nil, nil
+	}
 	logRecordPos := it.indexIter.Value()
 	it.db.mu.RLock()
 	defer it.db.mu.RUnlock()
@@ -61,16 +110,14 @@ func (it *Iterator) Close() {
 	it.indexIter.Close()
 }
 
-func (it *Iterator) skipToNext() {
-	prefixLen := len(it.options.Prefix)
-	if prefixLen == 0 {
-		return
-	}
-
-	for ; it.indexIter.Valid(); it.indexIter.Next() {
-		key := it.indexIter.Key()
-		if prefixLen <= len(key) && bytes.Compare(it.options.Prefix, key[:prefixLen]) == 0 {
-			break
-		}
+func (opts IteratorOptions) indexOptions() index.IteratorOptions {
+	return index.IteratorOptions{
+		Prefix:       opts.Prefix,
+		Reverse:      opts.Reverse,
+		LowerBound:   opts.LowerBound,
+		ExcludeLower: opts.ExcludeLower,
+		UpperBound:   opts.UpperBound,
+		IncludeUpper: opts.IncludeUpper,
+		Limit:        opts.Limit,
 	}
 }
@@ -108,3 +108,142 @@ func TestIterator_Multi_Values(t *testing.T) {
 		t.Log("key = ", string(iter3.Key()))
 	}
 }
+
+func TestIterator_Bounds(t *testing.T) {
+	for _, indexType := range []IndexerType{Btree, ART, BPlusTree, Hash, SkipList} {
+		opts := DefaultOptions
+		dir, _ := os.MkdirTemp("", "bitcask-go-iterator-bounds")
+		opts.DirPath = dir
+		opts.IndexType = indexType
+		db, err := Open(opts)
+		assert.Nil(t, err)
+
+		for i := 0; i < 100; i++ {
+			assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+		}
+
+		collect := func(iterOpts IteratorOptions) []int {
+			iter := db.NewIterator(iterOpts)
+			defer iter.Close()
+			var res []int
+			for iter.Rewind(); iter.Valid(); iter.Next() {
+				for i := 0; i < 100; i++ {
+					if string(utils.GetTestKey(i)) == string(iter.Key()) {
+						res = append(res, i)
+					}
+				}
+			}
+			return res
+		}
+
+		// [10, 15)
+		iterOpts := IteratorOptions{LowerBound: utils.GetTestKey(10), UpperBound: utils.GetTestKey(15)}
+		assert.Equal(t, []int{10, 11, 12, 13, 14}, collect(iterOpts), "index type %d", indexType)
+
+		// (10, 15]
+		iterOpts.ExcludeLower, iterOpts.IncludeUpper = true, true
+		assert.Equal(t, []int{11, 12, 13, 14, 15}, collect(iterOpts), "index type %d", indexType)
+
+		// 反向遍历 (10, 15]
+		iterOpts.Reverse = true
+		assert.Equal(t, []int{15, 14, 13, 12, 11}, collect(iterOpts), "index type %d", indexType)
+
+		// 反向遍历最多 2 条
+		iterOpts.Limit = 2
+		assert.Equal(t, []int{15, 14}, collect(iterOpts), "index type %d", indexType)
+
+		// 空的边界表示没有边界
+		iterOpts = IteratorOptions{LowerBound: []byte{}, UpperBound: []byte{}}
+		assert.Equal(t, 100, len(collect(iterOpts)), "index type %d", indexType)
+		iterOpts.Reverse = true
+		assert.Equal(t, 100, len(collect(iterOpts)), "index type %d", indexType)
+
+		// 前缀和范围取交集
+		iterOpts = IteratorOptions{Prefix: utils.GetTestKey(5)[:len(utils.GetTestKey(5))-1], LowerBound: utils.GetTestKey(7)}
+		assert.Equal(t, []int{7, 8, 9}, collect(iterOpts), "index type %d", indexType)
+
+		// 只遍历 key
+		iter := db.NewIterator(IteratorOptions{KeysOnly: true, Limit: 1})
+		iter.Rewind()
+		assert.True(t, iter.Valid())
+		value, err := iter.Value()
+		assert.Nil(t, err)
+		assert.Nil(t, value)
+		iter.Next()
+		assert.False(t, iter.Valid())
+		iter.Close()
+
+		destroyDB(db)
+	}
+}
+
+func TestDB_Scan(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-scan")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	_, err = db.Scan(nil, nil, 0)
+	assert.Equal(t, ErrInvalidScanLimit, err)
+
+	result, err := db.Scan(nil, nil, 10)
+	assert.Nil(t, err)
+	assert.Empty(t, result.Keys)
+	assert.Nil(t, result.Next)
+
+	for i := 0; i < 95; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+	}
+
+	// 空的边界和 nil 一样表示没有边界
+	result, err = db.Scan([]byte{}, []byte{}, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 10, len(result.Keys))
+	assert.NotNil(t, result.Next)
+
+	// 分页读取 [5, 90)
+	var keys [][]byte
+	start := utils.GetTestKey(5)
+	for pages := 0; ; pages++ {
+		result, err := db.Scan(start, utils.GetTestKey(90), 10)
+		assert.Nil(t, err)
+		assert.Equal(t, result.Keys, result.Values)
+		keys = append(keys, result.Keys...)
+		if result.Next == nil {
+			assert.Equal(t, 8, pages)
+			break
+		}
+		start = result.Next
+	}
+	assert.Equal(t, 85, len(keys))
+	for i, key := range keys {
+		assert.Equal(t, utils.GetTestKey(i+5), key)
+	}
+}
+
+func TestIterator_SkipListSnapshot(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-iterator-skiplist")
+	opts.DirPath = dir
+	opts.IndexType = SkipList
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+	}
+	iter := db.NewIterator(DefaultIteratorOptions)
+	defer iter.Close()
+
+	// 跳表本身的迭代器不是快照，创建之后的写入同样不可见
+	assert.Nil(t, db.Put(utils.GetTestKey(10), utils.GetTestKey(10)))
+	assert.Nil(t, db.Delete(utils.GetTestKey(0)))
+	var count int
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		count++
+	}
+	assert.Equal(t, 10, count)
+}
@@ -0,0 +1,134 @@
+package bitcask_go
+
+import (
+	"bitcask-go/fio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+const logConsumersFileName = "log-consumers"
+
+// RegisterConsumer 注册或者更新一个持久化的日志消费者，pos 为它下一条要读取的位置
+// 重启之后可以通过 ConsumerPosition 取出位置继续读取，注册的消费者没有读取完的数据不会被 merge 重写
+func (db *DB) RegisterConsumer(name string, pos LogPosition) error {
+	if db.options.ReadOnly {
+		return ErrReadOnly
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	consumers := db.copyConsumers()
+	consumers[name] = pos
+	return db.saveConsumers(consumers)
+}
+
+// UnregisterConsumer 删除日志消费者
+func (db *DB) UnregisterConsumer(name string) error {
+	if db.options.ReadOnly {
+		return ErrReadOnly
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.consumers[name]; !ok {
+		return nil
+	}
+	consumers := db.copyConsumers()
+	delete(consumers, name)
+	return db.saveConsumers(consumers)
+}
+
+// ConsumerPosition 返回日志消费者下一条要读取的位置
+func (db *DB) ConsumerPosition(name string) (LogPosition, bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	pos, ok := db.consumers[name]
+	return pos, ok
+}
+
+// ListConsumers 返回所有注册的日志消费者的名称
+func (db *DB) ListConsumers() []string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	names := make([]string, 0, len(db.consumers))
+	for name := range db.consumers {
+		names = append(names, name)
+	}
+	return names
+}
+
+// 加载持久化的日志消费者
+func (db *DB) loadConsumers() error {
+	db.consumers = make(map[string]LogPosition)
+	buf, err := os.ReadFile(filepath.Join(db.options.DirPath, logConsumersFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, &db.consumers)
+}
+
+// 先写入临时文件再重命名，保证文件中始终是完整的数据，调用方需要持有 db.mu
+func (db *DB) saveConsumers(consumers map[string]LogPosition) error {
+	buf, err := json.Marshal(consumers)
+	if err != nil {
+		return err
+	}
+	fileName := filepath.Join(db.options.DirPath, logConsumersFileName)
+	tmpFileName := fileName + ".tmp"
+	file, err := os.OpenFile(tmpFileName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, fio.DataFilePerm)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(buf); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFileName, fileName); err != nil {
+		return err
+	}
+	db.consumers = consumers
+	return nil
+}
+
+func (db *DB) copyConsumers() map[string]LogPosition {
+	consumers := make(map[string]LogPosition, len(db.consumers)+1)
+	for name, pos := range db.consumers {
+		consumers[name] = pos
+	}
+	return consumers
+}
+
+// 所有的日志消费者是否都已经读取完当前所有的数据，调用方需要持有 db.mu
+func (db *DB) consumersCaughtUp() bool {
+	for _, pos := range db.consumers {
+		if pos.Fid < db.activeFile.FileId || (pos.Fid == db.activeFile.FileId && pos.Offset < db.activeFile.WriteOff) {
+			return false
+		}
+	}
+	return true
+}
+
+// merge 会重写 fileId 之前所有的数据文件，将日志消费者的位置移动到 fileId 的开头，调用方需要持有 db.mu
+func (db *DB) advanceConsumers(fileId uint32) error {
+	if len(db.consumers) == 0 {
+		return nil
+	}
+	consumers := db.copyConsumers()
+	for name, pos := range consumers {
+		if pos.Fid < fileId {
+			consumers[name] = LogPosition{Fid: fileId}
+		}
+	}
+	return db.saveConsumers(consumers)
+}
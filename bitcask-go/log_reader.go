@@ -0,0 +1,168 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"io"
+	"sort"
+)
+
+// LogPosition 日志中的位置，即下一条要读取的记录所在的文件 id 和偏移
+type LogPosition struct {
+	Fid    uint32 `json:"fid"`
+	Offset int64  `json:"offset"`
+}
+
+// a 是否在 b 之前
+func positionBefore(a, b LogPosition) bool {
+	return a.Fid < b.Fid || (a.Fid == b.Fid && a.Offset < b.Offset)
+}
+
+// LogEntry 日志中的一条记录
+type LogEntry struct {
+	Key   []byte
+	Value []byte
+	Type  data.LogRecordType
+	SeqNo uint64      // 事务序列号，非事务写入为 0
+	Pos   LogPosition // 记录所在的位置
+	Next  LogPosition // 下一条记录的位置，可以用来恢复读取
+}
+
+// LogReader 按照写入的顺序读取日志记录
+// 读取的范围在创建时确定，到达创建时活跃文件的写入位置之后返回 io.EOF
+type LogReader struct {
+	db        *DB
+	fileIds   []uint32 // 需要读取的数据文件 id，从小到大排序
+	index     int      // 当前读取的文件在 fileIds 中的下标
+	offset    int64    // 当前文件中下一条记录的偏移
+	endOffset int64    // 最后一个文件的结束位置
+}
+
+// ReadLogFrom 从 pos 开始（包含）读取之后写入的所有日志记录
+// 事务中的记录和事务完成的标识记录都会原样返回
+func (db *DB) ReadLogFrom(pos LogPosition) (*LogReader, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	reader := &LogReader{db: db, offset: pos.Offset}
+	if db.activeFile == nil {
+		if pos.Fid != 0 || pos.Offset != 0 {
+			return nil, ErrLogPositionNotFound
+		}
+		return reader, nil
+	}
+	reader.endOffset = db.activeFile.WriteOff
+
+	for fid := range db.olderFiles {
+		if fid >= pos.Fid {
+			reader.fileIds = append(reader.fileIds, fid)
+		}
+	}
+	if db.activeFile.FileId >= pos.Fid {
+		reader.fileIds = append(reader.fileIds, db.activeFile.FileId)
+	}
+	sort.Slice(reader.fileIds, func(i, j int) bool {
+		return reader.fileIds[i] < reader.fileIds[j]
+	})
+
+	// 位置所在的文件不存在时，只能从下一个文件的开头开始读取
+	if len(reader.fileIds) == 0 || reader.fileIds[0] != pos.Fid {
+		if pos.Offset != 0 || (len(reader.fileIds) == 0 && pos.Fid != db.activeFile.FileId+1) {
+			return nil, ErrLogPositionNotFound
+		}
+		return reader, nil
+	}
+
+	// 偏移不能超过文件已经写入的大小
+	var fileSize int64
+	if pos.Fid == db.activeFile.FileId {
+		fileSize = db.activeFile.WriteOff
+	} else {
+		dataFile := db.olderFiles[pos.Fid]
+		if err := db.acquireDataFile(dataFile); err != nil {
+			return nil, err
+		}
+		size, err := dataFile.IoManager.Size()
+		db.releaseDataFile(dataFile)
+		if err != nil {
+			return nil, err
+		}
+		fileSize = size
+	}
+	if pos.Offset < 0 || pos.Offset > fileSize {
+		return nil, ErrLogPositionNotFound
+	}
+	return reader, nil
+}
+
+// LogEnd 返回日志当前的结束位置，即下一条记录将要写入的位置
+func (db *DB) LogEnd() LogPosition {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.activeFile == nil {
+		return LogPosition{}
+	}
+	return LogPosition{Fid: db.activeFile.FileId, Offset: db.activeFile.WriteOff}
+}
+
+// ReadLogFromSeqNo 读取事务 seqNo 提交之后写入的所有日志记录，seqNo 为 0 表示从头开始读取
+func (db *DB) ReadLogFromSeqNo(seqNo uint64) (*LogReader, error) {
+	// 最早的数据文件不存在时会从下一个文件的开头开始读取
+	reader, err := db.ReadLogFrom(LogPosition{})
+	if err != nil {
+		return nil, err
+	}
+	if seqNo == nonTransactionSeqNo {
+		return reader, nil
+	}
+
+	// 找到事务完成的标识记录，从它之后开始读取
+	for {
+		entry, err := reader.Next()
+		if err == io.EOF {
+			return nil, ErrLogPositionNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		if entry.Type == data.LogRecordTxnFinished && entry.SeqNo == seqNo {
+			return reader, nil
+		}
+	}
+}
+
+// Next 读取下一条日志记录，读取完毕之后返回 io.EOF
+func (r *LogReader) Next() (*LogEntry, error) {
+	for r.index < len(r.fileIds) {
+		fid := r.fileIds[r.index]
+		isLast := r.index == len(r.fileIds)-1
+		if isLast && r.offset >= r.endOffset {
+			return nil, io.EOF
+		}
+
+		r.db.mu.RLock()
+		logRecord, size, err := r.db.readLogRecord(fid, r.offset)
+		r.db.mu.RUnlock()
+		if err == io.EOF && !isLast {
+			// 当前文件已经读完，继续读取下一个文件
+			r.index++
+			r.offset = 0
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		key, seqNo := parseLogRecordKey(logRecord.Key)
+		entry := &LogEntry{
+			Key:   key,
+			Value: logRecord.Value,
+			Type:  logRecord.Type,
+			SeqNo: seqNo,
+			Pos:   LogPosition{Fid: fid, Offset: r.offset},
+			Next:  LogPosition{Fid: fid, Offset: r.offset + size},
+		}
+		r.offset += size
+		return entry, nil
+	}
+	return nil, io.EOF
+}
@@ -0,0 +1,204 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/utils"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"testing"
+)
+
+func readAllLog(t *testing.T, reader *LogReader) []*LogEntry {
+	var entries []*LogEntry
+	for {
+		entry, err := reader.Next()
+		if err == io.EOF {
+			return entries
+		}
+		assert.Nil(t, err)
+		entries = append(entries, entry)
+	}
+}
+
+func TestDB_ReadLogFrom(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-read-log")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 数据库为空
+	reader, err := db.ReadLogFrom(LogPosition{})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(readAllLog(t, reader)))
+
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	err = db.Delete(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	_ = wb.Put(utils.GetTestKey(2000), []byte("batch"))
+	err = wb.Commit()
+	assert.Nil(t, err)
+	batchSeqNo := db.seqNo
+	assert.True(t, len(db.olderFiles) > 0)
+
+	reader, err = db.ReadLogFrom(LogPosition{})
+	assert.Nil(t, err)
+	// 读取器创建之后的写入不会被读取到
+	err = db.Put(utils.GetTestKey(3000), []byte("after"))
+	assert.Nil(t, err)
+
+	entries := readAllLog(t, reader)
+	assert.Equal(t, 1003, len(entries))
+	assert.Equal(t, utils.GetTestKey(0), entries[0].Key)
+	assert.Equal(t, LogPosition{Fid: 0, Offset: 0}, entries[0].Pos)
+	assert.Equal(t, data.LogRecordDeleted, entries[1000].Type)
+	assert.Equal(t, utils.GetTestKey(2000), entries[1001].Key)
+	assert.Equal(t, batchSeqNo, entries[1001].SeqNo)
+	assert.Equal(t, data.LogRecordTxnFinished, entries[1002].Type)
+	for i := 1; i < len(entries); i++ {
+		if entries[i].Pos.Fid == entries[i-1].Next.Fid {
+			assert.Equal(t, entries[i-1].Next, entries[i].Pos)
+		} else {
+			assert.Equal(t, int64(0), entries[i].Pos.Offset)
+		}
+	}
+
+	// 从上一次读取到的位置继续读取
+	reader, err = db.ReadLogFrom(entries[len(entries)-1].Next)
+	assert.Nil(t, err)
+	entries = readAllLog(t, reader)
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, utils.GetTestKey(3000), entries[0].Key)
+
+	// 从事务提交之后开始读取
+	reader, err = db.ReadLogFromSeqNo(batchSeqNo)
+	assert.Nil(t, err)
+	entries = readAllLog(t, reader)
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, utils.GetTestKey(3000), entries[0].Key)
+
+	// 无效的位置
+	_, err = db.ReadLogFrom(LogPosition{Fid: 0, Offset: 1 << 30})
+	assert.Equal(t, ErrLogPositionNotFound, err)
+	_, err = db.ReadLogFrom(LogPosition{Fid: 1000})
+	assert.Equal(t, ErrLogPositionNotFound, err)
+	_, err = db.ReadLogFromSeqNo(1000)
+	assert.Equal(t, ErrLogPositionNotFound, err)
+}
+
+func TestDB_ReadLogFrom_Watch(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-read-log-watch")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	sub, err := db.Watch(nil, DefaultWatchOptions)
+	assert.Nil(t, err)
+	err = db.Put(utils.GetTestKey(1), []byte("v1"))
+	assert.Nil(t, err)
+	err = db.Put(utils.GetTestKey(2), []byte("v2"))
+	assert.Nil(t, err)
+
+	// 变更组中的位置可以用来从磁盘上继续读取
+	group := <-sub.C()
+	reader, err := db.ReadLogFrom(group.Next)
+	assert.Nil(t, err)
+	entries := readAllLog(t, reader)
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, utils.GetTestKey(2), entries[0].Key)
+	assert.Equal(t, []byte("v2"), entries[0].Value)
+}
+
+func TestDB_LogConsumer(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-log-consumer")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+
+	err = db.RegisterConsumer("search", LogPosition{})
+	assert.Nil(t, err)
+	reader, err := db.ReadLogFrom(LogPosition{})
+	assert.Nil(t, err)
+	var last *LogEntry
+	for i := 0; i < 500; i++ {
+		last, err = reader.Next()
+		assert.Nil(t, err)
+	}
+	err = db.RegisterConsumer("search", last.Next)
+	assert.Nil(t, err)
+
+	// 重启之后位置仍然存在
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	pos, ok := db.ConsumerPosition("search")
+	assert.True(t, ok)
+	assert.Equal(t, last.Next, pos)
+
+	// 消费者还没有读取完，不能 merge
+	err = db.Merge()
+	assert.Equal(t, ErrConsumerBehind, err)
+
+	reader, err = db.ReadLogFrom(pos)
+	assert.Nil(t, err)
+	entries := readAllLog(t, reader)
+	assert.Equal(t, 500, len(entries))
+	err = db.RegisterConsumer("search", entries[len(entries)-1].Next)
+	assert.Nil(t, err)
+
+	for i := 0; i < 500; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db.Merge()
+	assert.Equal(t, ErrConsumerBehind, err)
+	reader, err = db.ReadLogFrom(entries[len(entries)-1].Next)
+	assert.Nil(t, err)
+	entries = readAllLog(t, reader)
+	assert.Equal(t, 500, len(entries))
+	err = db.RegisterConsumer("search", entries[len(entries)-1].Next)
+	assert.Nil(t, err)
+
+	// 读取完之后可以 merge，位置被移动到新的活跃文件的开头
+	err = db.Merge()
+	assert.Nil(t, err)
+	pos, _ = db.ConsumerPosition("search")
+	assert.Equal(t, LogPosition{Fid: db.activeFile.FileId}, pos)
+
+	err = db.Put(utils.GetTestKey(2000), []byte("after-merge"))
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	pos, _ = db.ConsumerPosition("search")
+	reader, err = db.ReadLogFrom(pos)
+	assert.Nil(t, err)
+	entries = readAllLog(t, reader)
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, []byte("after-merge"), entries[0].Value)
+
+	err = db.UnregisterConsumer("search")
+	assert.Nil(t, err)
+	_, ok = db.ConsumerPosition("search")
+	assert.False(t, ok)
+}
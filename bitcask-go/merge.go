@@ -2,6 +2,8 @@ package bitcask_go
 
 import (
 	"bitcask-go/data"
+	"bitcask-go/fio"
+	"bitcask-go/index"
 	"bitcask-go/utils"
 	"io"
 	"os"
@@ -17,6 +19,9 @@ const (
 
 // Merge 清理无效数据、生成 Hint 文件
 func (db *DB) Merge() error {
+	if db.options.ReadOnly {
+		return ErrReadOnly
+	}
 	// 如果数据库为空， 则直接返回
 	if db.activeFile == nil {
 		return nil
@@ -40,6 +45,12 @@ func (db *DB) Merge() error {
 		return ErrMergeRatioUnreached
 	}
 
+	// merge 会重写所有的旧数据文件，注册的日志消费者需要先读取完所有的数据
+	if !db.consumersCaughtUp() {
+		db.mu.Unlock()
+		return ErrConsumerBehind
+	}
+
 	db.isMerging = true
 	defer func() {
 		db.isMerging = false
@@ -62,7 +73,11 @@ func (db *DB) Merge() error {
 		return err
 	}
 	// 将当前活跃数据文件转换为旧的数据文件
-	db.olderFiles[db.activeFile.FileId] = db.activeFile
+	if err := db.sealDataFileBloom(); err != nil {
+		db.mu.Unlock()
+		return err
+	}
+	db.addOlderFile(db.activeFile)
 	// 打开一个新的活跃文件
 	if err := db.setActiveDataFile(); err != nil {
 		db.mu.Unlock()
@@ -71,6 +86,10 @@ func (db *DB) Merge() error {
 
 	// 记录最近没有参与 merge 的文件 id
 	nonMergeFileId := db.activeFile.FileId
+	if err := db.advanceConsumers(nonMergeFileId); err != nil {
+		db.mu.Unlock()
+		return err
+	}
 
 	// 取出所有需要 merge 的文件
 	var mergeFiles []*data.DataFile
@@ -100,47 +119,29 @@ func (db *DB) Merge() error {
 	mergeOptions := db.options
 	mergeOptions.DirPath = mergePath
 	mergeOptions.SyncWrites = false
+	// 临时实例只负责追加写入，不能在 merge 目录中创建 B+ 树索引文件，否则会覆盖掉原来的索引
+	if mergeOptions.IndexType == BPlusTree {
+		mergeOptions.IndexType = Btree
+	}
 	mergeDB, err := Open(mergeOptions)
 	if err != nil {
 		return err
 	}
+	// merge 重写数据属于后台 IO，和读取共用同一个限速器
+	mergeDB.writeLimiter = db.bgLimiter
+	// 布隆过滤器在 merge 完成之后从索引重建，临时实例不需要
+	mergeDB.blooms = nil
 
 	// 打开 hint 文件 存储索引
 	hintFile, err := data.OpenHintFile(mergePath)
 	if err != nil {
 		return err
 	}
+	hintFile.IoManager = fio.NewRateLimitedIOManager(hintFile.IoManager, nil, db.bgLimiter)
 	// 遍历处理每个数据文件
-	for _, dataFile := range mergeFiles {
-		var offset int64 = 0
-		for {
-			logRecord, size, err := dataFile.ReadLogRecord(offset)
-			if err != nil {
-				if err == io.EOF {
-					break
-				}
-				return err
-			}
-			// 解析拿到实际的 key
-			realKey, _ := parseLogRecordKey(logRecord.Key)
-			logRecordPos := db.index.Get(realKey)
-			// 和内存中的索引位置进行比较。如果有效则重写
-			if logRecordPos != nil &&
-				logRecordPos.Fid == dataFile.FileId &&
-				logRecordPos.Offset == offset {
-				// 不需要使用事务序列号 清除事务标记
-				logRecord.Key = logRecordKeyWithSeq(realKey, nonTransactionSeqNo)
-				pos, err := mergeDB.appendLogRecord(logRecord)
-				if err != nil {
-					return err
-				}
-				// 将当前位置索引写到 Hint 文件中去
-				if err := hintFile.WriteHintRecord(realKey, pos); err != nil {
-					return err
-				}
-			}
-			// 增加 offset
-			offset += size
+	for _, file := range mergeFiles {
+		if err := db.mergeDataFile(file, mergeDB, hintFile); err != nil {
+			return err
 		}
 	}
 	// sync 保证持久化
@@ -172,6 +173,63 @@ func (db *DB) Merge() error {
 	return nil
 }
 
+// 将数据文件中有效的数据重写到 merge 目录中，并记录到 hint 文件
+func (db *DB) mergeDataFile(file *data.DataFile, mergeDB *DB, hintFile *data.DataFile) error {
+	if err := db.acquireDataFile(file); err != nil {
+		return err
+	}
+	defer db.releaseDataFile(file)
+
+	// 读取旧的数据文件需要经过后台 IO 限速，不影响前台读取使用的文件
+	dataFile := &data.DataFile{
+		FileId:    file.FileId,
+		WriteOff:  file.WriteOff,
+		IoManager: fio.NewRateLimitedIOManager(file.IoManager, db.bgLimiter, nil),
+		Cache:     file.Cache,
+	}
+	var offset int64 = 0
+	for {
+		logRecord, size, err := dataFile.ReadLogRecord(offset)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		// 解析拿到实际的 key
+		realKey, _ := parseLogRecordKey(logRecord.Key)
+		// 和内存中的索引位置进行比较。如果有效则重写
+		if db.isLogRecordLive(realKey, logRecord.Type, dataFile.FileId, offset) {
+			// 不需要使用事务序列号 清除事务标记
+			logRecord.Key = logRecordKeyWithSeq(realKey, nonTransactionSeqNo)
+			mergeDB.waitWriteTokens(logRecord.MaxEncodedSize())
+			pos, err := mergeDB.appendLogRecord(logRecord)
+			if err != nil {
+				return err
+			}
+			// 将当前位置索引写到 Hint 文件中去
+			if err := hintFile.WriteHintRecord(realKey, logRecord.Type, pos); err != nil {
+				return err
+			}
+		}
+		// 增加 offset
+		offset += size
+	}
+	return nil
+}
+
+// 判断数据文件中的记录是否仍然有效
+func (db *DB) isLogRecordLive(key []byte, typ data.LogRecordType, fid uint32, offset int64) bool {
+	switch typ {
+	case data.LogRecordNormal:
+		logRecordPos := db.index.Get(key)
+		return logRecordPos != nil && logRecordPos.Fid == fid && logRecordPos.Offset == offset
+	case data.LogRecordNsNormal, data.LogRecordNsCreated:
+		return db.isNamespaceRecordLive(key, typ, fid, offset)
+	}
+	return false
+}
+
 func (db *DB) getMergePath() string {
 	// 此处应使用 file 而非path
 	// path 主要用于处理以斜杠(/)分隔的路径（Unix 风格），
@@ -224,6 +282,10 @@ func (db *DB) loadMergeFiles() error {
 
 	nonMergeFileId, err := db.getNonMergeFileId(mergePath)
 	if err != nil {
+		// 标识文件没有写完整，说明 merge 并没有真正完成
+		if err == io.EOF || err == data.ErrInvalidCRC {
+			return nil
+		}
 		return err
 	}
 
@@ -231,12 +293,21 @@ func (db *DB) loadMergeFiles() error {
 	var fileId uint32 = 0
 	for ; fileId < nonMergeFileId; fileId++ {
 		fileName := data.GetDataFileName(db.options.DirPath, fileId)
+		if db.fileCache != nil {
+			if err := db.fileCache.remove(fileId); err != nil {
+				return err
+			}
+		}
 		if _, err := os.Stat(fileName); err == nil {
 			if err := os.Remove(fileName); err != nil {
 				return err
 			}
 		}
 	}
+	// 删除布隆过滤器，加载时从索引重建，去掉已经被 merge 清理的 key
+	if err := os.Remove(filepath.Join(db.options.DirPath, data.BloomFileName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
 	// 将新的数据文件移动到数据目录中
 	for _, fileName := range mergeFileNames {
 		srcPath := filepath.Join(mergePath, fileName)
@@ -264,8 +335,60 @@ func (db *DB) getNonMergeFileId(dirPath string) (uint32, error) {
 	return uint32(nonMergeFileId), nil
 }
 
+// MergedFileId 返回最近一次生效的 merge 重写的数据文件的范围，没有 merge 过返回 0
+// id 小于返回值的数据文件都是 merge 生成的，其中已经不是原来写入的日志
+func (db *DB) MergedFileId() (uint32, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.mergedFileId()
+}
+
+// merge 完成的标识文件只在打开数据库的时候才会被替换，调用方需要持有 db.mu
+func (db *DB) mergedFileId() (uint32, error) {
+	mergeFinFileName := filepath.Join(db.options.DirPath, data.MergeFinishedFileName)
+	if _, err := os.Stat(mergeFinFileName); os.IsNotExist(err) {
+		return 0, nil
+	}
+	return db.getNonMergeFileId(db.options.DirPath)
+}
+
+// merge 之后数据文件被替换，B+ 树索引中仍然指向 merge 之前的数据文件的位置需要更新
+// 索引中记录了最近一次已经更新的 merge，在一个事务中完成更新，中途崩溃之后下次打开重新更新
+func (db *DB) applyMergeToBPlusTree() error {
+	mergeFinFileName := filepath.Join(db.options.DirPath, data.MergeFinishedFileName)
+	if _, err := os.Stat(mergeFinFileName); os.IsNotExist(err) {
+		return nil
+	}
+	nonMergeFileId, err := db.getNonMergeFileId(db.options.DirPath)
+	if err != nil {
+		return err
+	}
+	bpt := db.index.(*index.BPlusTree)
+	if bpt.MergedFid() >= nonMergeFileId {
+		return nil
+	}
+	return bpt.ApplyMerge(nonMergeFileId, func(update func(key []byte, pos *data.LogRecordPos)) error {
+		return db.readHintFile(func(logRecord *data.LogRecord, pos *data.LogRecordPos) {
+			if logRecord.Type == data.LogRecordNormal {
+				update(logRecord.Key, pos)
+			}
+		})
+	})
+}
+
 // 从 hint 文件中加载索引
 func (db *DB) loadIndexFromHintFile() error {
+	return db.readHintFile(func(logRecord *data.LogRecord, pos *data.LogRecordPos) {
+		if logRecord.Type == data.LogRecordNormal {
+			db.index.Put(logRecord.Key, pos)
+		} else {
+			db.updateIndex(logRecord.Key, logRecord.Type, pos)
+		}
+	})
+}
+
+// 依次读取 hint 文件中的每一条位置索引，hint 文件不存在时直接返回
+func (db *DB) readHintFile(fn func(logRecord *data.LogRecord, pos *data.LogRecordPos)) error {
 	// 查看 hint 索引文件是否存在
 	hintFileName := filepath.Join(db.options.DirPath, data.HintFileName)
 	if _, err := os.Stat(hintFileName); os.IsNotExist(err) {
@@ -277,6 +400,7 @@ func (db *DB) loadIndexFromHintFile() error {
 	if err != nil {
 		return err
 	}
+	defer hintFile.Close()
 	// 读取文件中的索引
 	var offset int64 = 0
 	for {
@@ -288,8 +412,7 @@ func (db *DB) loadIndexFromHintFile() error {
 			return err
 		}
 		// 解码 拿到实际的位置索引
-		pos := data.DecodeLogRecordPos(logRecord.Value)
-		db.index.Put(logRecord.Key, pos)
+		fn(logRecord, data.DecodeLogRecordPos(logRecord.Value))
 		offset += size
 	}
 	return nil
@@ -1,11 +1,13 @@
 package bitcask_go
 
 import (
+	"bitcask-go/index"
 	"bitcask-go/utils"
 	"github.com/stretchr/testify/assert"
 	"os"
 	"sync"
 	"testing"
+	"time"
 )
 
 // 没有任何数据的情况下进行 merge
@@ -201,3 +203,119 @@ func TestDB_Merge_5(t *testing.T) {
 		assert.NotNil(t, val)
 	}
 }
+
+// merge 的读写经过后台 IO 限速
+func TestDB_Merge_RateLimit(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-rate-limit")
+	opts.DirPath = dir
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 2000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, time.Duration(0), db.Stat().BackgroundThrottled)
+
+	// 运行时调整限速
+	db.SetBackgroundIORate(256 * 1024)
+	err = db.Merge()
+	assert.Nil(t, err)
+
+	stat := db.Stat()
+	assert.True(t, stat.BackgroundThrottled > 0)
+	assert.Equal(t, time.Duration(0), stat.WriteThrottled)
+}
+
+// B+ 树索引在 merge 之后重新打开，索引指向 merge 之后的数据文件
+func TestDB_Merge_BPlusTree(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-bptree")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.IndexType = BPlusTree
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	expected := make(map[string][]byte)
+	for i := 0; i < 1000; i++ {
+		key, value := utils.GetTestKey(i), utils.RandomValue(128)
+		err := db.Put(key, value)
+		assert.Nil(t, err)
+		expected[string(key)] = value
+	}
+	for i := 0; i < 300; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		delete(expected, string(utils.GetTestKey(i)))
+	}
+	err = db.Merge()
+	assert.Nil(t, err)
+
+	// merge 之后的写入和删除不能被 merge 的结果覆盖
+	for i := 300; i < 400; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		delete(expected, string(utils.GetTestKey(i)))
+	}
+	for i := 900; i < 1100; i++ {
+		key, value := utils.GetTestKey(i), []byte("after-merge")
+		err := db.Put(key, value)
+		assert.Nil(t, err)
+		expected[string(key)] = value
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+
+	for i := 0; i < 2; i++ {
+		db2, err := Open(opts)
+		assert.Nil(t, err)
+		assertAcknowledgedState(t, db2, expected)
+		assert.True(t, db2.index.(*index.BPlusTree).MergedFid() > 0)
+		err = db2.Close()
+		assert.Nil(t, err)
+	}
+	_ = os.RemoveAll(dir)
+}
+
+// merge 之后没有新的写入，索引中已应用的位置在被替换的数据文件中
+func TestDB_Merge_BPlusTreeNoWrites(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-bptree-no-writes")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.IndexType = BPlusTree
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	expected := make(map[string][]byte)
+	for i := 0; i < 500; i++ {
+		key, value := utils.GetTestKey(i%250), utils.RandomValue(128)
+		err := db.Put(key, value)
+		assert.Nil(t, err)
+		expected[string(key)] = value
+	}
+	err = db.Merge()
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db2)
+	assertAcknowledgedState(t, db2, expected)
+	applied := db2.index.(*index.BPlusTree).Applied()
+	assert.Equal(t, uint32(0), applied.Size)
+
+	err = db2.Put(utils.GetTestKey(1), []byte("after-reopen"))
+	assert.Nil(t, err)
+	val, err := db2.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("after-reopen"), val)
+}
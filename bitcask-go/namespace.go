@@ -0,0 +1,368 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/index"
+	"encoding/binary"
+	"sort"
+	"sync/atomic"
+)
+
+// Namespace 命名空间，数据库中一个逻辑上独立的表
+// 所有的命名空间共享数据文件和事务，但是有各自的索引，可以单独遍历、统计和删除
+type Namespace struct {
+	db          *DB
+	id          uint32
+	name        string
+	index       index.Indexer
+	createPos   *data.LogRecordPos // 创建命名空间的记录所在的位置，merge 时用于判断记录是否有效
+	reclaimSize int64              // 命名空间中无效的数据量
+	dropped     atomic.Bool
+}
+
+// NamespaceStat 命名空间的统计信息
+type NamespaceStat struct {
+	Name            string
+	KeyNum          uint  // key 的数量
+	ReclaimableSize int64 // 可以进行 merge 回收的数据量 字节为单位
+}
+
+// Namespace 获取名称为 name 的命名空间，不存在时创建
+// 默认的命名空间即 DB 本身，B+ 树索引不支持命名空间
+func (db *DB) Namespace(name string) (*Namespace, error) {
+	if len(name) == 0 || isIndexNamespace(name) {
+		return nil, ErrInvalidNamespaceName
+	}
+	if db.options.IndexType == BPlusTree {
+		return nil, ErrNamespaceUnsupported
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if ns, ok := db.namespaces[name]; ok {
+		return ns, nil
+	}
+	if db.options.ReadOnly {
+		return nil, ErrNamespaceNotFound
+	}
+	if db.writeFenced.Load() {
+		return nil, ErrWriteFenced
+	}
+	return db.createNamespace(name)
+}
+
+// Namespaces 获取所有命名空间的名称
+func (db *DB) Namespaces() []string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	names := make([]string, 0, len(db.namespaces))
+	for name := range db.namespaces {
+		// 二级索引使用的命名空间对用户不可见
+		if !isIndexNamespace(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DropNamespace 删除命名空间及其中所有的数据，数据占用的空间在 merge 之后回收
+func (db *DB) DropNamespace(name string) error {
+	if db.options.ReadOnly {
+		return ErrReadOnly
+	}
+	if db.writeFenced.Load() {
+		return ErrWriteFenced
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	ns, ok := db.namespaces[name]
+	if !ok || isIndexNamespace(name) {
+		return ErrNamespaceNotFound
+	}
+	return db.dropNamespace(ns)
+}
+
+// Name 命名空间的名称
+func (ns *Namespace) Name() string {
+	return ns.name
+}
+
+// Put 写入 key/value 数据，key 不能为空
+func (ns *Namespace) Put(key []byte, value []byte) error {
+	if err := ns.checkWrite(key); err != nil {
+		return err
+	}
+
+	logRecord := &data.LogRecord{
+		Key:   logRecordKeyWithSeq(namespaceKey(ns.id, key), nonTransactionSeqNo),
+		Value: value,
+		Type:  data.LogRecordNsNormal,
+	}
+	return ns.db.appendLogRecordWithLock(logRecord, func(pos *data.LogRecordPos) {
+		if oldPos := ns.index.Put(key, pos); oldPos != nil {
+			ns.reclaim(oldPos.Size)
+		}
+	})
+}
+
+// Delete 根据 key 删除对应的数据
+func (ns *Namespace) Delete(key []byte) error {
+	if err := ns.checkWrite(key); err != nil {
+		return err
+	}
+	if pos := ns.index.Get(key); pos == nil {
+		return nil
+	}
+
+	logRecord := &data.LogRecord{
+		Key:  logRecordKeyWithSeq(namespaceKey(ns.id, key), nonTransactionSeqNo),
+		Type: data.LogRecordNsDeleted,
+	}
+	return ns.db.appendLogRecordWithLock(logRecord, func(pos *data.LogRecordPos) {
+		ns.reclaim(pos.Size)
+		if oldPos, _ := ns.index.Delete(key); oldPos != nil {
+			ns.reclaim(oldPos.Size)
+		}
+	})
+}
+
+// Get 根据 key 读取数据
+func (ns *Namespace) Get(key []byte) ([]byte, error) {
+	ns.db.mu.RLock()
+	defer ns.db.mu.RUnlock()
+
+	if len(key) == 0 {
+		return nil, ErrKeyIsEmpty
+	}
+	if ns.dropped.Load() {
+		return nil, ErrNamespaceDropped
+	}
+	logRecordPos := ns.index.Get(key)
+	if logRecordPos == nil {
+		if err := index.Err(ns.index); err != nil {
+			return nil, err
+		}
+		return nil, ErrKeyNotFound
+	}
+	return ns.db.getValueByPosition(logRecordPos)
+}
+
+// NewIterator 初始化命名空间的迭代器，遍历的是创建时刻的快照
+func (ns *Namespace) NewIterator(opts IteratorOptions) *Iterator {
+	ns.db.mu.RLock()
+	defer ns.db.mu.RUnlock()
+	return &Iterator{
+		indexIter: newIndexIterator(ns.index, opts.indexOptions()),
+		db:        ns.db,
+		options:   opts,
+	}
+}
+
+// ListKeys 获取命名空间中所有的 key
+func (ns *Namespace) ListKeys() [][]byte {
+	iterator := ns.index.Iterator(false)
+	defer iterator.Close()
+	keys := make([][]byte, 0, ns.index.Size())
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		keys = append(keys, iterator.Key())
+	}
+	return keys
+}
+
+// Fold 获取命名空间中所有的数据 并执行用户指定的操作
+func (ns *Namespace) Fold(fn func(key []byte, value []byte) bool) error {
+	ns.db.mu.RLock()
+	defer ns.db.mu.RUnlock()
+
+	iterator := ns.index.Iterator(false)
+	defer iterator.Close()
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		value, err := ns.db.getValueByPosition(iterator.Value())
+		if err != nil {
+			return err
+		}
+		if !fn(iterator.Key(), value) {
+			break
+		}
+	}
+	return nil
+}
+
+// Stat 返回命名空间的统计信息
+func (ns *Namespace) Stat() *NamespaceStat {
+	ns.db.mu.RLock()
+	defer ns.db.mu.RUnlock()
+	return &NamespaceStat{
+		Name:            ns.name,
+		KeyNum:          uint(ns.index.Size()),
+		ReclaimableSize: ns.reclaimSize,
+	}
+}
+
+func (ns *Namespace) checkWrite(key []byte) error {
+	if ns.db.options.ReadOnly {
+		return ErrReadOnly
+	}
+	if ns.db.writeFenced.Load() {
+		return ErrWriteFenced
+	}
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+	if ns.dropped.Load() {
+		return ErrNamespaceDropped
+	}
+	return nil
+}
+
+// 命名空间中无效的数据同时计入数据库的无效数据量
+func (ns *Namespace) reclaim(size uint32) {
+	ns.reclaimSize += int64(size)
+	ns.db.reclaimSize += int64(size)
+}
+
+// 写入创建命名空间的记录，调用方需要持有 db.mu
+func (db *DB) createNamespace(name string) (*Namespace, error) {
+	id := db.maxNamespaceId + 1
+	record := &data.LogRecord{
+		Key:  logRecordKeyWithSeq(namespaceKey(id, []byte(name)), nonTransactionSeqNo),
+		Type: data.LogRecordNsCreated,
+	}
+	pos, err := db.appendLogRecord(record)
+	if err != nil {
+		return nil, err
+	}
+	return db.addNamespace(id, name, pos), nil
+}
+
+// 写入删除命名空间的记录，调用方需要持有 db.mu
+func (db *DB) dropNamespace(ns *Namespace) error {
+	record := &data.LogRecord{
+		Key:  logRecordKeyWithSeq(namespaceKey(ns.id, []byte(ns.name)), nonTransactionSeqNo),
+		Type: data.LogRecordNsDropped,
+	}
+	pos, err := db.appendLogRecord(record)
+	if err != nil {
+		return err
+	}
+	db.removeNamespace(ns, pos)
+	return nil
+}
+
+// 调用方需要持有 db.mu
+func (db *DB) addNamespace(id uint32, name string, createPos *data.LogRecordPos) *Namespace {
+	ns := &Namespace{
+		db:        db,
+		id:        id,
+		name:      name,
+		index:     index.NewIndexer(db.options.IndexType, indexerOptions(db.options)),
+		createPos: createPos,
+	}
+	db.namespaces[name] = ns
+	db.namespacesById[id] = ns
+	if isIndexNamespace(name) {
+		db.indexNamespaceNum++
+	}
+	if id > db.maxNamespaceId {
+		db.maxNamespaceId = id
+	}
+	return ns
+}
+
+// 删除命名空间，命名空间中所有的数据都变为无效数据，调用方需要持有 db.mu
+func (db *DB) removeNamespace(ns *Namespace, dropPos *data.LogRecordPos) {
+	ns.dropped.Store(true)
+	delete(db.namespaces, ns.name)
+	delete(db.namespacesById, ns.id)
+	if isIndexNamespace(ns.name) {
+		db.indexNamespaceNum--
+	}
+
+	reclaimSize := int64(ns.createPos.Size) + int64(dropPos.Size)
+	iterator := ns.index.Iterator(false)
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		reclaimSize += int64(iterator.Value().Size)
+	}
+	iterator.Close()
+	db.reclaimSize += reclaimSize
+	_ = ns.index.Close()
+}
+
+// 加载数据文件或者提交事务时更新命名空间相关的记录，调用方需要持有 db.mu
+func (db *DB) updateNamespaceIndex(key []byte, typ data.LogRecordType, pos *data.LogRecordPos) {
+	id, realKey := parseNamespaceKey(key)
+	ns := db.namespacesById[id]
+	switch typ {
+	case data.LogRecordNsCreated:
+		if ns == nil {
+			db.addNamespace(id, string(realKey), pos)
+		}
+	case data.LogRecordNsDropped:
+		if ns != nil {
+			db.removeNamespace(ns, pos)
+		}
+	case data.LogRecordNsNormal:
+		if ns == nil {
+			// 命名空间已经被删除
+			db.reclaimSize += int64(pos.Size)
+		} else if oldPos := ns.index.Put(realKey, pos); oldPos != nil {
+			ns.reclaim(oldPos.Size)
+		}
+	case data.LogRecordNsDeleted:
+		if ns == nil {
+			db.reclaimSize += int64(pos.Size)
+			return
+		}
+		ns.reclaim(pos.Size)
+		if oldPos, _ := ns.index.Delete(realKey); oldPos != nil {
+			ns.reclaim(oldPos.Size)
+		}
+	}
+}
+
+// merge 时判断命名空间相关的记录是否仍然有效
+func (db *DB) isNamespaceRecordLive(key []byte, typ data.LogRecordType, fid uint32, offset int64) bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	id, realKey := parseNamespaceKey(key)
+	ns := db.namespacesById[id]
+	if ns == nil {
+		return false
+	}
+	var pos *data.LogRecordPos
+	switch typ {
+	case data.LogRecordNsCreated:
+		pos = ns.createPos
+	case data.LogRecordNsNormal:
+		pos = ns.index.Get(realKey)
+	}
+	return pos != nil && pos.Fid == fid && pos.Offset == offset
+}
+
+// 命名空间的名称
+func (db *DB) namespaceName(id uint32) string {
+	if ns := db.namespacesById[id]; ns != nil {
+		return ns.name
+	}
+	return ""
+}
+
+func isNamespaceRecord(typ data.LogRecordType) bool {
+	return typ >= data.LogRecordNsNormal && typ <= data.LogRecordNsDropped
+}
+
+// 命名空间中的 key 编码：命名空间 id + key
+func namespaceKey(id uint32, key []byte) []byte {
+	buf := binary.AppendUvarint(make([]byte, 0, binary.MaxVarintLen32+len(key)), uint64(id))
+	return append(buf, key...)
+}
+
+func parseNamespaceKey(key []byte) (uint32, []byte) {
+	id, n := binary.Uvarint(key)
+	if n <= 0 {
+		return 0, nil
+	}
+	return uint32(id), key[n:]
+}
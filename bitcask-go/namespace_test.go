@@ -0,0 +1,232 @@
+package bitcask_go
+
+import (
+	"bitcask-go/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func TestDB_Namespace(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-namespace")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	_, err = db.Namespace("")
+	assert.Equal(t, ErrInvalidNamespaceName, err)
+
+	users, err := db.Namespace("users")
+	assert.Nil(t, err)
+	orders, err := db.Namespace("orders")
+	assert.Nil(t, err)
+	same, err := db.Namespace("users")
+	assert.Nil(t, err)
+	assert.Equal(t, users, same)
+	assert.Equal(t, []string{"orders", "users"}, db.Namespaces())
+
+	// 相同的 key 在不同的命名空间中互不影响
+	assert.Nil(t, db.Put([]byte("k"), []byte("default")))
+	assert.Nil(t, users.Put([]byte("k"), []byte("users")))
+	assert.Nil(t, orders.Put([]byte("k"), []byte("orders")))
+	val, err := db.Get([]byte("k"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("default"), val)
+	val, err = users.Get([]byte("k"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("users"), val)
+
+	assert.Nil(t, orders.Delete([]byte("k")))
+	_, err = orders.Get([]byte("k"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err = users.Get([]byte("k"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("users"), val)
+
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, users.Put(utils.GetTestKey(i), utils.RandomValue(10)))
+	}
+	assert.Equal(t, 11, len(users.ListKeys()))
+	assert.Equal(t, 1, len(db.ListKeys()))
+	assert.Equal(t, uint(1), db.Stat().KeyNum)
+
+	stat := users.Stat()
+	assert.Equal(t, "users", stat.Name)
+	assert.Equal(t, uint(11), stat.KeyNum)
+	stat = orders.Stat()
+	assert.Equal(t, uint(0), stat.KeyNum)
+	assert.True(t, stat.ReclaimableSize > 0)
+
+	iter := users.NewIterator(IteratorOptions{Prefix: []byte("bitcask-go-key")})
+	var count int
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		value, err := iter.Value()
+		assert.Nil(t, err)
+		assert.NotNil(t, value)
+		count++
+	}
+	iter.Close()
+	assert.Equal(t, 10, count)
+
+	var folded int
+	assert.Nil(t, users.Fold(func(key []byte, value []byte) bool {
+		folded++
+		return true
+	}))
+	assert.Equal(t, 11, folded)
+
+	// 重启之后命名空间和数据仍然存在
+	assert.Nil(t, db.Close())
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db2)
+	assert.Equal(t, []string{"orders", "users"}, db2.Namespaces())
+	users2, err := db2.Namespace("users")
+	assert.Nil(t, err)
+	assert.Equal(t, uint(11), users2.Stat().KeyNum)
+	val, err = users2.Get([]byte("k"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("users"), val)
+	val, err = db2.Get([]byte("k"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("default"), val)
+}
+
+func TestDB_DropNamespace(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-namespace-drop")
+	opts.DirPath = dir
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	users, err := db.Namespace("users")
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, users.Put(utils.GetTestKey(i), utils.RandomValue(10)))
+	}
+	assert.Nil(t, db.Put(utils.GetTestKey(1), utils.RandomValue(10)))
+
+	assert.Nil(t, db.DropNamespace("users"))
+	assert.Equal(t, ErrNamespaceNotFound, db.DropNamespace("users"))
+	assert.Equal(t, ErrNamespaceDropped, users.Put([]byte("k"), []byte("v")))
+	_, err = users.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrNamespaceDropped, err)
+	assert.Empty(t, db.Namespaces())
+	assert.True(t, db.Stat().ReclaimableSize > 0)
+
+	// 重新创建同名的命名空间是空的
+	users, err = db.Namespace("users")
+	assert.Nil(t, err)
+	assert.Equal(t, uint(0), users.Stat().KeyNum)
+	assert.Nil(t, users.Put([]byte("k"), []byte("v")))
+
+	// 重启之后删除仍然生效
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	users, err = db.Namespace("users")
+	assert.Nil(t, err)
+	assert.Equal(t, uint(1), users.Stat().KeyNum)
+
+	// merge 之后删除的命名空间的数据被清理
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"users"}, db.Namespaces())
+	users, err = db.Namespace("users")
+	assert.Nil(t, err)
+	assert.Equal(t, uint(1), users.Stat().KeyNum)
+	val, err := users.Get([]byte("k"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v"), val)
+	assert.Equal(t, uint(1), db.Stat().KeyNum)
+	assert.Equal(t, int64(0), db.Stat().ReclaimableSize)
+
+	// 新的命名空间分配新的 id
+	orders, err := db.Namespace("orders")
+	assert.Nil(t, err)
+	assert.NotEqual(t, users.id, orders.id)
+}
+
+func TestDB_Namespace_WriteBatch(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-namespace-batch")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	users, err := db.Namespace("users")
+	assert.Nil(t, err)
+	orders, err := db.Namespace("orders")
+	assert.Nil(t, err)
+	assert.Nil(t, orders.Put([]byte("o1"), []byte("v")))
+
+	sub, err := db.Watch(nil, DefaultWatchOptions)
+	assert.Nil(t, err)
+	defer sub.Close()
+
+	// 一个批次原子地写入多个命名空间
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Put([]byte("k"), []byte("default")))
+	assert.Nil(t, wb.PutIn(users, []byte("k"), []byte("users")))
+	assert.Nil(t, wb.DeleteIn(orders, []byte("o1")))
+	_, err = users.Get([]byte("k"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Nil(t, wb.Commit())
+
+	val, err := db.Get([]byte("k"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("default"), val)
+	val, err = users.Get([]byte("k"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("users"), val)
+	_, err = orders.Get([]byte("o1"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	group := <-sub.C()
+	assert.Equal(t, 3, len(group.Events))
+	namespaces := make(map[string]ChangeType)
+	for _, event := range group.Events {
+		namespaces[event.Namespace] = event.Type
+	}
+	assert.Equal(t, map[string]ChangeType{"": ChangePut, "users": ChangePut, "orders": ChangeDelete}, namespaces)
+
+	// 重启之后批次中的数据仍然在各自的命名空间中
+	assert.Nil(t, db.Close())
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db2)
+	users2, err := db2.Namespace("users")
+	assert.Nil(t, err)
+	val, err = users2.Get([]byte("k"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("users"), val)
+	orders2, err := db2.Namespace("orders")
+	assert.Nil(t, err)
+	assert.Equal(t, uint(0), orders2.Stat().KeyNum)
+
+	// 不能写入其他数据库的命名空间
+	wb2 := db2.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Equal(t, ErrNamespaceNotFound, wb2.PutIn(users, []byte("k"), []byte("v")))
+}
+
+func TestDB_Namespace_BPlusTree(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-namespace-bptree")
+	opts.DirPath = dir
+	opts.IndexType = BPlusTree
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	_, err = db.Namespace("users")
+	assert.Equal(t, ErrNamespaceUnsupported, err)
+	err = db.CreateIndex("by-value", func(value []byte) [][]byte { return [][]byte{value} })
+	assert.Equal(t, ErrNamespaceUnsupported, err)
+}
@@ -18,13 +18,65 @@ type Options struct {
 	BytesPerSync uint
 
 	// 索引类型
+	// BPlusTree 索引持久化在单个 bucket 中，不支持命名空间和二级索引，Namespace 和 CreateIndex 返回 ErrNamespaceUnsupported
 	IndexType IndexerType
 
+	// Compact 索引是否对相邻的 key 做前缀压缩，key 有较长的公共前缀时可以节省更多的内存
+	IndexPrefixCompression bool
+
+	// Tiered 索引最多占用的内存字节数，超过之后将数据写入磁盘，每个命名空间的索引单独计算
+	IndexMemoryBudget int64
+
 	// 启动时是否使用 MMap 加载
 	MMapAtStartup bool
 
 	// 数据文件合并的阈值
 	DataFileMergeRatio float32
+
+	// 后台 IO（merge、备份、hint 索引文件写入）每秒最多读写的字节数，0 表示不限速
+	BackgroundIORate int64
+
+	// 前台写入每秒最多写入的字节数，0 表示不限速
+	// 写入在获取数据库的锁之前按照记录编码之后的最大长度预留令牌，限速等待的时候不会阻塞读取
+	WriteIORate int64
+
+	// 最多同时打开的旧数据文件数量，0 表示不限制
+	MaxOpenFiles int
+
+	// 读缓存最多占用的内存字节数，0 表示不开启读缓存
+	// 所有对数据文件的读取（包括 Get、迭代、启动加载索引、merge 以及 LogReader）都会经过读缓存
+	ReadCacheSize int64
+
+	// 是否以只读模式打开，只读模式不会加文件锁，可以和正在写入的进程共享同一个数据目录
+	// 只读模式下不会创建或者修改任何文件，不支持 B+ 树索引（返回 ErrReadOnlyBPlusTree），需要使用内存索引从数据文件中构建
+	ReadOnly bool
+
+	// 保留最近多少个变更组用于恢复订阅，第一次调用 Watch 之后才会开始记录
+	WatchHistorySize int
+}
+
+// ShardedOptions 分片数据库配置项
+type ShardedOptions struct {
+	// 数据目录，每个分片是其中的一个子目录
+	DirPath string
+
+	// 分片的数量，创建之后不能修改
+	ShardNum int
+
+	// 一致性哈希中每个分片的虚拟节点数量，创建之后不能修改
+	VirtualNodes int
+
+	// 每个分片的配置项，DirPath 会被忽略
+	ShardOptions Options
+}
+
+// WatchOptions 变更订阅配置项
+type WatchOptions struct {
+	// 订阅者最多缓冲的变更组数量，超过之后订阅会被关闭
+	BufferSize int
+
+	// 从这个序号之后的变更组开始接收，0 表示只接收新的变更
+	StartAfter uint64
 }
 
 // IteratorOptions 索引迭代器配置项
@@ -34,6 +86,24 @@ type IteratorOptions struct {
 
 	// 是否反向遍历，默认false是正向
 	Reverse bool
+
+	// 遍历的下界，默认包含下界本身，为空表示没有下界
+	LowerBound []byte
+
+	// 是否不包含下界本身
+	ExcludeLower bool
+
+	// 遍历的上界，默认不包含上界本身，为空表示没有上界
+	UpperBound []byte
+
+	// 是否包含上界本身
+	IncludeUpper bool
+
+	// 最多遍历的数据量，Rewind 或者 Seek 之后重新计数，0 表示不限制
+	Limit int
+
+	// 只遍历 key，Value 不会读取数据文件，直接返回空
+	KeysOnly bool
 }
 
 // WriteBatchOptions 批量写配置项
@@ -45,6 +115,37 @@ type WriteBatchOptions struct {
 	SyncWrites bool
 }
 
+// ExportOptions 导出数据配置项
+type ExportOptions struct {
+	// 导出的格式
+	Format ExportFormat
+
+	// 只导出前缀为指定值的 Key，默认为空
+	Prefix []byte
+}
+
+// ImportOptions 导入数据配置项
+type ImportOptions struct {
+	// 导入数据的格式，需要和导出时的格式一致
+	Format ExportFormat
+
+	// 每个 WriteBatch 中最多写入的数据量
+	BatchSize uint
+
+	// 每个批次提交的时候，是否进行可持久化
+	SyncWrites bool
+}
+
+type ExportFormat = int8
+
+const (
+	// ExportBinary 带校验的二进制格式
+	ExportBinary ExportFormat = iota + 1
+
+	// ExportJSONLines JSON Lines 格式，key 和 value 使用 base64 编码
+	ExportJSONLines
+)
+
 type IndexerType = int8
 
 const (
@@ -55,17 +156,49 @@ const (
 	ART
 
 	// BPlusTree B+ 树索引，将索引存储到磁盘上
+	// 不支持命名空间和二级索引，也不能以只读模式打开
 	BPlusTree
+
+	// Hash 分片的哈希索引，只适合点查，遍历时需要对所有的 key 排序
+	Hash
+
+	// Compact 紧凑索引，key 和位置信息编码在连续的内存块中，适合 key 数量非常多的场景
+	// 写入先进入一个小的 BTree，积累到一定数量之后再合并到内存块中
+	Compact
+
+	// Tiered 分层索引，最近写入的 key 在内存中，超过内存预算之后写入数据目录中的临时文件
+	// 适合 key 的数量超过内存能够容纳的范围的场景，重启之后仍然需要从 hint 文件和数据文件中重建
+	// 磁盘上的临时文件不会跨重启保留，重建时需要重新写入，启动比 Btree 更慢
+	Tiered
+
+	// SkipList 无锁的并发跳表索引，并发写入不需要全局锁，适合写多的并发场景
+	// 索引的迭代器遍历的不是快照，NewIterator、ListKeys 和 Export 在创建时复制一份数据，代价和数据的条数成正比
+	SkipList
 )
 
 var DefaultOptions = Options{
-	DirPath:            os.TempDir(),
-	DataFileSize:       256 * 1024 * 1024, // 256MB
-	SyncWrites:         false,
-	BytesPerSync:       0,
-	IndexType:          Btree,
-	MMapAtStartup:      true,
-	DataFileMergeRatio: 0.5,
+	DirPath:                os.TempDir(),
+	DataFileSize:           256 * 1024 * 1024, // 256MB
+	SyncWrites:             false,
+	BytesPerSync:           0,
+	IndexType:              Btree,
+	IndexPrefixCompression: false,
+	IndexMemoryBudget:      256 * 1024 * 1024, // 256MB
+	MMapAtStartup:          true,
+	DataFileMergeRatio:     0.5,
+	BackgroundIORate:       0,
+	WriteIORate:            0,
+	MaxOpenFiles:           0,
+	ReadCacheSize:          0,
+	ReadOnly:               false,
+	WatchHistorySize:       1024,
+}
+
+var DefaultShardedOptions = ShardedOptions{
+	DirPath:      os.TempDir(),
+	ShardNum:     4,
+	VirtualNodes: 128,
+	ShardOptions: DefaultOptions,
 }
 
 var DefaultIteratorOptions = IteratorOptions{
@@ -77,3 +210,19 @@ var DefaultWriteBatchOptions = WriteBatchOptions{
 	MaxBatchSize: 10000,
 	SyncWrites:   true,
 }
+
+var DefaultWatchOptions = WatchOptions{
+	BufferSize: 128,
+	StartAfter: 0,
+}
+
+var DefaultExportOptions = ExportOptions{
+	Format: ExportBinary,
+	Prefix: nil,
+}
+
+var DefaultImportOptions = ImportOptions{
+	Format:     ExportBinary,
+	BatchSize:  DefaultWriteBatchOptions.MaxBatchSize,
+	SyncWrites: true,
+}
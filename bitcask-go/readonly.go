@@ -0,0 +1,126 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Refresh 刷新只读实例的数据视图
+// 读取其他进程在活跃文件中新追加的数据，以及新创建的数据文件，非只读模式下直接返回
+// 写入进程重启时如果应用了 merge 的结果，数据文件会被替换，被替换文件的读缓存会失效，并返回 ErrDataFilesReplaced，只读实例需要重新打开
+func (db *DB) Refresh() error {
+	if !db.options.ReadOnly {
+		return nil
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.checkDataFilesReplaced(); err != nil {
+		return err
+	}
+
+	for {
+		// 继续读取当前活跃文件中新追加的数据
+		if err := db.refreshActiveFile(); err != nil {
+			return err
+		}
+
+		// 查找是否有新创建的数据文件
+		nextFileId, ok, err := db.nextDataFileId()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+
+		// 新文件是在旧文件写完之后才创建的，切换之前需要再读一次旧的文件，避免遗漏数据
+		if err := db.refreshActiveFile(); err != nil {
+			return err
+		}
+		dataFile, err := data.OpenDataFile(db.options.DirPath, nextFileId, db.standardIOType())
+		if err != nil {
+			return err
+		}
+		dataFile.Cache = db.readCache
+		if db.activeFile != nil {
+			db.addOlderFile(db.activeFile)
+		}
+		db.activeFile = dataFile
+	}
+}
+
+// 检查数据文件是否被 merge 替换，merge 会重写最小的文件 id，只需要先检查最旧的文件
+// 文件 id 被 merge 之后的文件复用，缓存的记录需要失效
+func (db *DB) checkDataFilesReplaced() error {
+	oldest := db.activeFile
+	for _, file := range db.olderFiles {
+		if oldest == nil || file.FileId < oldest.FileId {
+			oldest = file
+		}
+	}
+	if oldest == nil {
+		return nil
+	}
+	replaced, err := oldest.Replaced()
+	if err != nil || !replaced {
+		return err
+	}
+
+	files := []*data.DataFile{db.activeFile}
+	for _, file := range db.olderFiles {
+		files = append(files, file)
+	}
+	for _, file := range files {
+		replaced, err := file.Replaced()
+		if err != nil {
+			return err
+		}
+		if replaced && db.readCache != nil {
+			db.readCache.RemoveFile(file.FileId)
+		}
+	}
+	return ErrDataFilesReplaced
+}
+
+func (db *DB) refreshActiveFile() error {
+	if db.activeFile == nil {
+		return nil
+	}
+	offset, err := db.replayDataFile(db.activeFile, db.activeFile.WriteOff, true)
+	if err != nil {
+		return err
+	}
+	db.activeFile.WriteOff = offset
+	return nil
+}
+
+// 查找比当前活跃文件 id 更大的最小的数据文件 id
+func (db *DB) nextDataFileId() (uint32, bool, error) {
+	dirEntries, err := os.ReadDir(db.options.DirPath)
+	if err != nil {
+		return 0, false, err
+	}
+
+	var nextFileId uint32
+	var found bool
+	for _, entry := range dirEntries {
+		if !strings.HasSuffix(entry.Name(), data.DataFileNameSuffix) {
+			continue
+		}
+		fileId, err := strconv.Atoi(strings.Split(entry.Name(), ".")[0])
+		if err != nil {
+			return 0, false, ErrDataDirectoryCorrupted
+		}
+		fid := uint32(fileId)
+		if db.activeFile != nil && fid <= db.activeFile.FileId {
+			continue
+		}
+		if !found || fid < nextFileId {
+			nextFileId, found = fid, true
+		}
+	}
+	return nextFileId, found, nil
+}
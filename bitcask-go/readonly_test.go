@@ -0,0 +1,196 @@
+package bitcask_go
+
+import (
+	"bitcask-go/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDB_ReadOnly(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-readonly")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+
+	// 写入的进程持有文件锁的同时，可以以只读的方式打开
+	roOpts := opts
+	roOpts.ReadOnly = true
+	roDB, err := Open(roOpts)
+	assert.Nil(t, err)
+	assert.NotNil(t, roDB)
+	defer func() {
+		_ = roDB.Close()
+	}()
+	assert.Equal(t, 100, len(roDB.ListKeys()))
+	val, err := roDB.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+
+	// 只读实例不能写入
+	assert.Equal(t, ErrReadOnly, roDB.Put(utils.GetTestKey(1), []byte("a")))
+	assert.Equal(t, ErrReadOnly, roDB.Delete(utils.GetTestKey(1)))
+	assert.Equal(t, ErrReadOnly, roDB.Merge())
+	wb := roDB.NewWriteBatch(DefaultWriteBatchOptions)
+	err = wb.Put(utils.GetTestKey(1), []byte("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, ErrReadOnly, wb.Commit())
+
+	// 多个只读实例可以同时打开
+	roDB2, err := Open(roOpts)
+	assert.Nil(t, err)
+	assert.NotNil(t, roDB2)
+	err = roDB2.Close()
+	assert.Nil(t, err)
+}
+
+func TestDB_ReadOnly_Refresh(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-readonly-refresh")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	roOpts := opts
+	roOpts.ReadOnly = true
+	roDB, err := Open(roOpts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = roDB.Close()
+	}()
+	assert.Equal(t, 0, len(roDB.ListKeys()))
+
+	// 写入的数据会产生新的数据文件
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	err = db.Delete(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	err = wb.Put(utils.GetTestKey(2000), []byte("batch"))
+	assert.Nil(t, err)
+	err = wb.Commit()
+	assert.Nil(t, err)
+
+	// 刷新之前看不到新的数据
+	_, err = roDB.Get(utils.GetTestKey(0))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	err = roDB.Refresh()
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, len(roDB.ListKeys()))
+	_, err = roDB.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err := roDB.Get(utils.GetTestKey(2000))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("batch"), val)
+
+	// 继续追加写入到同一个活跃文件
+	err = db.Put(utils.GetTestKey(3000), []byte("tail"))
+	assert.Nil(t, err)
+	err = roDB.Refresh()
+	assert.Nil(t, err)
+	val, err = roDB.Get(utils.GetTestKey(3000))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("tail"), val)
+}
+
+func TestDB_ReadOnly_RefreshAfterMerge(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-readonly-refresh-merge")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(128)))
+	}
+
+	roOpts := opts
+	roOpts.ReadOnly = true
+	roOpts.ReadCacheSize = 1024 * 1024
+	roDB, err := Open(roOpts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = roDB.Close()
+	}()
+	_, err = roDB.Get(utils.GetTestKey(0))
+	assert.Nil(t, err)
+	cacheSize := roDB.readCache.Size()
+	assert.True(t, cacheSize > 0)
+
+	// 写入进程 merge 之后重启，数据文件被替换
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 被替换文件的缓存失效，需要重新打开只读实例
+	assert.Equal(t, ErrDataFilesReplaced, roDB.Refresh())
+	assert.True(t, roDB.readCache.Size() < cacheSize)
+}
+
+func TestDB_ReadOnly_NoWrites(t *testing.T) {
+	// 数据目录不存在，不会创建
+	opts := DefaultOptions
+	opts.DirPath = filepath.Join(os.TempDir(), "bitcask-go-readonly-not-exist")
+	opts.ReadOnly = true
+	_, err := Open(opts)
+	assert.NotNil(t, err)
+	_, err = os.Stat(opts.DirPath)
+	assert.True(t, os.IsNotExist(err))
+
+	// B+ 树索引的数据目录，只读打开不会修改任何文件
+	opts = DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-readonly-bptree")
+	opts.DirPath = dir
+	opts.IndexType = BPlusTree
+	opts.MMapAtStartup = false
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	before, _ := utils.DirSize(dir)
+	entries, _ := os.ReadDir(dir)
+
+	// B+ 树索引不能以只读的方式打开，需要使用内存索引
+	opts.ReadOnly = true
+	_, err = Open(opts)
+	assert.Equal(t, ErrReadOnlyBPlusTree, err)
+	opts.IndexType = Btree
+	roDB, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 100, len(roDB.ListKeys()))
+	err = roDB.Close()
+	assert.Nil(t, err)
+
+	after, _ := utils.DirSize(dir)
+	entries2, _ := os.ReadDir(dir)
+	assert.Equal(t, before, after)
+	assert.Equal(t, len(entries), len(entries2))
+}
@@ -0,0 +1,388 @@
+package replication
+
+import (
+	bitcask "bitcask-go"
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 主节点为从节点注册的日志消费者名称的前缀
+const consumerNamePrefix = "replica-"
+
+// 从节点断开了连接
+var errAckStopped = errors.New("the replica stopped sending acks")
+
+// PrimaryOptions 主节点配置项
+type PrimaryOptions struct {
+	// 监听的地址
+	Addr string
+
+	// 追上之后检查新数据的间隔
+	PollInterval time.Duration
+
+	// 发送心跳的间隔
+	HeartbeatInterval time.Duration
+
+	// 一帧中最多发送的记录数量
+	MaxBatchRecords int
+
+	// 持久化从节点确认位置的间隔，确认的位置只用来判断能否 merge 以及从节点重连，落后一些不影响正确性
+	AckSyncInterval time.Duration
+
+	// 从节点断开连接超过这个时间之后，释放为它注册的日志消费者，0 表示一直保留
+	// 注册的消费者会阻止 merge 重写它没有读取的数据，永久下线的从节点需要被释放，否则 merge 一直返回 ErrConsumerBehind
+	// 被释放的从节点重连时，如果需要的数据已经被 merge 重写，需要从新的检查点重建
+	ReplicaTTL time.Duration
+
+	// 记录从节点断开连接等错误的日志，为空时不记录
+	Logger *log.Logger
+}
+
+var DefaultPrimaryOptions = PrimaryOptions{
+	Addr:              "127.0.0.1:0",
+	PollInterval:      10 * time.Millisecond,
+	HeartbeatInterval: 100 * time.Millisecond,
+	MaxBatchRecords:   1024,
+	AckSyncInterval:   time.Second,
+	ReplicaTTL:        24 * time.Hour,
+}
+
+// Primary 复制的主节点，将写入的日志记录发送给连接上来的从节点
+type Primary struct {
+	db           *bitcask.DB
+	options      PrimaryOptions
+	listener     net.Listener
+	mu           *sync.Mutex
+	conns        map[net.Conn]struct{}
+	connected    map[string]int       // 从节点 id -> 当前的连接数量
+	disconnected map[string]time.Time // 注册了消费者但是没有连接的从节点 id -> 断开连接的时间
+	closed       chan struct{}
+	wg           *sync.WaitGroup
+}
+
+// NewPrimary 开始监听从节点的连接
+func NewPrimary(db *bitcask.DB, opts PrimaryOptions) (*Primary, error) {
+	listener, err := net.Listen("tcp", opts.Addr)
+	if err != nil {
+		return nil, err
+	}
+	p := &Primary{
+		db:           db,
+		options:      opts,
+		listener:     listener,
+		mu:           new(sync.Mutex),
+		conns:        make(map[net.Conn]struct{}),
+		connected:    make(map[string]int),
+		disconnected: make(map[string]time.Time),
+		closed:       make(chan struct{}),
+		wg:           new(sync.WaitGroup),
+	}
+	// 之前注册过的从节点从现在开始计算断开连接的时间
+	now := time.Now()
+	for _, name := range db.ListConsumers() {
+		if replicaId, ok := strings.CutPrefix(name, consumerNamePrefix); ok {
+			p.disconnected[replicaId] = now
+		}
+	}
+	p.wg.Add(1)
+	go p.accept()
+	if opts.ReplicaTTL > 0 {
+		p.wg.Add(1)
+		go p.expireReplicas()
+	}
+	return p, nil
+}
+
+// ReleaseReplica 释放为从节点注册的日志消费者，之后 merge 不再等待这个从节点
+// 用于永久下线的从节点，从节点仍然连接时返回 ErrReplicaConnected
+func (p *Primary) ReleaseReplica(replicaId string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.connected[replicaId] > 0 {
+		return ErrReplicaConnected
+	}
+	if err := p.db.UnregisterConsumer(consumerNamePrefix + replicaId); err != nil {
+		return err
+	}
+	delete(p.disconnected, replicaId)
+	return nil
+}
+
+// 定期释放断开连接超过 ReplicaTTL 的从节点
+func (p *Primary) expireReplicas() {
+	defer p.wg.Done()
+	ticker := time.NewTicker(min(p.options.ReplicaTTL, time.Minute))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.closed:
+			return
+		case <-ticker.C:
+		}
+
+		var expired []string
+		p.mu.Lock()
+		for replicaId, disconnectedAt := range p.disconnected {
+			if time.Since(disconnectedAt) >= p.options.ReplicaTTL {
+				expired = append(expired, replicaId)
+			}
+		}
+		p.mu.Unlock()
+		for _, replicaId := range expired {
+			err := p.ReleaseReplica(replicaId)
+			if err != nil && err != ErrReplicaConnected && p.options.Logger != nil {
+				p.options.Logger.Printf("replication: failed to release replica %s: %v", replicaId, err)
+			}
+		}
+	}
+}
+
+// 记录从节点建立了连接，释放从节点和注册消费者通过 p.mu 互斥
+func (p *Primary) replicaConnected(replicaId string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.connected[replicaId]++
+	delete(p.disconnected, replicaId)
+}
+
+func (p *Primary) replicaDisconnected(replicaId string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.connected[replicaId]--
+	if p.connected[replicaId] > 0 {
+		return
+	}
+	delete(p.connected, replicaId)
+	if _, ok := p.db.ConsumerPosition(consumerNamePrefix + replicaId); ok {
+		p.disconnected[replicaId] = time.Now()
+	}
+}
+
+// Addr 返回实际监听的地址
+func (p *Primary) Addr() string {
+	return p.listener.Addr().String()
+}
+
+// Close 停止监听并断开所有从节点的连接，不会关闭数据库
+func (p *Primary) Close() error {
+	select {
+	case <-p.closed:
+		return nil
+	default:
+	}
+	close(p.closed)
+	err := p.listener.Close()
+	p.mu.Lock()
+	for conn := range p.conns {
+		_ = conn.Close()
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+	return err
+}
+
+func (p *Primary) accept() {
+	defer p.wg.Done()
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		p.mu.Lock()
+		select {
+		case <-p.closed:
+			p.mu.Unlock()
+			_ = conn.Close()
+			return
+		default:
+		}
+		p.conns[conn] = struct{}{}
+		p.mu.Unlock()
+
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			if err := p.serve(conn); err != nil && err != io.EOF && err != ErrPrimaryIsClosed && p.options.Logger != nil {
+				p.options.Logger.Printf("replication: replica %s disconnected: %v", conn.RemoteAddr(), err)
+			}
+			p.mu.Lock()
+			delete(p.conns, conn)
+			p.mu.Unlock()
+			_ = conn.Close()
+		}()
+	}
+}
+
+// 处理一个从节点的连接
+func (p *Primary) serve(conn net.Conn) error {
+	typ, payload, err := readFrame(conn)
+	if err != nil {
+		return err
+	}
+	if typ != frameHello {
+		return ErrUnexpectedFrame
+	}
+	replicaId, pos, err := decodeHello(payload)
+	if err != nil {
+		return err
+	}
+	p.replicaConnected(replicaId)
+	defer p.replicaDisconnected(replicaId)
+
+	// 从节点先保存位置再发送确认，正常情况下不会落后于主节点记录的位置
+	consumerName := consumerNamePrefix + replicaId
+	if consumerPos, ok := p.db.ConsumerPosition(consumerName); ok && positionBefore(pos, consumerPos) {
+		// 主节点 merge 的时候会把从节点的位置移动到新的文件，只有从节点所在的文件已经被 merge 重写时才能从新的位置继续
+		mergedFileId, err := p.db.MergedFileId()
+		if err != nil {
+			return err
+		}
+		if pos.Fid >= mergedFileId {
+			return ErrReplicaBehind
+		}
+		pos = consumerPos
+	}
+	if err := p.db.RegisterConsumer(consumerName, pos); err != nil {
+		return err
+	}
+
+	// 接收从节点的 ACK，记录从节点的位置
+	acked := &ackedPosition{mu: new(sync.Mutex), pos: pos, saved: pos}
+	var ackErr error
+	ackDone := make(chan struct{})
+	go func() {
+		defer close(ackDone)
+		ackErr = p.receiveAcks(conn, acked)
+	}()
+
+	err = p.stream(conn, pos, ackDone, consumerName, acked)
+	// 关闭连接之后等待接收 ACK 的协程退出，再保存最后确认的位置
+	_ = conn.Close()
+	<-ackDone
+	if saveErr := p.saveAcked(consumerName, acked); saveErr != nil {
+		return saveErr
+	}
+	if err == errAckStopped {
+		return ackErr
+	}
+	return err
+}
+
+// 持续发送从 pos 开始的日志记录
+func (p *Primary) stream(conn net.Conn, pos bitcask.LogPosition, ackDone chan struct{},
+	consumerName string, acked *ackedPosition) error {
+	w := bufio.NewWriter(conn)
+	var lastHeartbeat, lastAckSync time.Time
+	var lastEnd bitcask.LogPosition
+	for {
+		reader, err := p.db.ReadLogFrom(pos)
+		if err != nil {
+			return err
+		}
+		for {
+			entries, err := readBatch(reader, p.options.MaxBatchRecords)
+			if err != nil {
+				return err
+			}
+			if len(entries) == 0 {
+				break
+			}
+			if err := writeFrame(w, frameRecords, encodeRecords(entries)); err != nil {
+				return err
+			}
+			pos = entries[len(entries)-1].Next
+		}
+
+		// 追上之后发送心跳，告诉从节点主节点日志的结束位置
+		end := p.db.LogEnd()
+		if end != lastEnd || time.Since(lastHeartbeat) >= p.options.HeartbeatInterval {
+			if err := writeFrame(w, frameHeartbeat, encodeHeartbeat(end, time.Now())); err != nil {
+				return err
+			}
+			lastHeartbeat, lastEnd = time.Now(), end
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+
+		// 定期保存从节点确认的位置
+		if time.Since(lastAckSync) >= p.options.AckSyncInterval {
+			if err := p.saveAcked(consumerName, acked); err != nil {
+				return err
+			}
+			lastAckSync = time.Now()
+		}
+
+		select {
+		case <-p.closed:
+			return ErrPrimaryIsClosed
+		case <-ackDone:
+			return errAckStopped
+		case <-time.After(p.options.PollInterval):
+		}
+	}
+}
+
+// 从节点确认的位置，定期保存到主节点的日志消费者中，避免每次确认都要持久化一次
+type ackedPosition struct {
+	mu    *sync.Mutex
+	pos   bitcask.LogPosition // 最新确认的位置
+	saved bitcask.LogPosition // 已经保存的位置
+}
+
+func (p *Primary) receiveAcks(conn net.Conn, acked *ackedPosition) error {
+	for {
+		typ, payload, err := readFrame(conn)
+		if err != nil {
+			return err
+		}
+		if typ != frameAck {
+			return ErrUnexpectedFrame
+		}
+		pos, err := decodePosition(payload)
+		if err != nil {
+			return err
+		}
+		acked.mu.Lock()
+		acked.pos = pos
+		acked.mu.Unlock()
+	}
+}
+
+// 保存从节点最新确认的位置，没有变化时不需要保存
+func (p *Primary) saveAcked(consumerName string, acked *ackedPosition) error {
+	acked.mu.Lock()
+	pos, saved := acked.pos, acked.saved
+	acked.mu.Unlock()
+	if pos == saved {
+		return nil
+	}
+	if err := p.db.RegisterConsumer(consumerName, pos); err != nil {
+		return err
+	}
+	acked.mu.Lock()
+	acked.saved = pos
+	acked.mu.Unlock()
+	return nil
+}
+
+func readBatch(reader *bitcask.LogReader, max int) ([]*bitcask.LogEntry, error) {
+	var entries []*bitcask.LogEntry
+	for len(entries) < max {
+		entry, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
@@ -0,0 +1,233 @@
+package replication
+
+import (
+	bitcask "bitcask-go"
+	"bitcask-go/data"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+var (
+	ErrInvalidFrame     = errors.New("invalid replication frame")
+	ErrNoStartPosition  = errors.New("the replica directory is neither a checkpoint nor a replica")
+	ErrReplicaPromoted  = errors.New("the replica has been promoted")
+	ErrPrimaryIsClosed  = errors.New("the primary is closed")
+	ErrUnexpectedFrame  = errors.New("unexpected replication frame")
+	ErrFrameSizeTooLong = errors.New("replication frame size too long")
+	ErrReplicaBehind    = errors.New("the replica is behind the position it acknowledged")
+	ErrReplicaConnected = errors.New("the replica is still connected")
+)
+
+// 复制协议
+// 每一帧：| type | payload size | payload | crc |，payload size 和 crc 都是 4 个字节，crc 校验的是 crc 之前的所有数据
+// 从节点连接之后发送 HELLO，带上下一条要读取的日志位置
+// 主节点从这个位置开始持续发送 RECORDS，追上之后定期发送 HEARTBEAT，带上主节点日志的结束位置
+// 从节点应用完一批记录之后回复 ACK，主节点据此记录从节点的位置，没有被读取的数据不会被 merge 重写
+
+type frameType = byte
+
+const (
+	frameHello frameType = iota + 1
+	frameRecords
+	frameHeartbeat
+	frameAck
+)
+
+const (
+	frameHeaderSize = 5
+	// 一帧数据最大的长度
+	maxFrameSize = 64 * 1024 * 1024
+)
+
+func writeFrame(w io.Writer, typ frameType, payload []byte) error {
+	buf := make([]byte, frameHeaderSize+len(payload)+4)
+	buf[0] = typ
+	binary.BigEndian.PutUint32(buf[1:frameHeaderSize], uint32(len(payload)))
+	copy(buf[frameHeaderSize:], payload)
+	crc := crc32.ChecksumIEEE(buf[:frameHeaderSize+len(payload)])
+	binary.BigEndian.PutUint32(buf[frameHeaderSize+len(payload):], crc)
+	_, err := w.Write(buf)
+	return err
+}
+
+func readFrame(r io.Reader) (frameType, []byte, error) {
+	header := make([]byte, frameHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > maxFrameSize {
+		return 0, nil, ErrFrameSizeTooLong
+	}
+	buf := make([]byte, int(size)+4)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, nil, err
+	}
+	payload := buf[:size]
+	crc := crc32.Update(crc32.ChecksumIEEE(header), crc32.IEEETable, payload)
+	if crc != binary.BigEndian.Uint32(buf[size:]) {
+		return 0, nil, ErrInvalidFrame
+	}
+	return header[0], payload, nil
+}
+
+// payload 的编解码
+
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) uvarint(v uint64) {
+	e.buf = binary.AppendUvarint(e.buf, v)
+}
+
+func (e *encoder) varint(v int64) {
+	e.buf = binary.AppendVarint(e.buf, v)
+}
+
+func (e *encoder) bytes(b []byte) {
+	e.uvarint(uint64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *encoder) position(pos bitcask.LogPosition) {
+	e.uvarint(uint64(pos.Fid))
+	e.varint(pos.Offset)
+}
+
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.err = ErrInvalidFrame
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.err = ErrInvalidFrame
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) bytes() []byte {
+	size := d.uvarint()
+	if d.err != nil {
+		return nil
+	}
+	if size > uint64(len(d.buf)) {
+		d.err = ErrInvalidFrame
+		return nil
+	}
+	b := d.buf[:size:size]
+	d.buf = d.buf[size:]
+	return b
+}
+
+func (d *decoder) position() bitcask.LogPosition {
+	fid := d.uvarint()
+	offset := d.varint()
+	return bitcask.LogPosition{Fid: uint32(fid), Offset: offset}
+}
+
+func encodeHello(replicaId string, pos bitcask.LogPosition) []byte {
+	e := &encoder{}
+	e.bytes([]byte(replicaId))
+	e.position(pos)
+	return e.buf
+}
+
+func decodeHello(payload []byte) (string, bitcask.LogPosition, error) {
+	d := &decoder{buf: payload}
+	replicaId := string(d.bytes())
+	pos := d.position()
+	return replicaId, pos, d.err
+}
+
+func encodeRecords(entries []*bitcask.LogEntry) []byte {
+	e := &encoder{}
+	e.uvarint(uint64(len(entries)))
+	for _, entry := range entries {
+		e.buf = append(e.buf, entry.Type)
+		e.uvarint(entry.SeqNo)
+		e.bytes(entry.Key)
+		e.bytes(entry.Value)
+		e.position(entry.Next)
+	}
+	return e.buf
+}
+
+func decodeRecords(payload []byte) ([]*bitcask.LogEntry, error) {
+	d := &decoder{buf: payload}
+	count := d.uvarint()
+	if count > uint64(len(payload)) {
+		return nil, ErrInvalidFrame
+	}
+	entries := make([]*bitcask.LogEntry, 0, count)
+	for i := uint64(0); i < count && d.err == nil; i++ {
+		if len(d.buf) == 0 {
+			return nil, ErrInvalidFrame
+		}
+		entry := &bitcask.LogEntry{Type: data.LogRecordType(d.buf[0])}
+		d.buf = d.buf[1:]
+		entry.SeqNo = d.uvarint()
+		entry.Key = d.bytes()
+		entry.Value = d.bytes()
+		entry.Next = d.position()
+		entries = append(entries, entry)
+	}
+	return entries, d.err
+}
+
+func encodePosition(pos bitcask.LogPosition) []byte {
+	e := &encoder{}
+	e.position(pos)
+	return e.buf
+}
+
+func decodePosition(payload []byte) (bitcask.LogPosition, error) {
+	d := &decoder{buf: payload}
+	pos := d.position()
+	return pos, d.err
+}
+
+func encodeHeartbeat(end bitcask.LogPosition, now time.Time) []byte {
+	e := &encoder{}
+	e.position(end)
+	e.varint(now.UnixNano())
+	return e.buf
+}
+
+func decodeHeartbeat(payload []byte) (bitcask.LogPosition, time.Time, error) {
+	d := &decoder{buf: payload}
+	pos := d.position()
+	nanos := d.varint()
+	return pos, time.Unix(0, nanos), d.err
+}
+
+// 日志位置 a 是否在 b 之前
+func positionBefore(a, b bitcask.LogPosition) bool {
+	if a.Fid != b.Fid {
+		return a.Fid < b.Fid
+	}
+	return a.Offset < b.Offset
+}
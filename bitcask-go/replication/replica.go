@@ -0,0 +1,328 @@
+package replication
+
+import (
+	bitcask "bitcask-go"
+	"bufio"
+	"encoding/json"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// 从节点已经应用的日志位置，保存在从节点的数据目录中
+const replicationPositionFileName = "replication-position"
+
+// ReplicaOptions 从节点配置项
+type ReplicaOptions struct {
+	// 从节点的唯一标识，主节点据此记录从节点的位置
+	ReplicaId string
+
+	// 主节点的地址
+	PrimaryAddr string
+
+	// 连接断开之后重连的间隔
+	ReconnectInterval time.Duration
+
+	// 记录和主节点断开连接等错误的日志，为空时不记录
+	Logger *log.Logger
+}
+
+var DefaultReplicaOptions = ReplicaOptions{
+	ReplicaId:         "replica",
+	PrimaryAddr:       "127.0.0.1:0",
+	ReconnectInterval: 100 * time.Millisecond,
+}
+
+// ReplicaStatus 从节点的复制状态
+type ReplicaStatus struct {
+	Connected  bool                // 是否连接到了主节点
+	Applied    bitcask.LogPosition // 已经应用的主节点日志位置
+	PrimaryEnd bitcask.LogPosition // 最近一次心跳中主节点日志的结束位置
+	CaughtUp   bool                // 是否已经追上了最近一次心跳中主节点的位置
+	Lag        time.Duration       // 距离最后一次追上主节点过去的时间，追上时为 0
+}
+
+// Replica 复制的从节点，从主节点接收日志记录并应用到本地的数据库中
+// 对外提供的是只读模式打开的数据库，每应用一批记录之后刷新，提升为主节点之后才可以写入
+type Replica struct {
+	writer       *bitcask.DB // 应用日志记录的数据库，只在从节点内部使用
+	db           *bitcask.DB // 对外提供读取的只读数据库，提升之后为 writer
+	options      ReplicaOptions
+	dirPath      string
+	mu           *sync.Mutex
+	status       ReplicaStatus
+	lastCaughtUp time.Time // 最后一次追上主节点的时间
+	conn         net.Conn
+	closed       chan struct{}
+	wg           *sync.WaitGroup
+}
+
+// NewReplica 打开从节点并开始复制
+// 数据目录必须是主节点的检查点（DB.Checkpoint 生成的目录），或者之前运行过的从节点的数据目录
+// 只读数据库不支持 B+ 树索引，dbOpts 为 B+ 树索引时只读数据库使用 BTree 索引，提升之后仍然是 B+ 树索引
+func NewReplica(dbOpts bitcask.Options, opts ReplicaOptions) (*Replica, error) {
+	pos, err := loadStartPosition(dbOpts.DirPath)
+	if err != nil {
+		return nil, err
+	}
+	writer, err := bitcask.Open(dbOpts)
+	if err != nil {
+		return nil, err
+	}
+	roOpts := dbOpts
+	roOpts.ReadOnly = true
+	if roOpts.IndexType == bitcask.BPlusTree {
+		roOpts.IndexType = bitcask.Btree
+	}
+	db, err := bitcask.Open(roOpts)
+	if err != nil {
+		_ = writer.Close()
+		return nil, err
+	}
+
+	r := &Replica{
+		writer:       writer,
+		db:           db,
+		options:      opts,
+		dirPath:      dbOpts.DirPath,
+		mu:           new(sync.Mutex),
+		status:       ReplicaStatus{Applied: pos},
+		lastCaughtUp: time.Now(),
+		closed:       make(chan struct{}),
+		wg:           new(sync.WaitGroup),
+	}
+	r.wg.Add(1)
+	go r.run()
+	return r, nil
+}
+
+// DB 返回从节点的数据库，提升为主节点之前是只读的
+func (r *Replica) DB() *bitcask.DB {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.db
+}
+
+// Status 返回从节点的复制状态
+func (r *Replica) Status() ReplicaStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	status := r.status
+	if !status.CaughtUp || !status.Connected {
+		status.Lag = time.Since(r.lastCaughtUp)
+	}
+	return status
+}
+
+// Promote 停止复制并将从节点提升为主节点，返回的数据库可以正常写入
+func (r *Replica) Promote() (*bitcask.DB, error) {
+	if err := r.stop(); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.db.Close(); err != nil {
+		return nil, err
+	}
+	r.db = r.writer
+	return r.writer, nil
+}
+
+// Close 停止复制并关闭数据库
+func (r *Replica) Close() error {
+	err := r.stop()
+	if err == ErrReplicaPromoted {
+		return r.writer.Close()
+	}
+	if err != nil {
+		return err
+	}
+	if err := r.db.Close(); err != nil {
+		return err
+	}
+	return r.writer.Close()
+}
+
+func (r *Replica) stop() error {
+	r.mu.Lock()
+	select {
+	case <-r.closed:
+		r.mu.Unlock()
+		return ErrReplicaPromoted
+	default:
+	}
+	close(r.closed)
+	if r.conn != nil {
+		_ = r.conn.Close()
+	}
+	r.mu.Unlock()
+	r.wg.Wait()
+	return nil
+}
+
+// 连接主节点，断开之后不断重连
+func (r *Replica) run() {
+	defer r.wg.Done()
+	for {
+		if err := r.replicate(); err != nil {
+			select {
+			case <-r.closed:
+				return
+			default:
+			}
+			if r.options.Logger != nil {
+				r.options.Logger.Printf("replication: connection to primary %s lost: %v", r.options.PrimaryAddr, err)
+			}
+		}
+		r.mu.Lock()
+		r.status.Connected = false
+		r.mu.Unlock()
+
+		select {
+		case <-r.closed:
+			return
+		case <-time.After(r.options.ReconnectInterval):
+		}
+	}
+}
+
+func (r *Replica) replicate() error {
+	conn, err := net.Dial("tcp", r.options.PrimaryAddr)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	select {
+	case <-r.closed:
+		r.mu.Unlock()
+		_ = conn.Close()
+		return nil
+	default:
+	}
+	r.conn = conn
+	r.status.Connected = true
+	applied := r.status.Applied
+	r.mu.Unlock()
+	defer conn.Close()
+
+	if err := writeFrame(conn, frameHello, encodeHello(r.options.ReplicaId, applied)); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(conn)
+	for {
+		typ, payload, err := readFrame(reader)
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case frameRecords:
+			entries, err := decodeRecords(payload)
+			if err != nil {
+				return err
+			}
+			if err := r.apply(entries); err != nil {
+				return err
+			}
+			if err := writeFrame(conn, frameAck, encodePosition(entries[len(entries)-1].Next)); err != nil {
+				return err
+			}
+		case frameHeartbeat:
+			end, _, err := decodeHeartbeat(payload)
+			if err != nil {
+				return err
+			}
+			r.mu.Lock()
+			r.status.PrimaryEnd = end
+			r.updateCaughtUp()
+			r.mu.Unlock()
+		default:
+			return ErrUnexpectedFrame
+		}
+	}
+}
+
+// 应用一批记录，数据持久化之后再保存位置，重启之后最多重复应用一批记录
+func (r *Replica) apply(entries []*bitcask.LogEntry) error {
+	if len(entries) == 0 {
+		return ErrInvalidFrame
+	}
+	if err := r.writer.ApplyLogEntries(entries); err != nil {
+		return err
+	}
+	if err := r.writer.Sync(); err != nil {
+		return err
+	}
+	pos := entries[len(entries)-1].Next
+	if err := saveReplicationPosition(r.dirPath, pos); err != nil {
+		return err
+	}
+	// 只读数据库读取新追加的数据
+	if err := r.db.Refresh(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.status.Applied = pos
+	r.updateCaughtUp()
+	r.mu.Unlock()
+	return nil
+}
+
+// 调用方需要持有 r.mu
+func (r *Replica) updateCaughtUp() {
+	r.status.CaughtUp = !positionBefore(r.status.Applied, r.status.PrimaryEnd)
+	if r.status.CaughtUp {
+		r.lastCaughtUp = time.Now()
+	}
+}
+
+// 从节点开始复制的位置，优先使用从节点保存的位置，其次是检查点的位置
+func loadStartPosition(dirPath string) (bitcask.LogPosition, error) {
+	buf, err := os.ReadFile(filepath.Join(dirPath, replicationPositionFileName))
+	if err == nil {
+		var pos bitcask.LogPosition
+		if err := json.Unmarshal(buf, &pos); err != nil {
+			return bitcask.LogPosition{}, err
+		}
+		return pos, nil
+	}
+	if !os.IsNotExist(err) {
+		return bitcask.LogPosition{}, err
+	}
+
+	pos, err := bitcask.ReadCheckpointPosition(dirPath)
+	if os.IsNotExist(err) {
+		return bitcask.LogPosition{}, ErrNoStartPosition
+	}
+	return pos, err
+}
+
+// 先写入临时文件再重命名，保证文件中始终是完整的数据
+func saveReplicationPosition(dirPath string, pos bitcask.LogPosition) error {
+	buf, err := json.Marshal(pos)
+	if err != nil {
+		return err
+	}
+	fileName := filepath.Join(dirPath, replicationPositionFileName)
+	tmpFileName := fileName + ".tmp"
+	file, err := os.OpenFile(tmpFileName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(buf); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFileName, fileName)
+}
@@ -0,0 +1,273 @@
+package replication
+
+import (
+	bitcask "bitcask-go"
+	"bitcask-go/utils"
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func destroyDB(db *bitcask.DB, dir string) {
+	if db != nil {
+		_ = db.Close()
+	}
+	_ = os.RemoveAll(dir)
+}
+
+// 等待从节点追上主节点
+func waitCaughtUp(t *testing.T, primary *bitcask.DB, replica *Replica) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		status := replica.Status()
+		if status.CaughtUp && status.Applied == primary.LogEnd() {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("replica did not catch up, status: %+v, primary end: %+v", replica.Status(), primary.LogEnd())
+}
+
+func TestReplication(t *testing.T) {
+	opts := bitcask.DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-replication-primary")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	db, err := bitcask.Open(opts)
+	defer destroyDB(db, dir)
+	assert.Nil(t, err)
+
+	for i := 0; i < 500; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+
+	// 从节点从主节点的检查点开始
+	replicaDir, _ := os.MkdirTemp("", "bitcask-go-replication-replica")
+	defer os.RemoveAll(replicaDir)
+	err = db.Checkpoint(replicaDir)
+	assert.Nil(t, err)
+
+	primary, err := NewPrimary(db, DefaultPrimaryOptions)
+	assert.Nil(t, err)
+	defer primary.Close()
+
+	replicaOpts := opts
+	replicaOpts.DirPath = replicaDir
+	opts2 := DefaultReplicaOptions
+	opts2.PrimaryAddr = primary.Addr()
+	replica, err := NewReplica(replicaOpts, opts2)
+	assert.Nil(t, err)
+
+	// 检查点之后的写入通过复制同步到从节点
+	for i := 500; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	err = db.Delete(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	wb := db.NewWriteBatch(bitcask.DefaultWriteBatchOptions)
+	_ = wb.Put(utils.GetTestKey(2000), []byte("batch"))
+	_ = wb.Delete(utils.GetTestKey(2))
+	err = wb.Commit()
+	assert.Nil(t, err)
+
+	waitCaughtUp(t, db, replica)
+	status := replica.Status()
+	assert.True(t, status.Connected)
+	assert.Equal(t, time.Duration(0), status.Lag)
+	assertSameData(t, db, replica.DB())
+
+	// 从节点的数据库是只读的
+	assert.Equal(t, bitcask.ErrReadOnly, replica.DB().Put(utils.GetTestKey(1), []byte("a")))
+	assert.Equal(t, bitcask.ErrReadOnly, replica.DB().Delete(utils.GetTestKey(3)))
+
+	// 主节点记录了从节点的位置，从节点应用之后才会异步地发送确认
+	var pos bitcask.LogPosition
+	var ok bool
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if pos, ok = db.ConsumerPosition(consumerNamePrefix + DefaultReplicaOptions.ReplicaId); pos == db.LogEnd() {
+			break
+		}
+	}
+	assert.True(t, ok)
+	assert.Equal(t, db.LogEnd(), pos)
+
+	// 从节点重启之后从保存的位置继续复制
+	err = replica.Close()
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), []byte("after-restart"))
+		assert.Nil(t, err)
+	}
+	replica, err = NewReplica(replicaOpts, opts2)
+	assert.Nil(t, err)
+	waitCaughtUp(t, db, replica)
+	assertSameData(t, db, replica.DB())
+
+	// 主节点关闭之后从节点落后，延迟不断增加
+	err = primary.Close()
+	assert.Nil(t, err)
+	err = db.Put(utils.GetTestKey(3000), []byte("lost"))
+	assert.Nil(t, err)
+	time.Sleep(20 * time.Millisecond)
+	status = replica.Status()
+	assert.True(t, status.Lag > 0)
+
+	// 提升为主节点之后可以写入
+	promoted, err := replica.Promote()
+	assert.Nil(t, err)
+	err = promoted.Put(utils.GetTestKey(4000), []byte("promoted"))
+	assert.Nil(t, err)
+	val, err := promoted.Get(utils.GetTestKey(4000))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("promoted"), val)
+	_, err = replica.Promote()
+	assert.Equal(t, ErrReplicaPromoted, err)
+	err = replica.Close()
+	assert.Nil(t, err)
+}
+
+func TestNewReplica_NoStartPosition(t *testing.T) {
+	opts := bitcask.DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-replication-empty")
+	defer os.RemoveAll(dir)
+	opts.DirPath = dir
+	_, err := NewReplica(opts, DefaultReplicaOptions)
+	assert.Equal(t, ErrNoStartPosition, err)
+}
+
+// 从节点的位置落后于主节点记录的位置时，只有落后的部分被 merge 重写了才能继续复制
+func TestPrimary_ReplicaBehind(t *testing.T) {
+	opts := bitcask.DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-replication-behind")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := bitcask.Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 500; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	consumerName := consumerNamePrefix + "behind"
+	err = db.RegisterConsumer(consumerName, db.LogEnd())
+	assert.Nil(t, err)
+
+	// 发送 hello 之后读取主节点的第一帧
+	hello := func(primary *Primary) error {
+		conn, err := net.Dial("tcp", primary.Addr())
+		assert.Nil(t, err)
+		defer conn.Close()
+		err = writeFrame(conn, frameHello, encodeHello("behind", bitcask.LogPosition{}))
+		assert.Nil(t, err)
+		_, _, err = readFrame(conn)
+		return err
+	}
+
+	// 从节点落后的部分仍然存在，拒绝连接
+	primary, err := NewPrimary(db, DefaultPrimaryOptions)
+	assert.Nil(t, err)
+	assert.NotNil(t, hello(primary))
+	err = primary.Close()
+	assert.Nil(t, err)
+
+	// merge 重写了落后的部分，从 merge 之后的位置继续
+	err = db.Merge()
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = bitcask.Open(opts)
+	defer destroyDB(db, dir)
+	assert.Nil(t, err)
+	mergedFileId, err := db.MergedFileId()
+	assert.Nil(t, err)
+	assert.True(t, mergedFileId > 0)
+	primary, err = NewPrimary(db, DefaultPrimaryOptions)
+	assert.Nil(t, err)
+	defer primary.Close()
+	assert.Nil(t, hello(primary))
+}
+
+func TestPrimary_ReleaseReplica(t *testing.T) {
+	opts := bitcask.DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-replication-release")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := bitcask.Open(opts)
+	defer destroyDB(db, dir)
+	assert.Nil(t, err)
+	for i := 0; i < 500; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	// 两个已经下线的从节点
+	assert.Nil(t, db.RegisterConsumer(consumerNamePrefix+"gone-1", bitcask.LogPosition{}))
+	assert.Nil(t, db.RegisterConsumer(consumerNamePrefix+"gone-2", bitcask.LogPosition{}))
+	assert.Equal(t, bitcask.ErrConsumerBehind, db.Merge())
+
+	// 手动释放
+	primary, err := NewPrimary(db, DefaultPrimaryOptions)
+	assert.Nil(t, err)
+	assert.Nil(t, primary.ReleaseReplica("gone-1"))
+	_, ok := db.ConsumerPosition(consumerNamePrefix + "gone-1")
+	assert.False(t, ok)
+	assert.Equal(t, bitcask.ErrConsumerBehind, db.Merge())
+	assert.Nil(t, primary.Close())
+
+	// 断开连接超过 ReplicaTTL 之后自动释放
+	primaryOpts := DefaultPrimaryOptions
+	primaryOpts.ReplicaTTL = 20 * time.Millisecond
+	primary, err = NewPrimary(db, primaryOpts)
+	assert.Nil(t, err)
+	defer primary.Close()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if len(db.ListConsumers()) == 0 {
+			break
+		}
+	}
+	assert.Equal(t, 0, len(db.ListConsumers()))
+	assert.Nil(t, db.Merge())
+}
+
+func TestFrame(t *testing.T) {
+	var buf bytes.Buffer
+	entries := []*bitcask.LogEntry{
+		{Key: []byte("a"), Value: []byte("1"), Type: 1, Next: bitcask.LogPosition{Fid: 1, Offset: 10}},
+		{Key: []byte("b"), Type: 2, SeqNo: 5, Next: bitcask.LogPosition{Fid: 1, Offset: 20}},
+	}
+	err := writeFrame(&buf, frameRecords, encodeRecords(entries))
+	assert.Nil(t, err)
+	frame := append([]byte(nil), buf.Bytes()...)
+
+	typ, payload, err := readFrame(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, frameRecords, typ)
+	decoded, err := decodeRecords(payload)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(decoded))
+	assert.Equal(t, []byte("a"), decoded[0].Key)
+	assert.Equal(t, []byte("1"), decoded[0].Value)
+	assert.Equal(t, uint64(5), decoded[1].SeqNo)
+	assert.Equal(t, entries[1].Next, decoded[1].Next)
+
+	// 数据损坏
+	frame[len(frame)/2] ^= 0xff
+	_, _, err = readFrame(bytes.NewReader(frame))
+	assert.Equal(t, ErrInvalidFrame, err)
+}
+
+func assertSameData(t *testing.T, expected, actual *bitcask.DB) {
+	keys := expected.ListKeys()
+	assert.Equal(t, len(keys), len(actual.ListKeys()))
+	for _, key := range keys {
+		expectedVal, _ := expected.Get(key)
+		val, err := actual.Get(key)
+		assert.Nil(t, err)
+		assert.Equal(t, expectedVal, val)
+	}
+}
@@ -0,0 +1,341 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/index"
+	"bytes"
+	"encoding/binary"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// IndexExtractor 从 value 中提取二级索引的 key，一个 value 可以对应零个或者多个二级索引的 key
+// 同一个 value 每次提取的结果必须相同，空的 key 会被忽略
+type IndexExtractor func(value []byte) [][]byte
+
+const (
+	// 二级索引的条目保存在以此为前缀的命名空间中，用户不能创建和访问这些命名空间
+	indexNamespacePrefix = "\x00index/"
+	// 重建二级索引时每个事务处理的 key 的数量
+	indexRebuildBatchSize = 1024
+)
+
+// 二级索引构建完成的标识，条目的 key 以二级索引 key 的长度开头，长度不为 0，不会和标识冲突
+var indexReadyKey = []byte{0}
+
+type secondaryIndex struct {
+	name    string
+	extract IndexExtractor
+}
+
+// CreateIndex 注册名称为 name 的二级索引，之后的写入会在同一个事务中维护索引的条目
+// 索引的条目持久化在数据文件中，但是 extract 不会持久化，每次打开数据库之后需要在写入之前重新注册
+// 没有注册时写入数据会把索引标记为过期，索引不存在或者过期时从已有的数据重建
+// 重建时分批写入，不会长时间阻塞读写，重建完成之前查询返回 ErrSecondaryIndexNotFound
+// 默认的命名空间即 DB 本身的数据才会被索引，B+ 树索引不支持二级索引
+func (db *DB) CreateIndex(name string, extract IndexExtractor) error {
+	if len(name) == 0 || extract == nil {
+		return ErrInvalidIndexName
+	}
+	if db.options.IndexType == BPlusTree {
+		return ErrNamespaceUnsupported
+	}
+
+	si := &secondaryIndex{name: name, extract: extract}
+	ns, err := db.registerSecondaryIndex(si)
+	if err != nil || ns == nil {
+		return err
+	}
+	if err := db.rebuildSecondaryIndex(si, ns); err != nil {
+		db.mu.Lock()
+		if db.secondaryIndexes[name] == si {
+			delete(db.secondaryIndexes, name)
+		}
+		db.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// 注册二级索引，索引已经构建完成时返回空，否则创建新的命名空间并返回，由调用方重建
+func (db *DB) registerSecondaryIndex(si *secondaryIndex) (*Namespace, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.secondaryIndexes[si.name]; ok {
+		return nil, ErrSecondaryIndexExists
+	}
+	ns := db.namespaces[indexNamespace(si.name)]
+	if ns != nil && ns.index.Get(indexReadyKey) != nil {
+		db.secondaryIndexes[si.name] = si
+		return nil, nil
+	}
+
+	// 索引不存在、上一次没有构建完成或者已经过期，从数据文件中重建
+	if db.options.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	if db.writeFenced.Load() {
+		return nil, ErrWriteFenced
+	}
+	if ns != nil {
+		if err := db.dropNamespace(ns); err != nil {
+			return nil, err
+		}
+	}
+	ns, err := db.createNamespace(indexNamespace(si.name))
+	if err != nil {
+		return nil, err
+	}
+	// 注册之后的写入会维护索引的条目，重建只需要补上已有的数据
+	db.secondaryIndexes[si.name] = si
+	return ns, nil
+}
+
+// DropIndex 删除二级索引及其所有的条目
+func (db *DB) DropIndex(name string) error {
+	if db.options.ReadOnly {
+		return ErrReadOnly
+	}
+	if db.writeFenced.Load() {
+		return ErrWriteFenced
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	_, registered := db.secondaryIndexes[name]
+	delete(db.secondaryIndexes, name)
+	ns := db.namespaces[indexNamespace(name)]
+	if ns == nil {
+		if !registered {
+			return ErrSecondaryIndexNotFound
+		}
+		return nil
+	}
+	return db.dropNamespace(ns)
+}
+
+// QueryIndex 获取二级索引中 secondaryKey 对应的所有主键
+func (db *DB) QueryIndex(name string, secondaryKey []byte) ([][]byte, error) {
+	if len(secondaryKey) == 0 {
+		return nil, ErrKeyIsEmpty
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if _, ok := db.secondaryIndexes[name]; !ok {
+		return nil, ErrSecondaryIndexNotFound
+	}
+	// 从节点上的索引可能还在构建中
+	ns := db.namespaces[indexNamespace(name)]
+	if ns == nil || ns.index.Get(indexReadyKey) == nil {
+		return nil, ErrSecondaryIndexNotFound
+	}
+
+	prefix := indexEntryPrefix(secondaryKey)
+	iterator := ns.index.IteratorWithOptions(index.IteratorOptions{Prefix: prefix})
+	defer iterator.Close()
+	var keys [][]byte
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		keys = append(keys, iterator.Key()[len(prefix):])
+	}
+	if !ns.index.Capabilities().Ordered {
+		slices.SortFunc(keys, bytes.Compare)
+	}
+	return keys, nil
+}
+
+// 存在二级索引时写入默认命名空间中的一条数据，调用方需要持有 db.mu
+func (db *DB) commitWithSecondaryIndexes(key []byte, record *data.LogRecord) error {
+	writes, err := db.withSecondaryIndexWrites(map[string]*data.LogRecord{
+		string(namespaceKey(0, key)): record,
+	})
+	if err != nil {
+		return err
+	}
+	return db.commitTxn(writes, db.options.SyncWrites)
+}
+
+// 写入时是否需要维护二级索引，包括把没有注册的索引标记为过期，调用方需要持有 db.mu
+func (db *DB) needSecondaryIndexWrites() bool {
+	if len(db.secondaryIndexes) > 0 {
+		return true
+	}
+	if db.indexNamespaceNum == 0 {
+		return false
+	}
+	for name, ns := range db.namespaces {
+		if isIndexNamespace(name) && ns.index.Get(indexReadyKey) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// 在事务中加入二级索引的变更，返回新的 pendingWrites，调用方需要持有 db.mu
+func (db *DB) withSecondaryIndexWrites(pendingWrites map[string]*data.LogRecord) (map[string]*data.LogRecord, error) {
+	writes := maps.Clone(pendingWrites)
+	var indexes []*secondaryIndex
+	for name, ns := range db.namespaces {
+		if !isIndexNamespace(name) {
+			continue
+		}
+		if si, ok := db.secondaryIndexes[indexNameOf(name)]; ok {
+			indexes = append(indexes, si)
+			continue
+		}
+		// 没有注册的二级索引无法维护，和这次写入一起删除完成标识，标记为过期，重新注册时从数据文件中重建
+		if ns.index.Get(indexReadyKey) != nil {
+			addIndexEntry(writes, ns, indexReadyKey, data.LogRecordNsDeleted)
+		}
+	}
+	if len(indexes) == 0 {
+		return writes, nil
+	}
+
+	for _, record := range pendingWrites {
+		if isNamespaceRecord(record.Type) {
+			continue
+		}
+		var oldValue []byte
+		pos := db.index.Get(record.Key)
+		if pos != nil {
+			var err error
+			if oldValue, err = db.getValueByPosition(pos); err != nil {
+				return nil, err
+			}
+		}
+		for _, si := range indexes {
+			var oldKeys, newKeys map[string]struct{}
+			if pos != nil {
+				oldKeys = si.keys(oldValue)
+			}
+			if record.Type == data.LogRecordNormal {
+				newKeys = si.keys(record.Value)
+			}
+			ns := db.namespaces[indexNamespace(si.name)]
+			for sk := range oldKeys {
+				if _, ok := newKeys[sk]; !ok {
+					addIndexEntry(writes, ns, indexEntryKey([]byte(sk), record.Key), data.LogRecordNsDeleted)
+				}
+			}
+			for sk := range newKeys {
+				if _, ok := oldKeys[sk]; !ok {
+					addIndexEntry(writes, ns, indexEntryKey([]byte(sk), record.Key), data.LogRecordNsNormal)
+				}
+			}
+		}
+	}
+	return writes, nil
+}
+
+// 遍历所有的数据，分批写入二级索引的条目，最后写入构建完成的标识
+// 遍历时不持有 db.mu，只有写入每一批时加锁，遍历期间的写入已经由 withSecondaryIndexWrites 维护
+// 中途失败或者崩溃时没有完成标识，下一次注册时重新构建
+func (db *DB) rebuildSecondaryIndex(si *secondaryIndex, ns *Namespace) error {
+	iterator := db.index.Iterator(false)
+	defer iterator.Close()
+	keys := make([][]byte, 0, indexRebuildBatchSize)
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		keys = append(keys, iterator.Key())
+		if len(keys) == indexRebuildBatchSize {
+			if err := db.rebuildSecondaryIndexBatch(si, ns, keys, false); err != nil {
+				return err
+			}
+			keys = keys[:0]
+		}
+	}
+	return db.rebuildSecondaryIndexBatch(si, ns, keys, true)
+}
+
+// 在一个事务中写入一批 key 的二级索引条目，last 为 true 时同时写入构建完成的标识
+func (db *DB) rebuildSecondaryIndexBatch(si *secondaryIndex, ns *Namespace, keys [][]byte, last bool) error {
+	// 按照每个 key 一个条目预留令牌，条目的 key 包含主键
+	var size int64
+	for _, key := range keys {
+		size += (&data.LogRecord{Key: key}).MaxEncodedSize() + binary.MaxVarintLen64
+	}
+	db.waitWriteTokens(size)
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	// 重建期间索引被删除
+	if db.secondaryIndexes[si.name] != si {
+		return ErrSecondaryIndexNotFound
+	}
+	if db.writeFenced.Load() {
+		return ErrWriteFenced
+	}
+
+	writes := make(map[string]*data.LogRecord)
+	for _, key := range keys {
+		// 遍历之后 key 可能已经被修改或者删除，按照当前的数据写入条目
+		pos := db.index.Get(key)
+		if pos == nil {
+			continue
+		}
+		value, err := db.getValueByPosition(pos)
+		if err != nil {
+			return err
+		}
+		for sk := range si.keys(value) {
+			addIndexEntry(writes, ns, indexEntryKey([]byte(sk), key), data.LogRecordNsNormal)
+		}
+	}
+	syncWrites := false
+	if last {
+		addIndexEntry(writes, ns, indexReadyKey, data.LogRecordNsNormal)
+		syncWrites = db.options.SyncWrites
+	}
+	if len(writes) == 0 {
+		return nil
+	}
+	return db.commitTxn(writes, syncWrites)
+}
+
+// 在一个事务中提交 pendingWrites，调用方需要持有 db.mu
+func (db *DB) commitTxn(pendingWrites map[string]*data.LogRecord, syncWrites bool) error {
+	txn, err := db.prepareTxn(pendingWrites)
+	if err != nil {
+		return err
+	}
+	return db.finishTxn(txn, syncWrites)
+}
+
+// 提取 value 对应的二级索引的 key，去掉重复的和空的 key
+func (si *secondaryIndex) keys(value []byte) map[string]struct{} {
+	keys := make(map[string]struct{})
+	for _, key := range si.extract(value) {
+		if len(key) > 0 {
+			keys[string(key)] = struct{}{}
+		}
+	}
+	return keys
+}
+
+func addIndexEntry(writes map[string]*data.LogRecord, ns *Namespace, entryKey []byte, typ data.LogRecordType) {
+	nsKey := namespaceKey(ns.id, entryKey)
+	writes[string(nsKey)] = &data.LogRecord{Key: nsKey, Type: typ}
+}
+
+// 二级索引条目的 key：二级索引 key 的长度 + 二级索引 key + 主键
+// 同一个二级索引 key 对应的条目有相同的前缀
+func indexEntryKey(secondaryKey, key []byte) []byte {
+	return append(indexEntryPrefix(secondaryKey), key...)
+}
+
+func indexEntryPrefix(secondaryKey []byte) []byte {
+	buf := binary.AppendUvarint(make([]byte, 0, binary.MaxVarintLen32+len(secondaryKey)), uint64(len(secondaryKey)))
+	return append(buf, secondaryKey...)
+}
+
+func indexNamespace(name string) string {
+	return indexNamespacePrefix + name
+}
+
+func indexNameOf(namespace string) string {
+	return strings.TrimPrefix(namespace, indexNamespacePrefix)
+}
+
+func isIndexNamespace(name string) bool {
+	return strings.HasPrefix(name, indexNamespacePrefix)
+}
@@ -0,0 +1,218 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+// value 的格式为 name|email，按照 email 建立索引
+func emailExtractor(value []byte) [][]byte {
+	if i := bytes.IndexByte(value, '|'); i >= 0 {
+		return [][]byte{value[i+1:]}
+	}
+	return nil
+}
+
+func TestDB_SecondaryIndex(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-secondary-index")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	assert.Equal(t, ErrInvalidIndexName, db.CreateIndex("", emailExtractor))
+	assert.Nil(t, db.CreateIndex("email", emailExtractor))
+	assert.Equal(t, ErrSecondaryIndexExists, db.CreateIndex("email", emailExtractor))
+	_, err = db.QueryIndex("name", []byte("a"))
+	assert.Equal(t, ErrSecondaryIndexNotFound, err)
+
+	assert.Nil(t, db.Put([]byte("user-1"), []byte("alice|a@x.com")))
+	assert.Nil(t, db.Put([]byte("user-2"), []byte("bob|b@x.com")))
+	assert.Nil(t, db.Put([]byte("user-3"), []byte("ann|a@x.com")))
+	assert.Nil(t, db.Put([]byte("no-email"), []byte("carol")))
+	keys, err := db.QueryIndex("email", []byte("a@x.com"))
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("user-1"), []byte("user-3")}, keys)
+
+	// 更新和删除数据时同时更新索引
+	assert.Nil(t, db.Put([]byte("user-1"), []byte("alice|c@x.com")))
+	assert.Nil(t, db.Delete([]byte("user-2")))
+	keys, _ = db.QueryIndex("email", []byte("a@x.com"))
+	assert.Equal(t, [][]byte{[]byte("user-3")}, keys)
+	keys, _ = db.QueryIndex("email", []byte("c@x.com"))
+	assert.Equal(t, [][]byte{[]byte("user-1")}, keys)
+	keys, _ = db.QueryIndex("email", []byte("b@x.com"))
+	assert.Nil(t, keys)
+
+	// 批量写入同样维护索引
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Put([]byte("user-4"), []byte("dave|c@x.com")))
+	assert.Nil(t, wb.Delete([]byte("user-1")))
+	keys, _ = db.QueryIndex("email", []byte("c@x.com"))
+	assert.Equal(t, [][]byte{[]byte("user-1")}, keys)
+	assert.Nil(t, wb.Commit())
+	keys, _ = db.QueryIndex("email", []byte("c@x.com"))
+	assert.Equal(t, [][]byte{[]byte("user-4")}, keys)
+
+	// 索引使用的命名空间对用户不可见
+	assert.Empty(t, db.Namespaces())
+	_, err = db.Namespace(indexNamespace("email"))
+	assert.Equal(t, ErrInvalidNamespaceName, err)
+	assert.Equal(t, 3, len(db.ListKeys()))
+
+	assert.Nil(t, db.DropIndex("email"))
+	assert.Equal(t, ErrSecondaryIndexNotFound, db.DropIndex("email"))
+	_, err = db.QueryIndex("email", []byte("c@x.com"))
+	assert.Equal(t, ErrSecondaryIndexNotFound, err)
+	assert.Nil(t, db.Put([]byte("user-5"), []byte("eve|e@x.com")))
+}
+
+func TestDB_SecondaryIndex_Rebuild(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-secondary-index-rebuild")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	// 已有的数据在创建索引时写入索引，数量超过一个重建批次
+	const userNum = 3000
+	for i := 0; i < userNum; i++ {
+		value := fmt.Sprintf("user%d|%d@x.com", i, i%10)
+		assert.Nil(t, db.Put([]byte(fmt.Sprintf("user-%04d", i)), []byte(value)))
+	}
+	assert.Nil(t, db.CreateIndex("email", emailExtractor))
+	keys, err := db.QueryIndex("email", []byte("3@x.com"))
+	assert.Nil(t, err)
+	assert.Equal(t, userNum/10, len(keys))
+	assert.Equal(t, []byte("user-0003"), keys[0])
+	nsId := db.namespaces[indexNamespace("email")].id
+	assert.Nil(t, db.Close())
+
+	// 重新打开之后注册不需要重建
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.CreateIndex("email", emailExtractor))
+	assert.Equal(t, nsId, db.namespaces[indexNamespace("email")].id)
+	keys, _ = db.QueryIndex("email", []byte("3@x.com"))
+	assert.Equal(t, userNum/10, len(keys))
+
+	// merge 之后索引的条目仍然有效
+	for i := 3; i < userNum; i += 20 {
+		assert.Nil(t, db.Delete([]byte(fmt.Sprintf("user-%04d", i))))
+	}
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+
+	// 没有注册索引时写入，索引的条目保留，但是被标记为过期，注册时重建
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put([]byte("user-0004"), []byte("user4|3@x.com")))
+	ns := db.namespaces[indexNamespace("email")]
+	assert.NotNil(t, ns)
+	assert.Nil(t, ns.index.Get(indexReadyKey))
+	assert.Nil(t, db.Close())
+
+	// 过期的标记是持久化的，之后的写入不需要再维护索引
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.namespaces[indexNamespace("email")].index.Get(indexReadyKey))
+	db.mu.Lock()
+	assert.False(t, db.needSecondaryIndexWrites())
+	db.mu.Unlock()
+	assert.Nil(t, db.CreateIndex("email", emailExtractor))
+	assert.NotEqual(t, nsId, db.namespaces[indexNamespace("email")].id)
+	keys, _ = db.QueryIndex("email", []byte("3@x.com"))
+	assert.Equal(t, userNum/20+1, len(keys))
+	assert.Equal(t, []byte("user-0004"), keys[0])
+	assert.Equal(t, []byte("user-0013"), keys[1])
+	assert.Nil(t, db.Close())
+
+	// 数据文件中的索引条目和数据保持一致
+	db, err = Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.Nil(t, db.CreateIndex("email", emailExtractor))
+	keys, _ = db.QueryIndex("email", []byte("3@x.com"))
+	assert.Equal(t, userNum/20+1, len(keys))
+}
+
+// 上一次构建没有完成的索引在注册时重新构建
+func TestDB_SecondaryIndex_Incomplete(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-secondary-index-incomplete")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put([]byte("user-1"), []byte("alice|a@x.com")))
+
+	// 只写入了部分条目，没有完成标识
+	db.mu.Lock()
+	ns, err := db.createNamespace(indexNamespace("email"))
+	assert.Nil(t, err)
+	writes := make(map[string]*data.LogRecord)
+	addIndexEntry(writes, ns, indexEntryKey([]byte("stale@x.com"), []byte("user-9")), data.LogRecordNsNormal)
+	assert.Nil(t, db.commitTxn(writes, false))
+	db.mu.Unlock()
+
+	assert.Nil(t, db.CreateIndex("email", emailExtractor))
+	keys, err := db.QueryIndex("email", []byte("stale@x.com"))
+	assert.Nil(t, err)
+	assert.Nil(t, keys)
+	keys, _ = db.QueryIndex("email", []byte("a@x.com"))
+	assert.Equal(t, [][]byte{[]byte("user-1")}, keys)
+}
+
+// 重建期间并发的写入同样维护索引，重建完成之后索引和数据保持一致
+func TestDB_SecondaryIndex_ConcurrentRebuild(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-secondary-index-concurrent")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	const userNum = 5000
+	for i := 0; i < userNum; i++ {
+		value := fmt.Sprintf("user%d|%d@x.com", i, i%10)
+		assert.Nil(t, db.Put([]byte(fmt.Sprintf("user-%04d", i)), []byte(value)))
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < userNum; i += 3 {
+			key := []byte(fmt.Sprintf("user-%04d", i))
+			if i%2 == 0 {
+				assert.Nil(t, db.Delete(key))
+			} else {
+				assert.Nil(t, db.Put(key, []byte(fmt.Sprintf("user%d|%d@y.com", i, i%10))))
+			}
+		}
+	}()
+	assert.Nil(t, db.CreateIndex("email", emailExtractor))
+	<-done
+
+	expected := make(map[string][][]byte)
+	assert.Nil(t, db.Fold(func(key []byte, value []byte) bool {
+		for _, sk := range emailExtractor(value) {
+			expected[string(sk)] = append(expected[string(sk)], key)
+		}
+		return true
+	}))
+	for _, domain := range []string{"x.com", "y.com"} {
+		for i := 0; i < 10; i++ {
+			sk := fmt.Sprintf("%d@%s", i, domain)
+			keys, err := db.QueryIndex("email", []byte(sk))
+			assert.Nil(t, err)
+			assert.Equal(t, expected[sk], keys, sk)
+		}
+	}
+}
@@ -0,0 +1,349 @@
+package bitcask_go
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+)
+
+const (
+	// 分片配置文件的名称
+	shardedMetaFileName = "sharded-meta"
+	// 两阶段提交协调者的数据目录
+	coordinatorDirName = "coordinator"
+)
+
+// ShardedDB 按照一致性哈希将 key 分散到多个独立的 bitcask 实例中，每个分片有自己的锁和活跃文件
+// 跨分片的 WriteBatch 通过两阶段提交保证原子性
+type ShardedDB struct {
+	options     ShardedOptions
+	shards      []*DB
+	ring        *hashRing
+	coordinator *DB    // 记录已经提交的跨分片事务
+	txnId       uint64 // 跨分片事务的 id
+}
+
+type shardedMeta struct {
+	ShardNum     int `json:"shardNum"`
+	VirtualNodes int `json:"virtualNodes"`
+}
+
+// OpenSharded 打开分片数据库，重启时会完成崩溃之前已经提交但还没有写完的跨分片事务
+func OpenSharded(opts ShardedOptions) (*ShardedDB, error) {
+	if opts.ShardNum <= 0 || opts.VirtualNodes <= 0 {
+		return nil, ErrInvalidShardOptions
+	}
+	if opts.ShardOptions.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	if err := os.MkdirAll(opts.DirPath, os.ModePerm); err != nil {
+		return nil, err
+	}
+	if err := checkShardedMeta(opts); err != nil {
+		return nil, err
+	}
+
+	sdb := &ShardedDB{
+		options: opts,
+		ring:    newHashRing(opts.ShardNum, opts.VirtualNodes),
+	}
+	coordinatorOpts := opts.ShardOptions
+	coordinatorOpts.DirPath = filepath.Join(opts.DirPath, coordinatorDirName)
+	coordinatorOpts.IndexType = Btree
+	coordinator, err := Open(coordinatorOpts)
+	if err != nil {
+		return nil, err
+	}
+	sdb.coordinator = coordinator
+	for i := 0; i < opts.ShardNum; i++ {
+		shardOpts := opts.ShardOptions
+		shardOpts.DirPath = filepath.Join(opts.DirPath, fmt.Sprintf("shard-%03d", i))
+		shard, err := Open(shardOpts)
+		if err != nil {
+			_ = sdb.Close()
+			return nil, err
+		}
+		sdb.shards = append(sdb.shards, shard)
+	}
+
+	if err := sdb.recoverTxns(); err != nil {
+		_ = sdb.Close()
+		return nil, err
+	}
+	return sdb, nil
+}
+
+// 分片的配置不能修改，否则 key 会被分配到其他的分片
+func checkShardedMeta(opts ShardedOptions) error {
+	meta := shardedMeta{ShardNum: opts.ShardNum, VirtualNodes: opts.VirtualNodes}
+	fileName := filepath.Join(opts.DirPath, shardedMetaFileName)
+	buf, err := os.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		buf, err := json.Marshal(meta)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(fileName, buf, 0644)
+	}
+	if err != nil {
+		return err
+	}
+	var existing shardedMeta
+	if err := json.Unmarshal(buf, &existing); err != nil {
+		return err
+	}
+	if existing != meta {
+		return ErrShardConfigMismatch
+	}
+	return nil
+}
+
+// Close 关闭所有的分片
+func (sdb *ShardedDB) Close() error {
+	var firstErr error
+	for _, shard := range sdb.shards {
+		if err := shard.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if err := sdb.coordinator.Close(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
+
+// Sync 持久化所有的分片
+func (sdb *ShardedDB) Sync() error {
+	for _, shard := range sdb.shards {
+		if err := shard.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Put 写入数据
+func (sdb *ShardedDB) Put(key []byte, value []byte) error {
+	return sdb.shardOf(key).Put(key, value)
+}
+
+// Get 读取数据
+func (sdb *ShardedDB) Get(key []byte) ([]byte, error) {
+	return sdb.shardOf(key).Get(key)
+}
+
+// Delete 删除数据
+func (sdb *ShardedDB) Delete(key []byte) error {
+	return sdb.shardOf(key).Delete(key)
+}
+
+// ListKeys 获取所有分片中的 key，按照顺序排列
+func (sdb *ShardedDB) ListKeys() [][]byte {
+	iter := sdb.NewIterator(DefaultIteratorOptions)
+	defer iter.Close()
+	var keys [][]byte
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		keys = append(keys, iter.Key())
+	}
+	return keys
+}
+
+// Fold 按照 key 的顺序遍历所有分片中的数据
+func (sdb *ShardedDB) Fold(fn func(key []byte, value []byte) bool) error {
+	iter := sdb.NewIterator(DefaultIteratorOptions)
+	defer iter.Close()
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		value, err := iter.Value()
+		if err != nil {
+			return err
+		}
+		if !fn(iter.Key(), value) {
+			break
+		}
+	}
+	return nil
+}
+
+// Stat 所有分片统计信息的汇总
+func (sdb *ShardedDB) Stat() *Stat {
+	total := &Stat{}
+	for _, shard := range sdb.shards {
+		stat := shard.Stat()
+		total.KeyNum += stat.KeyNum
+		total.DataFileNum += stat.DataFileNum
+		total.ReclaimableSize += stat.ReclaimableSize
+		total.DiskSize += stat.DiskSize
+		total.IndexMemory += stat.IndexMemory
+		total.BackgroundThrottled += stat.BackgroundThrottled
+		total.WriteThrottled += stat.WriteThrottled
+		total.ReadCacheHits += stat.ReadCacheHits
+		total.ReadCacheMisses += stat.ReadCacheMisses
+		total.BloomFilterRejects += stat.BloomFilterRejects
+		total.BloomFilterFalsePositives += stat.BloomFilterFalsePositives
+	}
+	total.BloomFilterFalsePositiveRate = bloomFalsePositiveRate(total.BloomFilterFalsePositives, total.BloomFilterRejects)
+	return total
+}
+
+// Merge 依次合并所有的分片，没有达到合并阈值的分片会被跳过
+func (sdb *ShardedDB) Merge() error {
+	for _, shard := range sdb.shards {
+		if err := shard.Merge(); err != nil && err != ErrMergeRatioUnreached {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sdb *ShardedDB) shardOf(key []byte) *DB {
+	return sdb.shards[sdb.ring.locate(key)]
+}
+
+func (sdb *ShardedDB) nextTxnId() uint64 {
+	return atomic.AddUint64(&sdb.txnId, 1)
+}
+
+// 完成协调者中记录的已经提交的跨分片事务，然后清空协调者
+func (sdb *ShardedDB) recoverTxns() error {
+	committed := make([]map[uint64]bool, len(sdb.shards))
+	keys := sdb.coordinator.ListKeys()
+	for _, key := range keys {
+		buf, err := sdb.coordinator.Get(key)
+		if err != nil {
+			return err
+		}
+		participants, err := decodeTxnParticipants(buf)
+		if err != nil {
+			return err
+		}
+		for shard, seqNo := range participants {
+			if shard >= len(sdb.shards) {
+				return ErrDataDirectoryCorrupted
+			}
+			if committed[shard] == nil {
+				committed[shard] = make(map[uint64]bool)
+			}
+			committed[shard][seqNo] = true
+		}
+	}
+
+	for i, seqNos := range committed {
+		if len(seqNos) == 0 {
+			continue
+		}
+		if err := sdb.shards[i].finishPreparedTxns(seqNos); err != nil {
+			return err
+		}
+	}
+	for _, key := range keys {
+		if err := sdb.coordinator.Delete(key); err != nil {
+			return err
+		}
+	}
+	return sdb.coordinator.Sync()
+}
+
+// 为准备阶段已经写入的事务补上完成的标识，并更新内存索引
+// 打开数据库时读到的没有完成标识的事务数据暂存在 pendingTxns 中，不需要重新读取整个日志
+func (db *DB) finishPreparedTxns(seqNos map[uint64]bool) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for seqNo := range seqNos {
+		txnRecords, ok := db.pendingTxns[seqNo]
+		// 崩溃之前已经写入了完成的标识
+		if !ok {
+			continue
+		}
+		txn := &preparedTxn{seqNo: seqNo}
+		for _, txnRecord := range txnRecords {
+			txn.records = append(txn.records, txnRecord.Record)
+			txn.positions = append(txn.positions, txnRecord.Pos)
+		}
+		if err := db.finishTxn(txn, true); err != nil {
+			return err
+		}
+		delete(db.pendingTxns, seqNo)
+	}
+	return nil
+}
+
+// 跨分片事务的参与者，分片下标 -> 分片中的事务序列号
+func encodeTxnParticipants(participants map[int]uint64) []byte {
+	var buf []byte
+	for shard, seqNo := range participants {
+		buf = binary.AppendUvarint(buf, uint64(shard))
+		buf = binary.AppendUvarint(buf, seqNo)
+	}
+	return buf
+}
+
+func decodeTxnParticipants(buf []byte) (map[int]uint64, error) {
+	participants := make(map[int]uint64)
+	for len(buf) > 0 {
+		shard, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return nil, ErrDataDirectoryCorrupted
+		}
+		buf = buf[n:]
+		seqNo, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return nil, ErrDataDirectoryCorrupted
+		}
+		buf = buf[n:]
+		participants[int(shard)] = seqNo
+	}
+	return participants, nil
+}
+
+// 一致性哈希环，每个分片对应多个虚拟节点
+type hashRing struct {
+	points []uint32 // 虚拟节点的哈希值，从小到大排序
+	shards []int    // 虚拟节点对应的分片
+}
+
+func newHashRing(shardNum, virtualNodes int) *hashRing {
+	type point struct {
+		hash  uint32
+		shard int
+	}
+	points := make([]point, 0, shardNum*virtualNodes)
+	for shard := 0; shard < shardNum; shard++ {
+		for v := 0; v < virtualNodes; v++ {
+			hash := crc32.ChecksumIEEE([]byte(fmt.Sprintf("shard-%d-%d", shard, v)))
+			points = append(points, point{hash: hash, shard: shard})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash != points[j].hash {
+			return points[i].hash < points[j].hash
+		}
+		return points[i].shard < points[j].shard
+	})
+
+	ring := &hashRing{
+		points: make([]uint32, len(points)),
+		shards: make([]int, len(points)),
+	}
+	for i, p := range points {
+		ring.points[i] = p.hash
+		ring.shards[i] = p.shard
+	}
+	return ring
+}
+
+// 顺时针找到第一个哈希值大于等于 key 的虚拟节点
+func (r *hashRing) locate(key []byte) int {
+	hash := crc32.ChecksumIEEE(key)
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i] >= hash
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.shards[i]
+}
@@ -0,0 +1,147 @@
+package bitcask_go
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"sync"
+)
+
+// ShardedWriteBatch 跨分片的原子批量写
+// 只涉及一个分片时直接提交该分片的事务，涉及多个分片时使用两阶段提交：
+// 1. 按照分片的顺序锁住所有参与的分片，在每个分片中写入事务数据但不写入完成标识，并持久化
+// 2. 在协调者中持久化事务的提交记录，此后事务一定会提交
+// 3. 在每个分片中写入事务完成的标识并更新索引，全部持久化之后删除协调者中的提交记录
+// 第 2 步之前崩溃，分片中没有完成标识的数据在重启之后被丢弃；之后崩溃，重启时根据提交记录补上完成标识
+// 第 3 步中部分分片失败时，其余的分片仍然会完成，失败的分片拒绝写入，Commit 返回 ErrCommitIncomplete，重新打开之后完成
+type ShardedWriteBatch struct {
+	options WriteBatchOptions
+	mu      *sync.Mutex
+	sdb     *ShardedDB
+	batches map[int]*WriteBatch // 分片下标 -> 分片中暂存的数据
+}
+
+// NewWriteBatch 初始化跨分片的 WriteBatch
+func (sdb *ShardedDB) NewWriteBatch(opts WriteBatchOptions) *ShardedWriteBatch {
+	return &ShardedWriteBatch{
+		options: opts,
+		mu:      new(sync.Mutex),
+		sdb:     sdb,
+		batches: make(map[int]*WriteBatch),
+	}
+}
+
+// Put 批量写数据
+func (swb *ShardedWriteBatch) Put(key []byte, value []byte) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+	swb.mu.Lock()
+	defer swb.mu.Unlock()
+	return swb.batchOf(key).Put(key, value)
+}
+
+// Delete 删除数据
+func (swb *ShardedWriteBatch) Delete(key []byte) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+	swb.mu.Lock()
+	defer swb.mu.Unlock()
+	return swb.batchOf(key).Delete(key)
+}
+
+// Commit 原子地提交所有分片中暂存的数据
+func (swb *ShardedWriteBatch) Commit() error {
+	swb.mu.Lock()
+	defer swb.mu.Unlock()
+
+	var shardIds []int
+	var total uint
+	for shardId, wb := range swb.batches {
+		if len(wb.pendingWrites) == 0 {
+			continue
+		}
+		shardIds = append(shardIds, shardId)
+		total += uint(len(wb.pendingWrites))
+	}
+	if total > swb.options.MaxBatchSize {
+		return ErrExceedMaxBatchNum
+	}
+	switch len(shardIds) {
+	case 0:
+		return nil
+	case 1:
+		// 单个分片的事务本身就是原子的
+		if err := swb.batches[shardIds[0]].Commit(); err != nil {
+			return err
+		}
+		swb.batches = make(map[int]*WriteBatch)
+		return nil
+	}
+
+	// 按照分片的顺序加锁，避免多个事务之间死锁
+	sort.Ints(shardIds)
+	for _, shardId := range shardIds {
+		shard := swb.sdb.shards[shardId]
+		if shard.writeFenced.Load() {
+			return ErrWriteFenced
+		}
+		shard.mu.Lock()
+		defer shard.mu.Unlock()
+	}
+
+	// 准备阶段
+	txns := make(map[int]*preparedTxn, len(shardIds))
+	participants := make(map[int]uint64, len(shardIds))
+	for _, shardId := range shardIds {
+		shard := swb.sdb.shards[shardId]
+		txn, err := shard.prepareTxn(swb.batches[shardId].pendingWrites)
+		if err != nil {
+			return err
+		}
+		if err := shard.activeFile.Sync(); err != nil {
+			return err
+		}
+		txns[shardId] = txn
+		participants[shardId] = txn.seqNo
+	}
+
+	// 持久化提交记录
+	txnKey := binary.BigEndian.AppendUint64(nil, swb.sdb.nextTxnId())
+	if err := swb.sdb.coordinator.Put(txnKey, encodeTxnParticipants(participants)); err != nil {
+		return err
+	}
+	if err := swb.sdb.coordinator.Sync(); err != nil {
+		return err
+	}
+
+	// 提交阶段，提交记录已经持久化，事务一定会提交，每个分片都需要完成
+	var errs []error
+	for _, shardId := range shardIds {
+		shard := swb.sdb.shards[shardId]
+		if err := shard.finishTxn(txns[shardId], true); err != nil {
+			// 分片中的数据落后于提交记录，拒绝写入，直到重新打开时根据提交记录完成
+			shard.writeFenced.Store(true)
+			errs = append(errs, err)
+		}
+	}
+	swb.batches = make(map[int]*WriteBatch)
+	if len(errs) > 0 {
+		// 保留提交记录
+		return errors.Join(append([]error{ErrCommitIncomplete}, errs...)...)
+	}
+	// 事务已经在所有分片中提交，删除提交记录失败不影响结果，重启时会再次完成这个事务并清理
+	_ = swb.sdb.coordinator.Delete(txnKey)
+	return nil
+}
+
+func (swb *ShardedWriteBatch) batchOf(key []byte) *WriteBatch {
+	shardId := swb.sdb.ring.locate(key)
+	wb, ok := swb.batches[shardId]
+	if !ok {
+		wb = swb.sdb.shards[shardId].NewWriteBatch(swb.options)
+		swb.batches[shardId] = wb
+	}
+	return wb
+}
@@ -0,0 +1,131 @@
+package bitcask_go
+
+import (
+	"bytes"
+	"container/heap"
+)
+
+// ShardedIterator 多个分片的迭代器按照 key 的顺序归并
+// 不同分片中的 key 不会重复，每次取出所有分片当前位置中最小（反向时最大）的 key
+// 每个分片最多遍历 Limit 条数据，归并之后再限制总的数据量
+type ShardedIterator struct {
+	iters   []*Iterator
+	heap    *iteratorHeap
+	options IteratorOptions
+	count   int // Rewind 或者 Seek 之后已经遍历的数据量
+}
+
+// NewIterator 初始化跨分片的迭代器
+func (sdb *ShardedDB) NewIterator(opts IteratorOptions) *ShardedIterator {
+	iters := make([]*Iterator, 0, len(sdb.shards))
+	for _, shard := range sdb.shards {
+		iters = append(iters, shard.NewIterator(opts))
+	}
+	it := &ShardedIterator{
+		iters:   iters,
+		heap:    &iteratorHeap{reverse: opts.Reverse},
+		options: opts,
+	}
+	it.rebuild()
+	return it
+}
+
+// Rewind 重新回到迭代器的起点，即第一个数据
+func (it *ShardedIterator) Rewind() {
+	for _, iter := range it.iters {
+		iter.Rewind()
+	}
+	it.rebuild()
+}
+
+// Seek 根据传入的 key 查找第一个大于(或小于)等于的目标key，从这个key开始遍历
+func (it *ShardedIterator) Seek(key []byte) {
+	for _, iter := range it.iters {
+		iter.Seek(key)
+	}
+	it.rebuild()
+}
+
+// Next 跳转到下一个key
+func (it *ShardedIterator) Next() {
+	if !it.Valid() {
+		return
+	}
+	it.count++
+	top := it.heap.iters[0]
+	top.Next()
+	if top.Valid() {
+		heap.Fix(it.heap, 0)
+	} else {
+		heap.Pop(it.heap)
+	}
+}
+
+// Valid 是否还有数据
+func (it *ShardedIterator) Valid() bool {
+	if it.options.Limit > 0 && it.count >= it.options.Limit {
+		return false
+	}
+	return len(it.heap.iters) > 0
+}
+
+// Key 当前遍历位置的 Key 数据
+func (it *ShardedIterator) Key() []byte {
+	return it.heap.iters[0].Key()
+}
+
+// Value 当前遍历位置的 Value 数据
+func (it *ShardedIterator) Value() ([]byte, error) {
+	return it.heap.iters[0].Value()
+}
+
+// Close 关闭迭代器，释放相应资源
+func (it *ShardedIterator) Close() {
+	for _, iter := range it.iters {
+		iter.Close()
+	}
+}
+
+// 用所有还有数据的分片迭代器重建堆
+func (it *ShardedIterator) rebuild() {
+	it.count = 0
+	it.heap.iters = it.heap.iters[:0]
+	for _, iter := range it.iters {
+		if iter.Valid() {
+			it.heap.iters = append(it.heap.iters, iter)
+		}
+	}
+	heap.Init(it.heap)
+}
+
+type iteratorHeap struct {
+	iters   []*Iterator
+	reverse bool
+}
+
+func (h *iteratorHeap) Len() int {
+	return len(h.iters)
+}
+
+func (h *iteratorHeap) Less(i, j int) bool {
+	cmp := bytes.Compare(h.iters[i].Key(), h.iters[j].Key())
+	if h.reverse {
+		return cmp > 0
+	}
+	return cmp < 0
+}
+
+func (h *iteratorHeap) Swap(i, j int) {
+	h.iters[i], h.iters[j] = h.iters[j], h.iters[i]
+}
+
+func (h *iteratorHeap) Push(x any) {
+	h.iters = append(h.iters, x.(*Iterator))
+}
+
+func (h *iteratorHeap) Pop() any {
+	n := len(h.iters)
+	iter := h.iters[n-1]
+	h.iters = h.iters[:n-1]
+	return iter
+}
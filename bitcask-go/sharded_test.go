@@ -0,0 +1,323 @@
+package bitcask_go
+
+import (
+	"bitcask-go/fio"
+	"bitcask-go/utils"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"sort"
+	"testing"
+)
+
+func destroyShardedDB(sdb *ShardedDB) {
+	if sdb == nil {
+		return
+	}
+	_ = sdb.Close()
+	_ = os.RemoveAll(sdb.options.DirPath)
+}
+
+func TestShardedDB(t *testing.T) {
+	opts := DefaultShardedOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-sharded")
+	opts.DirPath = dir
+	sdb, err := OpenSharded(opts)
+	defer destroyShardedDB(sdb)
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		err := sdb.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = sdb.Delete(utils.GetTestKey(0))
+	assert.Nil(t, err)
+	_, err = sdb.Get(utils.GetTestKey(0))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err := sdb.Get(utils.GetTestKey(10))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(10), val)
+
+	// key 分散在所有的分片中
+	for _, shard := range sdb.shards {
+		assert.True(t, shard.Stat().KeyNum > 100)
+	}
+	assert.Equal(t, uint(999), sdb.Stat().KeyNum)
+
+	// 重启之后数据仍然在原来的分片中
+	err = sdb.Close()
+	assert.Nil(t, err)
+	sdb, err = OpenSharded(opts)
+	assert.Nil(t, err)
+	val, err = sdb.Get(utils.GetTestKey(999))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(999), val)
+
+	// 分片的配置不能修改
+	badOpts := opts
+	badOpts.ShardNum = 8
+	_, err = OpenSharded(badOpts)
+	assert.Equal(t, ErrShardConfigMismatch, err)
+}
+
+func TestShardedDB_Iterator(t *testing.T) {
+	opts := DefaultShardedOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-sharded-iterator")
+	opts.DirPath = dir
+	sdb, err := OpenSharded(opts)
+	defer destroyShardedDB(sdb)
+	assert.Nil(t, err)
+
+	var keys [][]byte
+	for i := 0; i < 500; i++ {
+		keys = append(keys, utils.GetTestKey(i))
+		err := sdb.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 50; i++ {
+		key := []byte("prefix-" + string(utils.GetTestKey(i)))
+		keys = append(keys, key)
+		err := sdb.Put(key, utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+
+	// 正向遍历
+	assert.Equal(t, keys, sdb.ListKeys())
+	iter := sdb.NewIterator(DefaultIteratorOptions)
+	var i int
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		assert.Equal(t, keys[i], iter.Key())
+		i++
+	}
+	assert.Equal(t, len(keys), i)
+	iter.Seek(utils.GetTestKey(100))
+	assert.Equal(t, utils.GetTestKey(100), iter.Key())
+	iter.Close()
+
+	// 反向遍历
+	iterOpts := DefaultIteratorOptions
+	iterOpts.Reverse = true
+	iter = sdb.NewIterator(iterOpts)
+	i = len(keys) - 1
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		assert.Equal(t, keys[i], iter.Key())
+		i--
+	}
+	assert.Equal(t, -1, i)
+	iter.Close()
+
+	// 前缀遍历
+	iterOpts = DefaultIteratorOptions
+	iterOpts.Prefix = []byte("prefix-")
+	iter = sdb.NewIterator(iterOpts)
+	var count int
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		assert.True(t, bytes.HasPrefix(iter.Key(), iterOpts.Prefix))
+		count++
+	}
+	assert.Equal(t, 50, count)
+	iter.Close()
+
+	// 范围遍历，归并之后限制总的数据量
+	iterOpts = DefaultIteratorOptions
+	iterOpts.LowerBound = utils.GetTestKey(100)
+	iterOpts.UpperBound = utils.GetTestKey(200)
+	iterOpts.Limit = 10
+	iter = sdb.NewIterator(iterOpts)
+	count = 0
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		assert.Equal(t, utils.GetTestKey(100+count), iter.Key())
+		count++
+	}
+	assert.Equal(t, 10, count)
+	iter.Close()
+
+	// Fold 按顺序遍历并且可以提前结束
+	count = 0
+	err = sdb.Fold(func(key []byte, value []byte) bool {
+		assert.Equal(t, keys[count], key)
+		count++
+		return count < 100
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 100, count)
+}
+
+func TestShardedWriteBatch(t *testing.T) {
+	opts := DefaultShardedOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-sharded-batch")
+	opts.DirPath = dir
+	sdb, err := OpenSharded(opts)
+	defer destroyShardedDB(sdb)
+	assert.Nil(t, err)
+
+	err = sdb.Put(utils.GetTestKey(0), []byte("old"))
+	assert.Nil(t, err)
+
+	wb := sdb.NewWriteBatch(DefaultWriteBatchOptions)
+	for i := 1; i < 100; i++ {
+		err := wb.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = wb.Delete(utils.GetTestKey(0))
+	assert.Nil(t, err)
+	assert.True(t, len(wb.batches) > 1)
+
+	// 提交之前读取不到数据
+	_, err = sdb.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	err = wb.Commit()
+	assert.Nil(t, err)
+	for i := 1; i < 100; i++ {
+		val, err := sdb.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i), val)
+	}
+	_, err = sdb.Get(utils.GetTestKey(0))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Equal(t, 0, len(sdb.coordinator.ListKeys()))
+
+	// 超过批次的最大数据量
+	wb = sdb.NewWriteBatch(WriteBatchOptions{MaxBatchSize: 10, SyncWrites: true})
+	for i := 0; i < 11; i++ {
+		_ = wb.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+	}
+	assert.Equal(t, ErrExceedMaxBatchNum, wb.Commit())
+
+	// 重启之后事务中的数据仍然存在
+	err = sdb.Close()
+	assert.Nil(t, err)
+	sdb, err = OpenSharded(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 99, len(sdb.ListKeys()))
+}
+
+func TestShardedWriteBatch_Recover(t *testing.T) {
+	opts := DefaultShardedOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-sharded-recover")
+	opts.DirPath = dir
+	sdb, err := OpenSharded(opts)
+	defer destroyShardedDB(sdb)
+	assert.Nil(t, err)
+
+	// 模拟在两阶段提交的不同阶段崩溃
+	prepare := func(prefix string, commit bool) {
+		wb := sdb.NewWriteBatch(DefaultWriteBatchOptions)
+		for i := 0; i < 50; i++ {
+			err := wb.Put([]byte(prefix+string(utils.GetTestKey(i))), utils.GetTestKey(i))
+			assert.Nil(t, err)
+		}
+		participants := make(map[int]uint64)
+		for shardId, batch := range wb.batches {
+			shard := sdb.shards[shardId]
+			shard.mu.Lock()
+			txn, err := shard.prepareTxn(batch.pendingWrites)
+			shard.mu.Unlock()
+			assert.Nil(t, err)
+			participants[shardId] = txn.seqNo
+		}
+		if commit {
+			txnKey := binary.BigEndian.AppendUint64(nil, sdb.nextTxnId())
+			err := sdb.coordinator.Put(txnKey, encodeTxnParticipants(participants))
+			assert.Nil(t, err)
+		}
+	}
+	prepare("aborted-", false)
+	prepare("committed-", true)
+	assert.Equal(t, 0, len(sdb.ListKeys()))
+
+	err = sdb.Close()
+	assert.Nil(t, err)
+	sdb, err = OpenSharded(opts)
+	assert.Nil(t, err)
+
+	// 已经写入提交记录的事务在重启之后完成提交，其他的事务被丢弃
+	keys := sdb.ListKeys()
+	assert.Equal(t, 50, len(keys))
+	for _, key := range keys {
+		assert.True(t, bytes.HasPrefix(key, []byte("committed-")))
+	}
+	assert.Equal(t, 0, len(sdb.coordinator.ListKeys()))
+
+	// 再次重启，数据不会重复或者丢失
+	err = sdb.Close()
+	assert.Nil(t, err)
+	sdb, err = OpenSharded(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 50, len(sdb.ListKeys()))
+	val, err := sdb.Get([]byte("committed-" + string(utils.GetTestKey(1))))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(1), val)
+}
+
+// 第 failAt 次 Sync 返回错误的文件
+type syncFailIOManager struct {
+	fio.IOManager
+	syncs  int
+	failAt int
+}
+
+func (m *syncFailIOManager) Sync() error {
+	m.syncs++
+	if m.syncs == m.failAt {
+		return errors.New("injected sync failure")
+	}
+	return m.IOManager.Sync()
+}
+
+func TestShardedWriteBatch_FinishFailure(t *testing.T) {
+	opts := DefaultShardedOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-sharded-finish")
+	opts.DirPath = dir
+	sdb, err := OpenSharded(opts)
+	defer destroyShardedDB(sdb)
+	assert.Nil(t, err)
+
+	wb := sdb.NewWriteBatch(DefaultWriteBatchOptions)
+	for i := 0; i < 50; i++ {
+		err := wb.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	assert.True(t, len(wb.batches) > 1)
+
+	// 第一个分片在提交阶段持久化失败，第一次 Sync 是准备阶段
+	var shardIds []int
+	for shardId := range wb.batches {
+		shardIds = append(shardIds, shardId)
+	}
+	sort.Ints(shardIds)
+	failed := sdb.shards[shardIds[0]]
+	assert.Nil(t, failed.Put([]byte("seed"), []byte("seed")))
+	failed.activeFile.IoManager = &syncFailIOManager{IOManager: failed.activeFile.IoManager, failAt: 2}
+
+	err = wb.Commit()
+	assert.True(t, errors.Is(err, ErrCommitIncomplete))
+	assert.Equal(t, 1, len(sdb.coordinator.ListKeys()))
+
+	// 其余的分片仍然完成了提交，失败的分片拒绝写入
+	for i := 0; i < 50; i++ {
+		key := utils.GetTestKey(i)
+		shard := sdb.shardOf(key)
+		if shard == failed {
+			assert.Equal(t, ErrWriteFenced, sdb.Put(key, []byte("new")))
+			continue
+		}
+		val, err := sdb.Get(key)
+		assert.Nil(t, err)
+		assert.Equal(t, key, val)
+	}
+
+	// 重新打开之后根据提交记录完成失败的分片
+	err = sdb.Close()
+	assert.Nil(t, err)
+	sdb, err = OpenSharded(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 51, len(sdb.ListKeys()))
+	assert.Equal(t, 0, len(sdb.coordinator.ListKeys()))
+	assert.Nil(t, sdb.Put(utils.GetTestKey(0), []byte("new")))
+}
@@ -0,0 +1,111 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"math"
+)
+
+var ErrBloomFilterCorrupted = errors.New("the bloom filter data maybe corrupted")
+
+// BloomFilter 布隆过滤器，判断 key 是否可能存在
+// 返回不存在时 key 一定不存在，返回存在时有一定的概率误判
+type BloomFilter struct {
+	bits []byte
+	k    uint32 // 每个 key 设置的位数，即哈希函数的数量
+}
+
+// NewBloomFilter 根据预计的 key 的数量和期望的误判率创建布隆过滤器
+func NewBloomFilter(n int, falsePositiveRate float64) *BloomFilter {
+	n = max(n, 1)
+	// 最优的位数 m = -n*ln(p)/(ln2)^2，哈希函数的数量 k = m/n*ln2
+	m := int(math.Ceil(-float64(n) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+	m = max(m, 64)
+	k := uint32(math.Round(float64(m) / float64(n) * math.Ln2))
+	return &BloomFilter{
+		bits: make([]byte, (m+7)/8),
+		k:    min(max(k, 1), 30),
+	}
+}
+
+// Add 添加一个 key
+func (bf *BloomFilter) Add(key []byte) {
+	bf.AddHash(BloomHash(key))
+}
+
+// AddHash 添加一个由 BloomHash 计算得到的哈希值
+func (bf *BloomFilter) AddHash(h uint64) {
+	h1, h2 := splitBloomHash(h)
+	m := uint32(len(bf.bits) * 8)
+	for i := uint32(0); i < bf.k; i++ {
+		bit := (h1 + i*h2) % m
+		bf.bits[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+// MayContain 判断 key 是否可能存在
+func (bf *BloomFilter) MayContain(key []byte) bool {
+	return bf.MayContainHash(BloomHash(key))
+}
+
+// MayContainHash 判断哈希值对应的 key 是否可能存在，同一个 key 检查多个过滤器时只需要计算一次哈希值
+func (bf *BloomFilter) MayContainHash(h uint64) bool {
+	h1, h2 := splitBloomHash(h)
+	m := uint32(len(bf.bits) * 8)
+	for i := uint32(0); i < bf.k; i++ {
+		bit := (h1 + i*h2) % m
+		if bf.bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Size 返回占用的内存字节数
+func (bf *BloomFilter) Size() int {
+	return len(bf.bits)
+}
+
+// Encode 编码为字节数组：哈希函数的数量 + 位数组 + crc 校验值
+func (bf *BloomFilter) Encode() []byte {
+	buf := binary.LittleEndian.AppendUint32(make([]byte, 0, len(bf.bits)+8), bf.k)
+	buf = append(buf, bf.bits...)
+	return binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+}
+
+// DecodeBloomFilter 解码 Encode 编码的布隆过滤器，数据不完整时返回 ErrBloomFilterCorrupted
+func DecodeBloomFilter(buf []byte) (*BloomFilter, error) {
+	if len(buf) < 9 {
+		return nil, ErrBloomFilterCorrupted
+	}
+	body, crc := buf[:len(buf)-4], binary.LittleEndian.Uint32(buf[len(buf)-4:])
+	if crc32.ChecksumIEEE(body) != crc {
+		return nil, ErrBloomFilterCorrupted
+	}
+	return &BloomFilter{
+		bits: append([]byte(nil), body[4:]...),
+		k:    binary.LittleEndian.Uint32(body[:4]),
+	}, nil
+}
+
+// BloomHash 计算 key 的哈希值，可以先保存哈希值，之后再通过 AddHash 添加到过滤器中
+// 使用 64 位的 FNV-1a 哈希，再打散高低位
+func BloomHash(key []byte) uint64 {
+	var h uint64 = 14695981039346656037
+	for _, b := range key {
+		h ^= uint64(b)
+		h *= 1099511628211
+	}
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// 拆分为两个 32 位的哈希值，其他的哈希值由这两个组合得到
+func splitBloomHash(h uint64) (uint32, uint32) {
+	return uint32(h), uint32(h>>32) | 1
+}
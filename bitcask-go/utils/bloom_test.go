@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	bf := NewBloomFilter(10000, 0.01)
+	for i := 0; i < 10000; i++ {
+		bf.Add(GetTestKey(i))
+	}
+	// 添加过的 key 一定存在
+	for i := 0; i < 10000; i++ {
+		assert.True(t, bf.MayContain(GetTestKey(i)))
+	}
+
+	// 误判率接近期望的值
+	var falsePositives int
+	for i := 0; i < 10000; i++ {
+		if bf.MayContain([]byte(fmt.Sprintf("missing-key-%d", i))) {
+			falsePositives++
+		}
+	}
+	assert.True(t, falsePositives < 200, "false positives: %d", falsePositives)
+	assert.True(t, bf.Size() > 10000 && bf.Size() < 20000)
+
+	// 空的过滤器不包含任何 key
+	empty := NewBloomFilter(0, 0.01)
+	assert.False(t, empty.MayContain([]byte("key")))
+}
+
+func TestBloomFilter_Encode(t *testing.T) {
+	bf := NewBloomFilter(1000, 0.01)
+	for i := 0; i < 1000; i++ {
+		bf.AddHash(BloomHash(GetTestKey(i)))
+	}
+	buf := bf.Encode()
+	decoded, err := DecodeBloomFilter(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, bf, decoded)
+	for i := 0; i < 1000; i++ {
+		assert.True(t, decoded.MayContain(GetTestKey(i)))
+	}
+
+	// 数据被截断或者损坏
+	_, err = DecodeBloomFilter(buf[:len(buf)-1])
+	assert.Equal(t, ErrBloomFilterCorrupted, err)
+	buf[10] ^= 0xff
+	_, err = DecodeBloomFilter(buf)
+	assert.Equal(t, ErrBloomFilterCorrupted, err)
+	_, err = DecodeBloomFilter(nil)
+	assert.Equal(t, ErrBloomFilterCorrupted, err)
+}
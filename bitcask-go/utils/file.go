@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
@@ -8,10 +9,17 @@ import (
 	"syscall"
 )
 
+// 拷贝文件时每次读写的数据块大小
+const copyChunkSize = 1024 * 1024
+
 // DirSize 获取一个目录的大小
 func DirSize(dirPath string) (int64, error) {
 	var size int64
 	err := filepath.Walk(dirPath, func(path string, info fs.FileInfo, err error) error {
+		// 遍历的过程中被删除的临时文件不计入
+		if os.IsNotExist(err) {
+			return nil
+		}
 		if err != nil {
 			return err
 		}
@@ -38,6 +46,11 @@ func AvailableDiskSize() (uint64, error) {
 
 // CopyDir 拷贝数据目录
 func CopyDir(src, dest string, exclude []string) error {
+	return CopyDirWithThrottle(src, dest, exclude, nil)
+}
+
+// CopyDirWithThrottle 拷贝数据目录，每拷贝一块数据之前都会调用 throttle 进行限速，throttle 可以为空
+func CopyDirWithThrottle(src, dest string, exclude []string, throttle func(n int)) error {
 	// 目标目录不存在则创建
 	if _, err := os.Stat(dest); os.IsNotExist(err) {
 		if err := os.MkdirAll(dest, os.ModePerm); err != nil {
@@ -57,6 +70,10 @@ func CopyDir(src, dest string, exclude []string) error {
 				return err
 			}
 			if matched {
+				// 排除的目录不再遍历其中的文件
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
 				return nil
 			}
 		}
@@ -65,10 +82,87 @@ func CopyDir(src, dest string, exclude []string) error {
 			return os.MkdirAll(filepath.Join(dest, fileName), info.Mode())
 		}
 
-		data, err := os.ReadFile(filepath.Join(src, fileName))
+		return copyFile(filepath.Join(src, fileName), filepath.Join(dest, fileName), info.Mode(), 0, -1, throttle)
+	})
+}
+
+// 链接文件的方法，测试中可以替换
+var linkFile = os.Link
+
+// CopyFile 拷贝文件的前 size 个字节，size 小于 0 表示拷贝整个文件
+// 每拷贝一块数据之前都会调用 throttle 进行限速，throttle 可以为空
+func CopyFile(src, dest string, size int64, throttle func(n int)) error {
+	return CopyFileRange(src, dest, 0, size, throttle)
+}
+
+// CopyFileRange 拷贝文件从 offset 开始的 size 个字节，size 小于 0 表示拷贝到文件末尾
+func CopyFileRange(src, dest string, offset, size int64, throttle func(n int)) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if err := copyFile(src, dest, info.Mode(), offset, size, throttle); err != nil {
+		return err
+	}
+	return syncFile(dest)
+}
+
+// LinkOrCopyFile 创建文件的硬链接，无法创建硬链接时（例如跨设备）退化为拷贝文件
+func LinkOrCopyFile(src, dest string, throttle func(n int)) error {
+	if err := linkFile(src, dest); err == nil {
+		return nil
+	}
+	return CopyFile(src, dest, -1, throttle)
+}
+
+// 分块拷贝单个文件
+func copyFile(src, dest string, mode fs.FileMode, offset, size int64, throttle func(n int)) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+	if offset > 0 {
+		if _, err := srcFile.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+	}
+
+	destFile, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer destFile.Close()
+
+	var reader io.Reader = srcFile
+	if size >= 0 {
+		reader = io.LimitReader(srcFile, size)
+	}
+	buf := make([]byte, copyChunkSize)
+	for {
+		n, err := reader.Read(buf)
+		if n > 0 {
+			if throttle != nil {
+				throttle(n)
+			}
+			if _, err := destFile.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
 		if err != nil {
 			return err
 		}
-		return os.WriteFile(filepath.Join(dest, fileName), data, info.Mode())
-	})
+	}
+}
+
+func syncFile(fileName string) error {
+	file, err := os.OpenFile(fileName, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
 }
@@ -3,6 +3,8 @@ package utils
 import (
 	"github.com/stretchr/testify/assert"
 	"os"
+	"path/filepath"
+	"syscall"
 	"testing"
 )
 
@@ -20,3 +22,63 @@ func TestAvailableDiskSize(t *testing.T) {
 	t.Log(size / 1024 / 1024 / 1024)
 	assert.True(t, size > 0)
 }
+
+func TestCopyFile(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-copy-file")
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	err := os.WriteFile(src, []byte("bitcask-go"), 0644)
+	assert.Nil(t, err)
+
+	// 只拷贝前面一部分数据
+	err = CopyFile(src, filepath.Join(dir, "prefix"), 7, nil)
+	assert.Nil(t, err)
+	content, err := os.ReadFile(filepath.Join(dir, "prefix"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("bitcask"), content)
+
+	// 拷贝中间的一段数据
+	err = CopyFileRange(src, filepath.Join(dir, "range"), 3, 4, nil)
+	assert.Nil(t, err)
+	content, err = os.ReadFile(filepath.Join(dir, "range"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("cask"), content)
+
+	var throttled int
+	err = CopyFile(src, filepath.Join(dir, "all"), -1, func(n int) { throttled += n })
+	assert.Nil(t, err)
+	content, err = os.ReadFile(filepath.Join(dir, "all"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("bitcask-go"), content)
+	assert.Equal(t, 10, throttled)
+}
+
+func TestLinkOrCopyFile(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-link-file")
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	err := os.WriteFile(src, []byte("bitcask-go"), 0644)
+	assert.Nil(t, err)
+
+	// 硬链接
+	err = LinkOrCopyFile(src, filepath.Join(dir, "link"), nil)
+	assert.Nil(t, err)
+	srcInfo, _ := os.Stat(src)
+	linkInfo, _ := os.Stat(filepath.Join(dir, "link"))
+	assert.True(t, os.SameFile(srcInfo, linkInfo))
+
+	// 无法创建硬链接时退化为拷贝
+	linkFile = func(oldname, newname string) error {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.EXDEV}
+	}
+	defer func() {
+		linkFile = os.Link
+	}()
+	err = LinkOrCopyFile(src, filepath.Join(dir, "copy"), nil)
+	assert.Nil(t, err)
+	copyInfo, _ := os.Stat(filepath.Join(dir, "copy"))
+	assert.False(t, os.SameFile(srcInfo, copyInfo))
+	content, err := os.ReadFile(filepath.Join(dir, "copy"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("bitcask-go"), content)
+}
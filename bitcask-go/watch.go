@@ -0,0 +1,248 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bytes"
+	"sync"
+)
+
+type ChangeType = int8
+
+const (
+	// ChangePut 写入数据
+	ChangePut ChangeType = iota + 1
+
+	// ChangeDelete 删除数据
+	ChangeDelete
+)
+
+// ChangeEvent 一个 key 的变更
+type ChangeEvent struct {
+	Key   []byte
+	Value []byte
+	Type  ChangeType
+	SeqNo uint64 // 事务序列号，非事务写入为 0
+
+	Namespace string // 所属的命名空间，默认命名空间为空
+}
+
+// ChangeGroup 一组原子的变更，单次 Put/Delete 或者一个 WriteBatch 中的所有变更
+// 变更组会被多个订阅者共享，不能被修改
+type ChangeGroup struct {
+	Cursor uint64      // 变更组的序号，从 1 开始递增，可以用来恢复订阅
+	SeqNo  uint64      // 事务序列号，非事务写入为 0
+	Next   LogPosition // 变更组之后的日志位置，历史变更丢失之后可以通过 ReadLogFrom 从这里继续读取
+	Events []ChangeEvent
+}
+
+// Subscription 变更的订阅
+// 订阅者消费过慢时，缓冲区满了之后订阅会被关闭，Err 返回 ErrWatchLagged
+// 此时可以使用 Cursor 重新订阅，从上一次收到的变更组之后继续接收
+type Subscription struct {
+	hub    *watchHub
+	prefix []byte
+	ch     chan ChangeGroup
+	cursor uint64 // 最后一个放入缓冲区的变更组序号
+	err    error
+	closed bool
+}
+
+// C 返回接收变更组的 channel，订阅关闭之后 channel 会被关闭
+func (s *Subscription) C() <-chan ChangeGroup {
+	return s.ch
+}
+
+// Err 返回订阅被关闭的原因，正常关闭时为空
+func (s *Subscription) Err() error {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	return s.err
+}
+
+// Cursor 返回最后一个放入缓冲区的变更组序号，消费完 channel 中的数据之后即为最后收到的变更组序号
+func (s *Subscription) Cursor() uint64 {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	return s.cursor
+}
+
+// Close 取消订阅
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	s.hub.unsubscribe(s, nil)
+}
+
+// Watch 订阅前缀为 prefix 的 key 的变更，prefix 为空表示订阅所有的变更
+// 变更在数据成功写入之后按照写入的顺序发布
+func (db *DB) Watch(prefix []byte, opts WatchOptions) (*Subscription, error) {
+	if opts.BufferSize <= 0 {
+		return nil, ErrInvalidWatchBufferSize
+	}
+
+	// 发布变更时持有 db.mu，加锁保证订阅和补发历史变更之间不会遗漏数据
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	// 第一次订阅时才开始记录历史变更
+	if db.watchHub == nil {
+		db.watchHub = newWatchHub(db.options.WatchHistorySize)
+	}
+	return db.watchHub.subscribe(prefix, opts)
+}
+
+// 发布变更，调用方需要持有 db.mu
+func (db *DB) publishChanges(seqNo uint64, records []*data.LogRecord) {
+	if db.watchHub == nil {
+		return
+	}
+	group := ChangeGroup{
+		SeqNo:  seqNo,
+		Next:   LogPosition{Fid: db.activeFile.FileId, Offset: db.activeFile.WriteOff},
+		Events: make([]ChangeEvent, 0, len(records)),
+	}
+	for _, record := range records {
+		// 创建和删除命名空间不是 key 的变更
+		if record.Type == data.LogRecordNsCreated || record.Type == data.LogRecordNsDropped {
+			continue
+		}
+		key, namespace := record.Key, ""
+		if isNamespaceRecord(record.Type) {
+			var id uint32
+			id, key = parseNamespaceKey(record.Key)
+			namespace = db.namespaceName(id)
+			// 二级索引的条目随数据一起变更，不单独发布
+			if isIndexNamespace(namespace) {
+				continue
+			}
+		}
+		event := ChangeEvent{
+			Key:       append([]byte(nil), key...),
+			Value:     append([]byte(nil), record.Value...),
+			Type:      ChangePut,
+			SeqNo:     seqNo,
+			Namespace: namespace,
+		}
+		if record.Type == data.LogRecordDeleted || record.Type == data.LogRecordNsDeleted {
+			event.Type = ChangeDelete
+			event.Value = nil
+		}
+		group.Events = append(group.Events, event)
+	}
+	if len(group.Events) == 0 {
+		return
+	}
+	db.watchHub.publish(group)
+}
+
+// 关闭所有的订阅
+func (db *DB) closeWatchers() {
+	if db.watchHub == nil {
+		return
+	}
+	db.watchHub.close()
+}
+
+type watchHub struct {
+	mu          *sync.Mutex
+	cursor      uint64        // 最新的变更组序号
+	history     []ChangeGroup // 最近的变更组，用于恢复订阅
+	historySize int
+	subs        map[*Subscription]struct{}
+}
+
+func newWatchHub(historySize int) *watchHub {
+	return &watchHub{
+		mu:          new(sync.Mutex),
+		historySize: historySize,
+		subs:        make(map[*Subscription]struct{}),
+	}
+}
+
+func (h *watchHub) subscribe(prefix []byte, opts WatchOptions) (*Subscription, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// 需要补发的历史变更
+	var backlog []ChangeGroup
+	if opts.StartAfter > h.cursor {
+		return nil, ErrWatchCursorNotFound
+	}
+	if opts.StartAfter > 0 && opts.StartAfter < h.cursor {
+		if len(h.history) == 0 || h.history[0].Cursor > opts.StartAfter+1 {
+			return nil, ErrWatchCursorNotFound
+		}
+		backlog = h.history[opts.StartAfter+1-h.history[0].Cursor:]
+	}
+
+	sub := &Subscription{
+		hub:    h,
+		prefix: append([]byte(nil), prefix...),
+		ch:     make(chan ChangeGroup, opts.BufferSize+len(backlog)),
+		cursor: h.cursor,
+	}
+	if opts.StartAfter > 0 && opts.StartAfter < h.cursor {
+		sub.cursor = opts.StartAfter
+	}
+	h.subs[sub] = struct{}{}
+	for _, group := range backlog {
+		h.deliver(sub, group)
+	}
+	return sub, nil
+}
+
+func (h *watchHub) publish(group ChangeGroup) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.cursor++
+	group.Cursor = h.cursor
+	if h.historySize > 0 {
+		if len(h.history) >= h.historySize {
+			h.history = h.history[1:]
+		}
+		h.history = append(h.history, group)
+	}
+	for sub := range h.subs {
+		h.deliver(sub, group)
+	}
+}
+
+// 将变更组中符合订阅前缀的部分放入订阅的缓冲区，缓冲区满了则关闭订阅
+func (h *watchHub) deliver(sub *Subscription, group ChangeGroup) {
+	filtered := group
+	if len(sub.prefix) > 0 {
+		filtered.Events = nil
+		for _, event := range group.Events {
+			if bytes.HasPrefix(event.Key, sub.prefix) {
+				filtered.Events = append(filtered.Events, event)
+			}
+		}
+	}
+	if len(filtered.Events) > 0 {
+		select {
+		case sub.ch <- filtered:
+		default:
+			h.unsubscribe(sub, ErrWatchLagged)
+			return
+		}
+	}
+	sub.cursor = group.Cursor
+}
+
+func (h *watchHub) unsubscribe(sub *Subscription, err error) {
+	if sub.closed {
+		return
+	}
+	sub.closed = true
+	sub.err = err
+	delete(h.subs, sub)
+	close(sub.ch)
+}
+
+func (h *watchHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.subs {
+		h.unsubscribe(sub, nil)
+	}
+}
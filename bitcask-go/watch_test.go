@@ -0,0 +1,131 @@
+package bitcask_go
+
+import (
+	"bitcask-go/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func TestDB_Watch(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-watch")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 订阅之前的写入不会收到
+	err = db.Put(utils.GetTestKey(0), []byte("before"))
+	assert.Nil(t, err)
+
+	sub, err := db.Watch(nil, DefaultWatchOptions)
+	assert.Nil(t, err)
+	prefixSub, err := db.Watch([]byte("user-"), DefaultWatchOptions)
+	assert.Nil(t, err)
+
+	err = db.Put(utils.GetTestKey(1), []byte("v1"))
+	assert.Nil(t, err)
+	err = db.Delete(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	_ = wb.Put([]byte("user-1"), []byte("u1"))
+	_ = wb.Put([]byte("user-2"), []byte("u2"))
+	_ = wb.Put(utils.GetTestKey(2), []byte("v2"))
+	err = wb.Commit()
+	assert.Nil(t, err)
+
+	group := <-sub.C()
+	assert.Equal(t, uint64(1), group.Cursor)
+	assert.Equal(t, 1, len(group.Events))
+	assert.Equal(t, ChangePut, group.Events[0].Type)
+	assert.Equal(t, utils.GetTestKey(1), group.Events[0].Key)
+	assert.Equal(t, []byte("v1"), group.Events[0].Value)
+
+	group = <-sub.C()
+	assert.Equal(t, ChangeDelete, group.Events[0].Type)
+	assert.Equal(t, utils.GetTestKey(1), group.Events[0].Key)
+
+	// 整个批次作为一个变更组
+	group = <-sub.C()
+	assert.Equal(t, uint64(3), group.Cursor)
+	assert.Equal(t, db.seqNo, group.SeqNo)
+	assert.Equal(t, 3, len(group.Events))
+	for _, event := range group.Events {
+		assert.Equal(t, db.seqNo, event.SeqNo)
+	}
+
+	// 只收到前缀匹配的变更
+	group = <-prefixSub.C()
+	assert.Equal(t, uint64(3), group.Cursor)
+	assert.Equal(t, 2, len(group.Events))
+	assert.Equal(t, 0, len(prefixSub.C()))
+	assert.Equal(t, uint64(3), prefixSub.Cursor())
+
+	// 取消订阅
+	sub.Close()
+	_, ok := <-sub.C()
+	assert.False(t, ok)
+	assert.Nil(t, sub.Err())
+
+	// 关闭数据库会关闭所有的订阅
+	err = db.Close()
+	assert.Nil(t, err)
+	_, ok = <-prefixSub.C()
+	assert.False(t, ok)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+}
+
+func TestDB_Watch_Lagged(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-watch-lagged")
+	opts.DirPath = dir
+	opts.WatchHistorySize = 100
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	_, err = db.Watch(nil, WatchOptions{BufferSize: 0})
+	assert.Equal(t, ErrInvalidWatchBufferSize, err)
+
+	sub, err := db.Watch(nil, WatchOptions{BufferSize: 10})
+	assert.Nil(t, err)
+	for i := 0; i < 50; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(16))
+		assert.Nil(t, err)
+	}
+
+	// 缓冲区满了之后订阅被关闭
+	var received int
+	var cursor uint64
+	for group := range sub.C() {
+		received++
+		cursor = group.Cursor
+	}
+	assert.Equal(t, 10, received)
+	assert.Equal(t, ErrWatchLagged, sub.Err())
+	assert.Equal(t, cursor, sub.Cursor())
+
+	// 从上一次收到的位置恢复订阅
+	resumed, err := db.Watch(nil, WatchOptions{BufferSize: 10, StartAfter: cursor})
+	assert.Nil(t, err)
+	err = db.Put(utils.GetTestKey(50), nil)
+	assert.Nil(t, err)
+	for i := 10; i <= 50; i++ {
+		group := <-resumed.C()
+		assert.Equal(t, uint64(i+1), group.Cursor)
+		assert.Equal(t, utils.GetTestKey(i), group.Events[0].Key)
+	}
+	resumed.Close()
+
+	// 历史变更已经被丢弃
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(16))
+		assert.Nil(t, err)
+	}
+	_, err = db.Watch(nil, WatchOptions{BufferSize: 10, StartAfter: cursor})
+	assert.Equal(t, ErrWatchCursorNotFound, err)
+	_, err = db.Watch(nil, WatchOptions{BufferSize: 10, StartAfter: 100000})
+	assert.Equal(t, ErrWatchCursorNotFound, err)
+}